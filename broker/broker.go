@@ -1,45 +1,170 @@
 package main
 
 import (
-	"bytes"
-	"io"
+	"cmp"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
+	"math"
 	"net"
 	"net/http"
 	"net/url"
-	"sync/atomic"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
+
+	"github.com/dwladdimiroc/load-serverless/broker/proxy"
+	"github.com/dwladdimiroc/load-serverless/broker/tracing"
 )
 
 const (
 	FunctionBackendURL = "https://us-east1-powerful-vine-486914-k3.cloudfunctions.net"
 	VMBackendURL       = "http://10.142.0.3:8080"
 
-	ListenAddr   = ":8080"
-	MaxBodyBytes = int64(2 << 20) // 2MB
-)
+	ListenAddr        = ":8080"
+	ReadHeaderTimeout = 5 * time.Second
+	ShutdownTimeout   = 30 * time.Second // in-flight requests get this long after the prestop delay
 
-type Backend struct {
-	Name      string // "serverless" or "vm"
-	BaseURL   *url.URL
-	Transport http.RoundTripper
-}
+	// BROKER_IP_FAMILY=tcp4 or tcp6 dials backends over IPv4 or IPv6 only (default tcp, either)
+	IPFamilyEnv = "BROKER_IP_FAMILY"
 
-type Broker struct {
-	backends []Backend
-	rr       atomic.Uint64
-}
+	// BROKER_PRESTOP_DELAY: on SIGTERM, fail /health but keep serving this long before shutting down
+	PrestopDelayEnv = "BROKER_PRESTOP_DELAY"
+
+	// BROKER_CONFIG (or -config) names a JSON config file; env vars override it
+	ConfigEnv = "BROKER_CONFIG"
+
+	// BROKER_ADMIN_SECRET, when set, must be sent as X-Admin-Secret to admin endpoints
+	AdminSecretEnv = "BROKER_ADMIN_SECRET"
+
+	// BROKER_BREAKER_FAILURES > 0 opens a backend's circuit after that many consecutive failures
+	BreakerFailuresEnv = "BROKER_BREAKER_FAILURES"
+	BreakerCooldownEnv = "BROKER_BREAKER_COOLDOWN"
+	SlowStartEnv       = "BROKER_SLOW_START" // ramp-up window after a circuit closes, e.g. "30s"
+
+	// BROKER_CONCURRENCY_MAX > 0 enables the adaptive per-backend in-flight limit
+	ConcurrencyMinEnv = "BROKER_CONCURRENCY_MIN"
+	ConcurrencyMaxEnv = "BROKER_CONCURRENCY_MAX"
+
+	// BROKER_QUEUE_DEPTH > 0 queues requests for a slot (needs BROKER_CONCURRENCY_MAX) for at most BROKER_QUEUE_WAIT
+	QueueDepthEnv = "BROKER_QUEUE_DEPTH"
+	QueueWaitEnv  = "BROKER_QUEUE_WAIT"
+
+	// BROKER_OUTAGE_THRESHOLD > 0: after that many requests fail on every backend within
+	// BROKER_OUTAGE_WINDOW, answer 503 without trying them for BROKER_OUTAGE_BACKOFF
+	OutageThresholdEnv = "BROKER_OUTAGE_THRESHOLD"
+	OutageWindowEnv    = "BROKER_OUTAGE_WINDOW"
+	OutageBackoffEnv   = "BROKER_OUTAGE_BACKOFF"
+
+	// BROKER_RETRY_BUDGET in (0,1]: failovers after a backend got the request are capped at that
+	// fraction of requests, with up to BROKER_RETRY_BUDGET_BURST saved up
+	RetryBudgetEnv      = "BROKER_RETRY_BUDGET"
+	RetryBudgetBurstEnv = "BROKER_RETRY_BUDGET_BURST"
+
+	// BROKER_SLO_P99 > 0 tracks the rolling p99 over BROKER_SLO_WINDOW; /health says "degraded" above it
+	SLOTargetEnv = "BROKER_SLO_P99"
+	SLOWindowEnv = "BROKER_SLO_WINDOW"
+
+	// BROKER_DUPLICATE_WINDOW > 0 logs POSTs repeating a client's body within that window, e.g. "2s"
+	DuplicateWindowEnv = "BROKER_DUPLICATE_WINDOW"
+
+	// BROKER_SANITIZE_ERRORS=true replaces forwarded non-2xx bodies with a generic JSON error
+	SanitizeErrorsEnv = "BROKER_SANITIZE_ERRORS"
+
+	// BROKER_BACKEND_DURATION=true sets X-Backend-Duration (ms the serving backend took) on responses
+	BackendDurationEnv = "BROKER_BACKEND_DURATION"
+
+	// BROKER_NORMALIZE_PATHS=true forwards cleaned paths ("/a//b", "/a/../b") instead of redirecting
+	NormalizePathsEnv = "BROKER_NORMALIZE_PATHS"
+
+	// BROKER_PPROF=true serves net/http/pprof under /debug/pprof/ (behind the admin secret)
+	PprofEnv = "BROKER_PPROF"
+
+	// BROKER_OTEL_ENDPOINT, when set, exports request spans over OTLP/HTTP, e.g. "http://localhost:4318"
+	OtelEndpointEnv = "BROKER_OTEL_ENDPOINT"
+	OtelServiceEnv  = "BROKER_OTEL_SERVICE"
+
+	// Extra headers (comma-separated) never forwarded, on top of hop-by-hop ones
+	StripRequestHeadersEnv  = "BROKER_STRIP_REQUEST_HEADERS"
+	StripResponseHeadersEnv = "BROKER_STRIP_RESPONSE_HEADERS" // e.g. "Server,X-Powered-By"
+
+	// Upstream response header allow/deny lists (comma-separated, "X-Internal-*" prefixes
+	// allowed); deny wins and a set allow list drops everything else
+	ResponseHeaderAllowEnv = "BROKER_RESPONSE_HEADER_ALLOW"
+	ResponseHeaderDenyEnv  = "BROKER_RESPONSE_HEADER_DENY"
+
+	// BROKER_STARTUP_PROBE=false skips the startup connectivity check
+	StartupProbeEnv     = "BROKER_STARTUP_PROBE"
+	StartupProbeTimeout = 2 * time.Second
+
+	// BROKER_CACHE_SIZE > 0 enables the GET response cache with that many entries
+	CacheSizeEnv = "BROKER_CACHE_SIZE"
+
+	// BROKER_IDEMPOTENCY_TTL > 0 replays the response for a repeated Idempotency-Key within that window
+	IdempotencyTTLEnv  = "BROKER_IDEMPOTENCY_TTL"
+	IdempotencySizeEnv = "BROKER_IDEMPOTENCY_SIZE"
+
+	// BROKER_SHADOW=true mirrors every request to the other backend and logs divergences
+	ShadowEnv            = "BROKER_SHADOW"
+	ShadowCompareBodyEnv = "BROKER_SHADOW_COMPARE_BODY"
+	ShadowTimeoutEnv     = "BROKER_SHADOW_TIMEOUT"
+
+	// BROKER_ALLOW_BACKEND_OVERRIDE=true honors ?__backend=<name> (debugging only)
+	AllowBackendOverrideEnv = "BROKER_ALLOW_BACKEND_OVERRIDE"
+
+	// BROKER_FAILOVER_ORDER lists backend names tried after the primary fails, e.g. "vm,serverless"
+	FailoverOrderEnv = "BROKER_FAILOVER_ORDER"
+
+	// BROKER_FAILOVER_STATUSES lists upstream statuses that fail over, e.g. "429,500,503" (default 502,503,504)
+	FailoverStatusesEnv = "BROKER_FAILOVER_STATUSES"
+
+	// BROKER_BODY_SAMPLE_RATE in [0,1] logs that fraction of request/response bodies
+	BodySampleRateEnv = "BROKER_BODY_SAMPLE_RATE"
+	BodyLogMaxEnv     = "BROKER_BODY_LOG_MAX"
+	BodyRedactKeysEnv = "BROKER_BODY_REDACT_KEYS" // comma-separated JSON keys, e.g. "lat,lng"
+
+	// BROKER_RATE_LIMIT > 0 enables per-client-IP rate limiting (requests/second)
+	RateLimitEnv      = "BROKER_RATE_LIMIT"
+	RateBurstEnv      = "BROKER_RATE_BURST"
+	TrustedProxiesEnv = "BROKER_TRUSTED_PROXIES" // IPs/CIDRs whose X-Forwarded-For is honored
+)
 
 func main() {
-	functionURL := mustParseURL(FunctionBackendURL)
-	vmURL := mustParseURL(VMBackendURL)
+	configPath := flag.String("config", os.Getenv(ConfigEnv), "JSON config file (backends and global settings; env vars override it)")
+	flag.Parse()
+
+	fc := &fileConfig{}
+	if *configPath != "" {
+		var err error
+		if fc, err = loadConfigFile(*configPath); err != nil {
+			log.Fatalf("Invalid config: %v", err)
+		}
+	}
+	if len(fc.Backends) == 0 {
+		fc.Backends = []fileBackend{
+			{Name: "serverless", parsedURL: mustParseURL(FunctionBackendURL)},
+			{Name: "vm", parsedURL: mustParseURL(VMBackendURL)},
+		}
+	}
 
+	ipFamily := envString(IPFamilyEnv, cmp.Or(fc.IPFamily, "tcp"))
+	if !slices.Contains(ipFamilies, ipFamily) {
+		log.Fatalf("Invalid %s: %q (must be one of %s)", IPFamilyEnv, ipFamily, strings.Join(ipFamilies, ", "))
+	}
 	transport := &http.Transport{
 		Proxy: http.ProxyFromEnvironment,
-		DialContext: (&net.Dialer{
-			Timeout:   5 * time.Second,
+		DialContext: familyDialer(&net.Dialer{
+			Timeout:   proxy.DialTimeout,
 			KeepAlive: 30 * time.Second,
-		}).DialContext,
+		}, ipFamily),
 
 		ForceAttemptHTTP2: true,
 
@@ -52,124 +177,366 @@ func main() {
 		ExpectContinueTimeout: 1 * time.Second,
 	}
 
-	b := &Broker{
-		backends: []Backend{
-			{Name: "serverless", BaseURL: functionURL, Transport: transport},
-			{Name: "vm", BaseURL: vmURL, Transport: transport},
-		},
+	cfg := proxy.Config{
+		ListenAddr:        cmp.Or(fc.Listen, ListenAddr),
+		ReadHeaderTimeout: cmp.Or(time.Duration(fc.ReadHeaderTimeout), ReadHeaderTimeout),
 	}
-
-	mux := http.NewServeMux()
-
-	// Health endpoint
-	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "text/plain")
-		w.WriteHeader(http.StatusOK)
-		_, _ = w.Write([]byte("ok"))
-	})
-
-	// Main proxy handler (preserves path for both)
-	mux.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Buffer body to allow retry on POST/PUT/PATCH
-		var bodyCopy []byte
-		var err error
-		if r.Body != nil && (r.Method == http.MethodPost || r.Method == http.MethodPut || r.Method == http.MethodPatch) {
-			bodyCopy, err = readUpTo(r.Body, MaxBodyBytes)
-			if err != nil {
-				http.Error(w, "Request body too large or invalid", http.StatusRequestEntityTooLarge)
-				return
+	// Per-backend options from BROKER_<NAME>_<OPTION>, e.g. BROKER_VM_H2C=true,
+	// on top of the config file's
+	for _, fb := range fc.Backends {
+		cfg.Backends = append(cfg.Backends, proxy.Backend{Name: fb.Name, BaseURL: fb.parsedURL, Transport: transport})
+		be := &cfg.Backends[len(cfg.Backends)-1]
+		var fileLoc *proxy.LatLng
+		if fb.LatLng != "" {
+			fileLoc, _ = parseLatLng(fb.LatLng) // validated on load
+		}
+		be.H2C = envBool(backendEnv(be.Name, "H2C"), fb.H2C)
+		be.PreserveHost = envBool(backendEnv(be.Name, "PRESERVE_HOST"), fb.PreserveHost)
+		be.HealthPath = envString(backendEnv(be.Name, "HEALTH_PATH"), cmp.Or(fb.HealthPath, proxy.DefaultHealthPath))
+		be.Timeout = envDuration(backendEnv(be.Name, "TIMEOUT"), time.Duration(fb.Timeout))
+		be.Weight = envInt(backendEnv(be.Name, "WEIGHT"), fb.Weight)
+		if be.Weight < 0 {
+			log.Fatalf("Invalid %s: %d (must be >= 0)", backendEnv(be.Name, "WEIGHT"), be.Weight)
+		}
+		be.Region = envString(backendEnv(be.Name, "REGION"), fb.Region)
+		be.Location = envLatLng(backendEnv(be.Name, "LATLNG"), fileLoc)
+		if frac := envFloat(backendEnv(be.Name, "SOFT_DEADLINE"), 0); frac > 0 {
+			if frac >= 1 || be.Timeout <= 0 {
+				log.Fatalf("Invalid %s: %v (needs a fraction in (0,1) and %s)", backendEnv(be.Name, "SOFT_DEADLINE"), frac, backendEnv(be.Name, "TIMEOUT"))
 			}
+			be.SoftDeadline = time.Duration(frac * float64(be.Timeout))
+		}
+		if be.H2C {
+			be.Transport = h2cTransport(transport)
 		}
 
-		// Round robin
-		i := int(b.rr.Add(1) % uint64(len(b.backends)))
-		first := b.backends[i]
-		second := b.backends[(i+1)%len(b.backends)]
+		// Mutual TLS: BROKER_<NAME>_TLS_CERT/_TLS_KEY (client pair), BROKER_<NAME>_TLS_CA (server CA bundle)
+		cert := envString(backendEnv(be.Name, "TLS_CERT"), fb.TLSCert)
+		key := envString(backendEnv(be.Name, "TLS_KEY"), fb.TLSKey)
+		ca := envString(backendEnv(be.Name, "TLS_CA"), fb.TLSCA)
+		if cert != "" || key != "" || ca != "" {
+			if be.H2C {
+				log.Fatalf("Invalid %s: h2c backends cannot use TLS settings", backendEnv(be.Name, "H2C"))
+			}
+			be.Transport = tlsTransport(transport, be.Name, cert, key, ca)
+			be.MTLS = cert != ""
+		}
+	}
 
-		// Try first, then failover
-		if serveBackend(first, w, r, bodyCopy) {
-			return
+	if rate := envFloat(RateLimitEnv, fc.RateLimit); rate > 0 {
+		burst := envInt(RateBurstEnv, cmp.Or(fc.RateBurst, int(math.Ceil(rate))))
+		if burst < 1 {
+			log.Fatalf("Invalid %s: %d (must be >= 1)", RateBurstEnv, burst)
+		}
+		cfg.RateLimit = rate
+		cfg.RateBurst = burst
+		cfg.TrustedProxies = parseTrustedProxies(envList(TrustedProxiesEnv))
+	}
+	cfg.CacheSize = envInt(CacheSizeEnv, fc.CacheSize)
+	cfg.IdempotencyTTL = envDuration(IdempotencyTTLEnv, 0)
+	cfg.IdempotencySize = envInt(IdempotencySizeEnv, proxy.DefaultIdempotencySize)
+	cfg.Shadow = envBool(ShadowEnv, false)
+	cfg.ShadowCompareBody = envBool(ShadowCompareBodyEnv, false)
+	cfg.ShadowTimeout = envDuration(ShadowTimeoutEnv, proxy.DefaultShadowTimeout)
+	cfg.AllowBackendOverride = envBool(AllowBackendOverrideEnv, false)
+	cfg.FailoverOrder = envList(FailoverOrderEnv)
+	if len(cfg.FailoverOrder) == 0 {
+		cfg.FailoverOrder = fc.FailoverOrder
+	}
+	for _, name := range cfg.FailoverOrder {
+		if !slices.ContainsFunc(cfg.Backends, func(be proxy.Backend) bool { return be.Name == name }) {
+			log.Fatalf("Invalid %s: unknown backend %q", FailoverOrderEnv, name)
 		}
-		if serveBackend(second, w, r, bodyCopy) {
-			return
+	}
+	for _, item := range envList(FailoverStatusesEnv) {
+		code, err := strconv.Atoi(item)
+		if err != nil || code < 100 || code > 599 {
+			log.Fatalf("Invalid %s: %q (must be HTTP status codes)", FailoverStatusesEnv, item)
+		}
+		cfg.FailoverStatuses = append(cfg.FailoverStatuses, code)
+	}
+	if len(cfg.FailoverStatuses) == 0 {
+		cfg.FailoverStatuses = fc.FailoverStatuses
+	}
+	if rate := envFloat(BodySampleRateEnv, 0); rate > 0 {
+		if rate > 1 {
+			log.Fatalf("Invalid %s: %v (must be between 0 and 1)", BodySampleRateEnv, rate)
 		}
+		cfg.BodySampleRate = rate
+		cfg.BodyLogMax = envInt(BodyLogMaxEnv, proxy.DefaultBodyLogMax)
+		cfg.BodyRedactKeys = envList(BodyRedactKeysEnv)
+	}
+	cfg.BreakerFailures = envInt(BreakerFailuresEnv, fc.BreakerFailures)
+	cfg.BreakerCooldown = envDuration(BreakerCooldownEnv, cmp.Or(time.Duration(fc.BreakerCooldown), proxy.DefaultBreakerCooldown))
+	cfg.SlowStart = envDuration(SlowStartEnv, 0)
+	if cfg.SlowStart > 0 && cfg.BreakerFailures <= 0 {
+		log.Fatalf("Invalid %s: needs %s > 0", SlowStartEnv, BreakerFailuresEnv)
+	}
+	cfg.ConcurrencyMax = envInt(ConcurrencyMaxEnv, fc.ConcurrencyMax)
+	cfg.ConcurrencyMin = envInt(ConcurrencyMinEnv, cmp.Or(fc.ConcurrencyMin, min(proxy.DefaultConcurrencyMin, max(cfg.ConcurrencyMax, 1))))
+	if cfg.ConcurrencyMax > 0 && (cfg.ConcurrencyMin < 1 || cfg.ConcurrencyMin > cfg.ConcurrencyMax) {
+		log.Fatalf("Invalid %s: %d (must be between 1 and %s)", ConcurrencyMinEnv, cfg.ConcurrencyMin, ConcurrencyMaxEnv)
+	}
+	cfg.QueueDepth = envInt(QueueDepthEnv, fc.QueueDepth)
+	cfg.QueueWait = envDuration(QueueWaitEnv, cmp.Or(time.Duration(fc.QueueWait), proxy.DefaultQueueWait))
+	if cfg.QueueDepth > 0 && cfg.ConcurrencyMax <= 0 {
+		log.Fatalf("Invalid %s: needs %s > 0", QueueDepthEnv, ConcurrencyMaxEnv)
+	}
+	if cfg.QueueWait <= 0 {
+		log.Fatalf("Invalid %s: %s (must be > 0)", QueueWaitEnv, cfg.QueueWait)
+	}
+	cfg.PrestopDelay = envDuration(PrestopDelayEnv, time.Duration(fc.PrestopDelay))
+	if cfg.PrestopDelay < 0 {
+		log.Fatalf("Invalid %s: %s (must be >= 0)", PrestopDelayEnv, cfg.PrestopDelay)
+	}
+	cfg.OutageThreshold = envInt(OutageThresholdEnv, fc.OutageThreshold)
+	cfg.OutageWindow = envDuration(OutageWindowEnv, cmp.Or(time.Duration(fc.OutageWindow), proxy.DefaultOutageWindow))
+	cfg.OutageBackoff = envDuration(OutageBackoffEnv, cmp.Or(time.Duration(fc.OutageBackoff), proxy.DefaultOutageBackoff))
+	if cfg.OutageThreshold < 0 || cfg.OutageWindow <= 0 || cfg.OutageBackoff <= 0 {
+		log.Fatalf("Invalid %s/%s/%s: threshold must be >= 0, window and backoff > 0", OutageThresholdEnv, OutageWindowEnv, OutageBackoffEnv)
+	}
+	cfg.RetryBudget = envFloat(RetryBudgetEnv, fc.RetryBudget)
+	cfg.RetryBudgetBurst = envInt(RetryBudgetBurstEnv, cmp.Or(fc.RetryBudgetBurst, proxy.DefaultRetryBudgetBurst))
+	if cfg.RetryBudget < 0 || cfg.RetryBudget > 1 || cfg.RetryBudgetBurst <= 0 {
+		log.Fatalf("Invalid %s/%s: budget must be between 0 and 1, burst > 0", RetryBudgetEnv, RetryBudgetBurstEnv)
+	}
+	cfg.SanitizeErrors = envBool(SanitizeErrorsEnv, fc.SanitizeErrors)
+	cfg.NormalizePaths = envBool(NormalizePathsEnv, fc.NormalizePaths)
+	cfg.BackendDuration = envBool(BackendDurationEnv, fc.BackendDuration)
+	cfg.SLOTarget = envDuration(SLOTargetEnv, time.Duration(fc.SLOTarget))
+	cfg.SLOWindow = envDuration(SLOWindowEnv, cmp.Or(time.Duration(fc.SLOWindow), proxy.DefaultSLOWindow))
+	if cfg.SLOTarget < 0 || cfg.SLOWindow <= 0 {
+		log.Fatalf("Invalid %s/%s: %s/%s (target must be >= 0, window > 0)", SLOTargetEnv, SLOWindowEnv, cfg.SLOTarget, cfg.SLOWindow)
+	}
+	cfg.DuplicateWindow = envDuration(DuplicateWindowEnv, 0)
+	cfg.AdminSecret = os.Getenv(AdminSecretEnv)
+	cfg.Pprof = envBool(PprofEnv, false)
+	if endpoint := os.Getenv(OtelEndpointEnv); endpoint != "" {
+		exp := tracing.NewOTLPExporter(endpoint, envString(OtelServiceEnv, "broker"), "load-serverless/broker")
+		cfg.Tracer = tracing.New(exp, tracing.Config{Sample: 1, OnError: func(err error) { log.Print(err) }})
+	}
+	cfg.StripRequestHeaders = envList(StripRequestHeadersEnv)
+	cfg.StripResponseHeaders = envList(StripResponseHeadersEnv)
+	cfg.ResponseHeaderAllow = envList(ResponseHeaderAllowEnv)
+	cfg.ResponseHeaderDeny = envList(ResponseHeaderDenyEnv)
 
-		http.Error(w, "Both backends failed", http.StatusBadGateway)
-	}))
+	b := proxy.New(cfg)
 
 	srv := &http.Server{
-		Addr:              ListenAddr,
-		Handler:           mux,
-		ReadHeaderTimeout: 5 * time.Second,
+		Addr:              cfg.ListenAddr,
+		Handler:           b.Handler(),
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
 	}
 
-	log.Printf("Broker listening on %s", ListenAddr)
-	log.Printf("Serverless base: %s", functionURL.String())
-	log.Printf("VM base:         %s", vmURL.String())
-	log.Fatal(srv.ListenAndServe())
-}
-
-// serveBackend forwards the request to the chosen backend.
-// It sets response headers to indicate which backend was used and the final URL.
-func serveBackend(be Backend, w http.ResponseWriter, r *http.Request, bodyCopy []byte) bool {
-	// Build final destination URL: base + incoming path + query
-	targetURL := joinURL(be.BaseURL, r.URL.Path, r.URL.RawQuery)
-
-	// Create outbound request
-	outReq, err := http.NewRequestWithContext(r.Context(), r.Method, targetURL, nil)
-	if err != nil {
-		log.Printf("request build error (%s): %v", be.Name, err)
-		return false
-	}
-
-	// Copy headers (excluding Hop-by-hop headers)
-	copyHeaders(outReq.Header, r.Header)
-	outReq.Host = be.BaseURL.Host
-
-	// Restore body if needed
-	if bodyCopy != nil && (r.Method == http.MethodPost || r.Method == http.MethodPut || r.Method == http.MethodPatch) {
-		outReq.Body = io.NopCloser(bytes.NewReader(bodyCopy))
-		outReq.ContentLength = int64(len(bodyCopy))
-	} else {
-		// For GET etc, forward original body if any (rare), else nil
-		if r.Body != nil && r.Body != http.NoBody {
-			// Not buffering for methods other than POST/PUT/PATCH
-			outReq.Body = r.Body
+	log.Printf("Broker listening on %s", cfg.ListenAddr)
+	if v := proxy.Version(); v.Revision != "" {
+		log.Printf("Build:           %s (%s)", v.Revision, v.BuildTime)
+	}
+	if *configPath != "" {
+		log.Printf("Config file:     %s", *configPath)
+	}
+	for _, be := range cfg.Backends {
+		log.Printf("Backend %-10s %s", be.Name+":", be.BaseURL.String())
+		if be.Weight > 1 {
+			log.Printf("Backend %s has weight %d", be.Name, be.Weight)
+		}
+		if be.H2C {
+			log.Printf("Backend %s uses h2c", be.Name)
+		}
+		if be.MTLS {
+			log.Printf("Backend %s uses a TLS client certificate", be.Name)
+		}
+		if be.PreserveHost {
+			log.Printf("Backend %s receives the client's Host header", be.Name)
+		}
+		if be.Location != nil {
+			log.Printf("Backend %s located at %.4f,%.4f %s", be.Name, be.Location.Lat, be.Location.Lng, be.Region)
 		}
 	}
-
-	// Do request
-	resp, err := (&http.Client{Transport: be.Transport}).Do(outReq)
-	if err != nil {
-		log.Printf("backend call error (%s) url=%s err=%v", be.Name, targetURL, err)
-		return false
+	if ipFamily != "tcp" {
+		log.Printf("IP family:       %s only", ipFamily)
+	}
+	if len(cfg.FailoverStatuses) > 0 {
+		log.Printf("Failover on:     %v", cfg.FailoverStatuses)
+	}
+	if len(cfg.FailoverOrder) > 0 {
+		log.Printf("Failover order:  %s", strings.Join(cfg.FailoverOrder, ", "))
+	}
+	if len(cfg.ResponseHeaderAllow) > 0 {
+		log.Printf("Resp. allow:     %s", strings.Join(cfg.ResponseHeaderAllow, ", "))
+	}
+	if len(cfg.ResponseHeaderDeny) > 0 {
+		log.Printf("Resp. deny:      %s", strings.Join(cfg.ResponseHeaderDeny, ", "))
+	}
+	if cfg.RateLimit > 0 {
+		log.Printf("Rate limit:      %.2f req/s per IP, burst %d", cfg.RateLimit, cfg.RateBurst)
+	}
+	if cfg.CacheSize > 0 {
+		log.Printf("Response cache:  %d entries", cfg.CacheSize)
+	}
+	if cfg.IdempotencyTTL > 0 {
+		log.Printf("Idempotency:     %s TTL, %d keys", cfg.IdempotencyTTL, cfg.IdempotencySize)
+	}
+	if cfg.Shadow {
+		log.Printf("Shadow mode:     on (compare body=%t, timeout=%s)", cfg.ShadowCompareBody, cfg.ShadowTimeout)
+	}
+	if cfg.AllowBackendOverride {
+		log.Printf("Backend override via ?%s= is ENABLED", proxy.BackendOverrideParam)
+	}
+	if cfg.BodySampleRate > 0 {
+		log.Printf("Body sampling:   rate=%.3f max=%d redact=%d keys", cfg.BodySampleRate, cfg.BodyLogMax, len(cfg.BodyRedactKeys))
+	}
+	if cfg.BreakerFailures > 0 {
+		log.Printf("Circuit breaker: %d failures, %s cooldown, slow start %s", cfg.BreakerFailures, cfg.BreakerCooldown, cfg.SlowStart)
+	}
+	if cfg.ConcurrencyMax > 0 {
+		log.Printf("Concurrency:     adaptive, %d..%d in flight per backend", cfg.ConcurrencyMin, cfg.ConcurrencyMax)
+		if cfg.QueueDepth > 0 {
+			log.Printf("Queue:           up to %d requests per backend, max wait %s", cfg.QueueDepth, cfg.QueueWait)
+		}
+	}
+	if cfg.OutageThreshold > 0 {
+		log.Printf("Outage backoff:  %s after %d all-failed requests within %s", cfg.OutageBackoff, cfg.OutageThreshold, cfg.OutageWindow)
+	}
+	if cfg.RetryBudget > 0 {
+		log.Printf("Retry budget:    %g%% of requests, burst %d", cfg.RetryBudget*100, cfg.RetryBudgetBurst)
+	}
+	if cfg.SLOTarget > 0 {
+		log.Printf("Latency SLO:     p99 <= %s over %s", cfg.SLOTarget, cfg.SLOWindow)
+	}
+	if cfg.DuplicateWindow > 0 {
+		log.Printf("Duplicate POSTs: logged within %s", cfg.DuplicateWindow)
+	}
+	if cfg.BackendDuration {
+		log.Printf("Responses carry %s", proxy.BackendDurationHeader)
+	}
+	if cfg.NormalizePaths {
+		log.Printf("Request paths are normalized before forwarding")
+	}
+	if cfg.SanitizeErrors {
+		log.Printf("Upstream error bodies are sanitized")
+	}
+	if cfg.Tracer != nil {
+		log.Printf("Tracing:         OTLP export to %s", os.Getenv(OtelEndpointEnv))
+	}
+	if cfg.Pprof {
+		log.Printf("Profiling endpoints enabled under /debug/pprof/")
+	}
+	if cfg.PrestopDelay > 0 {
+		log.Printf("Prestop delay:   %s", cfg.PrestopDelay)
+	}
+	if envBool(StartupProbeEnv, true) {
+		b.ProbeBackends(StartupProbeTimeout)
 	}
-	defer func() { _ = resp.Body.Close() }()
 
-	// If upstream is "bad gateway-ish", allow failover
-	if resp.StatusCode == http.StatusBadGateway || resp.StatusCode == http.StatusServiceUnavailable || resp.StatusCode == http.StatusGatewayTimeout {
-		log.Printf("backend %s returned %d url=%s -> failover", be.Name, resp.StatusCode, targetURL)
-		return false
+	stop := make(chan os.Signal, 2)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	// Fail /health first and keep serving while the load balancer deregisters
+	// the Broker, then let in-flight requests finish
+	sig := <-stop
+	log.Printf("Received %s: failing /health, shutting down in %s", sig, cfg.PrestopDelay)
+	prestop(b, cfg.PrestopDelay, stop)
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Shutdown: %v", err)
 	}
+	// Export the spans of the last requests
+	if err := cfg.Tracer.Shutdown(ctx); err != nil {
+		log.Printf("Tracing: %v", err)
+	}
+	log.Printf("Broker stopped")
+}
 
-	// ---- IMPORTANT: write headers BEFORE writing body ----
-	// Indicate which backend served the request + the final URL used
-	w.Header().Set("X-Selected-Backend", be.Name) // "serverless" or "vm"
-	w.Header().Set("X-Selected-URL", targetURL)
+// prestop fails b's /health and waits out delay while b keeps serving, so
+// load balancers stop sending traffic before the server shuts down. Another
+// signal on stop skips the rest of the delay.
+func prestop(b *proxy.Broker, delay time.Duration, stop <-chan os.Signal) {
+	b.Drain()
+	select {
+	case <-time.After(delay):
+	case <-stop:
+	}
+}
 
-	// Copy upstream headers to client (you can filter if you want)
-	copyHeaders(w.Header(), resp.Header)
+// parseTrustedProxies parses IPs and CIDRs; a bare IP is a single-host network.
+func parseTrustedProxies(list []string) []*net.IPNet {
+	var out []*net.IPNet
+	for _, p := range list {
+		if !strings.Contains(p, "/") {
+			if strings.Contains(p, ":") {
+				p += "/128"
+			} else {
+				p += "/32"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(p)
+		if err != nil {
+			log.Fatalf("Invalid %s entry: %q", TrustedProxiesEnv, p)
+		}
+		out = append(out, ipNet)
+	}
+	return out
+}
 
-	// Write status code
-	w.WriteHeader(resp.StatusCode)
+// ipFamilies are the accepted BROKER_IP_FAMILY values.
+var ipFamilies = []string{"tcp", "tcp4", "tcp6"}
 
-	// Stream body
-	_, _ = io.Copy(w, resp.Body)
+// familyDialer returns d.DialContext dialing network (one of ipFamilies)
+// whatever network the transport asks for.
+func familyDialer(d *net.Dialer, network string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if network == "tcp" {
+		return d.DialContext
+	}
+	return func(ctx context.Context, _, addr string) (net.Conn, error) {
+		return d.DialContext(ctx, network, addr)
+	}
+}
 
-	// Log (optional)
-	// log.Printf("served via=%s url=%s status=%d", be.Name, targetURL, resp.StatusCode)
+// h2cTransport derives a transport from base that speaks HTTP/2 over cleartext
+// TCP with prior knowledge, for plain-HTTP backends that support h2c.
+func h2cTransport(base *http.Transport) *http.Transport {
+	t := base.Clone()
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	t.Protocols = &protocols
+	return t
+}
 
-	return true
+// tlsTransport derives a dedicated transport from base for one backend, with
+// an optional client certificate (both files required) and CA bundle.
+func tlsTransport(base *http.Transport, name, certFile, keyFile, caFile string) *http.Transport {
+	t := base.Clone()
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			log.Fatalf("Invalid %s/%s: both are required", backendEnv(name, "TLS_CERT"), backendEnv(name, "TLS_KEY"))
+		}
+		pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			log.Fatalf("Invalid %s/%s: %v", backendEnv(name, "TLS_CERT"), backendEnv(name, "TLS_KEY"), err)
+		}
+		cfg.Certificates = []tls.Certificate{pair}
+	}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			log.Fatalf("Invalid %s: %v", backendEnv(name, "TLS_CA"), err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			log.Fatalf("Invalid %s: no certificates in %q", backendEnv(name, "TLS_CA"), caFile)
+		}
+		cfg.RootCAs = pool
+	}
+	t.TLSClientConfig = cfg
+	return t
 }
 
 func mustParseURL(s string) *url.URL {
@@ -180,77 +547,97 @@ func mustParseURL(s string) *url.URL {
 	return u
 }
 
-func readUpTo(rc io.ReadCloser, max int64) ([]byte, error) {
-	defer func() { _ = rc.Close() }()
-	b, err := io.ReadAll(io.LimitReader(rc, max+1))
+// backendEnv names a per-backend env var: backendEnv("vm", "H2C") = "BROKER_VM_H2C".
+func backendEnv(name, option string) string {
+	return "BROKER_" + strings.ToUpper(name) + "_" + option
+}
+
+func envString(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func envInt(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
 	if err != nil {
-		return nil, err
+		log.Fatalf("Invalid %s: %q", key, v)
 	}
-	if int64(len(b)) > max {
-		return nil, io.ErrUnexpectedEOF
+	return n
+}
+
+func envBool(key string, def bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	ok, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Fatalf("Invalid %s: %q", key, v)
 	}
-	return b, nil
+	return ok
 }
 
-// joinURL combines base URL + path + query into a full URL string.
-func joinURL(base *url.URL, path string, rawQuery string) string {
-	u := *base // copy
-	if path == "" {
-		path = "/"
-	}
-	// Ensure proper slashes:
-	// base.Path usually empty; we want base + incoming path
-	if u.Path == "" || u.Path == "/" {
-		u.Path = path
-	} else {
-		// If base has path and incoming has path, join safely
-		u.Path = stringsTrimRightSlash(u.Path) + "/" + stringsTrimLeftSlash(path)
-	}
-	u.RawQuery = rawQuery
-	return u.String()
+func envFloat(key string, def float64) float64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		log.Fatalf("Invalid %s: %q", key, v)
+	}
+	return f
 }
 
-func stringsTrimLeftSlash(s string) string {
-	for len(s) > 0 && s[0] == '/' {
-		s = s[1:]
+// envLatLng parses a "lat,lng" env var, nil when unset.
+func envLatLng(key string, def *proxy.LatLng) *proxy.LatLng {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
 	}
-	return s
+	ll, err := parseLatLng(v)
+	if err != nil {
+		log.Fatalf("Invalid %s: %q", key, v)
+	}
+	return ll
 }
 
-func stringsTrimRightSlash(s string) string {
-	for len(s) > 0 && s[len(s)-1] == '/' {
-		s = s[:len(s)-1]
+// parseLatLng parses "lat,lng" in degrees.
+func parseLatLng(v string) (*proxy.LatLng, error) {
+	latStr, lngStr, ok := strings.Cut(v, ",")
+	lat, err1 := strconv.ParseFloat(strings.TrimSpace(latStr), 64)
+	lng, err2 := strconv.ParseFloat(strings.TrimSpace(lngStr), 64)
+	if !ok || err1 != nil || err2 != nil || lat < -90 || lat > 90 || lng < -180 || lng > 180 {
+		return nil, fmt.Errorf("%q is not \"lat,lng\" in degrees", v)
 	}
-	return s
+	return &proxy.LatLng{Lat: lat, Lng: lng}, nil
 }
 
-// copyHeaders copies headers from src to dst, skipping hop-by-hop headers.
-func copyHeaders(dst, src http.Header) {
-	// Hop-by-hop headers per RFC 7230 section 6.1
-	// We remove them to avoid proxy issues.
-	hopByHop := map[string]bool{
-		"Connection":          true,
-		"Proxy-Connection":    true,
-		"Keep-Alive":          true,
-		"Proxy-Authenticate":  true,
-		"Proxy-Authorization": true,
-		"Te":                  true,
-		"Trailer":             true,
-		"Transfer-Encoding":   true,
-		"Upgrade":             true,
-	}
-
-	for k, vv := range src {
-		if hopByHop[k] {
-			continue
-		}
-		// Don't forward our own selection headers from client
-		if k == "X-Selected-Backend" || k == "X-Selected-URL" {
-			continue
-		}
-		dst.Del(k)
-		for _, v := range vv {
-			dst.Add(k, v)
+// envList splits a comma-separated env var, dropping empty items.
+func envList(key string) []string {
+	var out []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
 		}
 	}
+	return out
+}
+
+func envDuration(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("Invalid %s: %q", key, v)
+	}
+	return d
 }
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dwladdimiroc/load-serverless/broker/proxy"
+)
+
+func TestH2CTransport(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Proto))
+	}))
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetHTTP1(true)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+
+	base := http.DefaultTransport.(*http.Transport)
+	for _, tt := range []struct {
+		transport http.RoundTripper
+		want      string
+	}{{base, "HTTP/1.1"}, {h2cTransport(base), "HTTP/2.0"}} {
+		be := proxy.Backend{Name: "vm", BaseURL: u, Transport: tt.transport}
+		b := proxy.New(proxy.Config{Backends: []proxy.Backend{be, be}})
+		rec := httptest.NewRecorder()
+		b.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/x", nil))
+		if got := rec.Body.String(); rec.Code != http.StatusOK || got != tt.want {
+			t.Errorf("backend saw %d %q, want %s", rec.Code, got, tt.want)
+		}
+	}
+	if base.Protocols != nil {
+		t.Error("h2cTransport modified the base transport")
+	}
+}
+
+// writeClientCert writes a self-signed client certificate and its key as PEM
+// files and returns their paths along with the parsed certificate.
+func writeClientCert(t *testing.T) (certFile, keyFile string, cert *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "broker"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+	cert, err = x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile, cert
+}
+
+func writePEM(t *testing.T, path, typ string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTLSTransportClientCert(t *testing.T) {
+	certFile, keyFile, clientCert := writeClientCert(t)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	srv.StartTLS()
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	writePEM(t, caFile, "CERTIFICATE", srv.Certificate().Raw)
+
+	base := http.DefaultTransport.(*http.Transport).Clone()
+	baseTLS := base.TLSClientConfig
+	for _, tt := range []struct {
+		name      string
+		transport http.RoundTripper
+		want      int
+	}{
+		{"client cert and CA", tlsTransport(base, "vm", certFile, keyFile, caFile), http.StatusOK},
+		{"CA only", tlsTransport(base, "vm", "", "", caFile), http.StatusBadGateway},
+		{"shared transport", base, http.StatusBadGateway},
+	} {
+		be := proxy.Backend{Name: "vm", BaseURL: u, Transport: tt.transport}
+		b := proxy.New(proxy.Config{Backends: []proxy.Backend{be, be}})
+		rec := httptest.NewRecorder()
+		b.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/x", nil))
+		if rec.Code != tt.want || (tt.want == http.StatusOK && rec.Body.String() != "broker") {
+			t.Errorf("%s: got %d %q, want %d", tt.name, rec.Code, rec.Body.String(), tt.want)
+		}
+	}
+	if base.TLSClientConfig != baseTLS {
+		t.Error("tlsTransport modified the base transport")
+	}
+}
+
+func TestPprofEnv(t *testing.T) {
+	be := proxy.Backend{Name: "vm", BaseURL: &url.URL{Scheme: "http", Host: "127.0.0.1:1"}, Transport: http.DefaultTransport}
+	for _, tt := range []struct {
+		env  string
+		want int
+	}{{"", http.StatusBadGateway}, {"false", http.StatusBadGateway}, {"true", http.StatusOK}} {
+		t.Setenv(PprofEnv, tt.env)
+		b := proxy.New(proxy.Config{Backends: []proxy.Backend{be, be}, Pprof: envBool(PprofEnv, false)})
+		rec := httptest.NewRecorder()
+		b.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/pprof/", nil))
+		// Off, the path is proxied like any other (to a backend that isn't there)
+		if rec.Code != tt.want {
+			t.Errorf("%s=%q: /debug/pprof/ got %d, want %d", PprofEnv, tt.env, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestPrestop(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	u, _ := url.Parse(backend.URL)
+	be := proxy.Backend{Name: "vm", BaseURL: u, Transport: backend.Client().Transport}
+	b := proxy.New(proxy.Config{Backends: []proxy.Backend{be, be}})
+	srv := httptest.NewServer(b.Handler())
+	defer srv.Close()
+	get := func(path string) int {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	stop := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	start := time.Now()
+	go func() {
+		prestop(b, 200*time.Millisecond, stop)
+		close(done)
+	}()
+
+	// /health fails at once, traffic is still served during the delay
+	deadline := time.Now().Add(time.Second)
+	for get("/health") != http.StatusServiceUnavailable {
+		if time.Now().After(deadline) {
+			t.Fatal("/health still passing")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for range 5 {
+		if code := get("/x"); code != http.StatusOK {
+			t.Errorf("request during the prestop delay: status %d", code)
+		}
+	}
+	select {
+	case <-done:
+		t.Fatal("prestop returned before the delay")
+	default:
+	}
+	<-done
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("prestop returned after %s, want the 200ms delay", elapsed)
+	}
+
+	// A second signal cuts the delay short
+	done = make(chan struct{})
+	go func() {
+		prestop(b, time.Minute, stop)
+		close(done)
+	}()
+	stop <- os.Interrupt
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("prestop ignored the second signal")
+	}
+}
+
+func TestFamilyDialer(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close() // listens on 127.0.0.1
+	addr := srv.Listener.Addr().String()
+	for _, family := range ipFamilies {
+		// The transport always asks for "tcp"; the family wins
+		conn, err := familyDialer(&net.Dialer{Timeout: time.Second}, family)(context.Background(), "tcp", addr)
+		if family == "tcp6" {
+			if err == nil {
+				conn.Close()
+				t.Errorf("tcp6 dialed IPv4 address %s", addr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", family, err)
+			continue
+		}
+		conn.Close()
+	}
+}
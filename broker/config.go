@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// fileConfig is the JSON file named by -config or BROKER_CONFIG. Every field
+// is optional: it replaces the built-in default, and the matching env var
+// (BROKER_*, BROKER_<NAME>_*) still overrides it. Durations are Go duration
+// strings such as "1.5s".
+type fileConfig struct {
+	Listen            string   `json:"listen"`
+	ReadHeaderTimeout duration `json:"read_header_timeout"`
+	PrestopDelay      duration `json:"prestop_delay"`
+
+	IPFamily string `json:"ip_family"` // "tcp" (default), "tcp4" or "tcp6"
+
+	// Replace the default serverless/vm pair when non-empty
+	Backends []fileBackend `json:"backends"`
+
+	FailoverOrder    []string `json:"failover_order"`
+	FailoverStatuses []int    `json:"failover_statuses"`
+
+	RateLimit       float64  `json:"rate_limit"`
+	RateBurst       int      `json:"rate_burst"`
+	CacheSize       int      `json:"cache_size"`
+	BreakerFailures int      `json:"breaker_failures"`
+	BreakerCooldown duration `json:"breaker_cooldown"`
+	ConcurrencyMin  int      `json:"concurrency_min"`
+	ConcurrencyMax  int      `json:"concurrency_max"`
+	QueueDepth      int      `json:"queue_depth"`
+	QueueWait       duration `json:"queue_wait"`
+	OutageThreshold int      `json:"outage_threshold"`
+	OutageWindow    duration `json:"outage_window"`
+	OutageBackoff   duration `json:"outage_backoff"`
+
+	RetryBudget      float64 `json:"retry_budget"`
+	RetryBudgetBurst int     `json:"retry_budget_burst"`
+
+	SanitizeErrors  bool     `json:"sanitize_errors"`
+	NormalizePaths  bool     `json:"normalize_paths"`
+	BackendDuration bool     `json:"backend_duration_header"`
+	SLOTarget       duration `json:"slo_p99"`
+	SLOWindow       duration `json:"slo_window"`
+}
+
+type fileBackend struct {
+	Name         string   `json:"name"`
+	URL          string   `json:"url"`
+	Weight       int      `json:"weight"`
+	Timeout      duration `json:"timeout"`
+	H2C          bool     `json:"h2c"`
+	PreserveHost bool     `json:"preserve_host"`
+	Region       string   `json:"region"`
+	LatLng       string   `json:"latlng"` // "lat,lng"
+	HealthPath   string   `json:"health_path"`
+	TLSCert      string   `json:"tls_cert"`
+	TLSKey       string   `json:"tls_key"`
+	TLSCA        string   `json:"tls_ca"`
+
+	// Set by validate
+	parsedURL   *url.URL
+	description string // "backends[i]" for error messages
+}
+
+// duration is a time.Duration read from a JSON string.
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return errors.New(`duration must be a string like "1.5s"`)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+// loadConfigFile reads and validates path. Unknown keys are errors, so a
+// typo doesn't silently leave a setting at its default.
+func loadConfigFile(path string) (*fileConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var fc fileConfig
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&fc); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := fc.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &fc, nil
+}
+
+func (fc *fileConfig) validate() error {
+	if fc.Backends != nil && len(fc.Backends) == 0 {
+		return errors.New("backends: at least 1 is required")
+	}
+	seen := make(map[string]bool)
+	for i := range fc.Backends {
+		be := &fc.Backends[i]
+		be.description = fmt.Sprintf("backends[%d]", i)
+		switch {
+		case be.Name == "":
+			return fmt.Errorf("%s: missing name", be.description)
+		case seen[be.Name]:
+			return fmt.Errorf("%s: duplicate name %q", be.description, be.Name)
+		case be.Weight < 0:
+			return fmt.Errorf("%s: weight must be >= 0", be.description)
+		case be.Timeout < 0:
+			return fmt.Errorf("%s: timeout must be >= 0", be.description)
+		}
+		seen[be.Name] = true
+		u, err := url.Parse(be.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("%s: invalid url %q", be.description, be.URL)
+		}
+		be.parsedURL = u
+		if be.LatLng != "" {
+			if _, err := parseLatLng(be.LatLng); err != nil {
+				return fmt.Errorf("%s: latlng: %w", be.description, err)
+			}
+		}
+	}
+	for _, name := range fc.FailoverOrder {
+		if len(fc.Backends) > 0 && !seen[name] {
+			return fmt.Errorf("failover_order: unknown backend %q", name)
+		}
+	}
+	for _, code := range fc.FailoverStatuses {
+		if code < 100 || code > 599 {
+			return fmt.Errorf("failover_statuses: %d is not an HTTP status", code)
+		}
+	}
+	switch {
+	case fc.RateLimit < 0 || fc.RateBurst < 0 || fc.CacheSize < 0 || fc.BreakerFailures < 0:
+		return errors.New("rate_limit, rate_burst, cache_size and breaker_failures must be >= 0")
+	case fc.ConcurrencyMin < 0 || fc.ConcurrencyMax < 0 || fc.QueueDepth < 0:
+		return errors.New("concurrency_min, concurrency_max and queue_depth must be >= 0")
+	case fc.SLOTarget < 0 || fc.SLOWindow < 0 || fc.PrestopDelay < 0:
+		return errors.New("slo_p99, slo_window and prestop_delay must be >= 0")
+	case fc.OutageThreshold < 0 || fc.OutageWindow < 0 || fc.OutageBackoff < 0:
+		return errors.New("outage_threshold, outage_window and outage_backoff must be >= 0")
+	case fc.RetryBudget < 0 || fc.RetryBudget > 1 || fc.RetryBudgetBurst < 0:
+		return errors.New("retry_budget must be between 0 and 1 and retry_budget_burst >= 0")
+	case fc.IPFamily != "" && !slices.Contains(ipFamilies, fc.IPFamily):
+		return fmt.Errorf("ip_family: %q must be one of %s", fc.IPFamily, strings.Join(ipFamilies, ", "))
+	}
+	return nil
+}
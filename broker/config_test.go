@@ -0,0 +1,87 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "broker.json")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+const sampleConfig = `{
+  "listen": ":9090",
+  "backends": [
+    {"name": "vm-us", "url": "http://10.0.0.1:8080", "weight": 3, "timeout": "2s", "region": "us-east1", "latlng": "33.8,-84.4"},
+    {"name": "vm-eu", "url": "http://10.0.0.2:8080", "h2c": true, "region": "europe-west1"},
+    {"name": "serverless", "url": "https://fn.example.com/Average", "preserve_host": true}
+  ],
+  "failover_order": ["vm-eu"],
+  "failover_statuses": [429, 503],
+  "breaker_failures": 5,
+  "breaker_cooldown": "10s",
+  "concurrency_max": 64,
+  "sanitize_errors": true
+}`
+
+func TestConfigFile(t *testing.T) {
+	fc, err := loadConfigFile(writeConfig(t, sampleConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fc.Listen != ":9090" || len(fc.Backends) != 3 {
+		t.Fatalf("listen %q, %d backends", fc.Listen, len(fc.Backends))
+	}
+	us, eu, fn := fc.Backends[0], fc.Backends[1], fc.Backends[2]
+	if us.Name != "vm-us" || us.parsedURL.String() != "http://10.0.0.1:8080" || us.Weight != 3 || time.Duration(us.Timeout) != 2*time.Second ||
+		us.Region != "us-east1" || us.LatLng != "33.8,-84.4" {
+		t.Errorf("vm-us = %+v", us)
+	}
+	if eu.Name != "vm-eu" || !eu.H2C || eu.Region != "europe-west1" || eu.LatLng != "" {
+		t.Errorf("vm-eu = %+v", eu)
+	}
+	if fn.Name != "serverless" || fn.parsedURL.Path != "/Average" || !fn.PreserveHost {
+		t.Errorf("serverless = %+v", fn)
+	}
+	if !slices.Equal(fc.FailoverOrder, []string{"vm-eu"}) || !slices.Equal(fc.FailoverStatuses, []int{429, 503}) {
+		t.Errorf("failover order %v, statuses %v", fc.FailoverOrder, fc.FailoverStatuses)
+	}
+	if fc.BreakerFailures != 5 || time.Duration(fc.BreakerCooldown) != 10*time.Second || fc.ConcurrencyMax != 64 || !fc.SanitizeErrors {
+		t.Errorf("breaker %d/%s, concurrency max %d, sanitize %t", fc.BreakerFailures, time.Duration(fc.BreakerCooldown), fc.ConcurrencyMax, fc.SanitizeErrors)
+	}
+}
+
+func TestConfigFileErrors(t *testing.T) {
+	for content, want := range map[string]string{
+		`{"listn": ":9090"}`: `unknown field "listn"`,
+		`{"backends": []}`:   "at least 1",
+		`{"backends": [{"name": "a", "url": "http://a"}, {"name": "a", "url": "http://b"}]}`:                          `backends[1]: duplicate name "a"`,
+		`{"backends": [{"name": "a", "url": "http://a"}, {"url": "http://b"}]}`:                                       "backends[1]: missing name",
+		`{"backends": [{"name": "a", "url": "ftp://a"}, {"name": "b", "url": "http://b"}]}`:                           `backends[0]: invalid url "ftp://a"`,
+		`{"backends": [{"name": "a", "url": "http://a", "latlng": "91,0"}, {"name": "b", "url": "http://b"}]}`:        "backends[0]: latlng",
+		`{"backends": [{"name": "a", "url": "http://a"}, {"name": "b", "url": "http://b"}], "failover_order": ["c"]}`: `unknown backend "c"`,
+		`{"failover_statuses": [99]}`: "99 is not an HTTP status",
+		`{"breaker_cooldown": 10}`:    "duration must be a string",
+		`{"queue_wait": "soon"}`:      "invalid duration",
+		`{"concurrency_max": -1}`:     "concurrency_max",
+		`{"retry_budget": 2}`:         "retry_budget must be between 0 and 1",
+		`{"ip_family": "tcp5"}`:       `ip_family: "tcp5"`,
+	} {
+		_, err := loadConfigFile(writeConfig(t, content))
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: %v, want %q", content, err, want)
+		}
+	}
+	if _, err := loadConfigFile(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("missing file loaded")
+	}
+}
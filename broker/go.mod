@@ -0,0 +1,3 @@
+module github.com/dwladdimiroc/load-serverless/broker
+
+go 1.25
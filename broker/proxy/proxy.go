@@ -0,0 +1,2543 @@
+// Package proxy implements the Broker: a reverse proxy that spreads requests
+// over the serverless and VM backends round robin, failing over to the other
+// backend when one is unavailable. It holds no env parsing of its own; the
+// broker command builds a Config from the environment and serves Handler.
+package proxy
+
+import (
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"container/list"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dwladdimiroc/load-serverless/broker/tracing"
+)
+
+const (
+	MaxBodyBytes = int64(2 << 20) // 2MB
+	DialTimeout  = 5 * time.Second
+
+	AdminSecretHeader = "X-Admin-Secret"
+
+	// Time the serving backend took to answer with headers, in milliseconds
+	BackendDurationHeader = "X-Backend-Duration"
+
+	DefaultHealthPath    = "/health"
+	DefaultShadowTimeout = 10 * time.Second
+	DefaultBodyLogMax    = 1024
+
+	BackendOverrideParam = "__backend"
+
+	// "lat,lng" of the client; routes to the nearest located backend
+	ClientLatLngHeader = "X-Client-LatLng"
+	EarthRadiusKm      = 6371.0
+
+	DefaultBreakerCooldown = 10 * time.Second
+	SlowStartMinWeight     = 0.05 // share a backend gets right after recovering
+
+	DefaultConcurrencyMin = 10
+	DefaultQueueWait      = 500 * time.Millisecond
+
+	DefaultOutageWindow  = 2 * time.Second
+	DefaultOutageBackoff = time.Second
+
+	DefaultRetryBudgetBurst = 10
+
+	DefaultSLOWindow = time.Minute
+	SLOMaxSamples    = 4096 // latencies kept per window; older ones drop out early under load
+	SLOMinSamples    = 10   // below this the SLO is not judged
+
+	IdempotencyKeyHeader   = "Idempotency-Key"
+	DefaultIdempotencySize = 10000
+
+	RateLimitShards          = 64
+	RateLimitCleanupInterval = time.Minute
+)
+
+// DefaultFailoverStatuses are the upstream statuses that fail over when
+// Config.FailoverStatuses is empty.
+var DefaultFailoverStatuses = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+
+type Backend struct {
+	Name      string // "serverless" or "vm"
+	BaseURL   *url.URL
+	Transport http.RoundTripper
+	H2C       bool // HTTP/2 cleartext (prior knowledge) instead of HTTP/1.1
+	MTLS      bool // Transport presents a client certificate (informational)
+
+	PreserveHost bool // forward the client's Host instead of BaseURL's
+
+	HealthPath string // probed at startup
+
+	Region   string  // informational label, e.g. "us-east1"
+	Location *LatLng // where the backend runs, nil = not eligible for geo routing
+
+	Weight int // share of round-robin turns relative to the other backends, 0 = 1
+
+	Timeout      time.Duration // per-attempt deadline, 0 = only the client's
+	SoftDeadline time.Duration // fail over if no headers by then (idempotent methods), 0 = off
+
+	state *backendState       // circuit breaker, nil when disabled
+	conc  *concurrencyLimiter // adaptive in-flight limit, nil when disabled
+	stats *backendStats       // set by New
+	slo   *latencyWindow      // rolling attempt latencies, nil when no SLO is set
+}
+
+// backendStats counts attempts against one backend.
+type backendStats struct {
+	requests atomic.Uint64
+	failures atomic.Uint64 // attempts that failed over or errored
+	inflight atomic.Int64  // attempts still being served
+	draining atomic.Bool   // taken out of rotation through /backends
+}
+
+// drainState reports a backend's /backends state: "active", "draining"
+// while requests it already took are still in flight, then "drained".
+func (s *backendStats) drainState() string {
+	switch {
+	case !s.draining.Load():
+		return "active"
+	case s.inflight.Load() > 0:
+		return "draining"
+	}
+	return "drained"
+}
+
+// LatLng is a point in degrees.
+type LatLng struct {
+	Lat float64 `json:"lat"`
+	Lng float64 `json:"lng"`
+}
+
+// Config holds everything a Broker needs. Zero values leave the optional
+// features off.
+type Config struct {
+	Backends []Backend
+
+	// Reported by /config only; the caller owns the http.Server
+	ListenAddr        string
+	ReadHeaderTimeout time.Duration
+	PrestopDelay      time.Duration // how long the caller serves after Drain
+
+	CacheSize int // > 0 enables the GET response cache with that many entries
+
+	Shadow            bool // mirror requests the first backend served to the other and log divergences
+	ShadowCompareBody bool
+	ShadowTimeout     time.Duration // 0 = DefaultShadowTimeout
+
+	AllowBackendOverride bool // honor ?__backend=<name> (debugging only)
+
+	// FirstBackend names the backend that takes the first round-robin turn,
+	// so tests can predict routing; empty or unknown leaves the usual start.
+	FirstBackend string
+
+	// Backend names tried, in this order, after the primary fails; unlisted
+	// backends follow in rotation order. Unknown names are ignored.
+	FailoverOrder []string
+
+	// Upstream statuses treated as a failed attempt (the next backend is
+	// tried); empty = DefaultFailoverStatuses.
+	FailoverStatuses []int
+
+	IdempotencyTTL  time.Duration // > 0 replays responses for a repeated Idempotency-Key this long
+	IdempotencySize int           // max stored keys, 0 = DefaultIdempotencySize
+
+	BodySampleRate float64 // in [0,1], fraction of request/response bodies logged
+	BodyLogMax     int     // 0 = DefaultBodyLogMax
+	BodyRedactKeys []string
+
+	RateLimit      float64 // > 0 enables per-client-IP rate limiting (requests/second)
+	RateBurst      int     // 0 = ceil(RateLimit)
+	TrustedProxies []*net.IPNet
+
+	// BreakerFailures > 0 opens a backend's circuit after that many consecutive
+	// failures; it half-opens after BreakerCooldown and a successful probe
+	// closes it. SlowStart then ramps the backend's share back up over that window.
+	BreakerFailures int
+	BreakerCooldown time.Duration // 0 = DefaultBreakerCooldown
+	SlowStart       time.Duration
+
+	// OutageThreshold > 0 answers 503 with Retry-After, without trying any
+	// backend, for OutageBackoff once that many requests failed on every
+	// backend within OutageWindow; a success through any backend clears it.
+	OutageThreshold int
+	OutageWindow    time.Duration // 0 = DefaultOutageWindow
+	OutageBackoff   time.Duration // 0 = DefaultOutageBackoff
+
+	// RetryBudget > 0 caps failovers after a backend already got the request
+	// to that fraction of all requests: each request earns RetryBudget
+	// tokens, up to RetryBudgetBurst saved (and available at start), and
+	// each such retry spends one. Without a token the failed backend's
+	// response is returned as is (502 if it gave none) instead of trying the
+	// next backend.
+	RetryBudget      float64
+	RetryBudgetBurst int // 0 = DefaultRetryBudgetBurst
+
+	// ConcurrencyMax > 0 caps each backend's in-flight requests with an
+	// adaptive limit between ConcurrencyMin and ConcurrencyMax that grows
+	// while latency is stable and shrinks when it climbs.
+	ConcurrencyMin int // 0 = DefaultConcurrencyMin
+	ConcurrencyMax int
+
+	// QueueDepth > 0 lets up to that many requests per backend wait, in FIFO
+	// order and for at most QueueWait, for a slot on the last backend they
+	// can fail over to; a full queue or an expired wait gets 503.
+	QueueDepth int
+	QueueWait  time.Duration // 0 = DefaultQueueWait
+
+	SanitizeErrors bool // replace forwarded non-2xx bodies with a generic JSON error
+
+	BackendDuration bool // set X-Backend-Duration on proxied responses
+
+	// NormalizePaths cleans request paths ("." and ".." elements, repeated
+	// slashes) before routing and forwarding, instead of ServeMux's redirect
+	// to the clean path. A trailing slash is kept.
+	NormalizePaths bool
+
+	// SLOTarget > 0 tracks the rolling p99 latency over SLOWindow, overall
+	// and per backend, against this target: /metrics reports it and /health
+	// answers "degraded" (still 200) while the overall p99 exceeds it.
+	SLOTarget time.Duration
+	SLOWindow time.Duration // 0 = DefaultSLOWindow
+
+	// DuplicateWindow > 0 logs a warning when a client POSTs the same body to
+	// the same path again within the window (observational only)
+	DuplicateWindow time.Duration
+
+	Tracer *tracing.Tracer // exports request spans when set
+
+	Pprof bool // serve net/http/pprof under /debug/pprof/ (admin only)
+
+	AdminSecret string // when set, must be sent as X-Admin-Secret to admin endpoints
+
+	StripRequestHeaders  []string // never forwarded, on top of hop-by-hop ones
+	StripResponseHeaders []string
+
+	// Upstream response header filters, applied after the strip list. Entries
+	// are header names or prefixes ending in "*" (e.g. "X-Internal-*"). Deny
+	// wins; a non-empty allow list drops every other upstream header. The
+	// broker's own X-Selected-* headers are never filtered.
+	ResponseHeaderAllow []string
+	ResponseHeaderDeny  []string
+
+	// Hooks for embedding the Broker as a library, e.g. for auth, custom
+	// logging or response rewriting; nil = none.
+	BeforeDispatch BeforeDispatchHook
+	AfterResponse  AfterResponseHook
+}
+
+// BeforeDispatchHook runs for every proxied request (not the admin
+// endpoints) after rate limiting and before the Broker does any other work
+// for it. It may modify r's headers. Returning false short-circuits the
+// request: the hook has answered it through w, e.g. with a 401, and no
+// backend is tried.
+type BeforeDispatchHook func(w http.ResponseWriter, r *http.Request) bool
+
+// AfterResponseHook sees the backend response about to be forwarded to the
+// client, once per request, after failover decisions: it may rewrite the
+// status, headers or body in place (a new body needs its Content-Length
+// header updated or removed). r is the client's request.
+type AfterResponseHook func(backend string, r *http.Request, resp *http.Response)
+
+type Broker struct {
+	backends []Backend
+	rr       atomic.Uint64
+	schedule []int          // weighted round-robin order of backend indexes, nil = plain rotation
+	cache    *responseCache // nil when caching is disabled
+
+	shadow            bool
+	shadowCompareBody bool
+	shadowTimeout     time.Duration
+	shadowDivergences atomic.Uint64
+
+	allowOverride bool
+
+	failoverOrder    []int // backend indexes, see Config.FailoverOrder
+	failoverStatuses map[int]bool
+
+	bodyLog *bodyLogger // nil when body sampling is disabled
+
+	idem *idempotencyStore // nil when Idempotency-Key handling is disabled
+
+	limiter *rateLimiter // nil when rate limiting is disabled
+
+	sanitizeErrors  bool
+	normalizePaths  bool
+	backendDuration bool
+
+	dups *dupDetector // nil when duplicate detection is disabled
+
+	outage *outageBackoff // nil when the all-backends-failed backoff is disabled
+
+	retries *retryBudget // nil when retries are unlimited
+
+	sloTarget time.Duration
+	slo       *latencyWindow // request latencies as clients see them, nil when no SLO is set
+
+	adminSecret string
+	pprof       bool
+
+	tracer *tracing.Tracer // nil when tracing is disabled
+
+	beforeDispatch BeforeDispatchHook
+	afterResponse  AfterResponseHook
+
+	stripRequest  map[string]bool
+	stripResponse map[string]bool
+	respFilter    *headerFilter // nil when no allow/deny list is set
+
+	listenAddr        string
+	readHeaderTimeout time.Duration
+	prestopDelay      time.Duration
+
+	draining atomic.Bool // set by Drain: /health fails, requests are still served
+}
+
+// New builds a Broker from cfg, which needs at least one backend. The rate
+// limiter's cleanup goroutine, if any, runs for the life of the process.
+func New(cfg Config) *Broker {
+	if len(cfg.Backends) == 0 {
+		panic("proxy: New needs at least one backend")
+	}
+	b := &Broker{
+		backends:          cfg.Backends,
+		shadow:            cfg.Shadow,
+		shadowCompareBody: cfg.ShadowCompareBody,
+		shadowTimeout:     cfg.ShadowTimeout,
+		allowOverride:     cfg.AllowBackendOverride,
+		sanitizeErrors:    cfg.SanitizeErrors,
+		normalizePaths:    cfg.NormalizePaths,
+		backendDuration:   cfg.BackendDuration,
+		adminSecret:       cfg.AdminSecret,
+		pprof:             cfg.Pprof,
+		tracer:            cfg.Tracer,
+		beforeDispatch:    cfg.BeforeDispatch,
+		afterResponse:     cfg.AfterResponse,
+		stripRequest:      headerSet(cfg.StripRequestHeaders),
+		stripResponse:     headerSet(cfg.StripResponseHeaders),
+		listenAddr:        cfg.ListenAddr,
+		readHeaderTimeout: cfg.ReadHeaderTimeout,
+		prestopDelay:      cfg.PrestopDelay,
+	}
+	if slices.ContainsFunc(b.backends, func(be Backend) bool { return be.Weight > 1 }) {
+		for i, be := range b.backends {
+			for range max(be.Weight, 1) {
+				b.schedule = append(b.schedule, i)
+			}
+		}
+	}
+	if cfg.OutageThreshold > 0 {
+		b.outage = &outageBackoff{
+			threshold: cfg.OutageThreshold,
+			window:    cmp.Or(cfg.OutageWindow, DefaultOutageWindow),
+			backoff:   cmp.Or(cfg.OutageBackoff, DefaultOutageBackoff),
+		}
+	}
+	if cfg.RetryBudget > 0 {
+		burst := float64(cmp.Or(cfg.RetryBudgetBurst, DefaultRetryBudgetBurst))
+		b.retries = &retryBudget{ratio: cfg.RetryBudget, burst: burst, tokens: burst}
+	}
+	if cfg.FirstBackend != "" {
+		b.startRotationAt(cfg.FirstBackend)
+	}
+	if cfg.SLOTarget > 0 {
+		b.sloTarget = cfg.SLOTarget
+		b.slo = newLatencyWindow(cfg.SLOWindow)
+	}
+	if cfg.DuplicateWindow > 0 {
+		b.dups = &dupDetector{window: cfg.DuplicateWindow, seen: make(map[uint64]time.Time)}
+	}
+	statuses := cfg.FailoverStatuses
+	if len(statuses) == 0 {
+		statuses = DefaultFailoverStatuses
+	}
+	b.failoverStatuses = make(map[int]bool, len(statuses))
+	for _, code := range statuses {
+		b.failoverStatuses[code] = true
+	}
+	if len(cfg.ResponseHeaderAllow) > 0 || len(cfg.ResponseHeaderDeny) > 0 {
+		b.respFilter = &headerFilter{allow: headerPatterns(cfg.ResponseHeaderAllow), deny: headerPatterns(cfg.ResponseHeaderDeny)}
+	}
+	for _, name := range cfg.FailoverOrder {
+		for i, be := range b.backends {
+			if be.Name == name && !slices.Contains(b.failoverOrder, i) {
+				b.failoverOrder = append(b.failoverOrder, i)
+			}
+		}
+	}
+	for i := range b.backends {
+		b.backends[i].stats = new(backendStats)
+		if b.slo != nil {
+			b.backends[i].slo = newLatencyWindow(cfg.SLOWindow)
+		}
+		if b.backends[i].HealthPath == "" {
+			b.backends[i].HealthPath = DefaultHealthPath
+		}
+		if cfg.BreakerFailures > 0 {
+			cooldown := cfg.BreakerCooldown
+			if cooldown <= 0 {
+				cooldown = DefaultBreakerCooldown
+			}
+			b.backends[i].state = &backendState{
+				name:           b.backends[i].Name,
+				failuresToOpen: cfg.BreakerFailures,
+				cooldown:       cooldown,
+				slowStart:      cfg.SlowStart,
+			}
+		}
+		if cfg.ConcurrencyMax > 0 {
+			minLimit := cfg.ConcurrencyMin
+			if minLimit <= 0 {
+				minLimit = min(DefaultConcurrencyMin, cfg.ConcurrencyMax)
+			}
+			b.backends[i].conc = newConcurrencyLimiter(minLimit, cfg.ConcurrencyMax)
+			if cfg.QueueDepth > 0 {
+				b.backends[i].conc.queueMax = cfg.QueueDepth
+				b.backends[i].conc.queueWait = cfg.QueueWait
+				if b.backends[i].conc.queueWait <= 0 {
+					b.backends[i].conc.queueWait = DefaultQueueWait
+				}
+			}
+		}
+	}
+	if b.shadowTimeout <= 0 {
+		b.shadowTimeout = DefaultShadowTimeout
+	}
+	if cfg.RateLimit > 0 {
+		burst := cfg.RateBurst
+		if burst <= 0 {
+			burst = int(math.Ceil(cfg.RateLimit))
+		}
+		b.limiter = newRateLimiter(cfg.RateLimit, burst, cfg.TrustedProxies)
+		go b.limiter.cleanupLoop(RateLimitCleanupInterval)
+	}
+	if cfg.CacheSize > 0 {
+		b.cache = newResponseCache(cfg.CacheSize)
+	}
+	if cfg.IdempotencyTTL > 0 {
+		size := cfg.IdempotencySize
+		if size <= 0 {
+			size = DefaultIdempotencySize
+		}
+		b.idem = newIdempotencyStore(cfg.IdempotencyTTL, size)
+	}
+	if cfg.BodySampleRate > 0 {
+		maxLen := cfg.BodyLogMax
+		if maxLen <= 0 {
+			maxLen = DefaultBodyLogMax
+		}
+		b.bodyLog = newBodyLogger(cfg.BodySampleRate, maxLen, cfg.BodyRedactKeys)
+	}
+	return b
+}
+
+// Handler returns the Broker's full mux: /health, /version, the admin
+// endpoints and the proxy itself for every other path.
+func (b *Broker) Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	// Health endpoint
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		if b.draining.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte("draining"))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		// Still 200 when degraded: the Broker serves, just slower than its SLO
+		if p99, breached := b.slo.breached(b.sloTarget, time.Now()); breached {
+			fmt.Fprintf(w, "degraded: p99 %s exceeds SLO %s", p99.Round(time.Millisecond), b.sloTarget)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	})
+
+	// Build identification (Go version, VCS revision, build time)
+	mux.HandleFunc("/version", handleVersion)
+
+	// Effective configuration (read-only, no secrets)
+	mux.HandleFunc("/config", b.adminOnly(b.handleConfig))
+
+	// Prometheus-style gauges
+	mux.HandleFunc("/metrics", b.adminOnly(b.handleMetrics))
+
+	// Live per-backend counts, breaker states and p99 as Server-Sent Events
+	mux.HandleFunc("/events", b.adminOnly(b.handleEvents))
+
+	// Per-backend drain for maintenance (admin)
+	mux.HandleFunc("/backends", b.adminOnly(b.handleBackends))
+
+	// Browser dashboard polling /config and /metrics; the page itself holds no
+	// data, so it is public and asks for the admin secret when one is needed
+	mux.HandleFunc("/status", handleStatus)
+
+	// Live profiling, only when enabled
+	if b.pprof {
+		mux.HandleFunc("/debug/pprof/", b.adminOnly(pprof.Index))
+		mux.HandleFunc("/debug/pprof/cmdline", b.adminOnly(pprof.Cmdline))
+		mux.HandleFunc("/debug/pprof/profile", b.adminOnly(pprof.Profile))
+		mux.HandleFunc("/debug/pprof/symbol", b.adminOnly(pprof.Symbol))
+		mux.HandleFunc("/debug/pprof/trace", b.adminOnly(pprof.Trace))
+	}
+
+	// Main proxy handler (preserves path for both)
+	mux.Handle("/", b)
+
+	if b.normalizePaths {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mux.ServeHTTP(w, withCleanPath(r))
+		})
+	}
+	return mux
+}
+
+// withCleanPath returns r with its URL path cleaned by cleanPath, or r
+// itself when the path is already clean.
+func withCleanPath(r *http.Request) *http.Request {
+	clean := cleanPath(r.URL.Path)
+	if clean == r.URL.Path {
+		return r
+	}
+	r2 := new(http.Request)
+	*r2 = *r
+	u := *r.URL
+	u.Path, u.RawPath = clean, ""
+	r2.URL = &u
+	return r2
+}
+
+// cleanPath resolves "." and ".." elements and repeated slashes, roots the
+// path and keeps a trailing slash; "" becomes "/".
+func cleanPath(p string) string {
+	if p == "" {
+		return "/"
+	}
+	if p[0] != '/' {
+		p = "/" + p
+	}
+	clean := path.Clean(p)
+	if strings.HasSuffix(p, "/") && clean != "/" {
+		clean += "/"
+	}
+	return clean
+}
+
+// Drain marks the Broker as shutting down: /health answers 503 from now on,
+// so load balancers stop routing to it, while requests are still served
+// until the caller shuts the server down.
+func (b *Broker) Drain() {
+	b.draining.Store(true)
+}
+
+// ServeHTTP is the main proxy handler.
+func (b *Broker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if b.normalizePaths {
+		r = withCleanPath(r)
+	}
+
+	// One server span per request, continuing the caller's trace if any
+	if b.tracer != nil {
+		span := b.tracer.Start("broker "+r.Method, tracing.SpanKindServer, nil, r.Header.Get(tracing.TraceparentHeader))
+		rec := &recordingWriter{ResponseWriter: w}
+		w = rec
+		r = r.WithContext(tracing.ContextWithSpan(r.Context(), span))
+		defer func() {
+			if rec.status == 0 {
+				rec.status = http.StatusOK
+			}
+			span.SetAttr("http.request.method", r.Method)
+			span.SetAttr("url.path", r.URL.Path)
+			span.SetAttr("http.response.status_code", rec.status)
+			if name := rec.Header().Get("X-Selected-Backend"); name != "" {
+				span.SetAttr("broker.backend", name)
+			}
+			if rec.status >= 500 {
+				span.SetError()
+			}
+			span.End()
+		}()
+	}
+
+	// Per-IP rate limit before doing any work for the request
+	if b.limiter != nil {
+		if ok, wait := b.limiter.allow(b.limiter.clientIP(r), time.Now()); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+	}
+
+	if b.beforeDispatch != nil && !b.beforeDispatch(w, r) {
+		return
+	}
+
+	if b.slo != nil {
+		start := time.Now()
+		defer func() { b.slo.record(time.Since(start), time.Now()) }()
+	}
+
+	// Requests carrying an Idempotency-Key are served once per key and replayed after
+	if b.idem != nil && r.Header.Get(IdempotencyKeyHeader) != "" {
+		b.serveIdempotent(w, r)
+		return
+	}
+
+	b.serve(w, r)
+}
+
+// serve proxies one request: round robin with failover to the other backend.
+func (b *Broker) serve(w http.ResponseWriter, r *http.Request) {
+	// Buffer body to allow retry on POST/PUT/PATCH
+	var bodyCopy []byte
+	var err error
+	if r.Body != nil && (r.Method == http.MethodPost || r.Method == http.MethodPut || r.Method == http.MethodPatch) {
+		bodyCopy, err = readUpTo(r.Body, MaxBodyBytes)
+		if err != nil {
+			http.Error(w, "Request body too large or invalid", http.StatusRequestEntityTooLarge)
+			return
+		}
+	}
+	if b.dups != nil && r.Method == http.MethodPost {
+		client := b.limiter.clientIP(r)
+		if since, dup := b.dups.check(client, r.URL.Path, bodyCopy, time.Now()); dup {
+			log.Printf("duplicate POST %s from %s: same %d-byte body %s after the previous one", r.URL.Path, client, len(bodyCopy), since.Round(time.Millisecond))
+		}
+	}
+
+	// Debug override forces the primary backend (failover still applies)
+	forced := -1
+	if b.allowOverride {
+		r, forced = b.backendOverride(r)
+	}
+
+	// Sampled body logging (request body is already buffered; response is teed)
+	if b.bodyLog != nil && rand.Float64() < b.bodyLog.rate {
+		rec := &recordingWriter{ResponseWriter: w, body: new(bytes.Buffer)}
+		w = rec
+		defer func() {
+			log.Printf("body sample %s %s status=%d request=%s response=%s",
+				r.Method, r.URL.Path, rec.status, b.bodyLog.format(bodyCopy), b.bodyLog.format(rec.body.Bytes()))
+		}()
+	}
+
+	// Serve repeated GETs from cache when enabled
+	if b.cache != nil && r.Method == http.MethodGet && forced < 0 {
+		if cached, ok := b.cache.get(cacheKey(r)); ok {
+			writeCached(w, cached)
+			return
+		}
+		w.Header().Set("X-Cache", "MISS")
+	}
+
+	// Every backend failed repeatedly just now: fail fast instead of
+	// cycling through them again
+	if wait, ok := b.outage.blocked(time.Now()); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, "All backends unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	b.retries.deposit()
+
+	// Nearest backend to the client's location hint, else round robin
+	i := forced
+	if i < 0 {
+		i = b.nearestBackend(r.Header.Get(ClientLatLngHeader))
+	}
+	if i < 0 {
+		i = b.nextBackend()
+	}
+	first := b.backends[i]
+	rest := b.failoverSequence(i)
+
+	// Slow start: a recovering primary only keeps its turn with probability
+	// equal to its ramp weight, otherwise it is tried last
+	if forced < 0 && len(rest) > 0 {
+		if wt := first.state.weight(time.Now()); wt < 1 && rand.Float64() >= wt {
+			first, rest = rest[0], append(rest[1:], first)
+		}
+	}
+
+	// Once a backend got the request, every further try is a retry drawn
+	// from the budget. The token is reserved before the attempt it would
+	// follow, so that with none left that attempt's failure is answered to
+	// the client as is instead of being failed over.
+	retry := b.retries.reserve()
+	defer func() {
+		if retry {
+			b.retries.refund()
+		}
+	}()
+
+	// Shadow: once the first backend has served the client, mirror to the
+	// second. A request that fails over is not mirrored, since the second
+	// backend may then serve it for real.
+	var ok, sent bool
+	if b.shadow && len(rest) > 0 && !rest[0].stats.draining.Load() {
+		rec := &recordingWriter{ResponseWriter: w}
+		if b.shadowCompareBody {
+			rec.body = new(bytes.Buffer)
+		}
+		if ok, sent = b.attempt(first, rec, r, bodyCopy, true, retry); ok {
+			go b.mirror(rest[0], r.Method, r.Host, r.URL.Path, r.URL.RawQuery, r.Header.Clone(), bodyCopy, rec)
+			return
+		}
+	} else if ok, sent = b.attempt(first, w, r, bodyCopy, len(rest) > 0, retry); ok {
+		return
+	}
+
+	// Failover, in the configured order
+	for j, be := range rest {
+		if sent {
+			if !retry {
+				// The failed backend gave no response to pass on
+				http.Error(w, "Backend failed (retry budget exhausted)", http.StatusBadGateway)
+				return
+			}
+			// This try spends the reserved token; reserve the next one
+			retry = b.retries.reserve()
+		}
+		if ok, sent = b.attempt(be, w, r, bodyCopy, j < len(rest)-1, retry); ok {
+			return
+		}
+	}
+
+	b.outage.failed(time.Now())
+	http.Error(w, "All backends failed", http.StatusBadGateway)
+}
+
+// nextBackend returns the next backend index in (weighted) rotation.
+func (b *Broker) nextBackend() int {
+	n := b.rr.Add(1)
+	if b.schedule == nil {
+		return int(n % uint64(len(b.backends)))
+	}
+	return b.schedule[n%uint64(len(b.schedule))]
+}
+
+// startRotationAt positions the rotation so that nextBackend's next turn
+// goes to the named backend.
+func (b *Broker) startRotationAt(name string) {
+	order := b.schedule
+	if order == nil {
+		order = make([]int, len(b.backends))
+		for i := range order {
+			order[i] = i
+		}
+	}
+	for pos, i := range order {
+		if b.backends[i].Name == name {
+			b.rr.Store(uint64(pos) - 1) // wraps for pos 0; nextBackend adds 1 first
+			return
+		}
+	}
+}
+
+// attempt serves the request from be unless it is drained or its circuit
+// breaker is open, and records the outcome in the breaker. sent reports
+// whether the request reached be at all. With retryable false (the retry
+// budget is spent) a failure is answered to the client rather than failed
+// over, and ok reports that the client got a response.
+func (b *Broker) attempt(be Backend, w http.ResponseWriter, r *http.Request, bodyCopy []byte, canFailover, retryable bool) (ok, sent bool) {
+	if be.stats.draining.Load() || !be.state.allow(time.Now()) {
+		return false, false
+	}
+	// A backend at its concurrency limit is skipped like an open breaker,
+	// except the last one, where the request queues when queuing is enabled
+	if !be.conc.acquire(r.Context(), !canFailover) {
+		// The request never reaches the backend: free the probe slot for
+		// the next one
+		be.state.abandonProbe()
+		if !canFailover && be.conc.queueMax > 0 {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Overloaded", http.StatusServiceUnavailable)
+			return true, false
+		}
+		return false, false
+	}
+	denied := canFailover && !retryable
+	start := time.Now()
+	be.stats.inflight.Add(1)
+	answered, failed := b.serveBackend(be, w, r, bodyCopy, canFailover && retryable, denied)
+	ok = answered && !failed
+	be.stats.inflight.Add(-1)
+	be.conc.release(time.Since(start))
+	be.slo.record(time.Since(start), time.Now())
+	be.state.record(ok, time.Now())
+	be.stats.requests.Add(1)
+	if !ok {
+		be.stats.failures.Add(1)
+		if denied {
+			b.retries.denied.Add(1)
+		}
+	} else {
+		b.outage.succeeded()
+	}
+	return answered, true
+}
+
+// serveIdempotent serves the first request for an Idempotency-Key and stores
+// its response; repeats within the TTL get that response replayed, and
+// concurrent repeats wait for the first one to finish. Keys are scoped to the
+// client (its Authorization header, else its IP), and a key reused with a
+// different body is refused with 422.
+func (b *Broker) serveIdempotent(w http.ResponseWriter, r *http.Request) {
+	client := r.Header.Get("Authorization")
+	if client == "" {
+		client = b.limiter.clientIP(r)
+	}
+	key := fmt.Sprintf("%s %s %x %s", r.Method, r.URL.Path, fingerprint([]byte(client)), r.Header.Get(IdempotencyKeyHeader))
+
+	body, err := readUpTo(r.Body, MaxBodyBytes)
+	if err != nil {
+		http.Error(w, "Request body too large or invalid", http.StatusRequestEntityTooLarge)
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	bodyHash := fingerprint(body)
+
+	call, stored, leader := b.idem.begin(key, bodyHash)
+	if (stored != nil && stored.bodyHash != bodyHash) || (call != nil && call.bodyHash != bodyHash) {
+		http.Error(w, IdempotencyKeyHeader+" reused with a different request body", http.StatusUnprocessableEntity)
+		return
+	}
+	if stored != nil {
+		writeReplayed(w, stored)
+		return
+	}
+	if !leader {
+		select {
+		case <-call.done:
+		case <-r.Context().Done():
+			return
+		}
+		if call.resp != nil {
+			writeReplayed(w, call.resp)
+			return
+		}
+		// The first response was not storable: proxy this one normally
+		b.serve(w, r)
+		return
+	}
+
+	rec := &recordingWriter{ResponseWriter: w, body: new(bytes.Buffer)}
+	var resp *cachedResponse
+	defer func() { b.idem.finish(key, call, resp) }()
+	b.serve(rec, r)
+	if rec.status != 0 && !rec.truncated {
+		resp = &cachedResponse{
+			key:      key,
+			status:   rec.status,
+			header:   w.Header().Clone(),
+			body:     rec.body.Bytes(),
+			expires:  time.Now().Add(b.idem.ttl),
+			bodyHash: bodyHash,
+		}
+	}
+}
+
+// nearestBackend returns the index of the located backend closest to the
+// "lat,lng" hint, or -1 if the hint is missing or invalid or no backend has a
+// location.
+func (b *Broker) nearestBackend(hint string) int {
+	if hint == "" {
+		return -1
+	}
+	latStr, lngStr, ok := strings.Cut(hint, ",")
+	if !ok {
+		return -1
+	}
+	lat, err1 := strconv.ParseFloat(strings.TrimSpace(latStr), 64)
+	lng, err2 := strconv.ParseFloat(strings.TrimSpace(lngStr), 64)
+	if err1 != nil || err2 != nil || lat < -90 || lat > 90 || lng < -180 || lng > 180 {
+		return -1
+	}
+	client := LatLng{Lat: lat, Lng: lng}
+
+	best, bestKm := -1, math.Inf(1)
+	for i, be := range b.backends {
+		if be.Location == nil {
+			continue
+		}
+		if d := DistanceKm(client, *be.Location); d < bestKm {
+			best, bestKm = i, d
+		}
+	}
+	return best
+}
+
+// DistanceKm is the great-circle (haversine) distance between two points, as
+// computed by the geo server.
+func DistanceKm(a, b LatLng) float64 {
+	toRad := math.Pi / 180
+	dLat := (b.Lat - a.Lat) * toRad
+	dLng := (b.Lng - a.Lng) * toRad
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(a.Lat*toRad)*math.Cos(b.Lat*toRad)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * EarthRadiusKm * math.Asin(math.Sqrt(math.Min(1, h)))
+}
+
+// failoverSequence lists the backends to try after primary: those named in
+// the failover order first, in that order, then the rest in rotation order.
+func (b *Broker) failoverSequence(primary int) []Backend {
+	seq := make([]Backend, 0, len(b.backends)-1)
+	listed := make(map[int]bool, len(b.failoverOrder))
+	for _, i := range b.failoverOrder {
+		if i != primary {
+			seq = append(seq, b.backends[i])
+		}
+		listed[i] = true
+	}
+	for k := 1; k < len(b.backends); k++ {
+		if i := (primary + k) % len(b.backends); !listed[i] {
+			seq = append(seq, b.backends[i])
+		}
+	}
+	return seq
+}
+
+// upstreamError replaces non-2xx bodies when errors are sanitized.
+type upstreamError struct {
+	Error  string `json:"error"`
+	Status int    `json:"status"`
+}
+
+// ServeBackend forwards the request to the chosen backend.
+// It sets response headers to indicate which backend was used and the final URL.
+// canFailover tells whether another backend is left to try, which enables the
+// backend's soft deadline.
+func (b *Broker) ServeBackend(be Backend, w http.ResponseWriter, r *http.Request, bodyCopy []byte, canFailover bool) bool {
+	answered, _ := b.serveBackend(be, w, r, bodyCopy, canFailover, false)
+	return answered
+}
+
+// serveBackend is ServeBackend reporting whether the client was answered.
+// With forwardFailure set, a failover status is forwarded to the client like
+// any other response instead of failing over, and reported as failed.
+func (b *Broker) serveBackend(be Backend, w http.ResponseWriter, r *http.Request, bodyCopy []byte, canFailover, forwardFailure bool) (answered, failed bool) {
+	// Build final destination URL: base + incoming path + query
+	targetURL := joinURL(be.BaseURL, r.URL.Path, r.URL.RawQuery)
+
+	ctx := r.Context()
+	if be.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, be.Timeout)
+		defer cancel()
+	}
+
+	// Soft deadline: abandon a slow backend while failing over can still help
+	var softTimer *time.Timer
+	if canFailover && be.SoftDeadline > 0 && isIdempotent(r.Method) {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		softTimer = time.AfterFunc(be.SoftDeadline, cancel)
+	}
+
+	// Create outbound request
+	outReq, err := http.NewRequestWithContext(ctx, r.Method, targetURL, nil)
+	if err != nil {
+		log.Printf("request build error (%s): %v", be.Name, err)
+		return false, false
+	}
+
+	// Copy headers (excluding Hop-by-hop headers)
+	copyHeaders(outReq.Header, r.Header, b.stripRequest)
+	outReq.Host = be.BaseURL.Host
+	if be.PreserveHost {
+		outReq.Host = r.Host
+	}
+
+	// Client span around the backend call; the backend continues the trace
+	span := b.tracer.Start("backend "+be.Name, tracing.SpanKindClient, tracing.SpanFromContext(r.Context()), "")
+	if span != nil {
+		defer span.End()
+		span.SetAttr("broker.backend", be.Name)
+		span.SetAttr("url.full", targetURL)
+		span.Inject(outReq.Header)
+	}
+
+	// Restore body if needed
+	if bodyCopy != nil && (r.Method == http.MethodPost || r.Method == http.MethodPut || r.Method == http.MethodPatch) {
+		outReq.Body = io.NopCloser(bytes.NewReader(bodyCopy))
+		outReq.ContentLength = int64(len(bodyCopy))
+	} else if r.Method != http.MethodHead {
+		// For GET etc, forward original body if any (rare), else nil
+		if r.Body != nil && r.Body != http.NoBody {
+			// Not buffering for methods other than POST/PUT/PATCH
+			outReq.Body = r.Body
+		}
+	}
+
+	// Do request
+	sent := time.Now()
+	resp, err := (&http.Client{Transport: be.Transport}).Do(outReq)
+	took := time.Since(sent)
+	if err != nil {
+		span.SetError()
+	} else {
+		span.SetAttr("http.response.status_code", resp.StatusCode)
+	}
+	if softTimer != nil && !softTimer.Stop() {
+		// Fired before (or right as) headers arrived: the context is gone either way
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+		log.Printf("backend %s missed soft deadline %s url=%s -> failover", be.Name, be.SoftDeadline, targetURL)
+		return false, false
+	}
+	if err != nil {
+		log.Printf("backend call error (%s) url=%s err=%v", be.Name, targetURL, err)
+		return false, false
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	// If upstream returned a failover status ("bad gateway-ish" by default), allow failover
+	if b.failoverStatuses[resp.StatusCode] {
+		if !forwardFailure {
+			log.Printf("backend %s returned %d url=%s -> failover", be.Name, resp.StatusCode, targetURL)
+			return false, false
+		}
+		log.Printf("backend %s returned %d url=%s -> forwarded (retry budget exhausted)", be.Name, resp.StatusCode, targetURL)
+		failed = true
+	}
+	if b.afterResponse != nil {
+		body := resp.Body
+		b.afterResponse(be.Name, r, resp)
+		if resp.Body != body {
+			defer func() { _ = body.Close() }()
+		}
+	}
+
+	// Decompress gzip bodies for clients that don't accept gzip. The gzip
+	// header is checked before anything is written to w, so an invalid body
+	// fails over without leaking this backend's headers into the next one's
+	src := io.Reader(resp.Body)
+	gunzip := r.Method != http.MethodHead && strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") && !acceptsEncoding(r.Header, "gzip")
+	if gunzip {
+		zr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			log.Printf("backend %s sent invalid gzip url=%s err=%v -> failover", be.Name, targetURL, err)
+			return false, false
+		}
+		defer func() { _ = zr.Close() }()
+		src = zr
+	}
+
+	// ---- IMPORTANT: write headers BEFORE writing body ----
+	// Indicate which backend served the request + the final URL used
+	w.Header().Set("X-Selected-Backend", be.Name) // "serverless" or "vm"
+	w.Header().Set("X-Selected-URL", targetURL)
+
+	// Copy upstream headers to client (you can filter if you want)
+	copyHeaders(w.Header(), resp.Header, b.stripResponse)
+	b.respFilter.apply(w.Header(), resp.Header)
+	// Unknown upstream length (chunked, typically streamed): never pass on a
+	// stale Content-Length, so net/http chunks the response to the client
+	streamed := resp.ContentLength < 0
+	if streamed {
+		w.Header().Del("Content-Length")
+	}
+	if b.backendDuration {
+		// This attempt only: time spent on backends that failed over is excluded
+		w.Header().Set(BackendDurationHeader, strconv.FormatFloat(float64(took)/float64(time.Millisecond), 'f', 3, 64))
+	}
+
+	// HEAD: forward the upstream headers (with its real Content-Length), no body
+	if r.Method == http.MethodHead {
+		if resp.ContentLength >= 0 {
+			w.Header().Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+		}
+		w.WriteHeader(resp.StatusCode)
+		return true, failed
+	}
+
+	if gunzip {
+		w.Header().Del("Content-Encoding")
+		w.Header().Del("Content-Length")
+	}
+
+	// Sanitize forwarded errors: keep the status, replace the body
+	if b.sanitizeErrors && (resp.StatusCode < 200 || resp.StatusCode >= 300) && resp.StatusCode != http.StatusNotModified {
+		orig, _ := io.ReadAll(io.LimitReader(src, MaxBodyBytes))
+		log.Printf("backend %s returned %d url=%s body=%q -> sanitized", be.Name, resp.StatusCode, targetURL, orig)
+		w.Header().Del("Content-Encoding")
+		w.Header().Del("Content-Length")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(resp.StatusCode)
+		_ = json.NewEncoder(w).Encode(upstreamError{Error: "upstream error", Status: resp.StatusCode})
+		return true, failed
+	}
+
+	// Only plain 200 GETs with an upstream max-age are cacheable (and never
+	// encoded bodies, since the cache key ignores Accept-Encoding)
+	var ttl time.Duration
+	if b.cache != nil && r.Method == http.MethodGet && resp.StatusCode == http.StatusOK && w.Header().Get("Content-Encoding") == "" {
+		ttl = cacheMaxAge(resp.Header)
+	}
+
+	// Write status code
+	w.WriteHeader(resp.StatusCode)
+
+	// Stream body
+	if ttl <= 0 {
+		copyBody(w, src, streamed)
+		return true, failed
+	}
+
+	// Keep a copy of the streamed body for the cache
+	var body bytes.Buffer
+	if _, err := io.Copy(w, io.TeeReader(src, &body)); err == nil && int64(body.Len()) <= MaxBodyBytes {
+		b.cache.put(&cachedResponse{
+			key:     cacheKey(r),
+			status:  resp.StatusCode,
+			header:  w.Header().Clone(),
+			body:    body.Bytes(),
+			expires: time.Now().Add(ttl),
+		})
+	}
+
+	// Log (optional)
+	// log.Printf("served via=%s url=%s status=%d", be.Name, targetURL, resp.StatusCode)
+
+	return true, failed
+}
+
+// ProbeBackends GETs every backend's health path once and warns about the
+// unreachable ones. It never fails startup: a backend may come up later.
+func (b *Broker) ProbeBackends(timeout time.Duration) {
+	var wg sync.WaitGroup
+	for _, be := range b.backends {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+
+			targetURL := joinURL(be.BaseURL, be.HealthPath, "")
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, targetURL, nil)
+			if err != nil {
+				log.Printf("WARNING: startup probe for backend %s: %v", be.Name, err)
+				return
+			}
+			resp, err := (&http.Client{Transport: be.Transport}).Do(req)
+			if err != nil {
+				log.Printf("WARNING: backend %s is UNREACHABLE at startup url=%s err=%v", be.Name, targetURL, err)
+				return
+			}
+			_, _ = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+			log.Printf("Startup probe:   %s reachable (status %d)", be.Name, resp.StatusCode)
+		}()
+	}
+	wg.Wait()
+}
+
+// isIdempotent reports whether a request with this method is safe to abandon
+// and resend elsewhere (RFC 9110 section 9.2.2).
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// adminOnly guards an admin endpoint with the admin secret, if one is configured.
+func (b *Broker) adminOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if b.adminSecret != "" &&
+			subtle.ConstantTimeCompare([]byte(r.Header.Get(AdminSecretHeader)), []byte(b.adminSecret)) != 1 {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
+
+type configReport struct {
+	ListenAddr        string          `json:"listen_addr"`
+	Routing           string          `json:"routing"` // round_robin or weighted_round_robin
+	FailoverOrder     []string        `json:"failover_order,omitempty"`
+	FailoverStatuses  []int           `json:"failover_statuses"`
+	Backends          []backendReport `json:"backends"`
+	MaxBodyBytes      int64           `json:"max_body_bytes"`
+	ReadHeaderTimeout string          `json:"read_header_timeout"`
+	PrestopDelay      string          `json:"prestop_delay,omitempty"`
+	RateLimit         float64         `json:"rate_limit"` // req/s per IP, 0 = off
+	RateBurst         int             `json:"rate_burst"`
+	CacheSize         int             `json:"cache_size"` // 0 = off
+	IdempotencyTTL    string          `json:"idempotency_ttl,omitempty"`
+	BreakerFailures   int             `json:"breaker_failures"` // 0 = off
+	BreakerCooldown   string          `json:"breaker_cooldown,omitempty"`
+	SlowStart         string          `json:"slow_start,omitempty"`
+	ConcurrencyMin    int             `json:"concurrency_min,omitempty"`
+	ConcurrencyMax    int             `json:"concurrency_max"` // 0 = off
+	QueueDepth        int             `json:"queue_depth,omitempty"`
+	QueueWait         string          `json:"queue_wait,omitempty"`
+	OutageThreshold   int             `json:"outage_threshold,omitempty"`
+	OutageWindow      string          `json:"outage_window,omitempty"`
+	OutageBackoff     string          `json:"outage_backoff,omitempty"`
+	RetryBudget       float64         `json:"retry_budget,omitempty"`
+	RetryBudgetBurst  int             `json:"retry_budget_burst,omitempty"`
+	Shadow            bool            `json:"shadow"`
+	ShadowTimeout     string          `json:"shadow_timeout,omitempty"`
+	BodySampleRate    float64         `json:"body_sample_rate"`
+	BackendOverride   bool            `json:"backend_override"`
+	SanitizeErrors    bool            `json:"sanitize_errors"`
+	NormalizePaths    bool            `json:"normalize_paths"`
+	BackendDuration   bool            `json:"backend_duration_header"`
+	DuplicateWindow   string          `json:"duplicate_window,omitempty"`
+	SLOTarget         string          `json:"slo_p99,omitempty"`
+	SLOWindow         string          `json:"slo_window,omitempty"`
+	Pprof             bool            `json:"pprof"`
+	TraceExport       string          `json:"trace_export,omitempty"`
+	ResponseAllow     []string        `json:"response_header_allow,omitempty"`
+	ResponseDeny      []string        `json:"response_header_deny,omitempty"`
+}
+
+type backendReport struct {
+	Name                string  `json:"name"`
+	URL                 string  `json:"url"`
+	H2C                 bool    `json:"h2c"`
+	MTLS                bool    `json:"mtls"`
+	PreserveHost        bool    `json:"preserve_host"`
+	Weight              int     `json:"weight,omitempty"`
+	Region              string  `json:"region,omitempty"`
+	Location            *LatLng `json:"location,omitempty"`
+	DialTimeout         string  `json:"dial_timeout"`
+	TLSHandshakeTimeout string  `json:"tls_handshake_timeout,omitempty"`
+	IdleConnTimeout     string  `json:"idle_conn_timeout,omitempty"`
+	MaxConnsPerHost     int     `json:"max_conns_per_host,omitempty"`
+}
+
+// handleConfig reports the settings the running Broker actually loaded.
+func (b *Broker) handleConfig(w http.ResponseWriter, r *http.Request) {
+	rep := configReport{
+		ListenAddr:        b.listenAddr,
+		Routing:           "round_robin",
+		MaxBodyBytes:      MaxBodyBytes,
+		ReadHeaderTimeout: b.readHeaderTimeout.String(),
+		Shadow:            b.shadow,
+		BackendOverride:   b.allowOverride,
+		SanitizeErrors:    b.sanitizeErrors,
+		NormalizePaths:    b.normalizePaths,
+		BackendDuration:   b.backendDuration,
+		Pprof:             b.pprof,
+	}
+	if b.schedule != nil {
+		rep.Routing = "weighted_round_robin"
+	}
+	if b.prestopDelay > 0 {
+		rep.PrestopDelay = b.prestopDelay.String()
+	}
+	for code := range b.failoverStatuses {
+		rep.FailoverStatuses = append(rep.FailoverStatuses, code)
+	}
+	slices.Sort(rep.FailoverStatuses)
+	for _, i := range b.failoverOrder {
+		rep.FailoverOrder = append(rep.FailoverOrder, b.backends[i].Name)
+	}
+	for _, be := range b.backends {
+		br := backendReport{Name: be.Name, URL: be.BaseURL.String(), H2C: be.H2C, MTLS: be.MTLS, PreserveHost: be.PreserveHost, Weight: be.Weight, Region: be.Region, Location: be.Location, DialTimeout: DialTimeout.String()}
+		if t, ok := be.Transport.(*http.Transport); ok {
+			br.TLSHandshakeTimeout = t.TLSHandshakeTimeout.String()
+			br.IdleConnTimeout = t.IdleConnTimeout.String()
+			br.MaxConnsPerHost = t.MaxConnsPerHost
+		}
+		rep.Backends = append(rep.Backends, br)
+	}
+	if b.limiter != nil {
+		rep.RateLimit = b.limiter.rate
+		rep.RateBurst = int(b.limiter.burst)
+	}
+	if b.cache != nil {
+		rep.CacheSize = b.cache.max
+	}
+	if st := b.backends[0].state; st != nil {
+		rep.BreakerFailures = st.failuresToOpen
+		rep.BreakerCooldown = st.cooldown.String()
+		if st.slowStart > 0 {
+			rep.SlowStart = st.slowStart.String()
+		}
+	}
+	if cl := b.backends[0].conc; cl != nil {
+		rep.ConcurrencyMin = int(cl.min)
+		rep.ConcurrencyMax = int(cl.max)
+		if cl.queueMax > 0 {
+			rep.QueueDepth = cl.queueMax
+			rep.QueueWait = cl.queueWait.String()
+		}
+	}
+	if b.dups != nil {
+		rep.DuplicateWindow = b.dups.window.String()
+	}
+	if b.outage != nil {
+		rep.OutageThreshold = b.outage.threshold
+		rep.OutageWindow = b.outage.window.String()
+		rep.OutageBackoff = b.outage.backoff.String()
+	}
+	if b.retries != nil {
+		rep.RetryBudget = b.retries.ratio
+		rep.RetryBudgetBurst = int(b.retries.burst)
+	}
+	if b.slo != nil {
+		rep.SLOTarget = b.sloTarget.String()
+		rep.SLOWindow = b.slo.window.String()
+	}
+	if b.respFilter != nil {
+		rep.ResponseAllow = b.respFilter.allow
+		rep.ResponseDeny = b.respFilter.deny
+	}
+	if b.tracer != nil {
+		rep.TraceExport = "custom exporter"
+		if e, ok := b.tracer.Exporter().(*tracing.OTLPExporter); ok {
+			rep.TraceExport = e.URL()
+		}
+	}
+	if b.idem != nil {
+		rep.IdempotencyTTL = b.idem.ttl.String()
+	}
+	if b.shadow {
+		rep.ShadowTimeout = b.shadowTimeout.String()
+	}
+	if b.bodyLog != nil {
+		rep.BodySampleRate = b.bodyLog.rate
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(rep)
+}
+
+// backendStatus is one /backends entry.
+type backendStatus struct {
+	Name     string `json:"name"`
+	URL      string `json:"url"`
+	State    string `json:"state"` // active, draining or drained
+	Inflight int64  `json:"inflight"`
+}
+
+// handleBackends lists the backends' drain state on GET. POST ?drain=<name>
+// takes a backend out of rotation while the requests it already has finish,
+// and ?undrain=<name> puts it back; both answer with that backend's status,
+// so a drain can be polled until it reports "drained".
+func (b *Broker) handleBackends(w http.ResponseWriter, r *http.Request) {
+	status := func(be Backend) backendStatus {
+		return backendStatus{Name: be.Name, URL: be.BaseURL.String(), State: be.stats.drainState(), Inflight: be.stats.inflight.Load()}
+	}
+	var out any
+	switch r.Method {
+	case http.MethodGet:
+		list := make([]backendStatus, 0, len(b.backends))
+		for _, be := range b.backends {
+			list = append(list, status(be))
+		}
+		out = list
+	case http.MethodPost:
+		q := r.URL.Query()
+		name, drain := q.Get("drain"), true
+		if name == "" {
+			name, drain = q.Get("undrain"), false
+		}
+		i := slices.IndexFunc(b.backends, func(be Backend) bool { return be.Name == name })
+		if i < 0 {
+			http.Error(w, "Unknown backend (use ?drain=<name> or ?undrain=<name>)", http.StatusNotFound)
+			return
+		}
+		be := b.backends[i]
+		if be.stats.draining.Swap(drain) != drain {
+			log.Printf("backend %s: drain=%t via /backends", be.Name, drain)
+		}
+		out = status(be)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Use GET or POST", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+// handleMetrics writes the Broker's gauges in the Prometheus text format.
+func (b *Broker) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	var limits, inflight, queued strings.Builder
+	for _, be := range b.backends {
+		if be.conc == nil {
+			continue
+		}
+		l, n, q := be.conc.snapshot()
+		fmt.Fprintf(&limits, "broker_concurrency_limit{backend=%q} %d\n", be.Name, l)
+		fmt.Fprintf(&inflight, "broker_inflight_requests{backend=%q} %d\n", be.Name, n)
+		fmt.Fprintf(&queued, "broker_queued_requests{backend=%q} %d\n", be.Name, q)
+	}
+	if limits.Len() > 0 {
+		fmt.Fprintf(w, "# HELP broker_concurrency_limit Adaptive per-backend concurrency limit.\n# TYPE broker_concurrency_limit gauge\n%s", limits.String())
+		fmt.Fprintf(w, "# HELP broker_inflight_requests Requests in flight per backend.\n# TYPE broker_inflight_requests gauge\n%s", inflight.String())
+		fmt.Fprintf(w, "# HELP broker_queued_requests Requests waiting for a concurrency slot per backend.\n# TYPE broker_queued_requests gauge\n%s", queued.String())
+	}
+	fmt.Fprintf(w, "# HELP broker_backend_requests_total Attempts sent to each backend.\n# TYPE broker_backend_requests_total counter\n")
+	for _, be := range b.backends {
+		fmt.Fprintf(w, "broker_backend_requests_total{backend=%q} %d\n", be.Name, be.stats.requests.Load())
+	}
+	fmt.Fprintf(w, "# HELP broker_backend_failures_total Attempts that failed (error or failover status).\n# TYPE broker_backend_failures_total counter\n")
+	for _, be := range b.backends {
+		fmt.Fprintf(w, "broker_backend_failures_total{backend=%q} %d\n", be.Name, be.stats.failures.Load())
+	}
+	if b.backends[0].state != nil {
+		fmt.Fprintf(w, "# HELP broker_breaker_state Circuit breaker state per backend (1 for the current state).\n# TYPE broker_breaker_state gauge\n")
+		now := time.Now()
+		for _, be := range b.backends {
+			cur := be.state.status(now)
+			for _, st := range []string{"closed", "open", "half_open"} {
+				v := 0
+				if st == cur {
+					v = 1
+				}
+				fmt.Fprintf(w, "broker_breaker_state{backend=%q,state=%q} %d\n", be.Name, st, v)
+			}
+		}
+	}
+	if b.slo != nil {
+		now := time.Now()
+		p99, breached := b.slo.breached(b.sloTarget, now)
+		fmt.Fprintf(w, "# HELP broker_slo_target_seconds Target for the rolling p99 latency.\n# TYPE broker_slo_target_seconds gauge\nbroker_slo_target_seconds %g\n", b.sloTarget.Seconds())
+		fmt.Fprintf(w, "# HELP broker_latency_p99_seconds Rolling p99 of request latency.\n# TYPE broker_latency_p99_seconds gauge\nbroker_latency_p99_seconds %g\n", p99.Seconds())
+		fmt.Fprintf(w, "# HELP broker_slo_breached 1 while the rolling p99 exceeds the target.\n# TYPE broker_slo_breached gauge\nbroker_slo_breached %d\n", boolGauge(breached))
+		var lat, br strings.Builder
+		for _, be := range b.backends {
+			p99, breached := be.slo.breached(b.sloTarget, now)
+			fmt.Fprintf(&lat, "broker_backend_latency_p99_seconds{backend=%q} %g\n", be.Name, p99.Seconds())
+			fmt.Fprintf(&br, "broker_backend_slo_breached{backend=%q} %d\n", be.Name, boolGauge(breached))
+		}
+		fmt.Fprintf(w, "# HELP broker_backend_latency_p99_seconds Rolling p99 of attempt latency per backend.\n# TYPE broker_backend_latency_p99_seconds gauge\n%s", lat.String())
+		fmt.Fprintf(w, "# HELP broker_backend_slo_breached 1 while the backend's rolling p99 exceeds the target.\n# TYPE broker_backend_slo_breached gauge\n%s", br.String())
+	}
+	if b.outage != nil {
+		fmt.Fprintf(w, "# HELP broker_outage_fast_fails_total Requests answered 503 without an attempt after every backend kept failing.\n# TYPE broker_outage_fast_fails_total counter\nbroker_outage_fast_fails_total %d\n", b.outage.fastFails.Load())
+	}
+	if b.retries != nil {
+		fmt.Fprintf(w, "# HELP broker_retry_budget_tokens Retries the budget currently allows.\n# TYPE broker_retry_budget_tokens gauge\nbroker_retry_budget_tokens %g\n", b.retries.available())
+		fmt.Fprintf(w, "# HELP broker_retries_denied_total Failed requests answered without a retry because the retry budget was spent.\n# TYPE broker_retries_denied_total counter\nbroker_retries_denied_total %d\n", b.retries.denied.Load())
+	}
+	if b.dups != nil {
+		fmt.Fprintf(w, "# HELP broker_duplicate_posts_total POSTs repeating a recent body from the same client.\n# TYPE broker_duplicate_posts_total counter\nbroker_duplicate_posts_total %d\n", b.dups.count.Load())
+	}
+	fmt.Fprintf(w, "# HELP broker_shadow_divergences_total Shadow responses that differed from the primary.\n# TYPE broker_shadow_divergences_total counter\nbroker_shadow_divergences_total %d\n", b.shadowDivergences.Load())
+}
+
+// boolGauge renders a flag as a 0/1 gauge value.
+func boolGauge(v bool) int {
+	if v {
+		return 1
+	}
+	return 0
+}
+
+// backendOverride strips the __backend query parameter from the request and
+// returns the index of the backend it names, or -1 if absent or unknown.
+func (b *Broker) backendOverride(r *http.Request) (*http.Request, int) {
+	q := r.URL.Query()
+	if !q.Has(BackendOverrideParam) {
+		return r, -1
+	}
+	name := q.Get(BackendOverrideParam)
+	q.Del(BackendOverrideParam)
+
+	r = r.Clone(r.Context())
+	r.URL.RawQuery = q.Encode()
+
+	for i, be := range b.backends {
+		if be.Name == name {
+			return r, i
+		}
+	}
+	log.Printf("unknown %s=%q, using normal selection", BackendOverrideParam, name)
+	return r, -1
+}
+
+// mirror replays a request against the shadow backend and compares the outcome
+// with what the primary served, recorded in rec. It runs detached from the
+// client request and never touches the client response.
+func (b *Broker) mirror(be Backend, method, host, path, rawQuery string, header http.Header, body []byte, rec *recordingWriter) {
+	ctx, cancel := context.WithTimeout(context.Background(), b.shadowTimeout)
+	defer cancel()
+
+	targetURL := joinURL(be.BaseURL, path, rawQuery)
+	outReq, err := http.NewRequestWithContext(ctx, method, targetURL, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("shadow request build error (%s): %v", be.Name, err)
+		return
+	}
+	copyHeaders(outReq.Header, header, b.stripRequest)
+	outReq.Host = be.BaseURL.Host
+	if be.PreserveHost {
+		outReq.Host = host
+	}
+
+	resp, err := (&http.Client{Transport: be.Transport}).Do(outReq)
+	if err != nil {
+		log.Printf("shadow call error (%s) url=%s err=%v", be.Name, targetURL, err)
+		return
+	}
+	defer func() { _ = resp.Body.Close() }()
+	shadowBody, _ := io.ReadAll(io.LimitReader(resp.Body, MaxBodyBytes))
+
+	switch {
+	case rec.status != resp.StatusCode:
+		n := b.shadowDivergences.Add(1)
+		log.Printf("shadow divergence #%d %s %s: primary status=%d, %s status=%d", n, method, path, rec.status, be.Name, resp.StatusCode)
+	case rec.body != nil && !bytes.Equal(bytes.TrimSpace(rec.body.Bytes()), bytes.TrimSpace(shadowBody)):
+		n := b.shadowDivergences.Add(1)
+		log.Printf("shadow divergence #%d %s %s: body differs (primary %q, %s %q)", n, method, path, rec.body.Bytes(), be.Name, shadowBody)
+	}
+}
+
+// recordingWriter passes the response through to the client while remembering
+// the status and, if body is set, a copy of the body (up to MaxBodyBytes,
+// beyond which truncated is set).
+type recordingWriter struct {
+	http.ResponseWriter
+	status    int
+	body      *bytes.Buffer
+	truncated bool
+}
+
+func (rw *recordingWriter) WriteHeader(code int) {
+	rw.status = code
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (rw *recordingWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+func (rw *recordingWriter) Write(p []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	if rw.body != nil {
+		if int64(rw.body.Len()+len(p)) <= MaxBodyBytes {
+			rw.body.Write(p)
+		} else {
+			rw.truncated = true
+		}
+	}
+	return rw.ResponseWriter.Write(p)
+}
+
+// rateLimiter is a per-client-IP token bucket limiter. Buckets live in a
+// sharded map so concurrent clients rarely contend on the same lock.
+type rateLimiter struct {
+	rate    float64 // tokens per second
+	burst   float64
+	trusted []*net.IPNet
+	shards  [RateLimitShards]rateShard
+}
+
+type rateShard struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int, trustedProxies []*net.IPNet) *rateLimiter {
+	l := &rateLimiter{rate: rate, burst: float64(burst), trusted: trustedProxies}
+	for i := range l.shards {
+		l.shards[i].buckets = make(map[string]*tokenBucket)
+	}
+	return l
+}
+
+func (l *rateLimiter) shard(key string) *rateShard {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return &l.shards[h.Sum32()%RateLimitShards]
+}
+
+// allow takes a token for key. When none is left it returns how long until
+// the next one is available.
+func (l *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	sh := l.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	tb, ok := sh.buckets[key]
+	if !ok {
+		tb = &tokenBucket{tokens: l.burst, last: now}
+		sh.buckets[key] = tb
+	}
+	tb.tokens = math.Min(l.burst, tb.tokens+now.Sub(tb.last).Seconds()*l.rate)
+	tb.last = now
+
+	if tb.tokens >= 1 {
+		tb.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - tb.tokens) / l.rate * float64(time.Second))
+}
+
+// cleanupLoop drops buckets idle long enough to have refilled completely,
+// which are indistinguishable from fresh ones.
+func (l *rateLimiter) cleanupLoop(every time.Duration) {
+	refill := time.Duration(l.burst / l.rate * float64(time.Second))
+	for now := range time.Tick(every) {
+		for i := range l.shards {
+			sh := &l.shards[i]
+			sh.mu.Lock()
+			for key, tb := range sh.buckets {
+				if now.Sub(tb.last) > refill {
+					delete(sh.buckets, key)
+				}
+			}
+			sh.mu.Unlock()
+		}
+	}
+}
+
+// clientIP is the peer address or, when the peer is a trusted proxy, the
+// rightmost X-Forwarded-For hop that is not itself a trusted proxy. Hops
+// further left are whatever the client sent, so they are never used. A nil
+// limiter trusts no proxy.
+func (l *rateLimiter) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !l.isTrusted(host) {
+		return host
+	}
+	var hops []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(v, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		if !l.isTrusted(hops[i]) {
+			return hops[i]
+		}
+	}
+	// Trusted proxies all the way: the leftmost one is the closest to the client
+	if len(hops) > 0 {
+		return hops[0]
+	}
+	return host
+}
+
+func (l *rateLimiter) isTrusted(host string) bool {
+	if l == nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range l.trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// bodyLogger formats sampled bodies for the log: configured JSON keys are
+// redacted (at any depth) and the result is truncated to maxLen bytes.
+type bodyLogger struct {
+	rate   float64
+	maxLen int
+	redact map[string]bool
+}
+
+func newBodyLogger(rate float64, maxLen int, redactKeys []string) *bodyLogger {
+	l := &bodyLogger{rate: rate, maxLen: maxLen, redact: make(map[string]bool)}
+	for _, k := range redactKeys {
+		l.redact[k] = true
+	}
+	return l
+}
+
+func (l *bodyLogger) format(body []byte) string {
+	if len(l.redact) > 0 {
+		var v any
+		if json.Unmarshal(body, &v) == nil {
+			if out, err := json.Marshal(l.redactValue(v)); err == nil {
+				body = out
+			}
+		}
+	}
+	if len(body) > l.maxLen {
+		return string(body[:l.maxLen]) + "...(truncated)"
+	}
+	return string(body)
+}
+
+func (l *bodyLogger) redactValue(v any) any {
+	switch t := v.(type) {
+	case map[string]any:
+		for k, x := range t {
+			if l.redact[k] {
+				t[k] = "[REDACTED]"
+			} else {
+				t[k] = l.redactValue(x)
+			}
+		}
+	case []any:
+		for i, x := range t {
+			t[i] = l.redactValue(x)
+		}
+	}
+	return v
+}
+
+// backendState is a backend's circuit breaker. It is closed until
+// failuresToOpen consecutive failures, then open for cooldown, then half-open:
+// a single probe request goes through and its outcome closes or reopens it.
+type backendState struct {
+	name           string
+	failuresToOpen int
+	cooldown       time.Duration
+	slowStart      time.Duration
+
+	mu          sync.Mutex
+	failures    int
+	openUntil   time.Time // zero when closed
+	probing     bool      // half-open probe in flight
+	recoveredAt time.Time // when the breaker last closed again
+}
+
+// allow reports whether a request may go to the backend, claiming the probe
+// slot when the breaker is half-open. A nil state always allows.
+func (s *backendState) allow(now time.Time) bool {
+	if s == nil {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.openUntil.IsZero() {
+		return true
+	}
+	if now.Before(s.openUntil) || s.probing {
+		return false
+	}
+	s.probing = true
+	return true
+}
+
+// abandonProbe frees the probe slot claimed by allow for a request that was
+// not sent after all, leaving the breaker half-open.
+func (s *backendState) abandonProbe() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.openUntil.IsZero() {
+		s.probing = false
+	}
+}
+
+func (s *backendState) record(ok bool, now time.Time) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	open := !s.openUntil.IsZero()
+	s.probing = false
+	if ok {
+		s.failures = 0
+		if open {
+			s.openUntil = time.Time{}
+			s.recoveredAt = now
+			log.Printf("backend %s circuit CLOSED", s.name)
+		}
+		return
+	}
+	s.failures++
+	if open || s.failures >= s.failuresToOpen {
+		if !open {
+			log.Printf("backend %s circuit OPEN for %s after %d failures", s.name, s.cooldown, s.failures)
+		}
+		s.openUntil = now.Add(s.cooldown)
+	}
+}
+
+// status names the breaker's state: "closed", "open", "half_open", or
+// "disabled" for a nil state.
+func (s *backendState) status(now time.Time) string {
+	if s == nil {
+		return "disabled"
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case s.openUntil.IsZero():
+		return "closed"
+	case now.Before(s.openUntil):
+		return "open"
+	}
+	return "half_open"
+}
+
+// weight is the backend's slow-start share of its normal traffic, ramping
+// linearly from SlowStartMinWeight to 1 over the window after recovery.
+func (s *backendState) weight(now time.Time) float64 {
+	if s == nil || s.slowStart <= 0 {
+		return 1
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.recoveredAt.IsZero() || now.Sub(s.recoveredAt) >= s.slowStart {
+		return 1
+	}
+	return math.Max(SlowStartMinWeight, float64(now.Sub(s.recoveredAt))/float64(s.slowStart))
+}
+
+// dupDetector remembers a hash of each (client, path, body) POST for a
+// window, to flag accidental double submissions.
+type dupDetector struct {
+	window time.Duration
+	count  atomic.Uint64
+
+	mu        sync.Mutex
+	seen      map[uint64]time.Time
+	lastSweep time.Time
+}
+
+// check records the POST and reports whether the same one was seen within
+// the window, and how long ago.
+func (d *dupDetector) check(client, path string, body []byte, now time.Time) (time.Duration, bool) {
+	h := fnv.New64a()
+	h.Write([]byte(client))
+	h.Write([]byte{0})
+	h.Write([]byte(path))
+	h.Write([]byte{0})
+	h.Write(body)
+	key := h.Sum64()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if now.Sub(d.lastSweep) >= d.window {
+		for k, t := range d.seen {
+			if now.Sub(t) >= d.window {
+				delete(d.seen, k)
+			}
+		}
+		d.lastSweep = now
+	}
+	prev, ok := d.seen[key]
+	d.seen[key] = now
+	if ok && now.Sub(prev) < d.window {
+		d.count.Add(1)
+		return now.Sub(prev), true
+	}
+	return 0, false
+}
+
+// outageBackoff counts requests that failed on every backend; threshold of
+// them within window blocks new attempts for backoff. Methods on a nil
+// *outageBackoff are no-ops.
+type outageBackoff struct {
+	threshold int
+	window    time.Duration
+	backoff   time.Duration
+	fastFails atomic.Uint64 // requests answered by the backoff
+
+	failing atomic.Bool // count > 0, so successes skip the lock
+
+	mu          sync.Mutex
+	count       int
+	windowStart time.Time
+	until       time.Time
+}
+
+// blocked reports whether requests should fail fast, and for how long.
+func (o *outageBackoff) blocked(now time.Time) (time.Duration, bool) {
+	if o == nil || !o.failing.Load() {
+		return 0, false
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if now.Before(o.until) {
+		o.fastFails.Add(1)
+		return o.until.Sub(now), true
+	}
+	return 0, false
+}
+
+// failed records a request that failed on every backend. Once the backoff
+// has engaged, each further failure (the probe after it expires) renews it.
+func (o *outageBackoff) failed(now time.Time) {
+	if o == nil {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if now.Sub(o.windowStart) > o.window && o.count < o.threshold {
+		o.count, o.windowStart = 0, now
+	}
+	o.count++
+	o.failing.Store(true)
+	if o.count >= o.threshold {
+		if now.After(o.until) {
+			log.Printf("all backends failed %d times within %s: failing fast for %s", o.count, o.window, o.backoff)
+		}
+		o.until = now.Add(o.backoff)
+	}
+}
+
+// succeeded clears the count after any backend served a request.
+func (o *outageBackoff) succeeded() {
+	if o == nil || !o.failing.Load() {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.count, o.until = 0, time.Time{}
+	o.failing.Store(false)
+}
+
+// retryBudget is a token bucket filled by requests rather than time: each
+// request adds ratio tokens, up to burst, and each retry takes a whole one.
+type retryBudget struct {
+	ratio  float64
+	burst  float64
+	denied atomic.Uint64 // retries refused
+
+	mu     sync.Mutex
+	tokens float64
+}
+
+// deposit credits one request.
+func (rb *retryBudget) deposit() {
+	if rb == nil {
+		return
+	}
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.tokens = min(rb.tokens+rb.ratio, rb.burst)
+}
+
+// reserve takes a token for a possible retry, reporting false when none is
+// left; an unused token goes back through refund.
+func (rb *retryBudget) reserve() bool {
+	if rb == nil {
+		return true
+	}
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	if rb.tokens < 1 {
+		return false
+	}
+	rb.tokens--
+	return true
+}
+
+// refund returns a reserved token that no retry used.
+func (rb *retryBudget) refund() {
+	if rb == nil {
+		return
+	}
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.tokens = min(rb.tokens+1, rb.burst)
+}
+
+func (rb *retryBudget) available() float64 {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	return rb.tokens
+}
+
+// latencyWindow keeps recent latencies for a rolling p99: the last
+// SLOMaxSamples of them, of which those within window count. Methods on a
+// nil *latencyWindow are no-ops.
+type latencyWindow struct {
+	window time.Duration
+
+	mu      sync.Mutex
+	samples []latencySample // ring buffer, next is the oldest once full
+	next    int
+}
+
+type latencySample struct {
+	at time.Time
+	d  time.Duration
+}
+
+func newLatencyWindow(window time.Duration) *latencyWindow {
+	if window <= 0 {
+		window = DefaultSLOWindow
+	}
+	return &latencyWindow{window: window, samples: make([]latencySample, 0, SLOMaxSamples)}
+}
+
+func (lw *latencyWindow) record(d time.Duration, now time.Time) {
+	if lw == nil {
+		return
+	}
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	if len(lw.samples) < SLOMaxSamples {
+		lw.samples = append(lw.samples, latencySample{now, d})
+		return
+	}
+	lw.samples[lw.next] = latencySample{now, d}
+	lw.next = (lw.next + 1) % SLOMaxSamples
+}
+
+// p99 returns the 99th percentile of the latencies within the window and
+// how many there were.
+func (lw *latencyWindow) p99(now time.Time) (time.Duration, int) {
+	if lw == nil {
+		return 0, 0
+	}
+	lw.mu.Lock()
+	ds := make([]time.Duration, 0, len(lw.samples))
+	for _, s := range lw.samples {
+		if now.Sub(s.at) < lw.window {
+			ds = append(ds, s.d)
+		}
+	}
+	lw.mu.Unlock()
+	if len(ds) == 0 {
+		return 0, 0
+	}
+	slices.Sort(ds)
+	return ds[(len(ds)-1)*99/100], len(ds)
+}
+
+// breached reports the rolling p99 and whether it exceeds target, judged
+// only once the window holds SLOMinSamples.
+func (lw *latencyWindow) breached(target time.Duration, now time.Time) (time.Duration, bool) {
+	p99, n := lw.p99(now)
+	return p99, n >= SLOMinSamples && p99 > target
+}
+
+// concurrencyLimiter is an adaptive in-flight limit in the style of a
+// gradient controller: it compares a fast and a slow moving average of the
+// request latency. While they agree the limit grows by about sqrt(limit);
+// once the fast one climbs past the slow one (queueing upstream) the limit
+// shrinks by their ratio.
+type concurrencyLimiter struct {
+	mu       sync.Mutex
+	min, max float64
+	limit    float64
+	inflight int
+	shortRTT float64 // fast EWMA of latency (ns)
+	longRTT  float64 // slow EWMA of latency (ns)
+
+	queueMax  int // 0 = no queuing
+	queueWait time.Duration
+	waiters   []chan struct{} // FIFO; closed when handed a slot
+}
+
+const (
+	concShortAlpha = 0.5
+	concLongAlpha  = 0.01
+	concTolerance  = 1.5 // short/long latency ratio tolerated before shrinking
+	concSmoothing  = 0.2
+)
+
+func newConcurrencyLimiter(min, max int) *concurrencyLimiter {
+	return &concurrencyLimiter{min: float64(min), max: float64(max), limit: float64(min)}
+}
+
+// acquire takes an in-flight slot. With wait and queuing enabled a request
+// finding no free slot queues for up to queueWait, leaving early if ctx is
+// done. A nil limiter always allows.
+func (l *concurrencyLimiter) acquire(ctx context.Context, wait bool) bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	if l.inflight < int(l.limit) && len(l.waiters) == 0 {
+		l.inflight++
+		l.mu.Unlock()
+		return true
+	}
+	if !wait || len(l.waiters) >= l.queueMax {
+		l.mu.Unlock()
+		return false
+	}
+	ready := make(chan struct{})
+	l.waiters = append(l.waiters, ready)
+	l.mu.Unlock()
+
+	timer := time.NewTimer(l.queueWait)
+	defer timer.Stop()
+	select {
+	case <-ready:
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if i := slices.Index(l.waiters, ready); i >= 0 {
+		l.waiters = slices.Delete(l.waiters, i, i+1)
+		return false
+	}
+	// Handed a slot just as we gave up: give it back
+	l.inflight--
+	l.grant()
+	return false
+}
+
+// grant hands free slots to queued requests in arrival order; l.mu is held.
+func (l *concurrencyLimiter) grant() {
+	for len(l.waiters) > 0 && l.inflight < int(l.limit) {
+		l.inflight++
+		close(l.waiters[0])
+		l.waiters = slices.Delete(l.waiters, 0, 1)
+	}
+}
+
+// release frees a slot and feeds the request's latency into the limit.
+func (l *concurrencyLimiter) release(rtt time.Duration) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.inflight--
+	sample := float64(rtt)
+	if l.longRTT == 0 {
+		l.shortRTT, l.longRTT = sample, sample
+	}
+	l.shortRTT += concShortAlpha * (sample - l.shortRTT)
+	l.longRTT += concLongAlpha * (sample - l.longRTT)
+	// Latency recovering: let the baseline follow it down faster
+	if l.longRTT > 2*l.shortRTT {
+		l.longRTT *= 0.95
+	}
+
+	gradient := math.Max(0.5, math.Min(1, concTolerance*l.longRTT/l.shortRTT))
+	next := l.limit*gradient + math.Sqrt(l.limit)
+	l.limit = math.Max(l.min, math.Min(l.max, l.limit*(1-concSmoothing)+next*concSmoothing))
+	l.grant()
+}
+
+// snapshot returns the current limit, in-flight and queued counts.
+func (l *concurrencyLimiter) snapshot() (limit, inflight, queued int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.limit), l.inflight, len(l.waiters)
+}
+
+// idempotencyStore keeps responses per Idempotency-Key for a TTL in a bounded
+// LRU, and tracks keys whose first request is still in flight.
+type idempotencyStore struct {
+	ttl      time.Duration
+	mu       sync.Mutex
+	done     *responseCache
+	inflight map[string]*idempotentCall
+}
+
+type idempotentCall struct {
+	bodyHash uint64        // the first request's body fingerprint
+	done     chan struct{} // closed once resp is set
+	resp     *cachedResponse
+}
+
+func newIdempotencyStore(ttl time.Duration, size int) *idempotencyStore {
+	return &idempotencyStore{
+		ttl:      ttl,
+		done:     newResponseCache(size),
+		inflight: make(map[string]*idempotentCall),
+	}
+}
+
+// begin returns the stored response for key if there is one. Otherwise it
+// returns the in-flight call for key, creating it (leader = true) for a
+// request with body fingerprint bodyHash if needed.
+func (s *idempotencyStore) begin(key string, bodyHash uint64) (call *idempotentCall, stored *cachedResponse, leader bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if resp, ok := s.done.get(key); ok {
+		return nil, resp, false
+	}
+	if call, ok := s.inflight[key]; ok {
+		return call, nil, false
+	}
+	call = &idempotentCall{bodyHash: bodyHash, done: make(chan struct{})}
+	s.inflight[key] = call
+	return call, nil, true
+}
+
+// finish stores resp (nil if the response could not be kept) and wakes the
+// requests waiting on call.
+func (s *idempotencyStore) finish(key string, call *idempotentCall, resp *cachedResponse) {
+	s.mu.Lock()
+	delete(s.inflight, key)
+	if resp != nil {
+		s.done.put(resp)
+	}
+	s.mu.Unlock()
+
+	call.resp = resp
+	close(call.done)
+}
+
+func writeReplayed(w http.ResponseWriter, c *cachedResponse) {
+	for k, vv := range c.header {
+		w.Header()[k] = vv
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(c.status)
+	_, _ = w.Write(c.body)
+}
+
+func writeCached(w http.ResponseWriter, c *cachedResponse) {
+	for k, vv := range c.header {
+		w.Header()[k] = vv
+	}
+	w.Header().Set("X-Cache", "HIT")
+	w.WriteHeader(c.status)
+	_, _ = w.Write(c.body)
+}
+
+// fingerprint hashes b (FNV-1a), to compare or key on it without keeping it.
+func fingerprint(b []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(b)
+	return h.Sum64()
+}
+
+func readUpTo(rc io.ReadCloser, max int64) ([]byte, error) {
+	defer func() { _ = rc.Close() }()
+	b, err := io.ReadAll(io.LimitReader(rc, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > max {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return b, nil
+}
+
+// joinURL combines base URL + path + query into a full URL string.
+func joinURL(base *url.URL, path string, rawQuery string) string {
+	u := *base // copy
+	if path == "" {
+		path = "/"
+	}
+	// Ensure proper slashes:
+	// base.Path usually empty; we want base + incoming path
+	if u.Path == "" || u.Path == "/" {
+		u.Path = path
+	} else {
+		// If base has path and incoming has path, join safely
+		u.Path = stringsTrimRightSlash(u.Path) + "/" + stringsTrimLeftSlash(path)
+	}
+	u.RawQuery = rawQuery
+	return u.String()
+}
+
+func stringsTrimLeftSlash(s string) string {
+	for len(s) > 0 && s[0] == '/' {
+		s = s[1:]
+	}
+	return s
+}
+
+func stringsTrimRightSlash(s string) string {
+	for len(s) > 0 && s[len(s)-1] == '/' {
+		s = s[:len(s)-1]
+	}
+	return s
+}
+
+// acceptsEncoding reports whether an Accept-Encoding header allows coding
+// (explicitly or via "*"), honoring q=0 as a refusal.
+func acceptsEncoding(h http.Header, coding string) bool {
+	accepted := false
+	for _, v := range h.Values("Accept-Encoding") {
+		for _, part := range strings.Split(v, ",") {
+			name, params, _ := strings.Cut(part, ";")
+			name = strings.TrimSpace(name)
+			exact := strings.EqualFold(name, coding)
+			if !exact && name != "*" {
+				continue
+			}
+			if qv, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+				if q, err := strconv.ParseFloat(qv, 64); err == nil && q == 0 {
+					if exact {
+						return false
+					}
+					continue
+				}
+			}
+			accepted = true
+		}
+	}
+	return accepted
+}
+
+// Hop-by-hop headers per RFC 7230 section 6.1
+// We remove them to avoid proxy issues.
+var hopByHopHeaders = map[string]bool{
+	"Connection":          true,
+	"Proxy-Connection":    true,
+	"Keep-Alive":          true,
+	"Proxy-Authenticate":  true,
+	"Proxy-Authorization": true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+}
+
+// copyHeaders copies headers from src to dst, skipping hop-by-hop headers,
+// any header named in src's Connection header, and the extra strip set
+// (canonical keys, may be nil).
+func copyHeaders(dst, src http.Header, strip map[string]bool) {
+	var connTokens map[string]bool
+	for _, v := range src.Values("Connection") {
+		for _, tok := range strings.Split(v, ",") {
+			if tok = strings.TrimSpace(tok); tok != "" {
+				if connTokens == nil {
+					connTokens = make(map[string]bool)
+				}
+				connTokens[http.CanonicalHeaderKey(tok)] = true
+			}
+		}
+	}
+
+	for k, vv := range src {
+		if hopByHopHeaders[k] || connTokens[k] || strip[k] {
+			continue
+		}
+		// Don't forward our own selection headers from client
+		if k == "X-Selected-Backend" || k == "X-Selected-URL" {
+			continue
+		}
+		dst.Del(k)
+		for _, v := range vv {
+			dst.Add(k, v)
+		}
+	}
+}
+
+// copyBody copies an upstream body to w. With flush set, for a streamed
+// response of unknown length, every chunk is flushed to the client as it
+// arrives rather than held until the writer's buffer fills.
+func copyBody(w http.ResponseWriter, src io.Reader, flush bool) {
+	if !flush {
+		_, _ = io.Copy(w, src)
+		return
+	}
+	rc := http.NewResponseController(w)
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return
+			}
+			_ = rc.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// headerFilter is an allow/deny filter over header names, see
+// Config.ResponseHeaderAllow.
+type headerFilter struct {
+	allow, deny []string // canonical names; a trailing "*" matches a prefix
+}
+
+// headerPatterns canonicalizes names, keeping a trailing "*".
+func headerPatterns(names []string) []string {
+	out := make([]string, 0, len(names))
+	for _, n := range names {
+		if prefix, ok := strings.CutSuffix(n, "*"); ok {
+			out = append(out, http.CanonicalHeaderKey(prefix)+"*")
+		} else {
+			out = append(out, http.CanonicalHeaderKey(n))
+		}
+	}
+	return out
+}
+
+func matchHeader(patterns []string, key string) bool {
+	for _, p := range patterns {
+		if prefix, ok := strings.CutSuffix(p, "*"); ok {
+			if strings.HasPrefix(key, prefix) {
+				return true
+			}
+		} else if key == p {
+			return true
+		}
+	}
+	return false
+}
+
+// permits reports whether header key may be forwarded.
+func (f *headerFilter) permits(key string) bool {
+	if strings.HasPrefix(key, "X-Selected-") {
+		return true
+	}
+	if matchHeader(f.deny, key) {
+		return false
+	}
+	return len(f.allow) == 0 || matchHeader(f.allow, key)
+}
+
+// apply removes from dst the headers copied from upstream that f rejects,
+// leaving headers the broker set itself alone. A nil filter does nothing.
+func (f *headerFilter) apply(dst, upstream http.Header) {
+	if f == nil {
+		return
+	}
+	for k := range upstream {
+		if !f.permits(k) {
+			dst.Del(k)
+		}
+	}
+}
+
+// headerSet builds a set of canonical header keys.
+func headerSet(keys []string) map[string]bool {
+	set := make(map[string]bool)
+	for _, h := range keys {
+		set[http.CanonicalHeaderKey(h)] = true
+	}
+	return set
+}
+
+// responseCache is a bounded LRU of GET responses keyed by method+path+query.
+type responseCache struct {
+	mu      sync.Mutex
+	max     int
+	ll      *list.List // front = most recently used
+	entries map[string]*list.Element
+}
+
+type cachedResponse struct {
+	key      string
+	status   int
+	header   http.Header
+	body     []byte
+	expires  time.Time
+	bodyHash uint64 // the request body's fingerprint, for Idempotency-Key replays
+}
+
+func newResponseCache(max int) *responseCache {
+	return &responseCache{
+		max:     max,
+		ll:      list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func (c *responseCache) get(key string) (*cachedResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*cachedResponse)
+	if time.Now().After(e.expires) {
+		c.ll.Remove(el)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	return e, true
+}
+
+func (c *responseCache) put(e *cachedResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[e.key]; ok {
+		el.Value = e
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.entries[e.key] = c.ll.PushFront(e)
+
+	// Evict least recently used entries beyond the bound
+	for c.ll.Len() > c.max {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedResponse).key)
+	}
+}
+
+func cacheKey(r *http.Request) string {
+	return r.Method + " " + r.URL.Path + "?" + r.URL.RawQuery
+}
+
+// cacheMaxAge returns the upstream Cache-Control max-age, or 0 when the
+// response must not be cached (no directive, no-store, no-cache, private, or
+// a Vary on request headers other than Accept-Encoding, which the cache key
+// doesn't hold).
+func cacheMaxAge(h http.Header) time.Duration {
+	for _, v := range h.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" && !strings.EqualFold(name, "Accept-Encoding") {
+				return 0
+			}
+		}
+	}
+	var maxAge time.Duration
+	for _, v := range h.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			d = strings.ToLower(strings.TrimSpace(d))
+			switch {
+			case d == "no-store" || d == "no-cache" || d == "private":
+				return 0
+			case strings.HasPrefix(d, "max-age="):
+				secs, err := strconv.Atoi(strings.TrimPrefix(d, "max-age="))
+				if err == nil && secs > 0 {
+					maxAge = time.Duration(secs) * time.Second
+				}
+			}
+		}
+	}
+	return maxAge
+}
@@ -0,0 +1,2014 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dwladdimiroc/load-serverless/broker/tracing"
+)
+
+// testBackend serves h as a backend named name for the duration of the test.
+func testBackend(t *testing.T, name string, h http.HandlerFunc) Backend {
+	t.Helper()
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Backend{Name: name, BaseURL: u, Transport: srv.Client().Transport}
+}
+
+// serveOnce sends req through the Broker and returns the response.
+func serveOnce(b *Broker, req *http.Request) *http.Response {
+	rec := httptest.NewRecorder()
+	b.Handler().ServeHTTP(rec, req)
+	return rec.Result()
+}
+
+func readBody(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestRoundRobinAndFailover(t *testing.T) {
+	var fnDown atomic.Bool
+	named := func(name string, down *atomic.Bool) Backend {
+		return testBackend(t, name, func(w http.ResponseWriter, r *http.Request) {
+			if down != nil && down.Load() {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			body, _ := io.ReadAll(r.Body)
+			fmt.Fprintf(w, "%s %s %s", name, r.URL.Path, body)
+		})
+	}
+	// Round robin starts at the second backend
+	b := New(Config{Backends: []Backend{named("fn", &fnDown), named("vm", nil)}})
+	srv := httptest.NewServer(b.Handler())
+	defer srv.Close()
+
+	post := func() (string, string) {
+		t.Helper()
+		resp, err := http.Post(srv.URL+"/geo_average", "application/json", strings.NewReader("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = resp.Body.Close() }()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("got %d, want 200", resp.StatusCode)
+		}
+		return resp.Header.Get("X-Selected-Backend"), readBody(t, resp)
+	}
+
+	var got []string
+	for range 4 {
+		backend, body := post()
+		if body != backend+" /geo_average {}" {
+			t.Errorf("%s answered %q", backend, body)
+		}
+		got = append(got, backend)
+	}
+	if want := []string{"vm", "fn", "vm", "fn"}; !slices.Equal(got, want) {
+		t.Errorf("round robin picked %v, want %v", got, want)
+	}
+
+	// fn's turns fail over to vm, replaying the buffered body
+	fnDown.Store(true)
+	for range 2 {
+		if backend, body := post(); backend != "vm" || body != "vm /geo_average {}" {
+			t.Errorf("with fn down: %s answered %q", backend, body)
+		}
+	}
+}
+
+func TestSingleBackend(t *testing.T) {
+	var down atomic.Bool
+	be := testBackend(t, "vm", func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		_, _ = w.Write([]byte("vm"))
+	})
+	b := New(Config{Backends: []Backend{be}, Shadow: true, BreakerFailures: 3, ConcurrencyMax: 4})
+
+	for range 2 {
+		resp := serveOnce(b, httptest.NewRequest(http.MethodGet, "/x", nil))
+		if body := readBody(t, resp); resp.StatusCode != http.StatusOK || body != "vm" {
+			t.Errorf("got %d %q, want vm's answer", resp.StatusCode, body)
+		}
+	}
+	down.Store(true)
+	if resp := serveOnce(b, httptest.NewRequest(http.MethodGet, "/x", nil)); resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("backend down: got %d, want 502", resp.StatusCode)
+	}
+	for _, path := range []string{"/config", "/metrics", "/health"} {
+		if resp := serveOnce(b, httptest.NewRequest(http.MethodGet, path, nil)); resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: status %d", path, resp.StatusCode)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("New with no backends did not panic")
+		}
+	}()
+	New(Config{})
+}
+
+func TestResponseCache(t *testing.T) {
+	var hits atomic.Int64
+	be := testBackend(t, "vm", func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if r.URL.Path != "/nostore" {
+			w.Header().Set("Cache-Control", "public, max-age=60")
+		}
+		fmt.Fprintf(w, "%s %d", r.URL.RequestURI(), hits.Load())
+	})
+	b := New(Config{Backends: []Backend{be, be}, CacheSize: 1})
+
+	get := func(target string) (string, string) {
+		resp := serveOnce(b, httptest.NewRequest(http.MethodGet, target, nil))
+		return readBody(t, resp), resp.Header.Get("X-Cache")
+	}
+	if body, xc := get("/a?q=1"); body != "/a?q=1 1" || xc != "MISS" {
+		t.Fatalf("first GET: %q X-Cache %q", body, xc)
+	}
+	if body, xc := get("/a?q=1"); body != "/a?q=1 1" || xc != "HIT" {
+		t.Errorf("repeated GET: %q X-Cache %q, want the cached body", body, xc)
+	}
+	if body, xc := get("/a?q=2"); body != "/a?q=2 2" || xc != "MISS" {
+		t.Errorf("other query: %q X-Cache %q, want its own entry", body, xc)
+	}
+	// Cache size 1: the second key evicted the first
+	if _, xc := get("/a?q=1"); xc != "MISS" {
+		t.Errorf("evicted entry: X-Cache %q, want MISS", xc)
+	}
+
+	get("/nostore")
+	if body, xc := get("/nostore"); xc != "MISS" || !strings.HasSuffix(body, " 5") {
+		t.Errorf("response without max-age: %q X-Cache %q, want it never cached", body, xc)
+	}
+
+	resp := serveOnce(b, httptest.NewRequest(http.MethodPost, "/a?q=2", strings.NewReader("{}")))
+	if xc := resp.Header.Get("X-Cache"); xc != "" {
+		t.Errorf("POST: X-Cache %q, want POSTs not cached", xc)
+	}
+}
+
+func TestCacheMaxAge(t *testing.T) {
+	tests := []struct {
+		cc   []string
+		vary []string
+		want time.Duration
+	}{
+		{nil, nil, 0},
+		{[]string{"max-age=30"}, nil, 30 * time.Second},
+		{[]string{"public", "Max-Age=5"}, nil, 5 * time.Second},
+		{[]string{"max-age=30, no-store"}, nil, 0},
+		{[]string{"private, max-age=30"}, nil, 0},
+		{[]string{"no-cache"}, nil, 0},
+		{[]string{"max-age=-1"}, nil, 0},
+		{[]string{"max-age=30"}, []string{"accept-encoding"}, 30 * time.Second},
+		{[]string{"max-age=30"}, []string{"Accept-Encoding, Authorization"}, 0},
+		{[]string{"max-age=30"}, []string{"Accept-Encoding", "Accept-Language"}, 0},
+		{[]string{"max-age=30"}, []string{"*"}, 0},
+	}
+	for _, tt := range tests {
+		h := http.Header{"Cache-Control": tt.cc, "Vary": tt.vary}
+		if got := cacheMaxAge(h); got != tt.want {
+			t.Errorf("cacheMaxAge(%q, Vary %q) = %s, want %s", tt.cc, tt.vary, got, tt.want)
+		}
+	}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestShadowDivergences(t *testing.T) {
+	var mirrored atomic.Int64
+	primary := testBackend(t, "primary", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("same"))
+	})
+	shadow := testBackend(t, "shadow", func(w http.ResponseWriter, r *http.Request) {
+		defer mirrored.Add(1)
+		body, _ := io.ReadAll(r.Body)
+		switch r.URL.Path {
+		case "/x/status":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "/x/body":
+			_, _ = w.Write([]byte("different " + string(body)))
+		default:
+			_, _ = w.Write([]byte("same"))
+		}
+	})
+	// Round robin starts at the second backend
+	b := New(Config{Backends: []Backend{shadow, primary}, Shadow: true, ShadowCompareBody: true})
+
+	for i, path := range []string{"/x/equal", "/x/status", "/x/body"} {
+		b.rr.Store(0)
+		resp := serveOnce(b, httptest.NewRequest(http.MethodPost, path, strings.NewReader("{}")))
+		if body := readBody(t, resp); resp.StatusCode != http.StatusOK || body != "same" {
+			t.Fatalf("%s: client got %d %q, want the primary's response", path, resp.StatusCode, body)
+		}
+		waitFor(t, "the mirrored request", func() bool { return mirrored.Load() == int64(i+1) })
+	}
+	waitFor(t, "two divergences", func() bool { return b.shadowDivergences.Load() == 2 })
+
+	// Without body comparison only the status counts
+	b = New(Config{Backends: []Backend{shadow, primary}, Shadow: true})
+	_ = serveOnce(b, httptest.NewRequest(http.MethodGet, "/x/status", nil))
+	waitFor(t, "a status divergence", func() bool { return b.shadowDivergences.Load() == 1 })
+
+	// A request failed over to the shadow backend is sent to it once, as the
+	// real request, and not compared
+	down := testBackend(t, "down", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	})
+	b = New(Config{Backends: []Backend{shadow, down}, Shadow: true, ShadowCompareBody: true})
+	before := mirrored.Load()
+	if resp := serveOnce(b, httptest.NewRequest(http.MethodPost, "/x/body", strings.NewReader("{}"))); resp.StatusCode != http.StatusOK {
+		t.Fatalf("failover to the shadow backend: status %d", resp.StatusCode)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := mirrored.Load() - before; n != 1 {
+		t.Errorf("shadow backend got the failed-over request %d times, want once", n)
+	}
+	if n := b.shadowDivergences.Load(); n != 0 {
+		t.Errorf("%d divergences logged for a failed-over request", n)
+	}
+}
+
+func TestBackendOverride(t *testing.T) {
+	echo := func(w http.ResponseWriter, r *http.Request) { _, _ = w.Write([]byte(r.URL.RawQuery)) }
+	sls, vm := testBackend(t, "serverless", echo), testBackend(t, "vm", echo)
+
+	b := New(Config{Backends: []Backend{sls, vm}, AllowBackendOverride: true})
+	for range 3 {
+		resp := serveOnce(b, httptest.NewRequest(http.MethodGet, "/x?a=1&__backend=vm", nil))
+		if got := resp.Header.Get("X-Selected-Backend"); got != "vm" {
+			t.Errorf("X-Selected-Backend = %q, want the forced vm", got)
+		}
+		if q := readBody(t, resp); q != "a=1" {
+			t.Errorf("backend got query %q, want __backend stripped", q)
+		}
+	}
+	seen := map[string]bool{}
+	for range 2 {
+		resp := serveOnce(b, httptest.NewRequest(http.MethodGet, "/x?__backend=nope", nil))
+		seen[resp.Header.Get("X-Selected-Backend")] = true
+	}
+	if !seen["serverless"] || !seen["vm"] {
+		t.Errorf("unknown name served by %v, want normal round robin", seen)
+	}
+
+	// Not honored unless enabled; round robin starts at the second backend
+	b = New(Config{Backends: []Backend{vm, sls}})
+	resp := serveOnce(b, httptest.NewRequest(http.MethodGet, "/x?__backend=vm", nil))
+	if got := resp.Header.Get("X-Selected-Backend"); got != "serverless" {
+		t.Errorf("override disabled: X-Selected-Backend = %q, want serverless", got)
+	}
+	if q := readBody(t, resp); q != "__backend=vm" {
+		t.Errorf("override disabled: backend got query %q", q)
+	}
+}
+
+func captureLog(t *testing.T) *strings.Builder {
+	t.Helper()
+	var out strings.Builder
+	var mu sync.Mutex
+	log.SetOutput(writerFunc(func(p []byte) (int, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return out.Write(p)
+	}))
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return &out
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
+
+func TestBodyLoggerRedactsAndTruncates(t *testing.T) {
+	l := newBodyLogger(1, 40, []string{"token", "lat"})
+	got := l.format([]byte(`{"token":"s3cret","points":[{"lat":1,"lng":2}]}`))
+	if strings.Contains(got, "s3cret") || strings.Contains(got, `"lat":1`) {
+		t.Errorf("format = %q, want token and nested lat redacted", got)
+	}
+	if !strings.HasSuffix(got, "...(truncated)") || len(got) != 40+len("...(truncated)") {
+		t.Errorf("format = %q, want it cut at 40 bytes", got)
+	}
+	if got := l.format([]byte("not json")); got != "not json" {
+		t.Errorf("non-JSON body = %q, want it as is", got)
+	}
+}
+
+func TestBodySampling(t *testing.T) {
+	be := testBackend(t, "vm", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"lat":1,"session":"abc"}`))
+	})
+	logged := captureLog(t)
+	b := New(Config{Backends: []Backend{be, be}, BodySampleRate: 1, BodyRedactKeys: []string{"password", "session"}})
+	resp := serveOnce(b, httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(`{"user":"u","password":"p"}`)))
+	if body := readBody(t, resp); body != `{"lat":1,"session":"abc"}` {
+		t.Errorf("client got %q, want the response unredacted", body)
+	}
+	out := logged.String()
+	for _, want := range []string{"body sample POST /login status=200", `"user":"u"`, `"password":"[REDACTED]"`, `"session":"[REDACTED]"`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("log %q lacks %q", out, want)
+		}
+	}
+	if strings.Contains(out, `"abc"`) {
+		t.Errorf("log %q leaks a redacted value", out)
+	}
+}
+
+func TestHeadForwardsHeadersWithoutBody(t *testing.T) {
+	var method string
+	be := testBackend(t, "vm", func(w http.ResponseWriter, r *http.Request) {
+		method = r.Method
+		w.Header().Set("Content-Length", "1234")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+	})
+	b := New(Config{Backends: []Backend{be, be}, CacheSize: 10})
+	srv := httptest.NewServer(b.Handler())
+	defer srv.Close()
+
+	for range 2 {
+		resp, err := http.Head(srv.URL + "/geo_average")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		if method != http.MethodHead {
+			t.Errorf("backend got %s, want HEAD", method)
+		}
+		if resp.StatusCode != http.StatusOK || resp.ContentLength != 1234 || resp.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("got %d, Content-Length %d, Content-Type %q; want the backend's headers", resp.StatusCode, resp.ContentLength, resp.Header.Get("Content-Type"))
+		}
+		if xc := resp.Header.Get("X-Cache"); xc != "" {
+			t.Errorf("HEAD went through the GET cache (X-Cache %s)", xc)
+		}
+	}
+}
+
+func TestRateLimitAfterBurst(t *testing.T) {
+	be := testBackend(t, "vm", func(w http.ResponseWriter, r *http.Request) {})
+	b := New(Config{Backends: []Backend{be, be}, RateLimit: 1, RateBurst: 3})
+
+	send := func(remote string) *http.Response {
+		req := httptest.NewRequest(http.MethodGet, "/x", nil)
+		req.RemoteAddr = remote
+		return serveOnce(b, req)
+	}
+	for i := range 3 {
+		if resp := send("192.0.2.1:1234"); resp.StatusCode != http.StatusOK {
+			t.Fatalf("request %d within the burst: got %d", i, resp.StatusCode)
+		}
+	}
+	resp := send("192.0.2.1:1234")
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("request after the burst: got %d, want 429", resp.StatusCode)
+	}
+	if resp.Header.Get("Retry-After") == "" {
+		t.Error("429 without Retry-After")
+	}
+	if resp := send("192.0.2.2:1234"); resp.StatusCode != http.StatusOK {
+		t.Errorf("another client: got %d, want its own bucket", resp.StatusCode)
+	}
+}
+
+func TestClientIPTrustedProxies(t *testing.T) {
+	var trusted []*net.IPNet
+	for _, cidr := range []string{"10.0.0.0/8", "192.0.2.1/32"} {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		trusted = append(trusted, n)
+	}
+	l := newRateLimiter(1, 1, trusted)
+	tests := []struct {
+		remote, xff, want string
+	}{
+		{"198.51.100.7:1", "203.0.113.9", "198.51.100.7"}, // untrusted peer: XFF ignored
+		{"10.0.0.1:1", "203.0.113.9", "203.0.113.9"},      // trusted proxy
+		{"192.0.2.1:1", "203.0.113.9", "203.0.113.9"},     // a single trusted address
+		{"192.0.2.2:1", "203.0.113.9", "192.0.2.2"},
+		{"10.0.0.1:1", "", "10.0.0.1"}, // no header
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = tt.remote
+		if tt.xff != "" {
+			req.Header.Set("X-Forwarded-For", tt.xff)
+		}
+		if got := l.clientIP(req); got != tt.want {
+			t.Errorf("clientIP(%s, XFF %q) = %q, want %q", tt.remote, tt.xff, got, tt.want)
+		}
+	}
+}
+
+func TestConfigEndpoint(t *testing.T) {
+	sls := testBackend(t, "serverless", func(w http.ResponseWriter, r *http.Request) {})
+	vm := testBackend(t, "vm", func(w http.ResponseWriter, r *http.Request) {})
+	vm.H2C = true
+	b := New(Config{
+		Backends:    []Backend{sls, vm},
+		ListenAddr:  ":8080",
+		CacheSize:   5,
+		RateLimit:   2.5,
+		RateBurst:   3,
+		AdminSecret: "s3cret",
+	})
+	h := b.Handler().ServeHTTP
+
+	rec := httptest.NewRecorder()
+	h(rec, httptest.NewRequest(http.MethodGet, "/config", nil))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("without the admin secret: got %d, want 403", rec.Code)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/config", nil)
+	req.Header.Set(AdminSecretHeader, "s3cret")
+	rec = httptest.NewRecorder()
+	h(rec, req)
+	body := rec.Body.String()
+	if strings.Contains(body, "s3cret") {
+		t.Error("/config leaks the admin secret")
+	}
+	var rep configReport
+	if err := json.Unmarshal([]byte(body), &rep); err != nil {
+		t.Fatalf("%v: %s", err, body)
+	}
+	if rep.ListenAddr != ":8080" || rep.Routing != "round_robin" || rep.CacheSize != 5 || rep.RateLimit != 2.5 || rep.RateBurst != 3 {
+		t.Errorf("report = %+v", rep)
+	}
+	if len(rep.Backends) != 2 || rep.Backends[1].Name != "vm" || !rep.Backends[1].H2C || rep.Backends[1].URL != vm.BaseURL.String() {
+		t.Errorf("backends = %+v", rep.Backends)
+	}
+}
+
+func TestGzipDecompression(t *testing.T) {
+	var zipped bytes.Buffer
+	zw := gzip.NewWriter(&zipped)
+	_, _ = zw.Write([]byte("hello"))
+	_ = zw.Close()
+	be := testBackend(t, "vm", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		_, _ = w.Write(zipped.Bytes())
+	})
+	b := New(Config{Backends: []Backend{be, be}})
+
+	tests := []struct {
+		accept   string
+		encoding string
+	}{
+		{"gzip", "gzip"},
+		{"br, gzip;q=0.5", "gzip"},
+		{"*", "gzip"},
+		{"", ""},
+		{"identity", ""},
+		{"gzip;q=0", ""},
+		{"*, gzip;q=0", ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/x", nil)
+		if tt.accept != "" {
+			req.Header.Set("Accept-Encoding", tt.accept)
+		}
+		resp := serveOnce(b, req)
+		body := readBody(t, resp)
+		if got := resp.Header.Get("Content-Encoding"); got != tt.encoding {
+			t.Errorf("Accept-Encoding %q: Content-Encoding = %q, want %q", tt.accept, got, tt.encoding)
+		}
+		if tt.encoding == "" && body != "hello" {
+			t.Errorf("Accept-Encoding %q: body = %q, want decompressed", tt.accept, body)
+		}
+		if tt.encoding == "gzip" && body != zipped.String() {
+			t.Errorf("Accept-Encoding %q: body was altered", tt.accept)
+		}
+	}
+}
+
+func TestProbeBackends(t *testing.T) {
+	var probed string
+	up := testBackend(t, "vm", func(w http.ResponseWriter, r *http.Request) {
+		probed = r.URL.Path
+		w.WriteHeader(http.StatusNoContent)
+	})
+	up.HealthPath = "/healthz"
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+	u, _ := url.Parse(srv.URL)
+	down := Backend{Name: "serverless", BaseURL: u, Transport: http.DefaultTransport}
+
+	logged := captureLog(t)
+	b := New(Config{Backends: []Backend{up, down}})
+	b.ProbeBackends(time.Second)
+
+	if probed != "/healthz" {
+		t.Errorf("probed %q, want the backend's health path", probed)
+	}
+	out := logged.String()
+	if !strings.Contains(out, "vm reachable (status 204)") {
+		t.Errorf("log %q does not report vm reachable", out)
+	}
+	if !strings.Contains(out, "WARNING: backend serverless is UNREACHABLE") {
+		t.Errorf("log %q does not warn about serverless", out)
+	}
+}
+
+func TestHeaderStripping(t *testing.T) {
+	var got http.Header
+	be := testBackend(t, "vm", func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		w.Header().Set("Server", "geo/1.0")
+		w.Header().Set("X-Powered-By", "go")
+		w.Header().Set("X-Kept", "1")
+	})
+	b := New(Config{
+		Backends:             []Backend{be, be},
+		StripRequestHeaders:  []string{"X-Debug"},
+		StripResponseHeaders: []string{"Server", "X-Powered-By"},
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/x", nil)
+	req.Header.Set("Connection", "keep-alive, X-Hop")
+	req.Header.Set("X-Hop", "1")
+	req.Header.Set("Proxy-Authorization", "Basic xyz")
+	req.Header.Set("X-Debug", "1")
+	req.Header.Set("X-Selected-Backend", "serverless")
+	req.Header.Set("X-Forwarded", "1")
+	resp := serveOnce(b, req)
+
+	for _, h := range []string{"Connection", "X-Hop", "Proxy-Authorization", "X-Debug"} {
+		if v := got.Get(h); v != "" {
+			t.Errorf("backend got %s: %q", h, v)
+		}
+	}
+	if got.Get("X-Forwarded") != "1" {
+		t.Error("backend did not get an unlisted header")
+	}
+	if got.Get("X-Selected-Backend") != "" {
+		t.Error("client's X-Selected-Backend forwarded")
+	}
+	for _, h := range []string{"Server", "X-Powered-By"} {
+		if v := resp.Header.Get(h); v != "" {
+			t.Errorf("client got %s: %q", h, v)
+		}
+	}
+	if resp.Header.Get("X-Kept") != "1" || resp.Header.Get("X-Selected-Backend") != "vm" {
+		t.Errorf("response headers = %v", resp.Header)
+	}
+}
+
+func TestSoftDeadlineAndTimeout(t *testing.T) {
+	slowHandler := func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(300 * time.Millisecond):
+			_, _ = w.Write([]byte("slow"))
+		case <-r.Context().Done():
+		}
+	}
+	slow := testBackend(t, "slow", slowHandler)
+	slow.SoftDeadline = 20 * time.Millisecond
+	fast := testBackend(t, "fast", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("fast"))
+	})
+	b := New(Config{Backends: []Backend{slow, fast}, AllowBackendOverride: true})
+
+	start := time.Now()
+	resp := serveOnce(b, httptest.NewRequest(http.MethodGet, "/x?__backend=slow", nil))
+	if body := readBody(t, resp); body != "fast" || time.Since(start) > 200*time.Millisecond {
+		t.Errorf("GET past the soft deadline: got %q after %s, want an early failover", body, time.Since(start))
+	}
+	// Not idempotent: the slow backend still answers
+	resp = serveOnce(b, httptest.NewRequest(http.MethodPost, "/x?__backend=slow", strings.NewReader("{}")))
+	if body := readBody(t, resp); body != "slow" {
+		t.Errorf("POST past the soft deadline: got %q, want the slow backend's answer", body)
+	}
+
+	// Timeout is a hard per-attempt deadline, on the failover backend too
+	limited := testBackend(t, "limited", slowHandler)
+	limited.Timeout = 20 * time.Millisecond
+	b = New(Config{Backends: []Backend{limited, limited}})
+	start = time.Now()
+	resp = serveOnce(b, httptest.NewRequest(http.MethodPost, "/x", strings.NewReader("{}")))
+	if resp.StatusCode != http.StatusBadGateway || time.Since(start) > 200*time.Millisecond {
+		t.Errorf("past Timeout: got %d after %s, want an early 502", resp.StatusCode, time.Since(start))
+	}
+}
+
+func TestFailoverOrder(t *testing.T) {
+	var mu sync.Mutex
+	var tried []string
+	backend := func(name string, status int) Backend {
+		return testBackend(t, name, func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			tried = append(tried, name)
+			mu.Unlock()
+			w.WriteHeader(status)
+		})
+	}
+	a, bb, c := backend("a", http.StatusBadGateway), backend("b", http.StatusOK), backend("c", http.StatusOK)
+	b := New(Config{Backends: []Backend{a, bb, c}, FailoverOrder: []string{"c", "unknown"}})
+	b.rr.Store(2) // the next pick is a
+
+	// Rotation would fail a over to b; the configured order prefers c
+	resp := serveOnce(b, httptest.NewRequest(http.MethodGet, "/x", nil))
+	if got := resp.Header.Get("X-Selected-Backend"); resp.StatusCode != http.StatusOK || got != "c" {
+		t.Errorf("got %d from %q, want 200 from c", resp.StatusCode, got)
+	}
+	if !slices.Equal(tried, []string{"a", "c"}) {
+		t.Errorf("tried %v, want [a c]", tried)
+	}
+
+	names := func(seq []Backend) []string {
+		var out []string
+		for _, be := range seq {
+			out = append(out, be.Name)
+		}
+		return out
+	}
+	for primary, want := range [][]string{{"c", "b"}, {"c", "a"}, {"a", "b"}} {
+		if got := names(b.failoverSequence(primary)); !slices.Equal(got, want) {
+			t.Errorf("after %s: %v, want %v (listed first, the rest in rotation order)", b.backends[primary].Name, got, want)
+		}
+	}
+	plain := New(Config{Backends: []Backend{a, bb, c}})
+	if got := names(plain.failoverSequence(1)); !slices.Equal(got, []string{"c", "a"}) {
+		t.Errorf("without an order, after b: %v, want rotation order [c a]", got)
+	}
+}
+
+func TestSanitizeErrors(t *testing.T) {
+	be := testBackend(t, "vm", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/x/ok" {
+			_, _ = w.Write([]byte(`{"lat":1,"lng":2}`))
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("pq: relation internal_points does not exist"))
+	})
+
+	plain := New(Config{Backends: []Backend{be, be}})
+	resp := serveOnce(plain, httptest.NewRequest(http.MethodGet, "/x/bad", nil))
+	if body := readBody(t, resp); resp.StatusCode != http.StatusBadRequest || body != "pq: relation internal_points does not exist" {
+		t.Errorf("sanitizing off: got %d %q, want the backend's 400 as is", resp.StatusCode, body)
+	}
+
+	logs := captureLog(t)
+	b := New(Config{Backends: []Backend{be, be}, SanitizeErrors: true})
+	resp = serveOnce(b, httptest.NewRequest(http.MethodGet, "/x/bad", nil))
+	if body := readBody(t, resp); resp.StatusCode != http.StatusBadRequest || body != `{"error":"upstream error","status":400}`+"\n" {
+		t.Errorf("sanitizing on: got %d %q", resp.StatusCode, body)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("sanitized Content-Type = %q", ct)
+	}
+	if !strings.Contains(logs.String(), "internal_points") {
+		t.Errorf("original body not logged:\n%s", logs)
+	}
+
+	resp = serveOnce(b, httptest.NewRequest(http.MethodGet, "/x/ok", nil))
+	if body := readBody(t, resp); resp.StatusCode != http.StatusOK || body != `{"lat":1,"lng":2}` {
+		t.Errorf("2xx: got %d %q, want it untouched", resp.StatusCode, body)
+	}
+}
+
+func TestIdempotencyKeyReplays(t *testing.T) {
+	var calls atomic.Int64
+	be := testBackend(t, "vm", func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "order %d", n)
+	})
+	b := New(Config{Backends: []Backend{be, be}, IdempotencyTTL: 100 * time.Millisecond})
+
+	post := func(key string) (*http.Response, string) {
+		req := httptest.NewRequest(http.MethodPost, "/x/orders", strings.NewReader("{}"))
+		if key != "" {
+			req.Header.Set(IdempotencyKeyHeader, key)
+		}
+		resp := serveOnce(b, req)
+		return resp, readBody(t, resp)
+	}
+
+	if resp, body := post("k1"); resp.StatusCode != http.StatusCreated || body != "order 1" || resp.Header.Get("Idempotent-Replayed") != "" {
+		t.Fatalf("first request: %d %q", resp.StatusCode, body)
+	}
+	resp, body := post("k1")
+	if resp.StatusCode != http.StatusCreated || body != "order 1" || resp.Header.Get("Idempotent-Replayed") != "true" {
+		t.Errorf("repeat: %d %q replayed=%q, want order 1 replayed", resp.StatusCode, body, resp.Header.Get("Idempotent-Replayed"))
+	}
+	if _, body := post("k2"); body != "order 2" {
+		t.Errorf("another key: %q, want a new order", body)
+	}
+	if _, body := post(""); body != "order 3" {
+		t.Errorf("no key: %q, want a new order", body)
+	}
+	if _, body := post(""); body != "order 4" {
+		t.Errorf("no key again: %q, want a new order", body)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if resp, body := post("k1"); body != "order 5" || resp.Header.Get("Idempotent-Replayed") != "" {
+		t.Errorf("after the TTL: %q, want the key forgotten", body)
+	}
+}
+
+func TestIdempotencyKeySingleFlight(t *testing.T) {
+	var calls atomic.Int64
+	arrived, release := make(chan struct{}), make(chan struct{})
+	be := testBackend(t, "vm", func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			close(arrived)
+			<-release
+		}
+		_, _ = w.Write([]byte("charged"))
+	})
+	b := New(Config{Backends: []Backend{be, be}, IdempotencyTTL: time.Minute})
+
+	bodies := make([]string, 5)
+	replayed := make([]string, 5)
+	var wg sync.WaitGroup
+	send := func(i int) {
+		defer wg.Done()
+		req := httptest.NewRequest(http.MethodPost, "/x/pay", strings.NewReader("{}"))
+		req.Header.Set(IdempotencyKeyHeader, "pay-1")
+		resp := serveOnce(b, req)
+		bodies[i], replayed[i] = readBody(t, resp), resp.Header.Get("Idempotent-Replayed")
+	}
+	wg.Add(1)
+	go send(0)
+	<-arrived
+	for i := 1; i < len(bodies); i++ {
+		wg.Add(1)
+		go send(i)
+	}
+	// Give the followers time to find the first request in flight
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := calls.Load(); n != 1 {
+		t.Errorf("backend got %d requests for one key, want 1", n)
+	}
+	for i, body := range bodies {
+		if body != "charged" || (i > 0) != (replayed[i] == "true") {
+			t.Errorf("request %d: %q replayed=%q", i, body, replayed[i])
+		}
+	}
+}
+
+func TestIdempotencyKeyScope(t *testing.T) {
+	var calls atomic.Int64
+	be := testBackend(t, "vm", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "order %d", calls.Add(1))
+	})
+	b := New(Config{Backends: []Backend{be, be}, IdempotencyTTL: time.Minute})
+
+	post := func(remoteAddr, auth, body string) (*http.Response, string) {
+		req := httptest.NewRequest(http.MethodPost, "/x/orders", strings.NewReader(body))
+		req.RemoteAddr = remoteAddr
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		req.Header.Set(IdempotencyKeyHeader, "k1")
+		resp := serveOnce(b, req)
+		return resp, readBody(t, resp)
+	}
+
+	for _, tc := range []struct {
+		name, remoteAddr, auth, body string
+		status                       int
+		want                         string
+	}{
+		{"first", "192.0.2.1:1000", "", "{}", http.StatusOK, "order 1"},
+		{"same client, another port", "192.0.2.1:2000", "", "{}", http.StatusOK, "order 1"},
+		{"another client", "192.0.2.2:1000", "", "{}", http.StatusOK, "order 2"},
+		{"another body", "192.0.2.1:1000", "", `{"n":2}`, http.StatusUnprocessableEntity, ""},
+		{"credentials", "192.0.2.1:1000", "Bearer a", "{}", http.StatusOK, "order 3"},
+		{"same credentials, another IP", "192.0.2.9:1000", "Bearer a", "{}", http.StatusOK, "order 3"},
+		{"other credentials", "192.0.2.1:1000", "Bearer b", "{}", http.StatusOK, "order 4"},
+	} {
+		resp, body := post(tc.remoteAddr, tc.auth, tc.body)
+		if resp.StatusCode != tc.status || (tc.want != "" && body != tc.want) {
+			t.Errorf("%s: %d %q, want %d %q", tc.name, resp.StatusCode, body, tc.status, tc.want)
+		}
+	}
+	if n := calls.Load(); n != 4 {
+		t.Errorf("backend called %d times, want 4", n)
+	}
+}
+
+func TestSlowStartWeight(t *testing.T) {
+	s := &backendState{name: "fn", failuresToOpen: 1, cooldown: time.Second, slowStart: 10 * time.Second}
+	t0 := time.Now()
+	if w := s.weight(t0); w != 1 {
+		t.Errorf("never tripped: weight %v, want 1", w)
+	}
+	s.record(false, t0)
+	s.allow(t0.Add(time.Second)) // the half-open probe
+	s.record(true, t0.Add(time.Second))
+	rec := t0.Add(time.Second)
+	for _, tt := range []struct {
+		after time.Duration
+		want  float64
+	}{{0, SlowStartMinWeight}, {time.Second, 0.1}, {5 * time.Second, 0.5}, {10 * time.Second, 1}, {time.Minute, 1}} {
+		if w := s.weight(rec.Add(tt.after)); math.Abs(w-tt.want) > 1e-9 {
+			t.Errorf("%s after closing: weight %v, want %v", tt.after, w, tt.want)
+		}
+	}
+	if w := (&backendState{}).weight(t0); w != 1 {
+		t.Errorf("slow start off: weight %v", w)
+	}
+}
+
+func TestSlowStartRampsTraffic(t *testing.T) {
+	_ = captureLog(t)
+	var fnDown atomic.Bool
+	fnDown.Store(true)
+	vm := testBackend(t, "vm", func(w http.ResponseWriter, r *http.Request) {})
+	fn := testBackend(t, "fn", func(w http.ResponseWriter, r *http.Request) {
+		if fnDown.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	})
+	b := New(Config{Backends: []Backend{vm, fn}, BreakerFailures: 1, BreakerCooldown: 20 * time.Millisecond, SlowStart: 500 * time.Millisecond})
+	fnState := b.backends[1].state
+	share := func(n int) int {
+		fnServed := 0
+		for range n {
+			if serveOnce(b, httptest.NewRequest(http.MethodGet, "/x", nil)).Header.Get("X-Selected-Backend") == "fn" {
+				fnServed++
+			}
+		}
+		return fnServed
+	}
+
+	waitFor(t, "fn's circuit to open", func() bool { share(1); return fnState.status(time.Now()) == "open" })
+	fnDown.Store(false)
+	waitFor(t, "fn's circuit to close", func() bool { share(1); return fnState.status(time.Now()) == "closed" })
+
+	// Right after recovering fn keeps only a few of its turns (half of 200
+	// at full share)
+	if n := share(200); n > 40 {
+		t.Errorf("fn served %d of 200 requests right after recovering", n)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if n := share(200); n != 100 {
+		t.Errorf("fn served %d of 200 requests after the slow start window, want its full share", n)
+	}
+}
+
+func TestBreakerProbeSkippedAtConcurrencyLimit(t *testing.T) {
+	_ = captureLog(t)
+	var fnDown atomic.Bool
+	fnDown.Store(true)
+	vm := testBackend(t, "vm", func(w http.ResponseWriter, r *http.Request) {})
+	fn := testBackend(t, "fn", func(w http.ResponseWriter, r *http.Request) {
+		if fnDown.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	})
+	b := New(Config{Backends: []Backend{vm, fn}, BreakerFailures: 1, BreakerCooldown: 20 * time.Millisecond, ConcurrencyMin: 1, ConcurrencyMax: 1})
+	fnState, fnConc := b.backends[1].state, b.backends[1].conc
+	send := func() { serveOnce(b, httptest.NewRequest(http.MethodGet, "/x", nil)) }
+
+	waitFor(t, "fn's circuit to open", func() bool { send(); return fnState.status(time.Now()) == "open" })
+	fnDown.Store(false)
+
+	// fn is at its limit when the cooldown ends: the would-be probes fail
+	// over to vm without holding the probe slot
+	if !fnConc.acquire(context.Background(), false) {
+		t.Fatal("acquire refused with nothing in flight")
+	}
+	time.Sleep(30 * time.Millisecond)
+	for range 4 {
+		send()
+	}
+	fnConc.release(time.Millisecond)
+	waitFor(t, "fn's circuit to close", func() bool { send(); return fnState.status(time.Now()) == "closed" })
+}
+
+func TestPprofToggle(t *testing.T) {
+	be := testBackend(t, "vm", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("proxied"))
+	})
+
+	off := New(Config{Backends: []Backend{be, be}})
+	if body := readBody(t, serveOnce(off, httptest.NewRequest(http.MethodGet, "/debug/pprof/", nil))); body != "proxied" {
+		t.Errorf("pprof off: /debug/pprof/ answered %q, want it proxied", body)
+	}
+
+	on := New(Config{Backends: []Backend{be, be}, Pprof: true, AdminSecret: "s3cret"})
+	if resp := serveOnce(on, httptest.NewRequest(http.MethodGet, "/debug/pprof/", nil)); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("pprof without the admin secret: got %d, want 403", resp.StatusCode)
+	}
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/heap?debug=1", "/debug/pprof/cmdline"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set(AdminSecretHeader, "s3cret")
+		resp := serveOnce(on, req)
+		if body := readBody(t, resp); resp.StatusCode != http.StatusOK || body == "proxied" {
+			t.Errorf("pprof on: %s got %d %.40q", path, resp.StatusCode, body)
+		}
+	}
+}
+
+func TestConcurrencyLimitFollowsLatency(t *testing.T) {
+	l := newConcurrencyLimiter(2, 50)
+	cycle := func(rtt time.Duration) {
+		if !l.acquire(context.Background(), false) {
+			t.Fatal("acquire refused with nothing in flight")
+		}
+		l.release(rtt)
+	}
+
+	for range 200 {
+		cycle(10 * time.Millisecond)
+	}
+	stable, _, _ := l.snapshot()
+	if stable != 50 {
+		t.Errorf("limit %d after stable latency, want it grown to the max 50", stable)
+	}
+
+	// Latency climbs steadily: the limit backs off
+	for i := range 50 {
+		cycle(time.Duration(10+5*i) * time.Millisecond)
+	}
+	climbing, _, _ := l.snapshot()
+	if climbing >= stable/2 {
+		t.Errorf("limit %d while latency climbs, want well below %d", climbing, stable)
+	}
+	for range 500 {
+		cycle(time.Second)
+	}
+	if limit, _, _ := l.snapshot(); limit < 2 {
+		t.Errorf("limit %d, below the min 2", limit)
+	}
+
+	// At the limit, further requests are refused rather than queued
+	small := newConcurrencyLimiter(2, 2)
+	if !small.acquire(context.Background(), false) || !small.acquire(context.Background(), false) {
+		t.Fatal("acquire refused below the limit")
+	}
+	if small.acquire(context.Background(), true) {
+		t.Error("third request admitted at limit 2")
+	}
+	if _, inflight, _ := small.snapshot(); inflight != 2 {
+		t.Errorf("inflight %d, want 2", inflight)
+	}
+}
+
+func TestConcurrencyLimitMetric(t *testing.T) {
+	be := testBackend(t, "vm", func(w http.ResponseWriter, r *http.Request) {})
+	b := New(Config{Backends: []Backend{be, be}, ConcurrencyMin: 3, ConcurrencyMax: 10})
+	body := readBody(t, serveOnce(b, httptest.NewRequest(http.MethodGet, "/metrics", nil)))
+	if !strings.Contains(body, `broker_concurrency_limit{backend="vm"} 3`) {
+		t.Errorf("/metrics lacks the starting limit:\n%s", body)
+	}
+}
+
+func TestGeoHintPicksNearestBackend(t *testing.T) {
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	east := testBackend(t, "us-east", ok)
+	east.Region, east.Location = "us-east1", &LatLng{Lat: 33.8, Lng: -84.4}
+	europe := testBackend(t, "europe", ok)
+	europe.Region, europe.Location = "europe-west1", &LatLng{Lat: 50.4, Lng: 3.8}
+	// Round robin starts at the second backend
+	b := New(Config{Backends: []Backend{europe, east}})
+
+	send := func(hint string) string {
+		req := httptest.NewRequest(http.MethodGet, "/x", nil)
+		if hint != "" {
+			req.Header.Set(ClientLatLngHeader, hint)
+		}
+		return serveOnce(b, req).Header.Get("X-Selected-Backend")
+	}
+	for hint, want := range map[string]string{
+		"40.4,-3.7":     "europe",  // Madrid
+		"40.7, -74.0":   "us-east", // New York
+		"52.5,13.4":     "europe",  // Berlin
+		"19.4,-99.1":    "us-east", // Mexico City
+		"-33.9, 151.2 ": "us-east", // Sydney, a bit closer to Atlanta
+	} {
+		for range 2 {
+			if got := send(hint); got != want {
+				t.Errorf("hint %q routed to %s, want %s", hint, got, want)
+			}
+		}
+	}
+
+	// Missing or invalid hints fall back to round robin
+	var got []string
+	for _, hint := range []string{"", "nowhere", "91,0", ""} {
+		got = append(got, send(hint))
+	}
+	if !slices.Equal(got, []string{"us-east", "europe", "us-east", "europe"}) {
+		t.Errorf("without a valid hint: %v, want round robin", got)
+	}
+
+	// Madrid to Paris is ~1050km
+	if d := DistanceKm(LatLng{40.4, -3.7}, LatLng{48.85, 2.35}); math.Abs(d-1053) > 10 {
+		t.Errorf("DistanceKm(Madrid, Paris) = %.0f", d)
+	}
+}
+
+func TestFailoverStatuses(t *testing.T) {
+	var secondHits atomic.Int64
+	first := testBackend(t, "first", func(w http.ResponseWriter, r *http.Request) {
+		status, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/x/"))
+		w.WriteHeader(status)
+		fmt.Fprintf(w, "first %d", status)
+	})
+	second := testBackend(t, "second", func(w http.ResponseWriter, r *http.Request) {
+		secondHits.Add(1)
+		_, _ = w.Write([]byte("second"))
+	})
+
+	for _, tc := range []struct {
+		statuses []int
+		status   int
+		failover bool
+	}{
+		{nil, http.StatusBadGateway, true},
+		{nil, http.StatusServiceUnavailable, true},
+		{nil, http.StatusTooManyRequests, false},
+		{nil, http.StatusInternalServerError, false},
+		{[]int{429, 500}, http.StatusTooManyRequests, true},
+		{[]int{429, 500}, http.StatusInternalServerError, true},
+		{[]int{429, 500}, http.StatusBadRequest, false},
+		{[]int{429, 500}, http.StatusBadGateway, false},
+	} {
+		b := New(Config{Backends: []Backend{first, second}, FailoverStatuses: tc.statuses})
+		b.rr.Store(1) // the next pick is first
+		before := secondHits.Load()
+		resp := serveOnce(b, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/x/%d", tc.status), nil))
+		body := readBody(t, resp)
+		if failedOver := secondHits.Load() > before; failedOver != tc.failover {
+			t.Errorf("statuses %v, first answers %d: failed over %t, want %t", tc.statuses, tc.status, failedOver, tc.failover)
+		}
+		if !tc.failover && (resp.StatusCode != tc.status || body != fmt.Sprintf("first %d", tc.status)) {
+			t.Errorf("statuses %v: got %d %q, want the first backend's %d", tc.statuses, resp.StatusCode, body, tc.status)
+		}
+	}
+}
+
+func TestResponseHeaderFilter(t *testing.T) {
+	be := testBackend(t, "vm", func(w http.ResponseWriter, r *http.Request) {
+		for _, h := range []string{"X-Internal-Host", "X-Internal-Trace", "X-Request-Id", "Cache-Control", "X-Other"} {
+			w.Header().Set(h, "1")
+		}
+		w.Header().Set("Content-Type", "application/json")
+	})
+	send := func(allow, deny []string) http.Header {
+		b := New(Config{Backends: []Backend{be, be}, ResponseHeaderAllow: allow, ResponseHeaderDeny: deny})
+		return serveOnce(b, httptest.NewRequest(http.MethodGet, "/x", nil)).Header
+	}
+
+	for _, tc := range []struct {
+		name        string
+		allow, deny []string
+		kept        []string
+		dropped     []string
+	}{
+		{"no filter", nil, nil, []string{"X-Internal-Host", "X-Other", "Cache-Control"}, nil},
+		{"deny prefix", nil, []string{"x-internal-*"}, []string{"X-Request-Id", "X-Other"}, []string{"X-Internal-Host", "X-Internal-Trace"}},
+		{"allow list", []string{"Content-Type", "cache-control", "X-Request-*"}, nil, []string{"Content-Type", "Cache-Control", "X-Request-Id"}, []string{"X-Internal-Host", "X-Other"}},
+		{"deny wins", []string{"X-*"}, []string{"X-Internal-Trace"}, []string{"X-Internal-Host", "X-Other"}, []string{"X-Internal-Trace", "Cache-Control"}},
+	} {
+		h := send(tc.allow, tc.deny)
+		for _, k := range tc.kept {
+			if h.Get(k) == "" {
+				t.Errorf("%s: %s dropped", tc.name, k)
+			}
+		}
+		for _, k := range tc.dropped {
+			if v := h.Get(k); v != "" {
+				t.Errorf("%s: %s = %q passed", tc.name, k, v)
+			}
+		}
+		if h.Get("X-Selected-Backend") != "vm" || h.Get("X-Selected-URL") == "" {
+			t.Errorf("%s: broker's X-Selected-* headers filtered: %v", tc.name, h)
+		}
+	}
+}
+
+func TestConcurrencyQueue(t *testing.T) {
+	l := newConcurrencyLimiter(1, 1)
+	l.queueMax, l.queueWait = 2, time.Second
+	ctx := context.Background()
+	if !l.acquire(ctx, true) {
+		t.Fatal("first acquire refused")
+	}
+
+	// Two requests queue in FIFO order; a third finds the queue full
+	order := make(chan int, 2)
+	for i := range 2 {
+		go func() {
+			if l.acquire(ctx, true) {
+				order <- i
+			}
+		}()
+		waitFor(t, "request to queue", func() bool { _, _, q := l.snapshot(); return q == i+1 })
+	}
+	if l.acquire(ctx, true) {
+		t.Error("acquire with a full queue succeeded")
+	}
+	l.release(time.Millisecond)
+	if got := <-order; got != 0 {
+		t.Errorf("request %d served first, want 0", got)
+	}
+	l.release(time.Millisecond)
+	if got := <-order; got != 1 {
+		t.Errorf("request %d served second, want 1", got)
+	}
+
+	// A wait times out, and a cancelled request leaves the queue
+	l.queueWait = 20 * time.Millisecond
+	if l.acquire(ctx, true) {
+		t.Error("acquire past queueWait succeeded")
+	}
+	cctx, cancel := context.WithCancel(ctx)
+	l.queueWait = time.Minute
+	done := make(chan bool)
+	go func() { done <- l.acquire(cctx, true) }()
+	waitFor(t, "request to queue", func() bool { _, _, q := l.snapshot(); return q == 1 })
+	cancel()
+	if <-done {
+		t.Error("cancelled request got a slot")
+	}
+	if limit, inflight, queued := l.snapshot(); limit != 1 || inflight != 1 || queued != 0 {
+		t.Errorf("limit %d, inflight %d, queued %d; want 1, 1, 0", limit, inflight, queued)
+	}
+}
+
+func TestQueueAbsorbsBursts(t *testing.T) {
+	var delay atomic.Int64
+	delay.Store(int64(20 * time.Millisecond))
+	be := testBackend(t, "vm", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Duration(delay.Load()))
+	})
+	b := New(Config{Backends: []Backend{be, be}, ConcurrencyMin: 1, ConcurrencyMax: 1, QueueDepth: 4, QueueWait: time.Second})
+
+	burst := func(n int) map[int]int {
+		var mu sync.Mutex
+		codes := map[int]int{}
+		var wg sync.WaitGroup
+		for range n {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				code := serveOnce(b, httptest.NewRequest(http.MethodGet, "/x", nil)).StatusCode
+				mu.Lock()
+				codes[code]++
+				mu.Unlock()
+			}()
+		}
+		wg.Wait()
+		return codes
+	}
+
+	// Two backends with one slot each and room for a few more in line
+	if codes := burst(5); codes[http.StatusOK] != 5 {
+		t.Errorf("short burst: %v, want every request queued and served", codes)
+	}
+
+	// Far more, far slower requests than the queue can hold or wait for
+	delay.Store(int64(300 * time.Millisecond))
+	b = New(Config{Backends: []Backend{be, be}, ConcurrencyMin: 1, ConcurrencyMax: 1, QueueDepth: 2, QueueWait: 50 * time.Millisecond})
+	if codes := burst(12); codes[http.StatusServiceUnavailable] == 0 || codes[http.StatusOK] == 0 {
+		t.Errorf("sustained overload: %v, want some served and the rest 503", codes)
+	}
+}
+
+func TestPreserveHost(t *testing.T) {
+	var mu sync.Mutex
+	hosts := map[string]string{}
+	record := func(name string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			hosts[name] = r.Host
+			mu.Unlock()
+		}
+	}
+	rewritten := testBackend(t, "vm", record("vm"))
+	preserved := testBackend(t, "serverless", record("serverless"))
+	preserved.PreserveHost = true
+	b := New(Config{Backends: []Backend{rewritten, preserved}})
+
+	for range 2 {
+		req := httptest.NewRequest(http.MethodGet, "/x", nil)
+		req.Host = "api.example.com"
+		if resp := serveOnce(b, req); resp.StatusCode != http.StatusOK {
+			t.Fatalf("status %d", resp.StatusCode)
+		}
+	}
+	if hosts["vm"] != rewritten.BaseURL.Host {
+		t.Errorf("default backend got Host %q, want %q", hosts["vm"], rewritten.BaseURL.Host)
+	}
+	if hosts["serverless"] != "api.example.com" {
+		t.Errorf("PreserveHost backend got Host %q, want the client's", hosts["serverless"])
+	}
+}
+
+func TestStatusPage(t *testing.T) {
+	be := testBackend(t, "vm", func(w http.ResponseWriter, r *http.Request) {})
+	b := New(Config{Backends: []Backend{be, be}, AdminSecret: "s3cret", BreakerFailures: 3})
+
+	// The page itself is static; the data it polls needs the secret
+	resp := serveOnce(b, httptest.NewRequest(http.MethodGet, "/status", nil))
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/html; charset=utf-8" {
+		t.Fatalf("status %d, Content-Type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	page := readBody(t, resp)
+	for _, id := range []string{`id="routing"`, `id="backends"`, `id="error"`, `id="updated"`} {
+		if !strings.Contains(page, id) {
+			t.Errorf("page has no %s", id)
+		}
+	}
+	if strings.Contains(page, "<script src=") || strings.Contains(page, `<link rel="stylesheet"`) {
+		t.Error("page loads external assets")
+	}
+
+	_ = serveOnce(b, httptest.NewRequest(http.MethodGet, "/x", nil))
+	if resp := serveOnce(b, httptest.NewRequest(http.MethodGet, "/metrics", nil)); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("/metrics without the secret: status %d", resp.StatusCode)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set(AdminSecretHeader, "s3cret")
+	metrics := readBody(t, serveOnce(b, req))
+	for _, line := range []string{
+		`broker_backend_requests_total{backend="vm"} 1`,
+		`broker_backend_failures_total{backend="vm"} 0`,
+		`broker_breaker_state{backend="vm",state="closed"} 1`,
+	} {
+		if !strings.Contains(metrics, line+"\n") {
+			t.Errorf("/metrics has no %q", line)
+		}
+	}
+}
+
+func TestDuplicatePostLogged(t *testing.T) {
+	be := testBackend(t, "vm", func(w http.ResponseWriter, r *http.Request) {})
+	b := New(Config{Backends: []Backend{be, be}, DuplicateWindow: time.Second})
+	logged := captureLog(t)
+
+	post := func(body, client string) {
+		req := httptest.NewRequest(http.MethodPost, "/x/Average", strings.NewReader(body))
+		req.RemoteAddr = client + ":1234"
+		if resp := serveOnce(b, req); resp.StatusCode != http.StatusOK {
+			t.Errorf("POST from %s: status %d, duplicates must not be blocked", client, resp.StatusCode)
+		}
+	}
+	post(`{"points":[]}`, "10.0.0.1")
+	post(`{"points":[{"lat":1}]}`, "10.0.0.1") // different body
+	post(`{"points":[]}`, "10.0.0.2")          // different client
+	if strings.Contains(logged.String(), "duplicate POST") || b.dups.count.Load() != 0 {
+		t.Fatalf("distinct POSTs flagged:\n%s", logged)
+	}
+	post(`{"points":[]}`, "10.0.0.1")
+	if !strings.Contains(logged.String(), "duplicate POST /x/Average from 10.0.0.1: same 13-byte body") || b.dups.count.Load() != 1 {
+		t.Errorf("duplicate not logged (count %d):\n%s", b.dups.count.Load(), logged)
+	}
+
+	// Outside the window it's a new submission
+	_, dup := b.dups.check("10.0.0.1", "/x/Average", []byte(`{"points":[]}`), time.Now().Add(2*time.Second))
+	if dup {
+		t.Error("POST after the window flagged as a duplicate")
+	}
+}
+
+func TestVersionEndpoint(t *testing.T) {
+	defer func(rev, at string) { Revision, BuildTime = rev, at }(Revision, BuildTime)
+	Revision, BuildTime = "0123abc", "2024-01-02T03:04:05Z"
+	be := testBackend(t, "vm", func(w http.ResponseWriter, r *http.Request) {})
+	b := New(Config{Backends: []Backend{be, be}, AdminSecret: "s3cret"})
+
+	// Public, like /health
+	resp := serveOnce(b, httptest.NewRequest(http.MethodGet, "/version", nil))
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("status %d, Content-Type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	var v VersionInfo
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	if v.GoVersion != runtime.Version() || v.Revision != "0123abc" || v.BuildTime != "2024-01-02T03:04:05Z" {
+		t.Errorf("/version = %+v", v)
+	}
+
+	// Without link-time values, the VCS stamp when the binary has one
+	Revision, BuildTime = "", ""
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			if s.Key == "vcs.revision" && Version().Revision != s.Value {
+				t.Errorf("revision %q, want the build info's %q", Version().Revision, s.Value)
+			}
+		}
+	}
+}
+
+func TestSLOBreach(t *testing.T) {
+	var delay atomic.Int64
+	be := testBackend(t, "vm", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Duration(delay.Load()))
+	})
+	b := New(Config{Backends: []Backend{be, be}, SLOTarget: 20 * time.Millisecond})
+	health := func() (int, string) {
+		resp := serveOnce(b, httptest.NewRequest(http.MethodGet, "/health", nil))
+		return resp.StatusCode, readBody(t, resp)
+	}
+	breached := func() string {
+		metrics := readBody(t, serveOnce(b, httptest.NewRequest(http.MethodGet, "/metrics", nil)))
+		for _, line := range strings.Split(metrics, "\n") {
+			if v, ok := strings.CutPrefix(line, "broker_slo_breached "); ok {
+				return v
+			}
+		}
+		t.Fatalf("/metrics has no broker_slo_breached:\n%s", metrics)
+		return ""
+	}
+
+	for range SLOMinSamples {
+		_ = serveOnce(b, httptest.NewRequest(http.MethodGet, "/x", nil))
+	}
+	if code, body := health(); code != http.StatusOK || body != "ok" || breached() != "0" {
+		t.Errorf("fast responses: /health %d %q, breached %s", code, body, breached())
+	}
+
+	delay.Store(int64(30 * time.Millisecond))
+	for range SLOMinSamples {
+		_ = serveOnce(b, httptest.NewRequest(http.MethodGet, "/x", nil))
+	}
+	code, body := health()
+	if code != http.StatusOK || !strings.HasPrefix(body, "degraded: p99 ") || !strings.HasSuffix(body, "exceeds SLO 20ms") || breached() != "1" {
+		t.Errorf("slow responses: /health %d %q, breached %s", code, body, breached())
+	}
+}
+
+func TestLatencyWindow(t *testing.T) {
+	now := time.Now()
+	lw := newLatencyWindow(time.Minute)
+	for i := range SLOMinSamples - 1 {
+		lw.record(time.Duration(i+1)*time.Millisecond, now)
+	}
+	// Too few samples to judge
+	if _, breached := lw.breached(time.Millisecond, now); breached {
+		t.Error("breached with fewer than SLOMinSamples")
+	}
+	lw.record(time.Second, now)
+	if p99, breached := lw.breached(time.Millisecond, now); p99 != 9*time.Millisecond || !breached {
+		t.Errorf("p99 %s, breached %t; want 9ms and true", p99, breached)
+	}
+
+	// Samples age out of the window, and the ring keeps only the newest
+	if _, n := lw.p99(now.Add(time.Minute)); n != 0 {
+		t.Errorf("%d samples a window later, want 0", n)
+	}
+	for range SLOMaxSamples {
+		lw.record(time.Millisecond, now.Add(time.Second))
+	}
+	if p99, n := lw.p99(now.Add(time.Second)); p99 != time.Millisecond || n != SLOMaxSamples {
+		t.Errorf("p99 %s over %d samples, want 1ms over %d", p99, n, SLOMaxSamples)
+	}
+	var nilWindow *latencyWindow
+	nilWindow.record(time.Second, now)
+	if _, breached := nilWindow.breached(0, now); breached {
+		t.Error("nil window breached")
+	}
+}
+
+func TestFirstBackend(t *testing.T) {
+	named := func(name string, weight int) Backend {
+		be := testBackend(t, name, func(w http.ResponseWriter, r *http.Request) { _, _ = w.Write([]byte(name)) })
+		be.Weight = weight
+		return be
+	}
+	a, bb, c := named("a", 0), named("b", 0), named("c", 0)
+	order := func(b *Broker, n int) []string {
+		var got []string
+		for range n {
+			got = append(got, readBody(t, serveOnce(b, httptest.NewRequest(http.MethodGet, "/x", nil))))
+		}
+		return got
+	}
+
+	for first, want := range map[string][]string{
+		"a": {"a", "b", "c", "a"},
+		"b": {"b", "c", "a", "b"},
+		"c": {"c", "a", "b", "c"},
+	} {
+		b := New(Config{Backends: []Backend{a, bb, c}, FirstBackend: first})
+		if got := order(b, 4); !slices.Equal(got, want) {
+			t.Errorf("FirstBackend %s: routed %v, want %v", first, got, want)
+		}
+	}
+
+	// An unknown name keeps the usual start, and weighted schedules honour it too
+	usual := order(New(Config{Backends: []Backend{a, bb, c}}), 3)
+	if got := order(New(Config{Backends: []Backend{a, bb, c}, FirstBackend: "nope"}), 3); !slices.Equal(got, usual) {
+		t.Errorf("unknown FirstBackend: routed %v, want %v", got, usual)
+	}
+	heavy := named("heavy", 3)
+	b := New(Config{Backends: []Backend{named("light", 1), heavy}, FirstBackend: "light"})
+	if got := order(b, 1); got[0] != "light" {
+		t.Errorf("weighted: first request went to %s", got[0])
+	}
+}
+
+func TestOutageBackoff(t *testing.T) {
+	var down atomic.Bool
+	var attempts atomic.Int64
+	down.Store(true)
+	be := testBackend(t, "vm", func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		if down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+	b := New(Config{Backends: []Backend{be, be}, OutageThreshold: 3, OutageWindow: time.Minute, OutageBackoff: 200 * time.Millisecond})
+	_ = captureLog(t)
+	get := func() *http.Response { return serveOnce(b, httptest.NewRequest(http.MethodGet, "/x", nil)) }
+
+	// Every backend is tried until the threshold
+	for i := range 3 {
+		if resp := get(); resp.StatusCode == http.StatusOK || resp.Header.Get("Retry-After") != "" {
+			t.Errorf("request %d: status %d, Retry-After %q", i, resp.StatusCode, resp.Header.Get("Retry-After"))
+		}
+	}
+	if n := attempts.Load(); n != 6 {
+		t.Fatalf("%d backend attempts, want 6", n)
+	}
+
+	// Then requests fail fast without an attempt
+	for range 5 {
+		resp := get()
+		if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") != "1" {
+			t.Errorf("during the backoff: status %d, Retry-After %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+		}
+	}
+	if n := attempts.Load(); n != 6 || b.outage.fastFails.Load() != 5 {
+		t.Errorf("%d attempts and %d fast fails during the backoff, want 6 and 5", n, b.outage.fastFails.Load())
+	}
+
+	// Once it expires the next request probes; a recovered backend clears it
+	time.Sleep(250 * time.Millisecond)
+	down.Store(false)
+	if resp := get(); resp.StatusCode != http.StatusOK {
+		t.Fatalf("after the backoff: status %d", resp.StatusCode)
+	}
+	down.Store(true)
+	if resp := get(); resp.Header.Get("Retry-After") != "" || attempts.Load() != 9 {
+		t.Errorf("after recovery: Retry-After %q with %d attempts; want the count cleared", resp.Header.Get("Retry-After"), attempts.Load())
+	}
+}
+
+func TestJoinURL(t *testing.T) {
+	for _, tc := range []struct {
+		base, path, query, want string
+	}{
+		{"http://vm:8080", "/geo_average", "", "http://vm:8080/geo_average"},
+		{"http://vm:8080/", "/geo_average", "a=1", "http://vm:8080/geo_average?a=1"},
+		{"http://vm:8080", "", "", "http://vm:8080/"},
+		{"https://fn.example.com/Average", "/", "", "https://fn.example.com/Average/"},
+		{"https://fn.example.com/Average/", "/geo_average", "", "https://fn.example.com/Average/geo_average"},
+		{"https://fn.example.com/api", "", "q=1", "https://fn.example.com/api/?q=1"},
+		// joinURL forwards paths as given; cleaning is NormalizePaths' job
+		{"http://vm:8080", "/a//b", "", "http://vm:8080/a//b"},
+		{"http://vm:8080", "/a/../b", "", "http://vm:8080/a/../b"},
+	} {
+		base, err := url.Parse(tc.base)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := joinURL(base, tc.path, tc.query); got != tc.want {
+			t.Errorf("joinURL(%s, %q, %q) = %s, want %s", tc.base, tc.path, tc.query, got, tc.want)
+		}
+	}
+}
+
+func TestCleanPath(t *testing.T) {
+	for in, want := range map[string]string{
+		"":                "/",
+		"/":               "/",
+		"a/b":             "/a/b",
+		"/a//b":           "/a/b",
+		"/a/../b":         "/b",
+		"/a/./b/":         "/a/b/",
+		"/../../etc":      "/etc",
+		"//geo_average//": "/geo_average/",
+	} {
+		if got := cleanPath(in); got != want {
+			t.Errorf("cleanPath(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestNormalizePaths(t *testing.T) {
+	be := testBackend(t, "vm", func(w http.ResponseWriter, r *http.Request) { _, _ = w.Write([]byte(r.URL.Path)) })
+
+	// By default ServeMux redirects to the clean path
+	b := New(Config{Backends: []Backend{be, be}})
+	if resp := serveOnce(b, httptest.NewRequest(http.MethodGet, "/x//a/../b", nil)); resp.StatusCode != http.StatusTemporaryRedirect {
+		t.Errorf("without NormalizePaths: status %d, want a redirect", resp.StatusCode)
+	}
+
+	b = New(Config{Backends: []Backend{be, be}, NormalizePaths: true})
+	for in, want := range map[string]string{"/x//a/../b": "/x/b", "/x/./y/": "/x/y/", "/x": "/x"} {
+		resp := serveOnce(b, httptest.NewRequest(http.MethodGet, in, nil))
+		if got := readBody(t, resp); resp.StatusCode != http.StatusOK || got != want {
+			t.Errorf("%s: status %d, backend got %q; want %q", in, resp.StatusCode, got, want)
+		}
+	}
+	// Admin routes match after cleaning too
+	if resp := serveOnce(b, httptest.NewRequest(http.MethodGet, "//health", nil)); readBody(t, resp) != "ok" {
+		t.Errorf("//health: status %d", resp.StatusCode)
+	}
+}
+
+func TestEventsStream(t *testing.T) {
+	be := testBackend(t, "vm", func(w http.ResponseWriter, r *http.Request) {})
+	b := New(Config{Backends: []Backend{be, be}, BreakerFailures: 3, SLOTarget: time.Second})
+	_ = serveOnce(b, httptest.NewRequest(http.MethodGet, "/x", nil))
+	srv := httptest.NewServer(b.Handler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type %q", ct)
+	}
+
+	sc := bufio.NewScanner(resp.Body)
+	var events []statusEvent
+	for len(events) < 2 && sc.Scan() {
+		data, ok := strings.CutPrefix(sc.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var ev statusEvent
+		if err := json.Unmarshal([]byte(data), &ev); err != nil {
+			t.Fatalf("event %q: %v", data, err)
+		}
+		events = append(events, ev)
+	}
+	if len(events) != 2 {
+		t.Fatalf("read %d events: %v", len(events), sc.Err())
+	}
+	if gap := events[1].Time.Sub(events[0].Time); gap < EventsInterval/2 {
+		t.Errorf("events %s apart, want about %s", gap, EventsInterval)
+	}
+	ev := events[1]
+	if len(ev.Backends) != 2 || ev.Backends[0].Name != "vm" || ev.Backends[0].Breaker != "closed" ||
+		ev.Backends[0].Requests+ev.Backends[1].Requests != 1 || ev.SLOBreached {
+		t.Errorf("event %+v", ev)
+	}
+}
+
+func TestBackendDurationHeader(t *testing.T) {
+	bad := testBackend(t, "bad", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	slow := testBackend(t, "slow", func(w http.ResponseWriter, r *http.Request) { time.Sleep(50 * time.Millisecond) })
+
+	// After failover the header times the backend that answered
+	b := New(Config{Backends: []Backend{bad, slow}, FirstBackend: "bad", BackendDuration: true})
+	resp := serveOnce(b, httptest.NewRequest(http.MethodGet, "/x", nil))
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Selected-Backend") != "slow" {
+		t.Fatalf("status %d from %q", resp.StatusCode, resp.Header.Get("X-Selected-Backend"))
+	}
+	ms, err := strconv.ParseFloat(resp.Header.Get(BackendDurationHeader), 64)
+	if err != nil || ms < 50 || ms >= 200 {
+		t.Errorf("%s = %q, want the slow backend's 50ms or so", BackendDurationHeader, resp.Header.Get(BackendDurationHeader))
+	}
+
+	b = New(Config{Backends: []Backend{slow, slow}})
+	if h := serveOnce(b, httptest.NewRequest(http.MethodGet, "/x", nil)).Header.Get(BackendDurationHeader); h != "" {
+		t.Errorf("%s = %q without BackendDuration", BackendDurationHeader, h)
+	}
+}
+
+func TestDrainBackend(t *testing.T) {
+	arrived, release := make(chan struct{}, 1), make(chan struct{})
+	slow := testBackend(t, "slow", func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		<-release
+		_, _ = w.Write([]byte("slow"))
+	})
+	other := testBackend(t, "other", func(w http.ResponseWriter, r *http.Request) { _, _ = w.Write([]byte("other")) })
+	b := New(Config{Backends: []Backend{slow, other}, FirstBackend: "slow"})
+	admin := func(method, query string) (int, backendStatus) {
+		resp := serveOnce(b, httptest.NewRequest(method, "/backends"+query, nil))
+		var st backendStatus
+		if resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(&st); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp.StatusCode, st
+	}
+
+	done := make(chan *http.Response)
+	go func() { done <- serveOnce(b, httptest.NewRequest(http.MethodGet, "/x", nil)) }()
+	<-arrived
+
+	// Out of rotation at once, but "draining" while its request runs
+	if code, st := admin(http.MethodPost, "?drain=slow"); code != http.StatusOK || st.State != "draining" || st.Inflight != 1 {
+		t.Errorf("drain: status %d, %+v; want draining with 1 in flight", code, st)
+	}
+	for range 3 {
+		if body := readBody(t, serveOnce(b, httptest.NewRequest(http.MethodGet, "/x", nil))); body != "other" {
+			t.Errorf("request went to %q while slow drains", body)
+		}
+	}
+
+	close(release)
+	if resp := <-done; readBody(t, resp) != "slow" {
+		t.Error("in-flight request didn't complete on the draining backend")
+	}
+	resp := serveOnce(b, httptest.NewRequest(http.MethodGet, "/backends", nil))
+	var list []backendStatus
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0] != (backendStatus{Name: "slow", URL: slow.BaseURL.String(), State: "drained"}) || list[1].State != "active" {
+		t.Errorf("after the request finished: %+v", list)
+	}
+
+	if code, st := admin(http.MethodPost, "?undrain=slow"); code != http.StatusOK || st.State != "active" {
+		t.Errorf("undrain: status %d, %+v", code, st)
+	}
+	if code, _ := admin(http.MethodPost, "?drain=nope"); code != http.StatusNotFound {
+		t.Errorf("unknown backend: status %d", code)
+	}
+	if code, _ := admin(http.MethodDelete, ""); code != http.StatusMethodNotAllowed {
+		t.Errorf("DELETE: status %d", code)
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	var retried atomic.Int64
+	down := testBackend(t, "down", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	up := testBackend(t, "up", func(w http.ResponseWriter, r *http.Request) {
+		retried.Add(1)
+		_, _ = w.Write([]byte("ok"))
+	})
+	b := New(Config{
+		Backends:             []Backend{down, up},
+		AllowBackendOverride: true,
+		RetryBudget:          0.5,
+		RetryBudgetBurst:     1,
+	})
+	get := func() (int, string) {
+		resp := serveOnce(b, httptest.NewRequest(http.MethodGet, "/x?__backend=down", nil))
+		return resp.StatusCode, readBody(t, resp)
+	}
+
+	// The saved token pays for the first request's retry
+	if code, body := get(); code != http.StatusOK || body != "ok" {
+		t.Fatalf("first request: got %d %q, want 200 from the retry", code, body)
+	}
+	// The next earns half a token, not enough for a retry
+	if code, _ := get(); code != http.StatusServiceUnavailable {
+		t.Fatalf("second request: got %d, want the primary's 503", code)
+	}
+	// The one after that completes a token again
+	if code, _ := get(); code != http.StatusOK {
+		t.Fatalf("third request: got %d, want 200 from the retry", code)
+	}
+	if n := retried.Load(); n != 2 {
+		t.Errorf("second backend got %d requests, want 2", n)
+	}
+	if n := b.retries.denied.Load(); n != 1 {
+		t.Errorf("denied = %d, want 1", n)
+	}
+
+	// Skipping a backend that never got the request is not a retry
+	b.retries.tokens = 0
+	b.backends[0].stats.draining.Store(true)
+	if code, _ := get(); code != http.StatusOK {
+		t.Errorf("with down drained: got %d, want 200", code)
+	}
+
+	rec := httptest.NewRecorder()
+	b.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.Contains(rec.Body.String(), "broker_retries_denied_total 1\n") {
+		t.Errorf("metrics lack the denied retries:\n%s", rec.Body)
+	}
+}
+
+func TestHooks(t *testing.T) {
+	var hits atomic.Int64
+	down := testBackend(t, "down", func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	up := testBackend(t, "up", func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		_, _ = io.WriteString(w, "hello "+r.Header.Get("X-Tenant"))
+	})
+	var mu sync.Mutex
+	var served []string
+	b := New(Config{
+		Backends:         []Backend{down, up},
+		FirstBackend:     "down",
+		FailoverStatuses: []int{503},
+		BeforeDispatch: func(w http.ResponseWriter, r *http.Request) bool {
+			if r.Header.Get("Authorization") == "" {
+				http.Error(w, "who are you", http.StatusUnauthorized)
+				return false
+			}
+			r.Header.Set("X-Tenant", "acme")
+			return true
+		},
+		AfterResponse: func(backend string, r *http.Request, resp *http.Response) {
+			mu.Lock()
+			served = append(served, backend)
+			mu.Unlock()
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body = io.NopCloser(strings.NewReader(strings.ToUpper(string(body))))
+			resp.Header.Del("Content-Length")
+			resp.Header.Set("X-Hooked", r.URL.Path)
+		},
+	})
+
+	// Short-circuited before any backend
+	resp := serveOnce(b, httptest.NewRequest(http.MethodGet, "/x", nil))
+	if resp.StatusCode != http.StatusUnauthorized || hits.Load() != 0 || len(served) != 0 {
+		t.Errorf("without auth: status %d, %d backend hits, after-response for %v", resp.StatusCode, hits.Load(), served)
+	}
+
+	// Seen once, for the backend that answered after failover
+	req := httptest.NewRequest(http.MethodGet, "/x", nil)
+	req.Header.Set("Authorization", "Bearer t")
+	resp = serveOnce(b, req)
+	if body := readBody(t, resp); resp.StatusCode != http.StatusOK || body != "HELLO ACME" || resp.Header.Get("X-Hooked") != "/x" {
+		t.Errorf("status %d, X-Hooked %q, body %q; want the rewritten response", resp.StatusCode, resp.Header.Get("X-Hooked"), body)
+	}
+	if hits.Load() != 2 || !slices.Equal(served, []string{"up"}) {
+		t.Errorf("%d backend hits, after-response for %v; want 2 and [up]", hits.Load(), served)
+	}
+
+	// Admin endpoints bypass the hooks
+	if resp := serveOnce(b, httptest.NewRequest(http.MethodGet, "/backends", nil)); resp.StatusCode != http.StatusOK {
+		t.Errorf("/backends: status %d", resp.StatusCode)
+	}
+}
+
+func TestStreamedResponse(t *testing.T) {
+	release := make(chan struct{})
+	stream := testBackend(t, "stream", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "first\n")
+		http.NewResponseController(w).Flush()
+		<-release
+		_, _ = io.WriteString(w, "second\n")
+	})
+	fixed := testBackend(t, "fixed", func(w http.ResponseWriter, r *http.Request) { _, _ = io.WriteString(w, "whole") })
+	srv := httptest.NewServer(New(Config{Backends: []Backend{stream, fixed}, FirstBackend: "stream"}).Handler())
+	defer srv.Close()
+
+	resp, err := srv.Client().Get(srv.URL + "/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.ContentLength != -1 || !slices.Equal(resp.TransferEncoding, []string{"chunked"}) {
+		t.Errorf("Content-Length %d, Transfer-Encoding %v; want a chunked response", resp.ContentLength, resp.TransferEncoding)
+	}
+	// The first chunk arrives while the backend still holds the rest
+	br := bufio.NewReader(resp.Body)
+	if line, err := br.ReadString('\n'); err != nil || line != "first\n" {
+		t.Fatalf("first chunk %q, %v", line, err)
+	}
+	close(release)
+	if rest, _ := io.ReadAll(br); string(rest) != "second\n" {
+		t.Errorf("rest %q", rest)
+	}
+
+	// A response of known length keeps it
+	resp, err = srv.Client().Get(srv.URL + "/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(t, resp); body != "whole" || resp.ContentLength != 5 {
+		t.Errorf("fixed response: %q with Content-Length %d", body, resp.ContentLength)
+	}
+}
+
+func TestInvalidGzipFailsOverWithoutLeakingHeaders(t *testing.T) {
+	bad := testBackend(t, "bad", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("X-From-Bad", "1")
+		_, _ = w.Write([]byte("not gzip"))
+	})
+	good := testBackend(t, "good", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	})
+	b := New(Config{Backends: []Backend{bad, good}, FirstBackend: "bad"})
+
+	req := httptest.NewRequest(http.MethodGet, "/x", nil)
+	req.Header.Set("Accept-Encoding", "identity")
+	resp := serveOnce(b, req)
+
+	if resp.StatusCode != http.StatusOK || readBody(t, resp) != "ok" {
+		t.Fatalf("got %d, want 200 ok from the second backend", resp.StatusCode)
+	}
+	if got := resp.Header.Get("X-Selected-Backend"); got != "good" {
+		t.Errorf("X-Selected-Backend = %q, want good", got)
+	}
+	for _, h := range []string{"Content-Encoding", "X-From-Bad"} {
+		if v := resp.Header.Get(h); v != "" {
+			t.Errorf("%s = %q leaked from the failed backend", h, v)
+		}
+	}
+	if strings.Contains(resp.Header.Get("X-Selected-URL"), bad.BaseURL.Host) {
+		t.Errorf("X-Selected-URL points at the failed backend")
+	}
+}
+
+func TestRetryBudgetExhaustedReturnsOriginalFailure(t *testing.T) {
+	var retried atomic.Int64
+	down := testBackend(t, "down", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte("down for maintenance"))
+	})
+	up := testBackend(t, "up", func(w http.ResponseWriter, r *http.Request) {
+		retried.Add(1)
+		_, _ = w.Write([]byte("ok"))
+	})
+	b := New(Config{
+		Backends:             []Backend{down, up},
+		AllowBackendOverride: true,
+		RetryBudget:          0.01,
+		RetryBudgetBurst:     1,
+	})
+
+	// The saved token pays for the first request's retry
+	resp := serveOnce(b, httptest.NewRequest(http.MethodGet, "/x?__backend=down", nil))
+	if resp.StatusCode != http.StatusOK || readBody(t, resp) != "ok" {
+		t.Fatalf("first request: got %d, want 200 from the retry", resp.StatusCode)
+	}
+
+	// Then the budget is spent: the primary's own failure comes back as is
+	for range 3 {
+		resp := serveOnce(b, httptest.NewRequest(http.MethodGet, "/x?__backend=down", nil))
+		if body := readBody(t, resp); resp.StatusCode != http.StatusServiceUnavailable || body != "down for maintenance" {
+			t.Fatalf("got %d %q, want the primary's 503", resp.StatusCode, body)
+		}
+		if got := resp.Header.Get("X-Selected-Backend"); got != "down" {
+			t.Errorf("X-Selected-Backend = %q, want down", got)
+		}
+	}
+	if n := retried.Load(); n != 1 {
+		t.Errorf("second backend got %d requests, want 1 (no retries once the budget is spent)", n)
+	}
+	if n := b.retries.denied.Load(); n != 3 {
+		t.Errorf("denied = %d, want 3", n)
+	}
+}
+
+func TestRetryBudgetExhaustedWithoutResponse(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close() // nothing listens there any more
+	u, _ := url.Parse(srv.URL)
+	gone := Backend{Name: "gone", BaseURL: u, Transport: http.DefaultTransport}
+	var retried atomic.Int64
+	up := testBackend(t, "up", func(w http.ResponseWriter, r *http.Request) {
+		retried.Add(1)
+	})
+	b := New(Config{Backends: []Backend{gone, up}, AllowBackendOverride: true, RetryBudget: 0.01, RetryBudgetBurst: 1})
+
+	_ = serveOnce(b, httptest.NewRequest(http.MethodGet, "/x?__backend=gone", nil))
+	resp := serveOnce(b, httptest.NewRequest(http.MethodGet, "/x?__backend=gone", nil))
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("got %d, want 502 when the failed backend gave no response", resp.StatusCode)
+	}
+	if n := retried.Load(); n != 1 {
+		t.Errorf("second backend got %d requests, want 1", n)
+	}
+}
+
+func TestClientIPIgnoresSpoofedForwardedFor(t *testing.T) {
+	_, lb, _ := net.ParseCIDR("10.0.0.0/8")
+	l := newRateLimiter(1, 1, []*net.IPNet{lb})
+
+	tests := []struct {
+		remote, xff, want string
+	}{
+		{"198.51.100.7:1", "203.0.113.9", "198.51.100.7"},               // untrusted peer: XFF ignored
+		{"10.0.0.1:1", "203.0.113.9", "203.0.113.9"},                    // one trusted proxy
+		{"10.0.0.1:1", "1.2.3.4, 203.0.113.9", "203.0.113.9"},           // client-supplied entry on the left
+		{"10.0.0.1:1", "1.2.3.4, 203.0.113.9, 10.0.0.2", "203.0.113.9"}, // chain of trusted proxies
+		{"10.0.0.1:1", "10.0.0.3, 10.0.0.2", "10.0.0.3"},                // only trusted hops
+		{"10.0.0.1:1", "", "10.0.0.1"},                                  // no header
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = tt.remote
+		if tt.xff != "" {
+			req.Header.Set("X-Forwarded-For", tt.xff)
+		}
+		if got := l.clientIP(req); got != tt.want {
+			t.Errorf("clientIP(%s, XFF %q) = %q, want %q", tt.remote, tt.xff, got, tt.want)
+		}
+	}
+
+	// A fresh spoofed leftmost entry per request must not get a fresh bucket
+	be := testBackend(t, "vm", func(w http.ResponseWriter, r *http.Request) {})
+	b := New(Config{Backends: []Backend{be, be}, RateLimit: 1, RateBurst: 1, TrustedProxies: []*net.IPNet{lb}})
+	codes := make([]int, 3)
+	for i := range codes {
+		req := httptest.NewRequest(http.MethodGet, "/x", nil)
+		req.RemoteAddr = "10.0.0.1:1"
+		req.Header.Set("X-Forwarded-For", fmt.Sprintf("192.0.2.%d, 203.0.113.9", i))
+		codes[i] = serveOnce(b, req).StatusCode
+	}
+	if codes[1] != http.StatusTooManyRequests || codes[2] != http.StatusTooManyRequests {
+		t.Errorf("statuses %v: spoofed X-Forwarded-For entries got fresh buckets", codes)
+	}
+}
+
+func TestTracingSpans(t *testing.T) {
+	var forwarded string
+	vm := testBackend(t, "vm", func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header.Get(tracing.TraceparentHeader)
+		w.WriteHeader(http.StatusCreated)
+	})
+	exp := new(tracing.InMemoryExporter)
+	tracer := tracing.New(exp, tracing.Config{Sample: 1})
+	b := New(Config{Backends: []Backend{vm, vm}, Tracer: tracer})
+
+	req := httptest.NewRequest(http.MethodPost, "/geo_average", strings.NewReader("{}"))
+	req.Header.Set(tracing.TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if resp := serveOnce(b, req); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("got %d, want 201", resp.StatusCode)
+	}
+	if err := tracer.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := exp.Spans()
+	if len(spans) != 2 {
+		t.Fatalf("exported %d spans, want a client and a server span", len(spans))
+	}
+	client, server := spans[0], spans[1]
+	if server.Name != "broker POST" || server.Kind != tracing.SpanKindServer {
+		t.Errorf("server span = %s kind %d", server.Name, server.Kind)
+	}
+	if server.Attrs["broker.backend"] != "vm" || server.Attrs["http.response.status_code"] != http.StatusCreated || server.Attrs["url.path"] != "/geo_average" {
+		t.Errorf("server span attributes = %v", server.Attrs)
+	}
+	if client.Name != "backend vm" || client.Kind != tracing.SpanKindClient || client.Attrs["broker.backend"] != "vm" {
+		t.Errorf("client span = %s kind %d attributes %v", client.Name, client.Kind, client.Attrs)
+	}
+	if client.TraceID != server.TraceID || client.ParentID != server.SpanID {
+		t.Error("backend span is not a child of the request span")
+	}
+	if want := "00-4bf92f3577b34da6a3ce929d0e0e4736-" + fmt.Sprintf("%x", client.SpanID) + "-01"; forwarded != want {
+		t.Errorf("backend got traceparent %q, want %q", forwarded, want)
+	}
+}
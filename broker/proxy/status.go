@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	EventsInterval     = time.Second
+	EventsWriteTimeout = 5 * time.Second // a client this slow to read is dropped
+)
+
+//go:embed status.html
+var statusPage []byte
+
+// handleStatus serves the self-contained status dashboard.
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	_, _ = w.Write(statusPage)
+}
+
+// statusEvent is one /events message.
+type statusEvent struct {
+	Time        time.Time      `json:"time"`
+	Backends    []backendEvent `json:"backends"`
+	P99Ms       float64        `json:"p99_ms,omitempty"` // rolling, only with an SLO
+	SLOBreached bool           `json:"slo_breached,omitempty"`
+}
+
+type backendEvent struct {
+	Name     string  `json:"name"`
+	Requests uint64  `json:"requests"`
+	Failures uint64  `json:"failures"`
+	Breaker  string  `json:"breaker"` // closed, open, half_open or disabled
+	Inflight int     `json:"inflight,omitempty"`
+	P99Ms    float64 `json:"p99_ms,omitempty"`
+}
+
+func (b *Broker) statusEvent(now time.Time) statusEvent {
+	ev := statusEvent{Time: now}
+	for _, be := range b.backends {
+		bev := backendEvent{
+			Name:     be.Name,
+			Requests: be.stats.requests.Load(),
+			Failures: be.stats.failures.Load(),
+			Breaker:  be.state.status(now),
+		}
+		if be.conc != nil {
+			_, bev.Inflight, _ = be.conc.snapshot()
+		}
+		p99, _ := be.slo.p99(now)
+		bev.P99Ms = float64(p99) / float64(time.Millisecond)
+		ev.Backends = append(ev.Backends, bev)
+	}
+	p99, breached := b.slo.breached(b.sloTarget, now)
+	ev.P99Ms, ev.SLOBreached = float64(p99)/float64(time.Millisecond), breached
+	return ev
+}
+
+// handleEvents streams a statusEvent as Server-Sent Events every
+// EventsInterval until the client goes away. Each event is flushed as it is
+// written, so nothing queues up for a slow client; one that can't take an
+// event within EventsWriteTimeout is disconnected.
+func (b *Broker) handleEvents(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no") // keep nginx-style proxies from buffering
+	w.WriteHeader(http.StatusOK)
+
+	ticker := time.NewTicker(EventsInterval)
+	defer ticker.Stop()
+	for {
+		data, _ := json.Marshal(b.statusEvent(time.Now()))
+		_ = rc.SetWriteDeadline(time.Now().Add(EventsWriteTimeout))
+		if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
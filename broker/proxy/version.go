@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+)
+
+// Build details injected at link time, e.g.
+//
+//	go build -ldflags "-X github.com/dwladdimiroc/load-serverless/broker/proxy.Revision=$(git rev-parse HEAD)"
+//
+// When empty they fall back to the VCS stamp in the binary's build info,
+// which `go build` records for package (not file) builds inside a checkout
+// (BuildTime then being the commit time).
+var (
+	Revision  string
+	BuildTime string
+)
+
+// VersionInfo identifies the running build.
+type VersionInfo struct {
+	GoVersion string `json:"go_version"`
+	Revision  string `json:"revision,omitempty"`
+	BuildTime string `json:"build_time,omitempty"`
+	Modified  bool   `json:"modified,omitempty"` // built from a dirty checkout
+}
+
+// Version reports the running build, preferring the link-time values.
+func Version() VersionInfo {
+	v := VersionInfo{GoVersion: runtime.Version(), Revision: Revision, BuildTime: BuildTime}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				if v.Revision == "" {
+					v.Revision = s.Value
+				}
+			case "vcs.time":
+				if v.BuildTime == "" {
+					v.BuildTime = s.Value
+				}
+			case "vcs.modified":
+				v.Modified = s.Value == "true"
+			}
+		}
+	}
+	return v
+}
+
+// handleVersion serves Version as JSON. It is public, like /health, so fleet
+// tooling can check builds without the admin secret.
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(Version())
+}
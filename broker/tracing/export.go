@@ -0,0 +1,145 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OTLPExporter posts spans to an OpenTelemetry collector over OTLP/HTTP
+// with the JSON encoding.
+type OTLPExporter struct {
+	url     string
+	service string
+	scope   string
+	client  *http.Client
+}
+
+// NewOTLPExporter exports to endpoint, e.g. "http://localhost:4318" (the
+// /v1/traces path is added when missing), as the given service name; scope
+// names the instrumentation, e.g. "load-serverless/broker".
+func NewOTLPExporter(endpoint, service, scope string) *OTLPExporter {
+	url := strings.TrimRight(endpoint, "/")
+	if !strings.HasSuffix(url, "/v1/traces") {
+		url += "/v1/traces"
+	}
+	return &OTLPExporter{url: url, service: service, scope: scope, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// URL is the collector's traces endpoint.
+func (e *OTLPExporter) URL() string {
+	return e.url
+}
+
+// Export sends spans in one OTLP request.
+func (e *OTLPExporter) Export(ctx context.Context, spans []SpanData) error {
+	otlp := make([]map[string]any, len(spans))
+	for i, s := range spans {
+		otlp[i] = otlpSpan(s)
+	}
+	payload := map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{"attributes": []any{
+				otlpAttr("service.name", e.service),
+			}},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": e.scope},
+				"spans": otlp,
+			}},
+		}},
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s: status %d", e.url, resp.StatusCode)
+	}
+	return nil
+}
+
+func otlpSpan(s SpanData) map[string]any {
+	keys := make([]string, 0, len(s.Attrs))
+	for k := range s.Attrs {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	attrs := make([]map[string]any, len(keys))
+	for i, k := range keys {
+		attrs[i] = otlpAttr(k, s.Attrs[k])
+	}
+	span := map[string]any{
+		"traceId":           hex.EncodeToString(s.TraceID[:]),
+		"spanId":            hex.EncodeToString(s.SpanID[:]),
+		"name":              s.Name,
+		"kind":              int(s.Kind),
+		"startTimeUnixNano": strconv.FormatInt(s.Start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(s.End.UnixNano(), 10),
+		"attributes":        attrs,
+	}
+	if s.ParentID != ([8]byte{}) {
+		span["parentSpanId"] = hex.EncodeToString(s.ParentID[:])
+	}
+	if s.Error {
+		span["status"] = map[string]any{"code": 2} // STATUS_CODE_ERROR
+	}
+	return span
+}
+
+// otlpAttr builds an OTLP KeyValue attribute.
+func otlpAttr(key string, v any) map[string]any {
+	var value map[string]any
+	switch x := v.(type) {
+	case int:
+		value = map[string]any{"intValue": strconv.Itoa(x)}
+	case int64:
+		value = map[string]any{"intValue": strconv.FormatInt(x, 10)}
+	case bool:
+		value = map[string]any{"boolValue": x}
+	case float64:
+		value = map[string]any{"doubleValue": x}
+	case string:
+		value = map[string]any{"stringValue": x}
+	default:
+		value = map[string]any{"stringValue": fmt.Sprint(x)}
+	}
+	return map[string]any{"key": key, "value": value}
+}
+
+// InMemoryExporter keeps exported spans in memory, for tests.
+type InMemoryExporter struct {
+	mu    sync.Mutex
+	spans []SpanData
+}
+
+func (e *InMemoryExporter) Export(_ context.Context, spans []SpanData) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+// Spans returns the spans exported so far.
+func (e *InMemoryExporter) Spans() []SpanData {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return slices.Clone(e.spans)
+}
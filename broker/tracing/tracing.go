@@ -0,0 +1,315 @@
+// Package tracing records spans and hands them in batches to an Exporter,
+// by default an OpenTelemetry collector over OTLP/HTTP (JSON encoding). The
+// Broker and the load client share it; it only needs the standard library.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	mrand "math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TraceparentHeader = "traceparent"
+
+	DefaultExportInterval = 5 * time.Second
+	DefaultExportBatch    = 512 // spans buffered before an early export
+	DefaultMaxQueued      = 8192
+)
+
+// SpanKind is the OTLP span kind.
+type SpanKind int
+
+const (
+	SpanKindServer SpanKind = 2
+	SpanKindClient SpanKind = 3
+)
+
+// SpanData is a finished span as handed to an Exporter.
+type SpanData struct {
+	TraceID  [16]byte
+	SpanID   [8]byte
+	ParentID [8]byte // zero for a root span
+
+	Name  string
+	Kind  SpanKind
+	Start time.Time
+	End   time.Time
+	Attrs map[string]any // int, int64, float64, bool or string values
+	Error bool
+}
+
+// Exporter sends finished spans somewhere. The Tracer calls Export from one
+// goroutine at a time.
+type Exporter interface {
+	Export(ctx context.Context, spans []SpanData) error
+}
+
+// Config tunes a Tracer. Zero durations and sizes take the defaults.
+type Config struct {
+	// Fraction of new traces recorded and exported, in [0,1]. Spans that
+	// continue a trace follow their parent's sampling decision instead.
+	Sample float64
+
+	ExportInterval time.Duration // 0 = DefaultExportInterval
+	ExportBatch    int           // 0 = DefaultExportBatch
+	MaxQueued      int           // spans kept while waiting for export, 0 = DefaultMaxQueued
+
+	// OnError, when set, is called with every failed export; the batch is
+	// dropped either way.
+	OnError func(error)
+}
+
+// Tracer records spans and exports them in the background until Shutdown.
+// A nil *Tracer records nothing, so call sites need no checks of their own.
+type Tracer struct {
+	exp       Exporter
+	sample    float64
+	interval  time.Duration
+	batch     int
+	maxQueued int
+	onError   func(error)
+
+	mu      sync.Mutex
+	pending []SpanData
+	dropped int
+	lastErr error
+
+	exportMu sync.Mutex // serializes Export calls
+	kick     chan struct{}
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// New starts a Tracer exporting through exp.
+func New(exp Exporter, cfg Config) *Tracer {
+	t := &Tracer{
+		exp:       exp,
+		sample:    cfg.Sample,
+		interval:  cfg.ExportInterval,
+		batch:     cfg.ExportBatch,
+		maxQueued: cfg.MaxQueued,
+		onError:   cfg.OnError,
+		kick:      make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	if t.interval <= 0 {
+		t.interval = DefaultExportInterval
+	}
+	if t.batch <= 0 {
+		t.batch = DefaultExportBatch
+	}
+	if t.maxQueued <= 0 {
+		t.maxQueued = DefaultMaxQueued
+	}
+	go t.exportLoop()
+	return t
+}
+
+// Exporter returns the exporter t was built with.
+func (t *Tracer) Exporter() Exporter {
+	return t.exp
+}
+
+// Span is one timed operation. Methods on a nil *Span are no-ops.
+type Span struct {
+	tracer  *Tracer
+	data    SpanData
+	sampled bool
+}
+
+// Start begins a span under parent. A nil parent with a valid traceparent
+// header value continues that remote trace; otherwise a new trace starts,
+// sampled at the Tracer's rate.
+func (t *Tracer) Start(name string, kind SpanKind, parent *Span, traceparent string) *Span {
+	if t == nil {
+		return nil
+	}
+	s := &Span{tracer: t, data: SpanData{Name: name, Kind: kind, Start: time.Now(), Attrs: make(map[string]any)}}
+	switch {
+	case parent != nil:
+		s.data.TraceID, s.data.ParentID, s.sampled = parent.data.TraceID, parent.data.SpanID, parent.sampled
+	case traceparent != "":
+		if tid, pid, sampled, ok := parseTraceparent(traceparent); ok {
+			s.data.TraceID, s.data.ParentID, s.sampled = tid, pid, sampled
+		}
+	}
+	if s.data.TraceID == ([16]byte{}) {
+		_, _ = rand.Read(s.data.TraceID[:])
+		s.sampled = t.sample >= 1 || mrand.Float64() < t.sample
+	}
+	_, _ = rand.Read(s.data.SpanID[:])
+	return s
+}
+
+func (s *Span) SetAttr(key string, value any) {
+	if s != nil {
+		s.data.Attrs[key] = value
+	}
+}
+
+// SetError marks the span's status as an error.
+func (s *Span) SetError() {
+	if s != nil {
+		s.data.Error = true
+	}
+}
+
+// Traceparent is the W3C trace context header value naming this span.
+func (s *Span) Traceparent() string {
+	if s == nil {
+		return ""
+	}
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(s.data.TraceID[:]) + "-" + hex.EncodeToString(s.data.SpanID[:]) + "-" + flags
+}
+
+// Inject sets the traceparent header naming this span on h.
+func (s *Span) Inject(h http.Header) {
+	if s != nil {
+		h.Set(TraceparentHeader, s.Traceparent())
+	}
+}
+
+// End finishes the span and queues it for export if sampled.
+func (s *Span) End() {
+	if s == nil || !s.sampled {
+		return
+	}
+	s.data.End = time.Now()
+
+	t := s.tracer
+	t.mu.Lock()
+	if len(t.pending) < t.maxQueued {
+		t.pending = append(t.pending, s.data)
+	} else {
+		t.dropped++
+	}
+	full := len(t.pending) >= t.batch
+	t.mu.Unlock()
+	if full {
+		select {
+		case t.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (t *Tracer) exportLoop() {
+	defer close(t.done)
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-t.kick:
+		case <-t.stop:
+			return
+		}
+		t.export(context.Background())
+	}
+}
+
+// Flush exports the pending spans now and reports the first export error
+// seen so far, including spans dropped because the queue was full.
+func (t *Tracer) Flush() error {
+	if t == nil {
+		return nil
+	}
+	t.export(context.Background())
+	return t.err()
+}
+
+// Shutdown stops the background export and exports what is still pending,
+// giving up when ctx is done. It reports like Flush. Spans ended after
+// Shutdown are never exported.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	t.stopOnce.Do(func() { close(t.stop) })
+	select {
+	case <-t.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	t.export(ctx)
+	return t.err()
+}
+
+func (t *Tracer) err() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.lastErr == nil && t.dropped > 0 {
+		return fmt.Errorf("%d spans dropped (export queue full)", t.dropped)
+	}
+	return t.lastErr
+}
+
+// export hands the pending spans to the exporter. A failed batch is
+// dropped: tracing must never hold back the traffic it observes.
+func (t *Tracer) export(ctx context.Context) {
+	t.exportMu.Lock()
+	defer t.exportMu.Unlock()
+	t.mu.Lock()
+	spans := t.pending
+	t.pending = nil
+	t.mu.Unlock()
+	if len(spans) == 0 {
+		return
+	}
+	if err := t.exp.Export(ctx, spans); err != nil {
+		err = fmt.Errorf("trace export (%d spans dropped): %w", len(spans), err)
+		t.mu.Lock()
+		if t.lastErr == nil {
+			t.lastErr = err
+		}
+		t.mu.Unlock()
+		if t.onError != nil {
+			t.onError(err)
+		}
+	}
+}
+
+// parseTraceparent decodes a W3C traceparent header (version 00).
+func parseTraceparent(v string) (traceID [16]byte, parentID [8]byte, sampled bool, ok bool) {
+	parts := strings.Split(strings.TrimSpace(v), "-")
+	if len(parts) < 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return traceID, parentID, false, false
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil || traceID == ([16]byte{}) {
+		return traceID, parentID, false, false
+	}
+	if _, err := hex.Decode(parentID[:], []byte(parts[2])); err != nil || parentID == ([8]byte{}) {
+		return traceID, parentID, false, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return traceID, parentID, false, false
+	}
+	return traceID, parentID, flags[0]&1 == 1, true
+}
+
+type spanKey struct{}
+
+// ContextWithSpan returns ctx carrying s, see SpanFromContext.
+func ContextWithSpan(ctx context.Context, s *Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, s)
+}
+
+// SpanFromContext returns the span ctx carries, or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
@@ -0,0 +1,191 @@
+package tracing
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const remoteParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func TestStartContinuesRemoteTrace(t *testing.T) {
+	exp := new(InMemoryExporter)
+	tr := New(exp, Config{Sample: 0})
+
+	server := tr.Start("server", SpanKindServer, nil, remoteParent)
+	client := tr.Start("client", SpanKindClient, server, "")
+	client.SetAttr("http.response.status_code", 200)
+	client.End()
+	server.SetError()
+	server.End()
+	if err := tr.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := exp.Spans()
+	if len(spans) != 2 {
+		t.Fatalf("exported %d spans, want 2 (a sampled remote parent overrides Sample 0)", len(spans))
+	}
+	c, s := spans[0], spans[1]
+	if got := hex.EncodeToString(s.TraceID[:]); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("server trace ID = %s, want the remote one", got)
+	}
+	if got := hex.EncodeToString(s.ParentID[:]); got != "00f067aa0ba902b7" {
+		t.Errorf("server parent = %s, want the remote span", got)
+	}
+	if c.TraceID != s.TraceID || c.ParentID != s.SpanID {
+		t.Errorf("client span is not a child of the server span")
+	}
+	if c.Kind != SpanKindClient || c.Attrs["http.response.status_code"] != 200 || c.Error {
+		t.Errorf("client span = %+v", c)
+	}
+	if !s.Error || s.End.Before(s.Start) {
+		t.Errorf("server span = %+v", s)
+	}
+}
+
+func TestSampling(t *testing.T) {
+	exp := new(InMemoryExporter)
+	tr := New(exp, Config{Sample: 0})
+	root := tr.Start("root", SpanKindClient, nil, "")
+	tr.Start("child", SpanKindClient, root, "").End()
+	root.End()
+	tr.Start("remote", SpanKindServer, nil, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00").End()
+	if err := tr.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(exp.Spans()); n != 0 {
+		t.Errorf("exported %d unsampled spans", n)
+	}
+	if got := root.Traceparent(); got[len(got)-2:] != "00" {
+		t.Errorf("unsampled traceparent %s should carry flags 00", got)
+	}
+
+	tr = New(exp, Config{Sample: 1})
+	root = tr.Start("root", SpanKindClient, nil, "invalid")
+	root.End()
+	_ = tr.Shutdown(context.Background())
+	if n := len(exp.Spans()); n != 1 {
+		t.Errorf("exported %d spans at Sample 1, want 1", n)
+	}
+}
+
+func TestBatchExportAndShutdown(t *testing.T) {
+	exp := new(InMemoryExporter)
+	tr := New(exp, Config{Sample: 1, ExportInterval: time.Hour, ExportBatch: 3})
+	for range 3 {
+		tr.Start("op", SpanKindClient, nil, "").End()
+	}
+	// A full batch is exported early, long before the interval
+	deadline := time.Now().Add(5 * time.Second)
+	for len(exp.Spans()) < 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := len(exp.Spans()); n != 3 {
+		t.Fatalf("exported %d spans after a full batch, want 3", n)
+	}
+
+	tr.Start("op", SpanKindClient, nil, "").End()
+	if err := tr.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(exp.Spans()); n != 4 {
+		t.Errorf("exported %d spans after Shutdown, want 4", n)
+	}
+	select {
+	case <-tr.done:
+	default:
+		t.Error("export goroutine still running after Shutdown")
+	}
+	if err := tr.Shutdown(context.Background()); err != nil {
+		t.Errorf("second Shutdown: %v", err)
+	}
+}
+
+type failingExporter struct{}
+
+func (failingExporter) Export(context.Context, []SpanData) error { return errors.New("collector down") }
+
+func TestExportErrors(t *testing.T) {
+	var reported []error
+	tr := New(failingExporter{}, Config{Sample: 1, MaxQueued: 1, OnError: func(err error) { reported = append(reported, err) }})
+	tr.Start("op", SpanKindClient, nil, "").End()
+	tr.Start("op", SpanKindClient, nil, "").End() // over MaxQueued: dropped
+	err := tr.Shutdown(context.Background())
+	if err == nil || len(reported) != 1 {
+		t.Fatalf("Shutdown = %v, %d errors reported; want the export error once", err, len(reported))
+	}
+
+	tr = New(new(InMemoryExporter), Config{Sample: 1, MaxQueued: 1})
+	tr.Start("op", SpanKindClient, nil, "").End()
+	tr.Start("op", SpanKindClient, nil, "").End()
+	if err := tr.Shutdown(context.Background()); err == nil {
+		t.Error("no error for spans dropped on a full queue")
+	}
+}
+
+func TestNilTracer(t *testing.T) {
+	var tr *Tracer
+	s := tr.Start("op", SpanKindClient, nil, "")
+	s.SetAttr("k", 1)
+	s.SetError()
+	s.Inject(http.Header{})
+	s.End()
+	if err := tr.Flush(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var got struct {
+		ResourceSpans []struct {
+			Resource struct {
+				Attributes []struct {
+					Key   string
+					Value map[string]any
+				}
+			}
+			ScopeSpans []struct {
+				Spans []map[string]any
+			}
+		}
+	}
+	var path string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		_ = json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer collector.Close()
+
+	exp := NewOTLPExporter(collector.URL+"/", "broker", "test")
+	tr := New(exp, Config{Sample: 1})
+	s := tr.Start("backend vm", SpanKindClient, nil, remoteParent)
+	s.SetAttr("broker.backend", "vm")
+	s.SetError()
+	s.End()
+	if err := tr.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if path != "/v1/traces" {
+		t.Errorf("posted to %s, want /v1/traces", path)
+	}
+	if len(got.ResourceSpans) != 1 || len(got.ResourceSpans[0].ScopeSpans) != 1 || len(got.ResourceSpans[0].ScopeSpans[0].Spans) != 1 {
+		t.Fatalf("payload = %+v", got)
+	}
+	if a := got.ResourceSpans[0].Resource.Attributes; len(a) != 1 || a[0].Key != "service.name" || a[0].Value["stringValue"] != "broker" {
+		t.Errorf("resource attributes = %+v", a)
+	}
+	span := got.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	if span["name"] != "backend vm" || span["kind"] != float64(SpanKindClient) || span["parentSpanId"] != "00f067aa0ba902b7" {
+		t.Errorf("span = %v", span)
+	}
+	if status, _ := span["status"].(map[string]any); status["code"] != float64(2) {
+		t.Errorf("status = %v, want code 2 (error)", span["status"])
+	}
+}
@@ -1,2 +1,2 @@
-go build -o broker broker.go
+go build -ldflags "-X github.com/dwladdimiroc/load-serverless/broker/proxy.Revision=$(git rev-parse HEAD) -X github.com/dwladdimiroc/load-serverless/broker/proxy.BuildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ)" -o broker .
 gcloud compute scp --zone "us-east1-c" ./broker load-balancing:~/broker
\ No newline at end of file
@@ -1,40 +1,116 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"flag"
 	"fmt"
-	"io"
-	"math"
-	"math/rand"
-	"net"
 	"net/http"
 	"os"
-	"runtime"
+	"os/signal"
+	"path/filepath"
 	"sort"
-	"strconv"
-	"sync"
-	"sync/atomic"
+	"strings"
+	"syscall"
 	"time"
+
+	"github.com/dwladdimiroc/load-serverless/cmd/loadgen"
 )
 
 func main() {
+	headers := http.Header{}
+	flag.Var(headerFlag{headers}, "H", `Extra request header "Key: Value" (repeatable, overrides Content-Type)`)
+
 	var (
 		urlStr      = flag.String("url", "", "Target Function URL, e.g. https://...run.app (must accept POST)")
+		targetFile  = flag.String("target-file", "", "File of url[,weight] lines to spread requests over by weight, instead of -url (# comments allowed)")
+		discover    = flag.String("discover", "", "Broker URL, e.g. http://broker:8080/geo_average: load its backends (from /backends) directly at that path, instead of -url ($BROKER_ADMIN_SECRET is sent when set)")
+		urlTemplate = flag.String("url-template", "", `Path (and query) appended to each URL per request, with "{i}" replaced by the request index and "{rand}" by a random number, e.g. "/item/{i}"`)
+		fanout      = flag.Bool("fanout", false, "Send each request to every -target-file or -discover URL at once with the same payload, for per-target comparison")
 		n           = flag.Int("n", 1_000_000, "Number of requests")
 		concurrency = flag.Int("c", 2000, "Number of concurrent workers")
-		timeout     = flag.Duration("timeout", 10*time.Second, "Per-request timeout")
+		timeout     = flag.Duration("timeout", 10*time.Second, "Per-request timeout (overall, including the body read)")
+		connTimeout = flag.Duration("connect-timeout", loadgen.DefaultConnectTimeout, "Transport dial timeout (TCP connect)")
+		tlsTimeout  = flag.Duration("tls-timeout", loadgen.DefaultTLSTimeout, "Transport TLS handshake timeout")
+		hdrTimeout  = flag.Duration("response-header-timeout", 0, "Transport timeout waiting for response headers after the request is sent (0 = only -timeout)")
+		ipFamily    = flag.String("ip-family", loadgen.IPFamilyAny, `Address family to dial: "tcp" (either), "tcp4" (IPv4 only) or "tcp6" (IPv6 only)`)
 		maxBody     = flag.Int64("max-body", 1<<20, "Max response body bytes to read (safety)")
 		seed        = flag.Int64("seed", 0, "Random seed (0 = time-based)")
+		detPayloads = flag.Bool("deterministic-payloads", false, "Derive each payload from -seed and the request index, so request i is identical across runs")
 		prec        = flag.Int("prec", 6, "Float precision for lat/lng in JSON (decimal places)")
+		padBytes    = flag.Int("pad-bytes", 0, `Inflate each generated payload by this many filler bytes in a "_pad" JSON field`)
+		noKeepAlive = flag.Bool("no-keepalive", false, "Disable keep-alives (fresh connection per request) and report connection setup overhead")
+		http1       = flag.Bool("http1", false, "Disable HTTP/2 (even over TLS) to benchmark HTTP/1.1 against an h2-capable backend")
+		maxConns    = flag.Int("max-conns-per-host", loadgen.DefaultMaxConnsPerHost, "Transport MaxConnsPerHost (connection cap per host)")
+		maxIdle     = flag.Int("max-idle-conns", loadgen.DefaultMaxIdleConns, "Transport MaxIdleConns and MaxIdleConnsPerHost (pooled idle connections kept)")
+		idleTimeout = flag.Duration("idle-timeout", loadgen.DefaultIdleTimeout, "Transport IdleConnTimeout (how long an idle pooled connection is kept)")
+		compare     = flag.Bool("compare", false, "Post to <url>/compare and count requests where spherical and simple averages diverge")
+		compareTol  = flag.Float64("compare-tol", 1.0, "Divergence tolerance for -compare (km)")
+		expectEcho  = flag.Bool("expect-echo", false, "Check each 2xx response echoes the payload (or carries its hex SHA-256 in the body or X-Body-Checksum) and count mismatches")
+		cluster     = flag.Bool("cluster", false, "Sample each request's points around a random cluster center instead of uniformly")
+		centers     = flag.Int("cluster-centers", 10, "Number of cluster centers for -cluster")
+		clusterSD   = flag.Float64("cluster-stddev", 0.5, "Standard deviation of points around their center for -cluster (degrees)")
+		replayFile  = flag.String("replay-file", "", "Post the newline-delimited JSON request bodies from this file instead of random points")
+		replayOrder = flag.String("replay-order", loadgen.ReplayRoundRobin, `Order for -replay-file: "round-robin" or "random"`)
+		prewarm     = flag.Int("prewarm", 0, "Open this many pooled connections (concurrent unrecorded HEAD requests) before the run")
+		userAgent   = flag.String("user-agent", loadgen.DefaultUserAgent(), "User-Agent sent with every request (-H User-Agent overrides it)")
+		markLoad    = flag.Bool("mark-load-test", false, "Send "+loadgen.LoadTestHeader+": true with every request, so backends can filter load tests from analytics")
+		coldHeader  = flag.String("cold-start-header", "", "Response header identifying the serving instance; first-seen values count as cold starts")
+		window      = flag.Duration("window", 0, "Also report throughput and p50/p99 per window of request start time, e.g. 10s (0 = off)")
+		perWorker   = flag.Bool("per-worker", false, "Print each worker's request count and p50/p99 to spot imbalance")
+		traceURL    = flag.String("trace-endpoint", "", "OTLP/HTTP collector, e.g. http://localhost:4318: send traceparent and export a span per sampled request")
+		traceSample = flag.Float64("trace-sample", 0.01, "Fraction of requests sampled for -trace-endpoint (0-1)")
+		output      = flag.String("output", "text", `Report format: "text", "json" (the Result, durations in ns) or "csv" (one row)`)
+		outputFile  = flag.String("output-file", "", "Write the -output report to this file (directories are created) instead of stdout")
+		appendOut   = flag.Bool("append", false, "Append to -output-file: CSV rows share one header, JSON becomes one object per line")
+		quiet       = flag.Bool("quiet", false, "With -output-file, don't print the text summary to stdout")
+		compareFile = flag.String("compare-file", "", "Compare against a previous -output json result and exit with status 3 on regression")
+		regressPct  = flag.Float64("regress-pct", 10, "Throughput drop or p50/p99 rise (percent) counted as a regression by -compare-file")
+		regressErr  = flag.Float64("regress-errors", 1, "Error rate rise (percentage points) counted as a regression by -compare-file")
+		grace       = flag.Duration("grace", 5*time.Second, "On Ctrl-C, how long in-flight requests may finish before being cancelled")
+		minSamples  = flag.Int("min-samples", 30, "Warn that latency percentiles are insignificant when fewer requests than this succeeded (0 = never)")
+		selftest    = flag.Bool("selftest", false, "Run a short load against an in-process Broker and backends, print PASS or FAIL and exit (status 1 on FAIL)")
+		maxErrors   = flag.Int("max-errors", 0, "Stop the run once more than this many requests have failed, report the partial results and exit with status 4 (0 = off)")
 	)
 	flag.Parse()
 
-	if *urlStr == "" {
+	if *selftest {
+		if !runSelfTest(os.Stdout) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	var targets []loadgen.WeightedTarget
+	switch {
+	case (*urlStr != "" && *targetFile != "") || (*discover != "" && (*urlStr != "" || *targetFile != "")):
+		fmt.Fprintln(os.Stderr, "-url, -target-file and -discover are mutually exclusive")
+		os.Exit(1)
+	case *targetFile != "":
+		var err error
+		if targets, err = loadgen.ReadTargetFile(*targetFile); err != nil {
+			fmt.Fprintln(os.Stderr, "-target-file:", err)
+			os.Exit(1)
+		}
+	case *discover != "":
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		var err error
+		targets, err = loadgen.DiscoverTargets(ctx, http.DefaultClient, *discover, os.Getenv("BROKER_ADMIN_SECRET"))
+		cancel()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "-discover:", err)
+			os.Exit(1)
+		}
+		for _, t := range targets {
+			fmt.Fprintln(os.Stderr, "Discovered target:", t.URL)
+		}
+	case *urlStr == "":
 		fmt.Fprintln(os.Stderr, "Missing -url")
 		os.Exit(1)
 	}
+	if *fanout && len(targets) < 2 {
+		fmt.Fprintln(os.Stderr, "-fanout needs a -target-file or -discover with at least two URLs")
+		os.Exit(1)
+	}
 	if *n <= 0 || *concurrency <= 0 {
 		fmt.Fprintln(os.Stderr, "-n and -c must be > 0")
 		os.Exit(1)
@@ -43,232 +119,273 @@ func main() {
 		fmt.Fprintln(os.Stderr, "-prec should be between 0 and 15")
 		os.Exit(1)
 	}
-
-	actualSeed := *seed
-	if actualSeed == 0 {
-		actualSeed = time.Now().UnixNano()
+	if *padBytes < 0 {
+		fmt.Fprintln(os.Stderr, "-pad-bytes must be >= 0")
+		os.Exit(1)
 	}
-
-	transport := &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
-		DialContext: (&net.Dialer{
-			Timeout:   5 * time.Second,
-			KeepAlive: 30 * time.Second,
-		}).DialContext,
-
-		ForceAttemptHTTP2: true,
-
-		MaxIdleConns:        10000,
-		MaxIdleConnsPerHost: 10000,
-		MaxConnsPerHost:     10000,
-
-		IdleConnTimeout:       90 * time.Second,
-		TLSHandshakeTimeout:   5 * time.Second,
-		ExpectContinueTimeout: 1 * time.Second,
+	if *padBytes > 0 && *replayFile != "" {
+		fmt.Fprintln(os.Stderr, "-pad-bytes and -replay-file are mutually exclusive")
+		os.Exit(1)
 	}
-
-	client := &http.Client{Transport: transport}
-
-	latencies := make([]int64, *n) // ns for successful (2xx) requests only
-	var (
-		nextIdx     uint64
-		okCount     uint64
-		errCount    uint64
-		status4xx   uint64
-		status5xx   uint64
-		statusOther uint64
-	)
-	var firstErr atomic.Value
-
-	// Start barrier so workers begin together
-	startCh := make(chan struct{})
-	var wg sync.WaitGroup
-	wg.Add(*concurrency)
-
-	// Reuse buffers to reduce allocations
-	bufPool := sync.Pool{
-		New: func() any { return new(bytes.Buffer) },
+	if *connTimeout <= 0 || *tlsTimeout <= 0 || *hdrTimeout < 0 {
+		fmt.Fprintln(os.Stderr, "-connect-timeout and -tls-timeout must be > 0 and -response-header-timeout >= 0")
+		os.Exit(1)
 	}
-
-	beginAll := time.Now()
-
-	for w := 0; w < *concurrency; w++ {
-		workerID := w
-		go func() {
-			defer wg.Done()
-			<-startCh
-
-			// One RNG per worker to avoid locks/contention
-			rng := rand.New(rand.NewSource(actualSeed + int64(workerID)*1_000_003))
-
-			for {
-				i := int(atomic.AddUint64(&nextIdx, 1) - 1)
-				if i >= *n {
-					return
-				}
-
-				// Build random payload (4 points)
-				buf := bufPool.Get().(*bytes.Buffer)
-				buf.Reset()
-				writeRandomPayload(buf, rng, *prec)
-				payload := buf.Bytes()
-
-				ctx, cancel := context.WithTimeout(context.Background(), *timeout)
-				start := time.Now()
-
-				req, err := http.NewRequestWithContext(ctx, http.MethodPost, *urlStr, bytes.NewReader(payload))
-				if err != nil {
-					cancel()
-					bufPool.Put(buf)
-					atomic.AddUint64(&errCount, 1)
-					storeFirstErr(&firstErr, fmt.Errorf("new request: %w", err))
-					continue
-				}
-				req.Header.Set("Content-Type", "application/json")
-
-				resp, err := client.Do(req)
-				if err != nil {
-					cancel()
-					bufPool.Put(buf)
-					atomic.AddUint64(&errCount, 1)
-					storeFirstErr(&firstErr, fmt.Errorf("do request: %w", err))
-					continue
-				}
-
-				// Read & discard body (critical for keep-alive reuse)
-				_, _ = io.CopyN(io.Discard, resp.Body, *maxBody)
-				_ = resp.Body.Close()
-				cancel()
-
-				// Done with buffer
-				bufPool.Put(buf)
-
-				dur := time.Since(start)
-
-				if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-					latencies[i] = dur.Nanoseconds()
-					atomic.AddUint64(&okCount, 1)
-				} else {
-					atomic.AddUint64(&errCount, 1)
-					switch {
-					case resp.StatusCode >= 400 && resp.StatusCode < 500:
-						atomic.AddUint64(&status4xx, 1)
-					case resp.StatusCode >= 500 && resp.StatusCode < 600:
-						atomic.AddUint64(&status5xx, 1)
-					default:
-						atomic.AddUint64(&statusOther, 1)
-					}
-				}
-			}
-		}()
+	if *maxConns <= 0 || *maxIdle <= 0 || *idleTimeout <= 0 {
+		fmt.Fprintln(os.Stderr, "-max-conns-per-host, -max-idle-conns and -idle-timeout must be > 0")
+		os.Exit(1)
 	}
-
-	close(startCh)
-	wg.Wait()
-
-	totalDur := time.Since(beginAll)
-
-	ok := int(atomic.LoadUint64(&okCount))
-	errs := int(atomic.LoadUint64(&errCount))
-
-	// Collect OK latencies
-	okLat := make([]int64, 0, ok)
-	for _, ns := range latencies {
-		if ns > 0 {
-			okLat = append(okLat, ns)
+	if *window < 0 {
+		fmt.Fprintln(os.Stderr, "-window must be >= 0")
+		os.Exit(1)
+	}
+	if *prewarm < 0 || *prewarm > *maxIdle {
+		fmt.Fprintln(os.Stderr, "-prewarm must be >= 0 and not above -max-idle-conns (the pool would close the extra connections)")
+		os.Exit(1)
+	}
+	if *expectEcho && *compare {
+		fmt.Fprintln(os.Stderr, "-expect-echo and -compare are mutually exclusive")
+		os.Exit(1)
+	}
+	if *output != "text" && *output != "json" && *output != "csv" {
+		fmt.Fprintln(os.Stderr, `-output must be "text", "json" or "csv"`)
+		os.Exit(1)
+	}
+	if (*appendOut || *quiet) && *outputFile == "" {
+		fmt.Fprintln(os.Stderr, "-append and -quiet need -output-file")
+		os.Exit(1)
+	}
+	var baseline loadgen.Result
+	if *compareFile != "" {
+		var err error
+		if baseline, err = loadgen.ReadResultFile(*compareFile); err != nil {
+			fmt.Fprintln(os.Stderr, "-compare-file:", err)
+			os.Exit(1)
 		}
 	}
+	if *replayOrder != loadgen.ReplayRoundRobin && *replayOrder != loadgen.ReplayRandom {
+		fmt.Fprintln(os.Stderr, `-replay-order must be "round-robin" or "random"`)
+		os.Exit(1)
+	}
+	if *traceSample < 0 || *traceSample > 1 {
+		fmt.Fprintln(os.Stderr, "-trace-sample must be between 0 and 1")
+		os.Exit(1)
+	}
+	if *cluster && (*centers <= 0 || *clusterSD < 0) {
+		fmt.Fprintln(os.Stderr, "-cluster-centers must be > 0 and -cluster-stddev >= 0")
+		os.Exit(1)
+	}
+	if *ipFamily != loadgen.IPFamilyAny && *ipFamily != loadgen.IPFamily4 && *ipFamily != loadgen.IPFamily6 {
+		fmt.Fprintln(os.Stderr, `-ip-family must be "tcp", "tcp4" or "tcp6"`)
+		os.Exit(1)
+	}
+	if *maxErrors < 0 || *minSamples < 0 {
+		fmt.Fprintln(os.Stderr, "-max-errors and -min-samples must be >= 0")
+		os.Exit(1)
+	}
 
-	// Report
-	fmt.Println("==== Load Test Result ====")
-	fmt.Printf("Go: %s | CPUs: %d | GOMAXPROCS: %d\n", runtime.Version(), runtime.NumCPU(), runtime.GOMAXPROCS(0))
-	fmt.Printf("Target URL: %s\n", *urlStr)
-	fmt.Printf("Requests: %d | Concurrency(workers): %d\n", *n, *concurrency)
-	fmt.Printf("Seed: %d\n", actualSeed)
-	fmt.Printf("Total time: %s\n", totalDur)
-	fmt.Printf("OK: %d | Errors: %d\n", ok, errs)
+	cfg := loadgen.Config{
+		URL:             *urlStr,
+		Targets:         targets,
+		Fanout:          *fanout,
+		URLTemplate:     *urlTemplate,
+		Requests:        *n,
+		Concurrency:     *concurrency,
+		Timeout:         *timeout,
+		MaxBody:         *maxBody,
+		Seed:            *seed,
+		Precision:       *prec,
+		PadBytes:        *padBytes,
+		Headers:         headers,
+		UserAgent:       *userAgent,
+		MarkLoadTest:    *markLoad,
+		NoKeepAlive:     *noKeepAlive,
+		HTTP1:           *http1,
+		MaxConnsPerHost: *maxConns,
+		MaxIdleConns:    *maxIdle,
+		IdleTimeout:     *idleTimeout,
+		Compare:         *compare,
+		CompareTol:      *compareTol,
+		ExpectEcho:      *expectEcho,
+		Cluster:         *cluster,
+		ClusterCenters:  *centers,
+		ClusterStdDev:   *clusterSD,
+		ReplayFile:      *replayFile,
+		ReplayOrder:     *replayOrder,
+		Prewarm:         *prewarm,
+		ColdStartHeader: *coldHeader,
+		PerWorker:       *perWorker,
+		Window:          *window,
+		Grace:           *grace,
+		MaxErrors:       *maxErrors,
+		MinSamples:      *minSamples,
+
+		DeterministicPayloads: *detPayloads,
+		ConnectTimeout:        *connTimeout,
+		TLSTimeout:            *tlsTimeout,
+		ResponseHeaderTimeout: *hdrTimeout,
+		IPFamily:              *ipFamily,
+	}
+	if *traceURL != "" {
+		cfg.Tracer = loadgen.NewTracer(*traceURL, *traceSample)
+	}
 
-	if errs > 0 {
-		fmt.Printf("Errors breakdown: 4xx=%d 5xx=%d other=%d\n",
-			atomic.LoadUint64(&status4xx),
-			atomic.LoadUint64(&status5xx),
-			atomic.LoadUint64(&statusOther),
-		)
-		if v := firstErr.Load(); v != nil {
-			fmt.Printf("First error: %v\n", v.(error))
+	// Ctrl-C stops issuing requests, lets in-flight ones finish within -grace and
+	// still prints the report. A second Ctrl-C exits immediately.
+	runCtx, stopRun := context.WithCancel(context.Background())
+	defer stopRun()
+	sigint := make(chan os.Signal, 2)
+	signal.Notify(sigint, os.Interrupt)
+	go func() {
+		<-sigint
+		fmt.Fprintf(os.Stderr, "\nInterrupted: waiting up to %s for in-flight requests (Ctrl-C again to exit now)\n", *grace)
+		stopRun()
+		<-sigint
+		os.Exit(130)
+	}()
+
+	// SIGUSR1 prints a snapshot of the stats so far to stderr without stopping the run
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+	defer signal.Stop(usr1)
+	snap := make(chan struct{})
+	go func() {
+		for range usr1 {
+			snap <- struct{}{}
 		}
+	}()
+	cfg.Snapshot = snap
+	cfg.OnSnapshot = func(s loadgen.Snapshot) {
+		fmt.Fprintln(os.Stderr, "---- Snapshot (SIGUSR1) ----")
+		fmt.Fprintf(os.Stderr, "Elapsed: %s | Issued: %d/%d\n", s.Elapsed.Round(time.Millisecond), s.Issued, *n)
+		fmt.Fprintf(os.Stderr, "OK: %d | Errors: %d (4xx=%d 5xx=%d other=%d)\n", s.OK, s.Errors, s.Status4xx, s.Status5xx, s.StatusOther)
+		fmt.Fprintf(os.Stderr, "Throughput: %.2f req/s\n", s.Throughput)
+		fmt.Fprintf(os.Stderr, "p50: %s | p90: %s | p99: %s\n", s.P50, s.P90, s.P99)
 	}
 
-	rps := float64(ok+errs) / totalDur.Seconds()
-	fmt.Printf("Throughput (total): %.2f req/s\n", rps)
+	res, err := loadgen.Run(runCtx, cfg)
+	// Run flushed the spans (any export error is in res.TraceErr)
+	_ = cfg.Tracer.Shutdown(context.Background())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 
-	if len(okLat) == 0 {
-		fmt.Println("No successful requests to compute latency stats.")
-		return
+	// Report: the -output format to -output-file or stdout, plus the text
+	// summary on stdout when the file gets the report. The comparison goes
+	// to stdout only when stdout carries text.
+	cmpOut := os.Stdout
+	if *outputFile != "" {
+		if err := writeOutputFile(*outputFile, *output, *appendOut, cfg, res, *traceURL, *traceSample); err != nil {
+			fmt.Fprintln(os.Stderr, "-output-file:", err)
+			os.Exit(1)
+		}
+		if !*quiet {
+			printReport(os.Stdout, cfg, res, *traceURL, *traceSample)
+		}
+	} else {
+		switch *output {
+		case "json":
+			err = res.WriteJSON(os.Stdout, true)
+			cmpOut = os.Stderr
+		case "csv":
+			err = writeCSV(os.Stdout, cfg, res, true)
+			cmpOut = os.Stderr
+		default:
+			printReport(os.Stdout, cfg, res, *traceURL, *traceSample)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
 	}
 
-	sort.Slice(okLat, func(i, j int) bool { return okLat[i] < okLat[j] })
+	if *compareFile != "" {
+		d := loadgen.Compare(baseline, res, *regressPct, *regressErr)
+		printDelta(cmpOut, *compareFile, baseline, res, d)
+		if len(d.Regressions) > 0 {
+			os.Exit(3)
+		}
+	}
+	if res.Aborted {
+		os.Exit(4)
+	}
+}
 
-	var sum int64
-	for _, ns := range okLat {
-		sum += ns
+// writeOutputFile writes the report in format to path, creating parent
+// directories. With appendTo, the file is extended instead of replaced: a
+// CSV header is only written to an empty file and JSON is one line per run.
+func writeOutputFile(path, format string, appendTo bool, cfg loadgen.Config, res loadgen.Result, traceURL string, traceSample float64) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if appendTo {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	f, err := os.OpenFile(path, flags, 0o644)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
 	}
-	min := okLat[0]
-	max := okLat[len(okLat)-1]
-	avg := float64(sum) / float64(len(okLat))
 
-	fmt.Println("---- Latency (successful requests) ----")
-	fmt.Printf("Count: %d\n", len(okLat))
-	fmt.Printf("Min: %s\n", time.Duration(min))
-	fmt.Printf("Avg: %s\n", time.Duration(int64(avg)))
-	fmt.Printf("Max: %s\n", time.Duration(max))
-	fmt.Printf("p50: %s\n", time.Duration(percentile(okLat, 0.50)))
-	fmt.Printf("p90: %s\n", time.Duration(percentile(okLat, 0.90)))
-	fmt.Printf("p95: %s\n", time.Duration(percentile(okLat, 0.95)))
-	fmt.Printf("p99: %s\n", time.Duration(percentile(okLat, 0.99)))
+	switch format {
+	case "json":
+		err = res.WriteJSON(f, !appendTo)
+	case "csv":
+		err = writeCSV(f, cfg, res, st.Size() == 0)
+	default:
+		printReport(f, cfg, res, traceURL, traceSample)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
 }
 
-// Generates 4 random points globally: lat [-90,90], lng [-180,180]
-func writeRandomPayload(buf *bytes.Buffer, rng *rand.Rand, prec int) {
-	buf.WriteString(`{"points":[`)
-	for i := 0; i < 4; i++ {
-		lat := -90.0 + rng.Float64()*180.0
-		lng := -180.0 + rng.Float64()*360.0
+// headerFlag collects repeatable -H "Key: Value" flags into a header set.
+type headerFlag struct{ h http.Header }
 
-		if i > 0 {
-			buf.WriteByte(',')
+func (f headerFlag) String() string {
+	if f.h == nil {
+		return ""
+	}
+	var parts []string
+	for k, vv := range f.h {
+		for _, v := range vv {
+			parts = append(parts, k+": "+v)
 		}
-		buf.WriteString(`{"lat":`)
-		buf.WriteString(strconv.FormatFloat(lat, 'f', prec, 64))
-		buf.WriteString(`,"lng":`)
-		buf.WriteString(strconv.FormatFloat(lng, 'f', prec, 64))
-		buf.WriteByte('}')
 	}
-	buf.WriteString(`]}`)
+	sort.Strings(parts)
+	return strings.Join(parts, ", ")
 }
 
-func percentile(sortedNs []int64, p float64) int64 {
-	if len(sortedNs) == 0 {
-		return 0
-	}
-	if p <= 0 {
-		return sortedNs[0]
+func (f headerFlag) Set(s string) error {
+	k, v, ok := strings.Cut(s, ":")
+	k = strings.TrimSpace(k)
+	if !ok || !validHeaderName(k) {
+		return fmt.Errorf(`invalid header %q, want "Key: Value"`, s)
 	}
-	if p >= 1 {
-		return sortedNs[len(sortedNs)-1]
-	}
-	rank := int(math.Ceil(p*float64(len(sortedNs)))) - 1
-	if rank < 0 {
-		rank = 0
-	}
-	if rank >= len(sortedNs) {
-		rank = len(sortedNs) - 1
-	}
-	return sortedNs[rank]
+	f.h.Add(k, strings.TrimSpace(v))
+	return nil
 }
 
-func storeFirstErr(slot *atomic.Value, err error) {
-	if slot.Load() == nil {
-		slot.Store(err)
+// validHeaderName reports whether s is a valid RFC 7230 token.
+func validHeaderName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.ContainsRune("!#$%&'*+-.^_`|~", c):
+		default:
+			return false
+		}
 	}
+	return true
 }
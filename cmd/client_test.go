@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/dwladdimiroc/load-serverless/cmd/loadgen"
+)
+
+// runMainEnv makes the test binary run the client's main instead of the tests,
+// so flag handling and the printed report can be checked end to end.
+const runMainEnv = "CLIENT_TEST_RUN_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(runMainEnv) == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// clientCmd prepares a run of the client with args.
+func clientCmd(args ...string) *exec.Cmd {
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), runMainEnv+"=1")
+	return cmd
+}
+
+// runClient runs the client with args and returns its combined output.
+func runClient(t *testing.T, args ...string) (string, error) {
+	t.Helper()
+	out, err := clientCmd(args...).CombinedOutput()
+	return string(out), err
+}
+
+func TestHeaderFlag(t *testing.T) {
+	h := http.Header{}
+	f := headerFlag{h}
+	for _, s := range []string{"X-Api-Key: abc", "x-multi:1", "X-Multi: 2 ", "Content-Type: text/plain"} {
+		if err := f.Set(s); err != nil {
+			t.Errorf("Set(%q): %v", s, err)
+		}
+	}
+	if got := h.Values("X-Multi"); len(got) != 2 || got[0] != "1" || got[1] != "2" {
+		t.Errorf("X-Multi = %q, want both values trimmed", got)
+	}
+	if want := "Content-Type: text/plain, X-Api-Key: abc, X-Multi: 1, X-Multi: 2"; f.String() != want {
+		t.Errorf("String() = %q, want %q", f.String(), want)
+	}
+	for _, s := range []string{"NoColon", ": value", "Bad Name: v", "Bad\x00: v"} {
+		if err := f.Set(s); err == nil {
+			t.Errorf("Set(%q) accepted", s)
+		}
+	}
+	if (headerFlag{}).String() != "" {
+		t.Error("zero headerFlag should print empty")
+	}
+}
+
+func TestReport(t *testing.T) {
+	var n atomic.Int64
+	var authorized atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			return
+		}
+		authorized.Store(r.Header.Get("Authorization") == "Bearer t")
+		i := n.Add(1)
+		w.Header().Set("Function-Execution-Id", fmt.Sprint("instance-", i%2))
+		// Every fourth answer is 1 degree of latitude (~111km) apart
+		simple := 10.0
+		if i%4 == 0 {
+			simple = 11
+		}
+		fmt.Fprintf(w, `{"spherical":{"lat":10,"lng":20},"simple":{"lat":%g,"lng":20}}`, simple)
+	}))
+	defer srv.Close()
+
+	out, err := runClient(t, "-url", srv.URL, "-n", "8", "-c", "1", "-H", "Authorization: Bearer t",
+		"-compare", "-compare-tol", "50", "-cluster", "-cluster-centers", "3", "-prewarm", "1",
+		"-cold-start-header", "Function-Execution-Id", "-no-keepalive", "-per-worker",
+		"-max-conns-per-host", "4", "-max-idle-conns", "8", "-idle-timeout", "30s")
+	if err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	for _, want := range []string{
+		"Target URL: " + srv.URL + "/compare\n",
+		"Requests: 8 | Concurrency(workers): 1\n",
+		"Transport: max-conns-per-host=4 | max-idle-conns=8 | idle-timeout=30s | keep-alive=false | http2=true\n",
+		"Prewarm: 1 requests opened 1 connections; the measured run opened 8 more\n",
+		"Payload: clustered (3 centers, stddev 0.500°)\n",
+		"OK: 8 | Errors: 0\n",
+		"Compare: 8 checked | 2 diverged > 50.000 km (25.00%)\n",
+		"---- Instances (by Function-Execution-Id) ----\nCold (new instance): 2 | avg latency ",
+		"Warm (reused):       6 | avg latency ",
+		"---- Latency (successful requests) ----\nWARNING: only 8 successful requests (-min-samples 30): the percentiles below are statistically insignificant\nCount: 8\n",
+		"---- Per worker (successful requests) ----\nWorker    0: count=8 p50=",
+		"---- Connections (keep-alive disabled) ----\nNew connections: 8\nAvg setup (DNS+TCP+TLS): ",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("report lacks %q:\n%s", want, out)
+		}
+	}
+	if !authorized.Load() {
+		t.Error("-H header not sent")
+	}
+	if strings.Contains(out, "INTERRUPTED") {
+		t.Errorf("completed run reported as interrupted:\n%s", out)
+	}
+}
+
+func TestOutputJSONAndCompareFile(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	cmd := clientCmd("-url", srv.URL, "-n", "20", "-c", "2", "-output", "json")
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	var res loadgen.Result
+	if err := json.Unmarshal(out, &res); err != nil || res.OK != 20 {
+		t.Fatalf("stdout is not the run's Result (%v):\n%s", err, out)
+	}
+
+	// Against itself nothing regresses; against a far faster baseline it does
+	path := filepath.Join(t.TempDir(), "base.json")
+	if err := os.WriteFile(path, out, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	report, err := runClient(t, "-url", srv.URL, "-n", "20", "-c", "2", "-compare-file", path, "-regress-pct", "1000000")
+	if err != nil || !strings.Contains(report, "---- Compared with "+path+" ----") || !strings.HasSuffix(report, "No regressions\n") {
+		t.Errorf("unchanged run: %v\n%s", err, report)
+	}
+	res.Throughput *= 1000
+	fast, _ := json.Marshal(res)
+	_ = os.WriteFile(path, fast, 0o644)
+	report, err = runClient(t, "-url", srv.URL, "-n", "20", "-c", "2", "-compare-file", path)
+	var exit *exec.ExitError
+	if !errors.As(err, &exit) || exit.ExitCode() != 3 || !strings.Contains(report, "REGRESSION: throughput down") {
+		t.Errorf("regressed run: %v, want exit status 3\n%s", err, report)
+	}
+}
+
+func TestFlagValidation(t *testing.T) {
+	for _, args := range [][]string{
+		{},
+		{"-url", "http://localhost", "-n", "0"},
+		{"-url", "http://localhost", "-prec", "16"},
+		{"-url", "http://localhost", "-prewarm", "-1"},
+		{"-url", "http://localhost", "-cluster", "-cluster-centers", "0"},
+		{"-url", "http://localhost", "-H", "NoColon"},
+		{"-url", "http://localhost", "-trace-sample", "2"},
+		{"-url", "http://localhost", "-output", "xml"},
+		{"-url", "http://localhost", "-max-conns-per-host", "0"},
+		{"-url", "http://localhost", "-expect-echo", "-compare"},
+		{"-url", "http://localhost", "-compare-file", "/nonexistent.json"},
+	} {
+		if out, err := runClient(t, args...); err == nil {
+			t.Errorf("%v accepted:\n%s", args, out)
+		}
+	}
+}
+
+func TestWriteOutputFileAppend(t *testing.T) {
+	dir := t.TempDir()
+	cfg := loadgen.Config{Requests: 10, Concurrency: 2}
+	runs := []loadgen.Result{{Target: "http://a", Seed: 1, OK: 10}, {Target: "http://a", Seed: 2, OK: 9, Errors: 1}}
+
+	// Two runs append to one CSV in a directory that doesn't exist yet
+	path := filepath.Join(dir, "sweep", "results.csv")
+	for _, res := range runs {
+		if err := writeOutputFile(path, "csv", true, cfg, res, "", 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 || rows[0][0] != csvHeader[0] {
+		t.Fatalf("CSV has %d rows, want a header and 2 data rows:\n%q", len(rows), rows)
+	}
+	seed := slices.Index(csvHeader, "seed")
+	if rows[1][seed] != "1" || rows[2][seed] != "2" {
+		t.Errorf("seeds %q and %q, want 1 and 2", rows[1][seed], rows[2][seed])
+	}
+
+	// Appended JSON is one object per line, and reads back as the last run
+	path = filepath.Join(dir, "results.jsonl")
+	for _, res := range runs {
+		if err := writeOutputFile(path, "json", true, cfg, res, "", 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, _ := os.ReadFile(path)
+	if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != 2 {
+		t.Errorf("JSON file has %d lines, want 2:\n%s", len(lines), data)
+	}
+	if res, err := loadgen.ReadResultFile(path); err != nil || res.Seed != 2 {
+		t.Errorf("read back seed %d, %v; want the last run", res.Seed, err)
+	}
+
+	// Without -append each run replaces the file
+	path = filepath.Join(dir, "report.txt")
+	for _, res := range runs {
+		if err := writeOutputFile(path, "text", false, cfg, res, "", 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, _ = os.ReadFile(path)
+	if n := strings.Count(string(data), "==== Load Test Result ===="); n != 1 || !strings.Contains(string(data), "Seed: 2") {
+		t.Errorf("text report holds %d runs, want only the last:\n%s", n, data)
+	}
+}
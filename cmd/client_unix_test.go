@@ -0,0 +1,158 @@
+//go:build unix
+
+package main
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSnapshotOnSIGUSR1(t *testing.T) {
+	// The first 5 requests answer at once, the 6th holds the run until the
+	// snapshot was printed
+	arrived, release := make(chan struct{}), make(chan struct{})
+	var n atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if n.Add(1) == 6 {
+			close(arrived)
+			<-release
+		}
+		time.Sleep(time.Millisecond)
+	}))
+	defer srv.Close()
+
+	cmd := clientCmd("-url", srv.URL, "-n", "10", "-c", "1")
+	var stdout strings.Builder
+	cmd.Stdout = &stdout
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		for sc := bufio.NewScanner(stderr); sc.Scan(); {
+			lines <- sc.Text()
+		}
+	}()
+
+	select {
+	case <-arrived:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the run never reached the 6th request")
+	}
+	if err := cmd.Process.Signal(syscall.SIGUSR1); err != nil {
+		t.Fatal(err)
+	}
+	var snapshot []string
+	timeout := time.After(5 * time.Second)
+	for len(snapshot) == 0 || !strings.HasPrefix(snapshot[len(snapshot)-1], "p50: ") {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				t.Fatalf("stderr closed after %q", snapshot)
+			}
+			snapshot = append(snapshot, line)
+		case <-timeout:
+			t.Fatalf("no complete snapshot on stderr: %q", snapshot)
+		}
+	}
+	close(release)
+	for range lines {
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("%v: %s", err, stdout.String())
+	}
+
+	got := strings.Join(snapshot, "\n")
+	for _, want := range []string{"---- Snapshot (SIGUSR1) ----", "| Issued: 6/10", "OK: 5 | Errors: 0 (4xx=0 5xx=0 other=0)", "Throughput: "} {
+		if !strings.Contains(got, want) {
+			t.Errorf("snapshot lacks %q:\n%s", want, got)
+		}
+	}
+	if !strings.Contains(stdout.String(), "OK: 10 | Errors: 0") {
+		t.Errorf("the snapshot disturbed the run:\n%s", stdout.String())
+	}
+}
+
+// interruptAt runs the client with args, sends it SIGINT once arrived is
+// closed and returns its stdout and stderr.
+func interruptAt(t *testing.T, arrived <-chan struct{}, args ...string) (string, string) {
+	t.Helper()
+	cmd := clientCmd(args...)
+	var stdout, stderr strings.Builder
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-arrived:
+	case <-time.After(5 * time.Second):
+		_ = cmd.Process.Kill()
+		t.Fatal("the run never reached the interrupt point")
+	}
+	if err := cmd.Process.Signal(os.Interrupt); err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("%v: %s%s", err, stdout.String(), stderr.String())
+	}
+	return stdout.String(), stderr.String()
+}
+
+func TestInterruptKeepsPartialResult(t *testing.T) {
+	arrived := make(chan struct{})
+	var n atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if n.Add(1) == 5 {
+			close(arrived)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}))
+	defer srv.Close()
+
+	stdout, stderr := interruptAt(t, arrived, "-url", srv.URL, "-n", "100", "-c", "2", "-grace", "5s")
+	if !strings.Contains(stderr, "Interrupted: waiting up to 5s for in-flight requests") {
+		t.Errorf("stderr lacks the interrupt notice:\n%s", stderr)
+	}
+	// In-flight requests finish within -grace; no new ones start
+	if !strings.Contains(stdout, "INTERRUPTED: partial results over ") || !strings.Contains(stdout, "| Errors: 0\n") || n.Load() > 6 {
+		t.Errorf("server saw %d requests; report:\n%s", n.Load(), stdout)
+	}
+}
+
+func TestInterruptGraceExpires(t *testing.T) {
+	arrived := make(chan struct{})
+	var once sync.Once
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		once.Do(func() { close(arrived) })
+		// The server notices the client hanging up once the body is read
+		_, _ = io.Copy(io.Discard, r.Body)
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer srv.Close()
+
+	start := time.Now()
+	stdout, _ := interruptAt(t, arrived, "-url", srv.URL, "-n", "10", "-c", "1", "-grace", "50ms")
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("run took %s with a 50ms grace", d)
+	}
+	if !strings.Contains(stdout, "INTERRUPTED: partial results over 1 completed requests\n") || !strings.Contains(stdout, "OK: 0 | Errors: 1\n") {
+		t.Errorf("want the in-flight request cancelled:\n%s", stdout)
+	}
+}
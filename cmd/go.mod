@@ -0,0 +1,28 @@
+module github.com/dwladdimiroc/load-serverless/cmd
+
+go 1.25
+
+require (
+	github.com/dwladdimiroc/load-serverless/broker v0.0.0
+	github.com/dwladdimiroc/load-serverless/server v0.0.0
+	github.com/gogearbox/gearbox v1.2.4
+)
+
+require (
+	github.com/andybalholm/brotli v1.0.2 // indirect
+	github.com/json-iterator/go v1.1.12 // indirect
+	github.com/klauspost/compress v1.13.4 // indirect
+	github.com/modern-go/concurrent v0.0.0-20180228061459-e0a39a4cb421 // indirect
+	github.com/modern-go/reflect2 v1.0.2 // indirect
+	github.com/valyala/bytebufferpool v1.0.0 // indirect
+	github.com/valyala/fasthttp v1.31.0 // indirect
+	github.com/valyala/tcplisten v1.0.0 // indirect
+	golang.org/x/sys v0.0.0-20210514084401-e8d321eab015 // indirect
+)
+
+// The broker and server modules live next to this one in the repository
+// (-selftest)
+replace (
+	github.com/dwladdimiroc/load-serverless/broker => ../broker
+	github.com/dwladdimiroc/load-serverless/server => ../server
+)
@@ -0,0 +1,78 @@
+package loadgen
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// Transport error classes reported in Result.TransportErrors
+const (
+	ErrClassDNS           = "dns"
+	ErrClassDialTimeout   = "dial_timeout" // ConnectTimeout, or Timeout while dialing
+	ErrClassRefused       = "refused"
+	ErrClassTLS           = "tls"
+	ErrClassTLSTimeout    = "tls_timeout"    // TLSTimeout
+	ErrClassHeaderTimeout = "header_timeout" // ResponseHeaderTimeout
+	ErrClassTimeout       = "timeout"        // overall Timeout (or cancellation) hit after connecting
+	ErrClassReset         = "reset"          // connection reset or closed by the peer mid-request
+	ErrClassOther         = "other"
+)
+
+// ErrorClasses lists the transport error classes in report order.
+var ErrorClasses = []string{
+	ErrClassDNS, ErrClassDialTimeout, ErrClassRefused, ErrClassTLS, ErrClassTLSTimeout,
+	ErrClassHeaderTimeout, ErrClassTimeout, ErrClassReset, ErrClassOther,
+}
+
+// TransportErrorStats counts the requests that failed without a response
+// in one error class.
+type TransportErrorStats struct {
+	Class string `json:"class"`
+	Count int    `json:"count"`
+	First string `json:"first"` // first error seen in the class
+}
+
+// classifyErr names the ErrorClasses entry of a client.Do error, found by
+// walking its chain.
+func classifyErr(err error) string {
+	var (
+		dnsErr   *net.DNSError
+		opErr    *net.OpError
+		netErr   net.Error
+		recErr   tls.RecordHeaderError
+		alertErr tls.AlertError
+		certErr  *tls.CertificateVerificationError
+		authErr  x509.UnknownAuthorityError
+		hostErr  x509.HostnameError
+		invErr   x509.CertificateInvalidError
+	)
+	switch {
+	case errors.As(err, &dnsErr):
+		return ErrClassDNS
+	case errors.As(err, &opErr) && opErr.Op == "dial" && opErr.Timeout():
+		return ErrClassDialTimeout
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ErrClassRefused
+	case errors.As(err, &recErr), errors.As(err, &alertErr), errors.As(err, &certErr),
+		errors.As(err, &authErr), errors.As(err, &hostErr), errors.As(err, &invErr):
+		return ErrClassTLS
+	// net/http doesn't export these two error types, only their messages
+	case strings.Contains(err.Error(), "net/http: TLS handshake timeout"):
+		return ErrClassTLSTimeout
+	case strings.Contains(err.Error(), "net/http: timeout awaiting response headers"):
+		return ErrClassHeaderTimeout
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return ErrClassTimeout
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE),
+		errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return ErrClassReset
+	}
+	return ErrClassOther
+}
@@ -0,0 +1,152 @@
+package loadgen
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// timeoutErr is a net.Error that timed out.
+type timeoutErr struct{}
+
+func (timeoutErr) Error() string   { return "i/o timeout" }
+func (timeoutErr) Timeout() bool   { return true }
+func (timeoutErr) Temporary() bool { return true }
+
+func TestClassifyErr(t *testing.T) {
+	wrap := func(err error) error { return &url.Error{Op: "Post", URL: "http://vm/x", Err: err} }
+	for _, tc := range []struct {
+		err  error
+		want string
+	}{
+		{&net.DNSError{Err: "no such host", Name: "vm", IsNotFound: true}, ErrClassDNS},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: timeoutErr{}}, ErrClassDialTimeout},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, ErrClassRefused},
+		{tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"}, ErrClassTLS},
+		{&tls.CertificateVerificationError{Err: errors.New("x509: certificate signed by unknown authority")}, ErrClassTLS},
+		{errors.New("net/http: TLS handshake timeout"), ErrClassTLSTimeout},
+		{errors.New("net/http: timeout awaiting response headers"), ErrClassHeaderTimeout},
+		{context.DeadlineExceeded, ErrClassTimeout},
+		{&net.OpError{Op: "read", Net: "tcp", Err: timeoutErr{}}, ErrClassTimeout},
+		{&net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, ErrClassReset},
+		{io.EOF, ErrClassReset},
+		{errors.New("something else"), ErrClassOther},
+	} {
+		if got := classifyErr(wrap(tc.err)); got != tc.want {
+			t.Errorf("classifyErr(%v) = %s, want %s", tc.err, got, tc.want)
+		}
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func TestTransportErrorBreakdown(t *testing.T) {
+	// Cycle through failures of different classes, one request in five succeeding
+	failures := []error{
+		&net.DNSError{Err: "no such host", Name: "vm", IsNotFound: true},
+		&net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)},
+		&net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)},
+		io.ErrUnexpectedEOF,
+		nil,
+	}
+	var n atomic.Int64
+	client := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		if err := failures[int(n.Add(1)-1)%len(failures)]; err != nil {
+			return nil, err
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: r}, nil
+	})}
+
+	res, err := Run(context.Background(), Config{URL: "http://vm/x", Requests: 50, Concurrency: 4, Precision: 6, Client: client})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.OK != 10 || res.Errors != 40 {
+		t.Errorf("OK %d, Errors %d; want 10 and 40", res.OK, res.Errors)
+	}
+	got := map[string]TransportErrorStats{}
+	for _, s := range res.TransportErrors {
+		got[s.Class] = s
+	}
+	for class, want := range map[string]int{ErrClassDNS: 10, ErrClassRefused: 20, ErrClassReset: 10} {
+		if got[class].Count != want || got[class].First == "" {
+			t.Errorf("%s: %+v, want %d with the first error", class, got[class], want)
+		}
+	}
+	if len(got) != 3 {
+		t.Errorf("classes %v, want dns, refused and reset only", res.TransportErrors)
+	}
+	if res.FirstErr == nil {
+		t.Error("no FirstErr")
+	}
+}
+
+func TestPhaseTimeouts(t *testing.T) {
+	// Stalls before sending headers
+	stall := make(chan struct{})
+	defer close(stall)
+	res := testRun(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-stall:
+		case <-r.Context().Done():
+		}
+	}, Config{Requests: 4, Concurrency: 2, ResponseHeaderTimeout: 50 * time.Millisecond})
+	if res.Errors != 4 || len(res.TransportErrors) != 1 || res.TransportErrors[0].Class != ErrClassHeaderTimeout {
+		t.Errorf("stalled headers: %d errors classified %+v, want 4 %s", res.Errors, res.TransportErrors, ErrClassHeaderTimeout)
+	}
+
+	// Accepts connections but never answers the TLS handshake
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		var held []net.Conn
+		defer func() {
+			for _, conn := range held {
+				_ = conn.Close()
+			}
+		}()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			held = append(held, conn)
+		}
+	}()
+	start := time.Now()
+	res, err = Run(context.Background(), Config{URL: "https://" + ln.Addr().String(), Requests: 2, Concurrency: 2, Precision: 6, TLSTimeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Errors != 2 || len(res.TransportErrors) != 1 || res.TransportErrors[0].Class != ErrClassTLSTimeout {
+		t.Errorf("silent TLS server: %d errors classified %+v, want 2 %s", res.Errors, res.TransportErrors, ErrClassTLSTimeout)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("run took %s; the TLS timeout didn't cut it short", elapsed)
+	}
+
+	// The overall Timeout still covers the whole request
+	res = testRun(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-stall:
+		case <-r.Context().Done():
+		}
+	}, Config{Requests: 2, Concurrency: 2, Timeout: 50 * time.Millisecond, ResponseHeaderTimeout: time.Minute})
+	if len(res.TransportErrors) != 1 || res.TransportErrors[0].Class != ErrClassTimeout {
+		t.Errorf("overall timeout classified %+v, want %s", res.TransportErrors, ErrClassTimeout)
+	}
+}
@@ -0,0 +1,1202 @@
+// Package loadgen drives POST load against a geo_average endpoint and
+// collects latency and error statistics. The load client in cmd is a thin
+// flag-parsing wrapper around Run; tests can call Run directly against an
+// httptest server.
+package loadgen
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"runtime/debug"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dwladdimiroc/load-serverless/broker/tracing"
+)
+
+// Connection pool defaults of the client built by NewClient
+const (
+	DefaultMaxConnsPerHost = 10000
+	DefaultMaxIdleConns    = 10000
+	DefaultIdleTimeout     = 90 * time.Second
+
+	DefaultConnectTimeout = 5 * time.Second
+	DefaultTLSTimeout     = 5 * time.Second
+)
+
+// LoadTestHeader is set to "true" on requests with Config.MarkLoadTest.
+const LoadTestHeader = "X-Load-Test"
+
+// Address families for Config.IPFamily, as net.Dial networks
+const (
+	IPFamilyAny = "tcp"
+	IPFamily4   = "tcp4"
+	IPFamily6   = "tcp6"
+)
+
+// Config describes one load run. Zero Timeout and MaxBody fall back to
+// 10s and 1 MiB; a zero Seed is replaced by a time-based one.
+type Config struct {
+	URL         string        // Target URL (must accept POST)
+	Requests    int           // Number of requests
+	Concurrency int           // Number of concurrent workers
+	Timeout     time.Duration // Per-request timeout
+	MaxBody     int64         // Max response body bytes to read
+	Seed        int64         // Random seed (0 = time-based)
+	Precision   int           // Float precision for lat/lng in JSON (decimal places)
+	PadBytes    int           // Filler bytes added to generated payloads as a "_pad" string field
+	Headers     http.Header   // Extra request headers (override Content-Type)
+
+	// UserAgent is sent with every request ("" = DefaultUserAgent()), and
+	// MarkLoadTest adds "LoadTestHeader: true", so backends can tell load
+	// tests from real traffic. Headers override both.
+	UserAgent    string
+	MarkLoadTest bool
+
+	// DeterministicPayloads derives each request's RNG from Seed and the
+	// request index instead of the worker, so request i carries the same
+	// payload on every run with that seed, whichever worker sends it.
+	DeterministicPayloads bool
+
+	// Targets, when set instead of URL, spreads the requests over several
+	// URLs in proportion to their weights (Result.Targets).
+	Targets []WeightedTarget
+
+	// Fanout sends every request to all Targets at once with the same
+	// payload instead of spreading them, so each target gets a directly
+	// comparable sample; Requests then counts these logical requests.
+	Fanout bool
+
+	// URLTemplate is appended to the URL (or every target) and gets "{i}"
+	// replaced by the request index and "{rand}" by a random number, so
+	// requests can spread over many distinct paths, e.g. "/item/{i}".
+	URLTemplate string
+
+	// Client is used for requests when set; otherwise Run builds a pooled
+	// transport honouring NoKeepAlive.
+	Client      *http.Client
+	NoKeepAlive bool // Fresh connection per request, reporting setup overhead
+	HTTP1       bool // Disable HTTP/2 in the built client, even over TLS
+
+	// Connection pool sizing for the built client; 0 = the Default* values
+	MaxConnsPerHost int
+	MaxIdleConns    int // also the per-host idle limit
+	IdleTimeout     time.Duration
+
+	// Phase timeouts of the built client, within the overall Timeout:
+	// dialing, the TLS handshake (0 = the Default* values) and waiting for
+	// response headers once the request is written (0 = none). A request
+	// failing on one is counted under its class in Result.TransportErrors.
+	ConnectTimeout        time.Duration
+	TLSTimeout            time.Duration
+	ResponseHeaderTimeout time.Duration
+
+	// IPFamily restricts the built client's dialer to IPv4 or IPv6 targets
+	// (IPFamily4, IPFamily6); "" = IPFamilyAny, whichever resolves.
+	IPFamily string
+
+	Compare    bool    // Post to <URL>/compare and count divergent averages
+	CompareTol float64 // Divergence tolerance for Compare (km)
+
+	// ExpectEcho checks every 2xx response against the payload sent: the body
+	// must echo it verbatim or contain its hex SHA-256, or the response carry
+	// that digest in BodyChecksumHeader. Mismatches are counted
+	// in Result.EchoMismatched (not as errors).
+	ExpectEcho bool
+
+	Cluster        bool    // Sample points around random cluster centers
+	ClusterCenters int     // Number of centers for Cluster
+	ClusterStdDev  float64 // Stddev of points around their center (degrees)
+
+	// ReplayFile, when set, posts the JSON-lines request bodies recorded in
+	// that file instead of generated points, cycling through them in
+	// ReplayOrder (ReplayRoundRobin, the default, or ReplayRandom).
+	ReplayFile  string
+	ReplayOrder string
+
+	PerWorker bool // Also summarise latencies per worker (Result.Workers)
+
+	// Window > 0 also bins requests by start time into windows of this
+	// length (Result.Windows), to expose spikes the overall p99 hides.
+	Window time.Duration
+
+	// Prewarm > 0 first opens that many pooled connections per target with
+	// unrecorded HEAD requests (at most MaxIdleConns, which the pool keeps),
+	// and counts the new connections the measured run still opens.
+	Prewarm int
+
+	ColdStartHeader string // Response header identifying the serving instance
+
+	// Tracer, when set, sends a traceparent with every request and exports a
+	// span per sampled request; it is flushed before Run returns.
+	Tracer *tracing.Tracer
+
+	// Grace is how long in-flight requests may finish once ctx is cancelled.
+	Grace time.Duration
+
+	// MaxErrors > 0 aborts the run once more requests than that have failed:
+	// no new requests are issued, as when ctx is cancelled, and the partial
+	// result has Aborted set.
+	MaxErrors int
+
+	// MinSamples flags Result.Latency as Insignificant when fewer
+	// requests than that succeeded (0 = never).
+	MinSamples int
+
+	// Snapshot, when set, makes Run call OnSnapshot with the stats so far on
+	// every receive without stopping the run.
+	Snapshot   <-chan struct{}
+	OnSnapshot func(Snapshot)
+}
+
+// Result holds the statistics of a finished (or interrupted) run. It
+// encodes to JSON with durations in nanoseconds (see WriteJSON).
+type Result struct {
+	Target      string        `json:"target"` // comma-separated with Targets
+	Seed        int64         `json:"seed"`
+	Interrupted bool          `json:"interrupted"` // ctx was cancelled before every request completed
+	Duration    time.Duration `json:"duration_ns"`
+	Throughput  float64       `json:"throughput"` // completed requests per second
+
+	OK          int   `json:"ok"`
+	Errors      int   `json:"errors"`
+	Status4xx   int   `json:"status_4xx"`
+	Status5xx   int   `json:"status_5xx"`
+	StatusOther int   `json:"status_other"`
+	FirstErr    error `json:"-"`
+
+	Aborted bool `json:"aborted,omitempty"` // stopped after more than MaxErrors errors
+
+	PrewarmConns int `json:"prewarm_conns,omitempty"`
+	ReplayBodies int `json:"replay_bodies,omitempty"` // bodies indexed from ReplayFile
+
+	// Latency covers successful (2xx) requests only.
+	Latency LatencyStats `json:"latency"`
+
+	Compared int `json:"compared,omitempty"` // only with Compare
+	Diverged int `json:"diverged,omitempty"`
+
+	EchoMatched    int `json:"echo_matched,omitempty"` // only with ExpectEcho
+	EchoMismatched int `json:"echo_mismatched,omitempty"`
+
+	Cold    int           `json:"cold,omitempty"` // only with ColdStartHeader
+	Warm    int           `json:"warm,omitempty"`
+	ColdAvg time.Duration `json:"cold_avg_ns,omitempty"`
+	WarmAvg time.Duration `json:"warm_avg_ns,omitempty"`
+
+	// Responses per negotiated protocol, e.g. {"HTTP/2.0": 1000}
+	Protocols map[string]int `json:"protocols,omitempty"`
+
+	// Requests that failed without a response, by class (ErrorClasses
+	// order, classes without failures omitted)
+	TransportErrors []TransportErrorStats `json:"transport_errors,omitempty"`
+
+	NewConns     int           `json:"new_conns,omitempty"` // only with NoKeepAlive or Prewarm
+	ConnSetupAvg time.Duration `json:"conn_setup_avg_ns,omitempty"`
+
+	Targets []TargetStats `json:"targets,omitempty"` // only with Config.Targets, in its order
+	Workers []WorkerStats `json:"workers,omitempty"` // only with PerWorker, indexed by worker ID
+	Windows []WindowStats `json:"windows,omitempty"` // only with Window, in time order
+
+	TraceErr error `json:"-"` // first span export failure, only with Tracer
+}
+
+// WorkerStats summarises one worker's successful requests.
+type WorkerStats struct {
+	ID    int           `json:"id"`
+	Count int           `json:"count"`
+	P50   time.Duration `json:"p50_ns"`
+	P99   time.Duration `json:"p99_ns"`
+}
+
+// WindowStats summarises the requests started within one time window.
+type WindowStats struct {
+	Start      time.Duration `json:"start_ns"` // offset from the start of the run
+	OK         int           `json:"ok"`
+	Errors     int           `json:"errors"`
+	Throughput float64       `json:"throughput"` // completed requests per second of window
+	P50        time.Duration `json:"p50_ns"`     // successful requests only
+	P99        time.Duration `json:"p99_ns"`
+}
+
+// LatencyStats summarises a set of request latencies.
+type LatencyStats struct {
+	Count int           `json:"count"`
+	Min   time.Duration `json:"min_ns"`
+	Avg   time.Duration `json:"avg_ns"`
+	Max   time.Duration `json:"max_ns"`
+	P50   time.Duration `json:"p50_ns"`
+	P90   time.Duration `json:"p90_ns"`
+	P95   time.Duration `json:"p95_ns"`
+	P99   time.Duration `json:"p99_ns"`
+
+	// Fewer than Config.MinSamples successful requests: too few for the
+	// percentiles to mean much
+	Insignificant bool `json:"insignificant,omitempty"`
+}
+
+// Snapshot is a point-in-time view of a run in progress.
+type Snapshot struct {
+	Elapsed                           time.Duration
+	Issued                            int
+	OK, Errors                        int
+	Status4xx, Status5xx, StatusOther int
+	Throughput                        float64
+	P50, P90, P99                     time.Duration
+}
+
+// Target returns the URL requests are sent to: URL, or <URL>/compare with
+// Compare.
+func (cfg Config) Target() (string, error) {
+	return cfg.targetURL(cfg.URL)
+}
+
+func (cfg Config) targetURL(raw string) (string, error) {
+	if !cfg.Compare {
+		return raw, nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", err
+	}
+	u.Path = strings.TrimRight(u.Path, "/") + "/compare"
+	return u.String(), nil
+}
+
+// DefaultUserAgent is "load-serverless-client/<version>", the version being
+// the binary's module version or else its short VCS revision ("dev" when
+// neither is stamped).
+func DefaultUserAgent() string {
+	version := "dev"
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if v := info.Main.Version; v != "" && v != "(devel)" {
+			version = v
+		} else {
+			for _, s := range info.Settings {
+				if s.Key == "vcs.revision" && len(s.Value) >= 7 {
+					version = s.Value[:7]
+				}
+			}
+		}
+	}
+	return "load-serverless-client/" + version
+}
+
+// requestHeaders merges the identifying headers with cfg.Headers, which
+// take precedence. Content-Type is left to the caller.
+func (cfg Config) requestHeaders() http.Header {
+	h := http.Header{}
+	h.Set("User-Agent", cmp.Or(cfg.UserAgent, DefaultUserAgent()))
+	if cfg.MarkLoadTest {
+		h.Set(LoadTestHeader, "true")
+	}
+	for k, vv := range cfg.Headers {
+		h[k] = vv
+	}
+	return h
+}
+
+// withTemplate appends URLTemplate to target, without doubling a slash.
+func withTemplate(target, tmpl string) string {
+	if strings.HasPrefix(tmpl, "/") {
+		target = strings.TrimSuffix(target, "/")
+	}
+	return target + tmpl
+}
+
+// expandURL replaces URLTemplate's placeholders in target.
+func expandURL(target, idx, rnd string) string {
+	target = strings.ReplaceAll(target, "{i}", idx)
+	return strings.ReplaceAll(target, "{rand}", rnd)
+}
+
+func (cfg Config) validate() error {
+	switch {
+	case cfg.URL == "" && len(cfg.Targets) == 0:
+		return errors.New("missing URL")
+	case cfg.URL != "" && len(cfg.Targets) > 0:
+		return errors.New("URL and Targets are mutually exclusive")
+	case cfg.Fanout && len(cfg.Targets) < 2:
+		return errors.New("Fanout needs at least two Targets")
+	case cfg.URLTemplate != "" && cfg.Compare:
+		return errors.New("URLTemplate and Compare are mutually exclusive")
+	case cfg.Requests <= 0 || cfg.Concurrency <= 0:
+		return errors.New("Requests and Concurrency must be > 0")
+	case cfg.Precision < 0 || cfg.Precision > 15:
+		return errors.New("Precision should be between 0 and 15")
+	case cfg.PadBytes < 0:
+		return errors.New("PadBytes must be >= 0")
+	case cfg.PadBytes > 0 && cfg.ReplayFile != "":
+		return errors.New("PadBytes and ReplayFile are mutually exclusive")
+	case cfg.MaxConnsPerHost < 0 || cfg.MaxIdleConns < 0 || cfg.IdleTimeout < 0:
+		return errors.New("MaxConnsPerHost, MaxIdleConns and IdleTimeout must be >= 0")
+	case cfg.ConnectTimeout < 0 || cfg.TLSTimeout < 0 || cfg.ResponseHeaderTimeout < 0:
+		return errors.New("ConnectTimeout, TLSTimeout and ResponseHeaderTimeout must be >= 0")
+	case cfg.IPFamily != "" && cfg.IPFamily != IPFamilyAny && cfg.IPFamily != IPFamily4 && cfg.IPFamily != IPFamily6:
+		return fmt.Errorf("IPFamily must be %q, %q or %q", IPFamilyAny, IPFamily4, IPFamily6)
+	case cfg.Window < 0:
+		return errors.New("Window must be >= 0")
+	case cfg.MaxErrors < 0 || cfg.MinSamples < 0:
+		return errors.New("MaxErrors and MinSamples must be >= 0")
+	case cfg.Prewarm < 0:
+		return errors.New("Prewarm must be >= 0")
+	case cfg.Client == nil && cfg.Prewarm > cmp.Or(cfg.MaxIdleConns, DefaultMaxIdleConns):
+		return fmt.Errorf("Prewarm (%d) exceeds MaxIdleConns (%d): the pool would close the extra connections", cfg.Prewarm, cmp.Or(cfg.MaxIdleConns, DefaultMaxIdleConns))
+	case cfg.ExpectEcho && cfg.Compare:
+		return errors.New("ExpectEcho and Compare are mutually exclusive")
+	case cfg.Cluster && (cfg.ClusterCenters <= 0 || cfg.ClusterStdDev < 0):
+		return errors.New("ClusterCenters must be > 0 and ClusterStdDev >= 0")
+	case cfg.ReplayOrder != "" && cfg.ReplayOrder != ReplayRoundRobin && cfg.ReplayOrder != ReplayRandom:
+		return fmt.Errorf("ReplayOrder must be %q or %q", ReplayRoundRobin, ReplayRandom)
+	}
+	if cfg.URLTemplate != "" {
+		for _, u := range append([]string{cfg.URL}, targetURLs(cfg.Targets)...) {
+			if u == "" {
+				continue
+			}
+			if err := checkTargetURL(expandURL(withTemplate(u, cfg.URLTemplate), "0", "0")); err != nil {
+				return fmt.Errorf("URLTemplate: %w", err)
+			}
+		}
+	}
+	for _, t := range cfg.Targets {
+		if t.Weight < 0 {
+			return fmt.Errorf("target %s: Weight must be >= 0", t.URL)
+		}
+		if err := checkTargetURL(t.URL); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewClient returns the pooled HTTP client used when Config.Client is nil,
+// sized by cfg's pool settings and honouring NoKeepAlive and the phase
+// timeouts.
+func NewClient(cfg Config) *http.Client {
+	cfg.applyPoolDefaults()
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: familyDialer(&net.Dialer{
+			Timeout:   cfg.ConnectTimeout,
+			KeepAlive: 30 * time.Second,
+		}, cfg.IPFamily),
+
+		ForceAttemptHTTP2: !cfg.HTTP1,
+
+		MaxIdleConns:        cfg.MaxIdleConns,
+		MaxIdleConnsPerHost: cfg.MaxIdleConns,
+		MaxConnsPerHost:     cfg.MaxConnsPerHost,
+
+		IdleConnTimeout:       cfg.IdleTimeout,
+		TLSHandshakeTimeout:   cfg.TLSTimeout,
+		ResponseHeaderTimeout: cfg.ResponseHeaderTimeout,
+		ExpectContinueTimeout: 1 * time.Second,
+
+		DisableKeepAlives: cfg.NoKeepAlive,
+	}
+	if cfg.HTTP1 {
+		// A non-nil empty map keeps the transport from upgrading to h2 via ALPN
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return &http.Client{Transport: transport}
+}
+
+// familyDialer returns d.DialContext, dialing family (an IPFamily* value)
+// instead of the network the transport asks for unless that's IPFamilyAny.
+func familyDialer(d *net.Dialer, family string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if family == "" || family == IPFamilyAny {
+		return d.DialContext
+	}
+	return func(ctx context.Context, _, addr string) (net.Conn, error) {
+		return d.DialContext(ctx, family, addr)
+	}
+}
+
+// applyPoolDefaults fills zero pool settings and connect/TLS timeouts with
+// the Default* values.
+func (cfg *Config) applyPoolDefaults() {
+	if cfg.MaxConnsPerHost == 0 {
+		cfg.MaxConnsPerHost = DefaultMaxConnsPerHost
+	}
+	if cfg.MaxIdleConns == 0 {
+		cfg.MaxIdleConns = DefaultMaxIdleConns
+	}
+	if cfg.IdleTimeout == 0 {
+		cfg.IdleTimeout = DefaultIdleTimeout
+	}
+	if cfg.ConnectTimeout == 0 {
+		cfg.ConnectTimeout = DefaultConnectTimeout
+	}
+	if cfg.TLSTimeout == 0 {
+		cfg.TLSTimeout = DefaultTLSTimeout
+	}
+}
+
+// Run performs the load run described by cfg. Cancelling ctx stops issuing
+// requests; in-flight ones get cfg.Grace to finish and the partial result is
+// returned with Interrupted set. The error is non-nil only for an invalid cfg.
+func Run(ctx context.Context, cfg Config) (Result, error) {
+	if err := cfg.validate(); err != nil {
+		return Result{}, err
+	}
+	// Exceeding MaxErrors cancels the run's own ctx, so it isn't reported
+	// as Interrupted
+	parent := ctx
+	ctx, abort := context.WithCancel(ctx)
+	defer abort()
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	if cfg.MaxBody == 0 {
+		cfg.MaxBody = 1 << 20
+	}
+	urls := []string{cfg.URL}
+	var schedule []int // target index per request slot, nil with a single URL
+	if len(cfg.Targets) > 0 {
+		urls = targetURLs(cfg.Targets)
+		schedule = targetSchedule(cfg.Targets)
+	}
+	targets := make([]string, len(urls))
+	for i, u := range urls {
+		var err error
+		if targets[i], err = cfg.targetURL(u); err != nil {
+			return Result{}, fmt.Errorf("invalid URL: %w", err)
+		}
+	}
+	// Prewarming only needs the hosts; targets keep URLTemplate's
+	// placeholders, which Result.Target shows too
+	baseTargets := targets
+	if cfg.URLTemplate != "" {
+		targets = slices.Clone(targets)
+		for i := range targets {
+			targets[i] = withTemplate(targets[i], cfg.URLTemplate)
+		}
+	}
+
+	res := Result{Target: strings.Join(targets, ","), Seed: cfg.Seed}
+	if res.Seed == 0 {
+		res.Seed = time.Now().UnixNano()
+	}
+
+	var clusterCenters []latLng
+	if cfg.Cluster {
+		clusterCenters = randomCenters(rand.New(rand.NewSource(res.Seed)), cfg.ClusterCenters)
+	}
+
+	var padding string
+	if cfg.PadBytes > 0 {
+		padding = strings.Repeat("x", cfg.PadBytes)
+	}
+
+	var replay *replaySource
+	if cfg.ReplayFile != "" {
+		var err error
+		if replay, err = openReplay(cfg.ReplayFile); err != nil {
+			return Result{}, fmt.Errorf("replay file: %w", err)
+		}
+		defer replay.Close()
+		res.ReplayBodies = replay.len()
+	}
+
+	headers := cfg.requestHeaders()
+	client := cfg.Client
+	if client == nil {
+		client = NewClient(cfg)
+	}
+
+	if cfg.Prewarm > 0 {
+		for _, target := range baseTargets {
+			res.PrewarmConns += int(prewarmPool(client, target, headers, cfg.Prewarm, cfg.Timeout))
+		}
+	}
+
+	// With Fanout every logical request fills one slot per target: request i
+	// to target ti is slot i*fan+ti. Otherwise slot i is request i.
+	n := cfg.Requests
+	fan := 1
+	if cfg.Fanout {
+		fan = len(targets)
+	}
+	latencies := make([]int64, n*fan) // ns for successful (2xx) requests only
+	var (
+		nextIdx     uint64
+		okCount     uint64
+		errCount    uint64
+		status4xx   uint64
+		status5xx   uint64
+		statusOther uint64
+		newConns    uint64 // only tracked with NoKeepAlive or Prewarm
+		connSetupNs int64
+		compared    uint64 // only tracked with Compare
+		diverged    uint64
+		echoOK      uint64 // only tracked with ExpectEcho
+		echoBad     uint64
+		coldCount   uint64 // only tracked with ColdStartHeader
+		coldNs      int64
+		warmCount   uint64
+		warmNs      int64
+	)
+	var targetReqs, targetOK []uint64 // per target, only with schedule
+	if schedule != nil {
+		targetReqs = make([]uint64, len(targets))
+		targetOK = make([]uint64, len(targets))
+	}
+	var seenInstances sync.Map
+	var protoCounts sync.Map // resp.Proto -> *uint64
+	var firstErr atomic.Value
+	classCounts := make([]uint64, len(ErrorClasses))      // transport errors by class
+	classFirst := make([]atomic.Value, len(ErrorClasses)) // and the first of each
+
+	// Each worker appends only to its own slice, so no locking is needed
+	var workerLat [][]int64
+	if cfg.PerWorker {
+		workerLat = make([][]int64, cfg.Concurrency)
+	}
+
+	// Start offsets (ns since the run began) by slot, only with Window;
+	// 0 = never issued, so offsets are stored +1
+	var startOffsets []int64
+	if cfg.Window > 0 {
+		startOffsets = make([]int64, n*fan)
+	}
+
+	// Start barrier so workers begin together
+	startCh := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(cfg.Concurrency)
+
+	// Reuse buffers to reduce allocations
+	bufPool := sync.Pool{
+		New: func() any { return new(bytes.Buffer) },
+	}
+
+	// Cancelling ctx stops new requests; in-flight ones are cancelled after Grace.
+	reqCtx, cancelInFlight := context.WithCancel(context.Background())
+	defer cancelInFlight()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			time.AfterFunc(cfg.Grace, cancelInFlight)
+		case <-done:
+		}
+	}()
+
+	beginAll := time.Now()
+
+	if cfg.Snapshot != nil && cfg.OnSnapshot != nil {
+		go func() {
+			for {
+				select {
+				case <-cfg.Snapshot:
+				case <-done:
+					return
+				}
+				var sofar []int64
+				for i := range latencies {
+					if ns := atomic.LoadInt64(&latencies[i]); ns > 0 {
+						sofar = append(sofar, ns)
+					}
+				}
+				sort.Slice(sofar, func(i, j int) bool { return sofar[i] < sofar[j] })
+
+				elapsed := time.Since(beginAll)
+				okSoFar := atomic.LoadUint64(&okCount)
+				errSoFar := atomic.LoadUint64(&errCount)
+				cfg.OnSnapshot(Snapshot{
+					Elapsed:     elapsed,
+					Issued:      int(min(atomic.LoadUint64(&nextIdx), uint64(n))) * fan,
+					OK:          int(okSoFar),
+					Errors:      int(errSoFar),
+					Status4xx:   int(atomic.LoadUint64(&status4xx)),
+					Status5xx:   int(atomic.LoadUint64(&status5xx)),
+					StatusOther: int(atomic.LoadUint64(&statusOther)),
+					Throughput:  float64(okSoFar+errSoFar) / elapsed.Seconds(),
+					P50:         time.Duration(percentile(sofar, 0.50)),
+					P90:         time.Duration(percentile(sofar, 0.90)),
+					P99:         time.Duration(percentile(sofar, 0.99)),
+				})
+			}
+		}()
+	}
+
+	var aborted atomic.Bool
+	addErrors := func(k uint64) {
+		if total := atomic.AddUint64(&errCount, k); cfg.MaxErrors > 0 && total > uint64(cfg.MaxErrors) && !aborted.Swap(true) {
+			abort()
+		}
+	}
+
+	// send posts payload to target ti as slot and records the outcome. It
+	// returns the latency in ns of a successful request, 0 otherwise.
+	send := func(slot, ti int, target string, payload []byte) int64 {
+		if targetReqs != nil {
+			atomic.AddUint64(&targetReqs[ti], 1)
+		}
+		ctx, cancel := context.WithTimeout(reqCtx, cfg.Timeout)
+		if cfg.NoKeepAlive || cfg.Prewarm > 0 {
+			ctx = httptrace.WithClientTrace(ctx, connSetupTrace(&newConns, &connSetupNs))
+		}
+		start := time.Now()
+		if startOffsets != nil {
+			startOffsets[slot] = start.Sub(beginAll).Nanoseconds() + 1
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(payload))
+		if err != nil {
+			cancel()
+			addErrors(1)
+			storeFirstErr(&firstErr, fmt.Errorf("new request: %w", err))
+			return 0
+		}
+		req.Header.Set("Content-Type", "application/json")
+		for k, vv := range headers {
+			req.Header[k] = vv
+		}
+		span := cfg.Tracer.Start(http.MethodPost, tracing.SpanKindClient, nil, "")
+		span.Inject(req.Header)
+
+		resp, err := client.Do(req)
+		if err != nil {
+			endSpan(span, target, 0, time.Since(start), err)
+			cancel()
+			addErrors(1)
+			err = fmt.Errorf("do request: %w", err)
+			storeFirstErr(&firstErr, err)
+			ci := slices.Index(ErrorClasses, classifyErr(err))
+			atomic.AddUint64(&classCounts[ci], 1)
+			storeFirstErr(&classFirst[ci], err)
+			return 0
+		}
+
+		if cfg.Compare && resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			var cr compareResult
+			if json.NewDecoder(io.LimitReader(resp.Body, cfg.MaxBody)).Decode(&cr) == nil {
+				atomic.AddUint64(&compared, 1)
+				if greatCircleKm(cr.Spherical, cr.Simple) > cfg.CompareTol {
+					atomic.AddUint64(&diverged, 1)
+				}
+			}
+		}
+		if cfg.ExpectEcho && resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			body, err := io.ReadAll(io.LimitReader(resp.Body, cfg.MaxBody))
+			if err == nil && echoes(body, resp.Header.Get(BodyChecksumHeader), payload) {
+				atomic.AddUint64(&echoOK, 1)
+			} else {
+				atomic.AddUint64(&echoBad, 1)
+			}
+		}
+
+		// Read & discard body (critical for keep-alive reuse)
+		_, _ = io.CopyN(io.Discard, resp.Body, cfg.MaxBody)
+		_ = resp.Body.Close()
+		cancel()
+
+		dur := time.Since(start)
+		endSpan(span, target, resp.StatusCode, dur, nil)
+
+		if c, ok := protoCounts.Load(resp.Proto); ok {
+			atomic.AddUint64(c.(*uint64), 1)
+		} else {
+			c, _ := protoCounts.LoadOrStore(resp.Proto, new(uint64))
+			atomic.AddUint64(c.(*uint64), 1)
+		}
+
+		if cfg.ColdStartHeader != "" {
+			if id := resp.Header.Get(cfg.ColdStartHeader); id != "" {
+				if _, seen := seenInstances.LoadOrStore(id, struct{}{}); seen {
+					atomic.AddUint64(&warmCount, 1)
+					atomic.AddInt64(&warmNs, dur.Nanoseconds())
+				} else {
+					atomic.AddUint64(&coldCount, 1)
+					atomic.AddInt64(&coldNs, dur.Nanoseconds())
+				}
+			}
+		}
+
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			atomic.StoreInt64(&latencies[slot], dur.Nanoseconds())
+			atomic.AddUint64(&okCount, 1)
+			if targetOK != nil {
+				atomic.AddUint64(&targetOK[ti], 1)
+			}
+			return dur.Nanoseconds()
+		}
+		addErrors(1)
+		switch {
+		case resp.StatusCode >= 400 && resp.StatusCode < 500:
+			atomic.AddUint64(&status4xx, 1)
+		case resp.StatusCode >= 500 && resp.StatusCode < 600:
+			atomic.AddUint64(&status5xx, 1)
+		default:
+			atomic.AddUint64(&statusOther, 1)
+		}
+		return 0
+	}
+
+	for w := 0; w < cfg.Concurrency; w++ {
+		workerID := w
+		go func() {
+			defer wg.Done()
+			<-startCh
+
+			// One RNG per worker to avoid locks/contention. With
+			// DeterministicPayloads it is reseeded for every request index.
+			var idxSrc splitMix64
+			rng := rand.New(rand.NewSource(res.Seed + int64(workerID)*1_000_003))
+			if cfg.DeterministicPayloads {
+				rng = rand.New(&idxSrc)
+			}
+			okNs := make([]int64, fan) // per slot of the current request
+
+			for {
+				if ctx.Err() != nil {
+					return
+				}
+				i := int(atomic.AddUint64(&nextIdx, 1) - 1)
+				if i >= n {
+					return
+				}
+
+				if cfg.DeterministicPayloads {
+					idxSrc.Seed(res.Seed ^ int64(i)*-0x61c8864680b583eb)
+				}
+
+				// Build the payload: a recorded body, or random points (4)
+				buf := bufPool.Get().(*bytes.Buffer)
+				buf.Reset()
+				if replay != nil {
+					j := i % replay.len()
+					if cfg.ReplayOrder == ReplayRandom {
+						j = rng.Intn(replay.len())
+					}
+					if err := replay.write(buf, j); err != nil {
+						bufPool.Put(buf)
+						addErrors(uint64(fan))
+						storeFirstErr(&firstErr, err)
+						continue
+					}
+				} else if cfg.Cluster {
+					writeClusteredPayload(buf, rng, cfg.Precision, clusterCenters[rng.Intn(len(clusterCenters))], cfg.ClusterStdDev)
+				} else {
+					writeRandomPayload(buf, rng, cfg.Precision)
+				}
+				if padding != "" {
+					padPayload(buf, padding)
+				}
+				payload := buf.Bytes()
+
+				// Fill in URLTemplate, with the same values for every target
+				// of a fanned out request
+				reqTargets := targets
+				if cfg.URLTemplate != "" {
+					idx, rnd := strconv.Itoa(i), strconv.FormatUint(rng.Uint64(), 10)
+					reqTargets = make([]string, len(targets))
+					for ti, t := range targets {
+						reqTargets[ti] = expandURL(t, idx, rnd)
+					}
+				}
+
+				// Send it to the scheduled target or, with Fanout, to every
+				// target at once
+				if cfg.Fanout {
+					var fw sync.WaitGroup
+					for ti, target := range reqTargets {
+						fw.Add(1)
+						go func() {
+							defer fw.Done()
+							okNs[ti] = send(i*fan+ti, ti, target, payload)
+						}()
+					}
+					fw.Wait()
+				} else {
+					target, ti := reqTargets[0], 0
+					if schedule != nil {
+						ti = schedule[i%len(schedule)]
+						target = reqTargets[ti]
+					}
+					okNs[0] = send(i, ti, target, payload)
+				}
+
+				// Done with buffer
+				bufPool.Put(buf)
+
+				if workerLat != nil {
+					for _, ns := range okNs {
+						if ns > 0 {
+							workerLat[workerID] = append(workerLat[workerID], ns)
+						}
+					}
+				}
+			}
+		}()
+	}
+
+	close(startCh)
+	wg.Wait()
+
+	res.Duration = time.Since(beginAll)
+	res.OK = int(atomic.LoadUint64(&okCount))
+	res.Errors = int(atomic.LoadUint64(&errCount))
+	var targetLat [][]int64 // successful latencies per target
+	if len(cfg.Targets) > 0 {
+		targetLat = make([][]int64, len(targets))
+		for slot, ns := range latencies {
+			if ns == 0 {
+				continue
+			}
+			ti := slot % fan
+			if !cfg.Fanout {
+				ti = schedule[slot%len(schedule)]
+			}
+			targetLat[ti] = append(targetLat[ti], ns)
+		}
+	}
+	for i, t := range cfg.Targets {
+		reqs, ok := int(atomic.LoadUint64(&targetReqs[i])), int(atomic.LoadUint64(&targetOK[i]))
+		ls := latencyStats(targetLat[i])
+		res.Targets = append(res.Targets, TargetStats{URL: targets[i], Weight: max(t.Weight, 1), Requests: reqs, OK: ok, Errors: reqs - ok, P50: ls.P50, P99: ls.P99})
+	}
+	res.Interrupted = res.OK+res.Errors < n*fan && parent.Err() != nil
+	res.Aborted = aborted.Load()
+	res.Throughput = float64(res.OK+res.Errors) / res.Duration.Seconds()
+	res.Status4xx = int(atomic.LoadUint64(&status4xx))
+	res.Status5xx = int(atomic.LoadUint64(&status5xx))
+	res.StatusOther = int(atomic.LoadUint64(&statusOther))
+	if v := firstErr.Load(); v != nil {
+		res.FirstErr = v.(error)
+	}
+	for ci, class := range ErrorClasses {
+		if count := int(atomic.LoadUint64(&classCounts[ci])); count > 0 {
+			first := classFirst[ci].Load().(error)
+			res.TransportErrors = append(res.TransportErrors, TransportErrorStats{Class: class, Count: count, First: first.Error()})
+		}
+	}
+	res.TraceErr = cfg.Tracer.Flush()
+
+	res.Compared = int(atomic.LoadUint64(&compared))
+	res.Diverged = int(atomic.LoadUint64(&diverged))
+	res.EchoMatched = int(atomic.LoadUint64(&echoOK))
+	res.EchoMismatched = int(atomic.LoadUint64(&echoBad))
+
+	res.Cold = int(atomic.LoadUint64(&coldCount))
+	res.Warm = int(atomic.LoadUint64(&warmCount))
+	if res.Cold > 0 {
+		res.ColdAvg = time.Duration(atomic.LoadInt64(&coldNs) / int64(res.Cold))
+	}
+	if res.Warm > 0 {
+		res.WarmAvg = time.Duration(atomic.LoadInt64(&warmNs) / int64(res.Warm))
+	}
+
+	protoCounts.Range(func(k, v any) bool {
+		if res.Protocols == nil {
+			res.Protocols = make(map[string]int)
+		}
+		res.Protocols[k.(string)] = int(atomic.LoadUint64(v.(*uint64)))
+		return true
+	})
+
+	res.NewConns = int(atomic.LoadUint64(&newConns))
+	if res.NewConns > 0 {
+		res.ConnSetupAvg = time.Duration(atomic.LoadInt64(&connSetupNs) / int64(res.NewConns))
+	}
+
+	// Collect OK latencies
+	okLat := make([]int64, 0, res.OK)
+	for _, ns := range latencies {
+		if ns > 0 {
+			okLat = append(okLat, ns)
+		}
+	}
+	res.Latency = latencyStats(okLat)
+	res.Latency.Insignificant = res.Latency.Count > 0 && res.Latency.Count < cfg.MinSamples
+
+	if startOffsets != nil {
+		res.Windows = windowStats(startOffsets, latencies, cfg.Window, res.Duration)
+	}
+
+	for id, ns := range workerLat {
+		ls := latencyStats(ns)
+		res.Workers = append(res.Workers, WorkerStats{ID: id, Count: ls.Count, P50: ls.P50, P99: ls.P99})
+	}
+
+	return res, nil
+}
+
+// BodyChecksumHeader carries the hex SHA-256 of the request body as the
+// server received it (the server's GEO_BODY_CHECKSUM mode).
+const BodyChecksumHeader = "X-Body-Checksum"
+
+// echoes reports whether body is payload echoed back (ignoring surrounding
+// whitespace), or body or the checksum header carries payload's hex SHA-256.
+func echoes(body []byte, checksum string, payload []byte) bool {
+	if bytes.Equal(bytes.TrimSpace(body), bytes.TrimSpace(payload)) {
+		return true
+	}
+	sum := sha256.Sum256(payload)
+	want := hex.EncodeToString(sum[:])
+	if checksum != "" {
+		return strings.EqualFold(checksum, want)
+	}
+	return bytes.Contains(bytes.ToLower(body), []byte(want))
+}
+
+// windowStats bins issued requests by start offset (stored +1) into windows
+// of length w. latencies holds the ns of successful requests, 0 otherwise.
+// The last window's throughput counts only the part before total.
+func windowStats(startOffsets, latencies []int64, w, total time.Duration) []WindowStats {
+	var bins [][]int64 // successful latencies per window
+	var errs []int
+	for i, off := range startOffsets {
+		if off == 0 {
+			continue
+		}
+		k := int((off - 1) / int64(w))
+		for len(bins) <= k {
+			bins = append(bins, nil)
+			errs = append(errs, 0)
+		}
+		if latencies[i] > 0 {
+			bins[k] = append(bins[k], latencies[i])
+		} else {
+			errs[k]++
+		}
+	}
+	out := make([]WindowStats, len(bins))
+	for k, ns := range bins {
+		sort.Slice(ns, func(a, b int) bool { return ns[a] < ns[b] })
+		start := time.Duration(k) * w
+		span := min(w, total-start)
+		if span <= 0 {
+			span = w
+		}
+		out[k] = WindowStats{
+			Start:      start,
+			OK:         len(ns),
+			Errors:     errs[k],
+			Throughput: float64(len(ns)+errs[k]) / span.Seconds(),
+			P50:        time.Duration(percentile(ns, 0.50)),
+			P99:        time.Duration(percentile(ns, 0.99)),
+		}
+	}
+	return out
+}
+
+// latencyStats sorts ns in place and summarises it.
+func latencyStats(ns []int64) LatencyStats {
+	if len(ns) == 0 {
+		return LatencyStats{}
+	}
+	sort.Slice(ns, func(i, j int) bool { return ns[i] < ns[j] })
+
+	var sum int64
+	for _, v := range ns {
+		sum += v
+	}
+	return LatencyStats{
+		Count: len(ns),
+		Min:   time.Duration(ns[0]),
+		Avg:   time.Duration(sum / int64(len(ns))),
+		Max:   time.Duration(ns[len(ns)-1]),
+		P50:   time.Duration(percentile(ns, 0.50)),
+		P90:   time.Duration(percentile(ns, 0.90)),
+		P95:   time.Duration(percentile(ns, 0.95)),
+		P99:   time.Duration(percentile(ns, 0.99)),
+	}
+}
+
+// prewarmPool fires n concurrent HEAD requests at target so the transport
+// holds n idle connections when the measured run starts. Responses are
+// drained and not recorded; they carry header. It returns how many
+// connections were opened.
+func prewarmPool(client *http.Client, target string, header http.Header, n int, timeout time.Duration) uint64 {
+	var newConns uint64
+	var setupNs int64
+
+	startCh := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			<-startCh
+
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			ctx = httptrace.WithClientTrace(ctx, connSetupTrace(&newConns, &setupNs))
+
+			req, err := http.NewRequestWithContext(ctx, http.MethodHead, target, nil)
+			if err != nil {
+				return
+			}
+			req.Header = header.Clone()
+			resp, err := client.Do(req)
+			if err != nil {
+				return
+			}
+			_, _ = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+		}()
+	}
+	close(startCh)
+	wg.Wait()
+
+	return atomic.LoadUint64(&newConns)
+}
+
+// connSetupTrace counts new connections and the time spent establishing them
+// (from asking the pool for a connection until one is ready).
+func connSetupTrace(newConns *uint64, setupNs *int64) *httptrace.ClientTrace {
+	var getConnAt time.Time
+	return &httptrace.ClientTrace{
+		GetConn: func(string) { getConnAt = time.Now() },
+		GotConn: func(info httptrace.GotConnInfo) {
+			if !info.Reused {
+				atomic.AddUint64(newConns, 1)
+				atomic.AddInt64(setupNs, int64(time.Since(getConnAt)))
+			}
+		},
+	}
+}
+
+type latLng struct {
+	Lat float64 `json:"lat"`
+	Lng float64 `json:"lng"`
+}
+
+// compareResult is the server's /geo_average/compare response.
+type compareResult struct {
+	Spherical latLng `json:"spherical"`
+	Simple    latLng `json:"simple"`
+}
+
+// greatCircleKm is the haversine distance between two points.
+func greatCircleKm(a, b latLng) float64 {
+	const earthRadiusKm = 6371.0
+	toRad := math.Pi / 180
+	dLat := (b.Lat - a.Lat) * toRad
+	dLng := (b.Lng - a.Lng) * toRad
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(a.Lat*toRad)*math.Cos(b.Lat*toRad)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(math.Min(1, h)))
+}
+
+// Generates 4 random points globally: lat [-90,90], lng [-180,180]
+func writeRandomPayload(buf *bytes.Buffer, rng *rand.Rand, prec int) {
+	buf.WriteString(`{"points":[`)
+	for i := 0; i < 4; i++ {
+		lat := -90.0 + rng.Float64()*180.0
+		lng := -180.0 + rng.Float64()*360.0
+
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(`{"lat":`)
+		buf.WriteString(strconv.FormatFloat(lat, 'f', prec, 64))
+		buf.WriteString(`,"lng":`)
+		buf.WriteString(strconv.FormatFloat(lng, 'f', prec, 64))
+		buf.WriteByte('}')
+	}
+	buf.WriteString(`]}`)
+}
+
+// padPayload adds padding to the JSON object in buf as a "_pad" string
+// field, which the geo handlers ignore. padding must need no escaping.
+func padPayload(buf *bytes.Buffer, padding string) {
+	buf.Truncate(buf.Len() - 1) // the closing '}'
+	buf.WriteString(`,"_pad":"`)
+	buf.WriteString(padding)
+	buf.WriteString(`"}`)
+}
+
+// randomCenters picks n cluster centers uniformly over the globe.
+func randomCenters(rng *rand.Rand, n int) []latLng {
+	out := make([]latLng, n)
+	for i := range out {
+		out[i] = latLng{Lat: -90.0 + rng.Float64()*180.0, Lng: -180.0 + rng.Float64()*360.0}
+	}
+	return out
+}
+
+// Generates 4 points normally distributed (sd degrees) around center,
+// clamping latitude and wrapping longitude back into range
+func writeClusteredPayload(buf *bytes.Buffer, rng *rand.Rand, prec int, center latLng, sd float64) {
+	buf.WriteString(`{"points":[`)
+	for i := 0; i < 4; i++ {
+		lat := math.Max(-90, math.Min(90, center.Lat+rng.NormFloat64()*sd))
+		lng := math.Mod(center.Lng+rng.NormFloat64()*sd+540, 360) - 180
+
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(`{"lat":`)
+		buf.WriteString(strconv.FormatFloat(lat, 'f', prec, 64))
+		buf.WriteString(`,"lng":`)
+		buf.WriteString(strconv.FormatFloat(lng, 'f', prec, 64))
+		buf.WriteByte('}')
+	}
+	buf.WriteString(`]}`)
+}
+
+func percentile(sortedNs []int64, p float64) int64 {
+	if len(sortedNs) == 0 {
+		return 0
+	}
+	if p <= 0 {
+		return sortedNs[0]
+	}
+	if p >= 1 {
+		return sortedNs[len(sortedNs)-1]
+	}
+	rank := int(math.Ceil(p*float64(len(sortedNs)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(sortedNs) {
+		rank = len(sortedNs) - 1
+	}
+	return sortedNs[rank]
+}
+
+// splitMix64 is a rand.Source that is cheap to reseed, used to give every
+// request index its own stream under Config.DeterministicPayloads.
+type splitMix64 struct{ state uint64 }
+
+func (s *splitMix64) Seed(seed int64) { s.state = uint64(seed) }
+
+func (s *splitMix64) Uint64() uint64 {
+	s.state += 0x9e3779b97f4a7c15
+	z := s.state
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+func (s *splitMix64) Int63() int64 { return int64(s.Uint64() >> 1) }
+
+func storeFirstErr(slot *atomic.Value, err error) {
+	if slot.Load() == nil {
+		slot.Store(err)
+	}
+}
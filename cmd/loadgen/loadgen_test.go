@@ -0,0 +1,683 @@
+package loadgen
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testRun runs cfg against h, filling in the URL and defaults for a quick run.
+func testRun(t *testing.T, h http.HandlerFunc, cfg Config) Result {
+	t.Helper()
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	if cfg.URL == "" {
+		cfg.URL = srv.URL
+	}
+	if cfg.Requests == 0 {
+		cfg.Requests = 20
+	}
+	if cfg.Concurrency == 0 {
+		cfg.Concurrency = 4
+	}
+	cfg.Timeout = cmp.Or(cfg.Timeout, 5*time.Second)
+	cfg.Precision = 6
+	res, err := Run(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestRunResult(t *testing.T) {
+	// Requests 1-6 of every 10 succeed, 7-8 get a 404 and 9-10 a 503
+	var n atomic.Int64
+	h := func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("%s request with Content-Type %q", r.Method, r.Header.Get("Content-Type"))
+		}
+		switch i := n.Add(1) % 10; {
+		case i == 7 || i == 8:
+			w.WriteHeader(http.StatusNotFound)
+		case i == 9 || i == 0:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}
+	res := testRun(t, h, Config{Requests: 50, Concurrency: 1, Seed: 42})
+	if res.OK != 30 || res.Errors != 20 || res.Status4xx != 10 || res.Status5xx != 10 || res.StatusOther != 0 {
+		t.Errorf("OK %d, Errors %d (4xx %d, 5xx %d, other %d); want 30, 20 (10, 10, 0)",
+			res.OK, res.Errors, res.Status4xx, res.Status5xx, res.StatusOther)
+	}
+	if res.FirstErr != nil {
+		t.Errorf("FirstErr %v; every request got a response", res.FirstErr)
+	}
+	lat := res.Latency
+	if lat.Count != 30 || lat.Min <= 0 || lat.Min > lat.P50 || lat.P50 > lat.P99 || lat.P99 > lat.Max {
+		t.Errorf("latency stats %+v", lat)
+	}
+	if res.Seed != 42 || res.Duration <= 0 || res.Throughput <= 0 || res.Interrupted {
+		t.Errorf("Seed %d, Duration %s, Throughput %.2f, Interrupted %t",
+			res.Seed, res.Duration, res.Throughput, res.Interrupted)
+	}
+
+	for _, cfg := range []Config{
+		{Requests: 1, Concurrency: 1},
+		{URL: "http://localhost", Concurrency: 1},
+		{URL: "http://localhost", Requests: 1, Concurrency: 1, Precision: 16},
+		{URL: "http://localhost", Requests: 1, Concurrency: 1, Prewarm: -1},
+		{URL: "http://localhost", Requests: 1, Concurrency: 1, Cluster: true},
+	} {
+		if _, err := Run(context.Background(), cfg); err == nil {
+			t.Errorf("Run(%+v) succeeded", cfg)
+		}
+	}
+}
+func TestNoKeepAliveDialsPerRequest(t *testing.T) {
+	var remotes sync.Map
+	h := func(w http.ResponseWriter, r *http.Request) { remotes.Store(r.RemoteAddr, true) }
+
+	res := testRun(t, h, Config{Requests: 12, Concurrency: 3, NoKeepAlive: true})
+	if res.OK != 12 || res.NewConns != 12 || res.ConnSetupAvg <= 0 {
+		t.Errorf("OK %d, NewConns %d, ConnSetupAvg %s; want 12 fresh connections with their setup time", res.OK, res.NewConns, res.ConnSetupAvg)
+	}
+	n := 0
+	remotes.Range(func(any, any) bool { n++; return true })
+	if n != 12 {
+		t.Errorf("server saw %d client connections, want 12", n)
+	}
+
+	res = testRun(t, h, Config{Requests: 12, Concurrency: 3})
+	if res.NewConns != 0 {
+		t.Errorf("keep-alive run reported %d new connections, want them untracked", res.NewConns)
+	}
+}
+func TestHeadersOverrideDefaults(t *testing.T) {
+	var got atomic.Value
+	h := func(w http.ResponseWriter, r *http.Request) { got.Store(r.Header.Clone()) }
+
+	res := testRun(t, h, Config{Requests: 1, Concurrency: 1, Headers: http.Header{
+		"Authorization": {"Bearer t"},
+		"Content-Type":  {"application/x-test"},
+		"X-Multi":       {"1", "2"},
+	}})
+	if res.OK != 1 {
+		t.Fatalf("%d of 1 requests OK", res.OK)
+	}
+	hdr := got.Load().(http.Header)
+	if hdr.Get("Authorization") != "Bearer t" || hdr.Get("Content-Type") != "application/x-test" || len(hdr.Values("X-Multi")) != 2 {
+		t.Errorf("server got headers %v", hdr)
+	}
+}
+func TestCompareCountsDivergence(t *testing.T) {
+	var n atomic.Int64
+	var paths sync.Map
+	h := func(w http.ResponseWriter, r *http.Request) {
+		paths.Store(r.URL.Path, true)
+		// Every fourth answer is 1 degree of latitude (~111km) apart
+		simple := 10.0
+		if n.Add(1)%4 == 0 {
+			simple = 11
+		}
+		fmt.Fprintf(w, `{"spherical":{"lat":10,"lng":20},"simple":{"lat":%g,"lng":20}}`, simple)
+	}
+
+	res := testRun(t, h, Config{Requests: 20, Compare: true, CompareTol: 50})
+	if res.Compared != 20 || res.Diverged != 5 {
+		t.Errorf("Compared %d, Diverged %d; want 20 and 5", res.Compared, res.Diverged)
+	}
+	if _, ok := paths.Load("/compare"); !ok || !strings.HasSuffix(res.Target, "/compare") {
+		t.Errorf("requests not sent to /compare: %s", res.Target)
+	}
+
+	res = testRun(t, h, Config{Requests: 8, Compare: true, CompareTol: 200})
+	if res.Compared != 8 || res.Diverged != 0 {
+		t.Errorf("tolerance 200km: Compared %d, Diverged %d", res.Compared, res.Diverged)
+	}
+}
+func TestClusterPayloads(t *testing.T) {
+	var mu sync.Mutex
+	var bodies [][]latLng
+	h := func(w http.ResponseWriter, r *http.Request) {
+		var body struct{ Points []latLng }
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || len(body.Points) != 4 {
+			t.Errorf("payload %v: %v", body, err)
+			return
+		}
+		mu.Lock()
+		bodies = append(bodies, body.Points)
+		mu.Unlock()
+	}
+	testRun(t, h, Config{Requests: 40, Cluster: true, ClusterCenters: 8, ClusterStdDev: 0.1})
+	if len(bodies) != 40 {
+		t.Fatalf("got %d payloads, want 40", len(bodies))
+	}
+
+	// Within a request the points sit around one center; across requests the
+	// first points land near at least two different centers
+	var far bool
+	for _, points := range bodies {
+		for _, p := range points[1:] {
+			if d := greatCircleKm(points[0], p); d > 150 {
+				t.Errorf("points %v are %.0fkm apart with stddev 0.1°", points, d)
+			}
+		}
+		far = far || greatCircleKm(bodies[0][0], points[0]) > 500
+	}
+	if !far {
+		t.Errorf("all payloads near %v", bodies[0][0])
+	}
+}
+func TestClusteredPayloadStaysInRange(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	var buf bytes.Buffer
+	for _, center := range []latLng{{89.9, 0}, {-89.9, 0}, {0, 179.9}, {0, -179.9}} {
+		buf.Reset()
+		writeClusteredPayload(&buf, rng, 6, center, 5)
+		var body struct{ Points []latLng }
+		if err := json.Unmarshal(buf.Bytes(), &body); err != nil || len(body.Points) != 4 {
+			t.Fatalf("payload %s: %v", buf.Bytes(), err)
+		}
+		for _, p := range body.Points {
+			if p.Lat < -90 || p.Lat > 90 || p.Lng < -180 || p.Lng > 180 {
+				t.Errorf("around %v: point %v out of range", center, p)
+			}
+		}
+	}
+}
+
+func TestGreatCircleKm(t *testing.T) {
+	if d := greatCircleKm(latLng{10, 20}, latLng{11, 20}); math.Abs(d-111.19) > 0.01 {
+		t.Errorf("1 degree of latitude = %.2fkm", d)
+	}
+	if d := greatCircleKm(latLng{0, 179.5}, latLng{0, -179.5}); math.Abs(d-111.19) > 0.01 {
+		t.Errorf("across the antimeridian = %.2fkm", d)
+	}
+	if d := greatCircleKm(latLng{90, 0}, latLng{-90, 0}); math.Abs(d-math.Pi*6371) > 1e-6 {
+		t.Errorf("pole to pole = %.2fkm", d)
+	}
+}
+
+func TestPrewarmPrimesPool(t *testing.T) {
+	var heads atomic.Int64
+	h := func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			heads.Add(1)
+			// Slow enough that the HEAD requests overlap, each on its own connection
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+	res := testRun(t, h, Config{Requests: 200, Concurrency: 8, Prewarm: 8})
+	if heads.Load() != 8 || res.PrewarmConns != 8 {
+		t.Errorf("prewarm sent %d HEAD requests opening %d connections, want 8 and 8", heads.Load(), res.PrewarmConns)
+	}
+	if res.OK != 200 {
+		t.Fatalf("%d of 200 requests OK", res.OK)
+	}
+	// The pool holds a connection per worker: the measured run should not
+	// need to dial (a straggler the server closed may be redialed)
+	if res.NewConns > 1 {
+		t.Errorf("measured run opened %d new connections after prewarming", res.NewConns)
+	}
+}
+
+func TestPrewarmAboveMaxIdleConns(t *testing.T) {
+	cfg := Config{URL: "http://localhost", Requests: 1, Concurrency: 1, MaxIdleConns: 4, Prewarm: 5}
+	if err := cfg.validate(); err == nil || !strings.Contains(err.Error(), "MaxIdleConns") {
+		t.Errorf("validate() = %v, want Prewarm above MaxIdleConns refused", err)
+	}
+	cfg.Prewarm = 4
+	if err := cfg.validate(); err != nil {
+		t.Errorf("Prewarm == MaxIdleConns: %v", err)
+	}
+	cfg.MaxIdleConns, cfg.Prewarm = 0, DefaultMaxIdleConns+1
+	if err := cfg.validate(); err == nil {
+		t.Error("Prewarm above DefaultMaxIdleConns accepted")
+	}
+}
+
+func TestCancelKeepsPartialResult(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var n atomic.Int64
+	h := func(w http.ResponseWriter, r *http.Request) {
+		if n.Add(1) == 5 {
+			cancel()
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(h))
+	defer srv.Close()
+
+	res, err := Run(ctx, Config{URL: srv.URL, Requests: 100, Concurrency: 2, Grace: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// In-flight requests finish within Grace; no new ones start
+	if !res.Interrupted || res.Errors != 0 || res.OK < 5 || res.OK > 6 || res.Latency.Count != res.OK {
+		t.Errorf("Interrupted %t, OK %d, Errors %d, latency count %d", res.Interrupted, res.OK, res.Errors, res.Latency.Count)
+	}
+}
+func TestCancelGraceExpires(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := func(w http.ResponseWriter, r *http.Request) {
+		cancel()
+		// The server notices the client hanging up once the body is read
+		_, _ = io.Copy(io.Discard, r.Body)
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}
+	srv := httptest.NewServer(http.HandlerFunc(h))
+	defer srv.Close()
+
+	start := time.Now()
+	res, err := Run(ctx, Config{URL: srv.URL, Requests: 10, Concurrency: 1, Grace: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("Run took %s with a 50ms grace", d)
+	}
+	if !res.Interrupted || res.OK != 0 || res.Errors != 1 {
+		t.Errorf("Interrupted %t, OK %d, Errors %d; want the in-flight request cancelled", res.Interrupted, res.OK, res.Errors)
+	}
+
+	// A run that completed isn't interrupted, even if ctx is cancelled later
+	res = testRun(t, func(http.ResponseWriter, *http.Request) {}, Config{Requests: 4})
+	if res.Interrupted || res.OK != 4 {
+		t.Errorf("completed run: Interrupted %t, OK %d", res.Interrupted, res.OK)
+	}
+}
+func TestColdStartHeader(t *testing.T) {
+	// Three instances take turns; each is slow on its first request
+	var n atomic.Int64
+	h := func(w http.ResponseWriter, r *http.Request) {
+		i := n.Add(1)
+		if i > 20 {
+			return // no instance header: neither cold nor warm
+		}
+		if i <= 3 {
+			time.Sleep(30 * time.Millisecond)
+		}
+		w.Header().Set("Function-Execution-Id", fmt.Sprint("instance-", i%3))
+	}
+	res := testRun(t, h, Config{Requests: 24, Concurrency: 1, ColdStartHeader: "Function-Execution-Id"})
+	if res.Cold != 3 || res.Warm != 17 {
+		t.Errorf("Cold %d, Warm %d; want 3 and 17", res.Cold, res.Warm)
+	}
+	if res.ColdAvg < 30*time.Millisecond || res.WarmAvg >= res.ColdAvg {
+		t.Errorf("ColdAvg %s, WarmAvg %s", res.ColdAvg, res.WarmAvg)
+	}
+
+	res = testRun(t, h, Config{Requests: 4, Concurrency: 1})
+	if res.Cold != 0 || res.Warm != 0 {
+		t.Errorf("without ColdStartHeader: Cold %d, Warm %d", res.Cold, res.Warm)
+	}
+}
+
+func TestPerWorkerStats(t *testing.T) {
+	h := func(w http.ResponseWriter, r *http.Request) {}
+	if res := testRun(t, h, Config{}); res.Workers != nil {
+		t.Errorf("Workers = %v without PerWorker", res.Workers)
+	}
+	res := testRun(t, h, Config{Requests: 30, Concurrency: 3, PerWorker: true})
+	if len(res.Workers) != 3 {
+		t.Fatalf("%d worker stats for 3 workers", len(res.Workers))
+	}
+	total := 0
+	for i, ws := range res.Workers {
+		if ws.ID != i || ws.Count > 0 && (ws.P50 <= 0 || ws.P99 < ws.P50) {
+			t.Errorf("worker %d: %+v", i, ws)
+		}
+		total += ws.Count
+	}
+	if total != 30 {
+		t.Errorf("workers counted %d requests, want 30", total)
+	}
+}
+
+func TestMaxConnsPerHost(t *testing.T) {
+	var inflight, peak atomic.Int64
+	var remotes sync.Map
+	h := func(w http.ResponseWriter, r *http.Request) {
+		remotes.Store(r.RemoteAddr, true)
+		n := inflight.Add(1)
+		defer inflight.Add(-1)
+		for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	res := testRun(t, h, Config{Requests: 40, Concurrency: 8, MaxConnsPerHost: 2, HTTP1: true})
+	if res.OK != 40 {
+		t.Fatalf("%d of 40 requests OK", res.OK)
+	}
+	conns := 0
+	remotes.Range(func(any, any) bool { conns++; return true })
+	if conns > 2 || peak.Load() > 2 {
+		t.Errorf("%d connections, %d requests at once with MaxConnsPerHost 2", conns, peak.Load())
+	}
+
+	// The client's own view: no more than 2 dials however many requests wait
+	srv := httptest.NewServer(http.HandlerFunc(h))
+	defer srv.Close()
+	client := NewClient(Config{MaxConnsPerHost: 2, MaxIdleConns: 2, HTTP1: true})
+	var dials atomic.Int64
+	trace := &httptrace.ClientTrace{ConnectDone: func(string, string, error) { dials.Add(1) }}
+	var wg sync.WaitGroup
+	for range 16 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), trace), http.MethodGet, srv.URL, nil)
+			if resp, err := client.Do(req); err == nil {
+				_ = resp.Body.Close()
+			}
+		}()
+	}
+	wg.Wait()
+	if n := dials.Load(); n > 2 {
+		t.Errorf("client dialed %d connections with MaxConnsPerHost 2", n)
+	}
+
+	if err := (Config{URL: srv.URL, Requests: 1, Concurrency: 1, MaxConnsPerHost: -1}).validate(); err == nil {
+		t.Error("negative MaxConnsPerHost accepted")
+	}
+}
+
+func TestExpectEcho(t *testing.T) {
+	echo := func(w http.ResponseWriter, r *http.Request) { _, _ = io.Copy(w, r.Body) }
+	digestInBody := func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, `{"sha256":"%x"}`, sha256.Sum256(b))
+	}
+	// A checksum header decides, even when the body has the right digest
+	wrongHeader := func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		w.Header().Set(BodyChecksumHeader, fmt.Sprintf("%x", sha256.Sum256(append(b, ' '))))
+		fmt.Fprintf(w, `{"sha256":"%x"}`, sha256.Sum256(b))
+	}
+	var n atomic.Int64
+	corrupt := func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		if n.Add(1)%2 == 0 {
+			b[len(b)/2] ^= 1
+		}
+		_, _ = w.Write(b)
+	}
+
+	for _, tc := range []struct {
+		name              string
+		h                 http.HandlerFunc
+		matched, mismatch int
+	}{
+		{"echo", echo, 10, 0},
+		{"digest in body", digestInBody, 10, 0},
+		{"wrong checksum header", wrongHeader, 0, 10},
+		{"corrupting", corrupt, 5, 5},
+	} {
+		res := testRun(t, tc.h, Config{Requests: 10, Concurrency: 1, ExpectEcho: true})
+		if res.EchoMatched != tc.matched || res.EchoMismatched != tc.mismatch {
+			t.Errorf("%s: %d matched, %d mismatched; want %d and %d", tc.name, res.EchoMatched, res.EchoMismatched, tc.matched, tc.mismatch)
+		}
+	}
+
+	res := testRun(t, echo, Config{Requests: 4})
+	if res.EchoMatched != 0 || res.EchoMismatched != 0 {
+		t.Errorf("without ExpectEcho: %d matched, %d mismatched", res.EchoMatched, res.EchoMismatched)
+	}
+	if err := (Config{URL: "http://x", Requests: 1, Concurrency: 1, ExpectEcho: true, Compare: true}).validate(); err == nil {
+		t.Error("ExpectEcho with Compare accepted")
+	}
+}
+
+func TestWindowStats(t *testing.T) {
+	// Fast, except for requests arriving 130-170ms into the run
+	var first atomic.Int64
+	h := func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now().UnixNano()
+		first.CompareAndSwap(0, now)
+		if since := time.Duration(now - first.Load()); since >= 130*time.Millisecond && since < 170*time.Millisecond {
+			time.Sleep(25 * time.Millisecond)
+			return
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+	res := testRun(t, h, Config{Requests: 150, Concurrency: 1, Window: 100 * time.Millisecond})
+	if len(res.Windows) < 3 {
+		t.Fatalf("%d windows over %s, want at least 3", len(res.Windows), res.Duration)
+	}
+
+	ok := 0
+	for k, win := range res.Windows {
+		ok += win.OK
+		if win.Start != time.Duration(k)*100*time.Millisecond || win.Throughput <= 0 {
+			t.Errorf("window %d: %+v", k, win)
+		}
+	}
+	if ok != res.OK {
+		t.Errorf("windows hold %d OK requests, want %d", ok, res.OK)
+	}
+	slow, before, after := res.Windows[1], res.Windows[0], res.Windows[len(res.Windows)-1]
+	if slow.P99 < 25*time.Millisecond || before.P99 >= 20*time.Millisecond || after.P99 >= 20*time.Millisecond {
+		t.Errorf("p99 per window %s, %s, ..., %s; want only the second one slow", before.P99, slow.P99, after.P99)
+	}
+	if slow.Throughput >= before.Throughput {
+		t.Errorf("throughput %.0f/s while slow, %.0f/s before", slow.Throughput, before.Throughput)
+	}
+}
+
+func TestDeterministicPayloads(t *testing.T) {
+	// Bodies in arrival order, which is the request order with one worker
+	record := func(cfg Config) []string {
+		var mu sync.Mutex
+		var bodies []string
+		h := func(w http.ResponseWriter, r *http.Request) {
+			b, _ := io.ReadAll(r.Body)
+			mu.Lock()
+			bodies = append(bodies, string(b))
+			mu.Unlock()
+		}
+		cfg.Requests, cfg.DeterministicPayloads = 40, true
+		if res := testRun(t, h, cfg); res.OK != 40 {
+			t.Fatalf("%d of 40 requests OK", res.OK)
+		}
+		return bodies
+	}
+
+	first := record(Config{Seed: 7, Concurrency: 1})
+	if again := record(Config{Seed: 7, Concurrency: 1}); !slices.Equal(first, again) {
+		t.Error("two runs with seed 7 sent different payloads")
+	}
+	if first[0] == first[1] {
+		t.Error("requests 0 and 1 carry the same payload")
+	}
+
+	// Scheduling differs between one worker and eight; the payloads don't
+	second := record(Config{Seed: 7, Concurrency: 8})
+	slices.Sort(second)
+	if sorted := slices.Sorted(slices.Values(first)); !slices.Equal(sorted, second) {
+		t.Error("eight workers sent other payloads than one worker with the same seed")
+	}
+	if other := record(Config{Seed: 8, Concurrency: 1}); other[0] == first[0] {
+		t.Error("seeds 7 and 8 give request 0 the same payload")
+	}
+}
+
+func TestHTTP1AgainstH2Server(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+	trusted := srv.Client().Transport.(*http.Transport).TLSClientConfig
+
+	for _, tc := range []struct {
+		http1 bool
+		proto string
+	}{{false, "HTTP/2.0"}, {true, "HTTP/1.1"}} {
+		cfg := Config{URL: srv.URL, Requests: 10, Concurrency: 2, Precision: 6, HTTP1: tc.http1}
+		cfg.Client = NewClient(cfg)
+		cfg.Client.Transport.(*http.Transport).TLSClientConfig = trusted.Clone()
+		res, err := Run(context.Background(), cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.OK != 10 || res.Protocols[tc.proto] != 10 {
+			t.Errorf("HTTP1=%t: OK %d, protocols %v; want all %s", tc.http1, res.OK, res.Protocols, tc.proto)
+		}
+	}
+}
+
+func TestPadBytes(t *testing.T) {
+	for _, pad := range []int{0, 100, 64 << 10} {
+		var mu sync.Mutex
+		var sizes []int
+		var bad []string
+		h := func(w http.ResponseWriter, r *http.Request) {
+			b, _ := io.ReadAll(r.Body)
+			var req struct {
+				Points []struct{ Lat, Lng float64 } `json:"points"`
+				Pad    *string                      `json:"_pad"`
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			sizes = append(sizes, len(b))
+			if err := json.Unmarshal(b, &req); err != nil || len(req.Points) != 4 || (req.Pad != nil) != (pad > 0) || (req.Pad != nil && len(*req.Pad) != pad) {
+				bad = append(bad, string(b))
+			}
+		}
+		res := testRun(t, h, Config{Requests: 10, PadBytes: pad})
+		if res.OK != 10 || len(bad) > 0 {
+			t.Errorf("PadBytes %d: OK %d, bodies without the padding: %.200q", pad, res.OK, bad)
+		}
+		// Four points at precision 6 take about 150 bytes
+		for _, n := range sizes {
+			if n < pad+100 || n > pad+250 {
+				t.Errorf("PadBytes %d: %d-byte body", pad, n)
+				break
+			}
+		}
+	}
+}
+
+func TestMaxErrors(t *testing.T) {
+	var hits atomic.Int64
+	res := testRun(t, func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}, Config{Requests: 1000, MaxErrors: 5})
+	if !res.Aborted || res.Interrupted {
+		t.Errorf("aborted %t, interrupted %t; want an abort only", res.Aborted, res.Interrupted)
+	}
+	// Requests already in flight may still fail past the limit
+	if res.Errors <= 5 || res.Errors > 5+4 || hits.Load() > 5+4 {
+		t.Errorf("%d errors over %d requests, want the run stopped just past 5", res.Errors, hits.Load())
+	}
+
+	// At or under the limit the run completes
+	var n atomic.Int64
+	res = testRun(t, func(w http.ResponseWriter, r *http.Request) {
+		if n.Add(1)%10 == 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}, Config{Requests: 50, MaxErrors: 5})
+	if res.Aborted || res.OK != 45 || res.Errors != 5 {
+		t.Errorf("5 failures under MaxErrors 5: aborted %t, OK %d, Errors %d", res.Aborted, res.OK, res.Errors)
+	}
+
+	if _, err := Run(context.Background(), Config{URL: "http://vm/x", Requests: 1, Concurrency: 1, MaxErrors: -1}); err == nil {
+		t.Error("negative MaxErrors accepted")
+	}
+}
+
+func TestIPFamily(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(srv.Close) // listens on 127.0.0.1
+	for family, wantOK := range map[string]bool{"": true, IPFamilyAny: true, IPFamily4: true, IPFamily6: false} {
+		res, err := Run(context.Background(), Config{URL: srv.URL, Requests: 2, Concurrency: 1, Precision: 6, IPFamily: family})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok := res.OK == 2; ok != wantOK {
+			t.Errorf("IPFamily %q to an IPv4 server: OK %d, Errors %d (%v)", family, res.OK, res.Errors, res.FirstErr)
+		}
+	}
+	if _, err := Run(context.Background(), Config{URL: srv.URL, Requests: 1, Concurrency: 1, IPFamily: "udp"}); err == nil {
+		t.Error("IPFamily udp accepted")
+	}
+}
+
+func TestMinSamples(t *testing.T) {
+	// Six of twenty requests succeed: indexes ending in 0, 4 or 8
+	h := func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "0") && !strings.HasSuffix(r.URL.Path, "4") && !strings.HasSuffix(r.URL.Path, "8") {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}
+	for _, tc := range []struct {
+		minSamples    int
+		insignificant bool
+	}{
+		{0, false},
+		{20, true},
+		{6, false}, // exactly enough
+	} {
+		res := testRun(t, h, Config{Requests: 20, URLTemplate: "/{i}", MinSamples: tc.minSamples})
+		if res.Latency.Count != 6 || res.Latency.Insignificant != tc.insignificant {
+			t.Errorf("MinSamples %d: %d samples, insignificant %t; want 6 and %t", tc.minSamples, res.Latency.Count, res.Latency.Insignificant, tc.insignificant)
+		}
+	}
+
+	// No samples at all is not reported as insignificant ones
+	res := testRun(t, func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusBadGateway) }, Config{Requests: 4, MinSamples: 10})
+	if res.Latency.Insignificant {
+		t.Error("no successes flagged insignificant")
+	}
+}
+
+func TestIdentifyingHeaders(t *testing.T) {
+	for _, tc := range []struct {
+		cfg           Config
+		ua, marked    string
+		wantPrewarmed bool
+	}{
+		{Config{}, DefaultUserAgent(), "", false},
+		{Config{UserAgent: "probe/1", MarkLoadTest: true, Prewarm: 2}, "probe/1", "true", true},
+		{Config{UserAgent: "probe/1", MarkLoadTest: true, Headers: http.Header{"User-Agent": {"mine"}, LoadTestHeader: {"no"}}}, "mine", "no", false},
+	} {
+		var mu sync.Mutex
+		seen := map[string]int{} // method, User-Agent and LoadTestHeader -> requests
+		res := testRun(t, func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			seen[r.Method+" "+r.UserAgent()+" "+r.Header.Get(LoadTestHeader)]++
+			mu.Unlock()
+		}, tc.cfg)
+		want := map[string]int{"POST " + tc.ua + " " + tc.marked: 20}
+		if tc.wantPrewarmed {
+			want["HEAD "+tc.ua+" "+tc.marked] = 2
+		}
+		if res.OK != 20 || !maps.Equal(seen, want) {
+			t.Errorf("%+v: requests seen %v, want %v", tc.cfg, seen, want)
+		}
+	}
+	if ua := DefaultUserAgent(); !strings.HasPrefix(ua, "load-serverless-client/") || len(ua) == len("load-serverless-client/") {
+		t.Errorf("DefaultUserAgent() = %q", ua)
+	}
+}
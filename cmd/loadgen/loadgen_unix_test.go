@@ -0,0 +1,70 @@
+//go:build unix
+
+package loadgen
+
+import (
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSnapshotOnSIGUSR1(t *testing.T) {
+	// The first 5 requests answer at once, the 6th holds the run until the
+	// snapshot was taken
+	arrived, release := make(chan struct{}), make(chan struct{})
+	var n atomic.Int64
+	h := func(w http.ResponseWriter, r *http.Request) {
+		if n.Add(1) == 6 {
+			close(arrived)
+			<-release
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Wired the way the client does it
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+	defer signal.Stop(usr1)
+	snap := make(chan struct{})
+	go func() {
+		for range usr1 {
+			snap <- struct{}{}
+		}
+	}()
+	snapshots := make(chan Snapshot, 1)
+	go func() {
+		<-arrived
+		_ = syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+		select {
+		case s := <-snapshots:
+			snapshots <- s
+		case <-time.After(5 * time.Second):
+		}
+		close(release)
+	}()
+
+	res := testRun(t, h, Config{
+		Requests:    10,
+		Concurrency: 1,
+		Snapshot:    snap,
+		OnSnapshot:  func(s Snapshot) { snapshots <- s },
+	})
+	if res.OK != 10 {
+		t.Fatalf("%d of 10 requests OK: the snapshot disturbed the run", res.OK)
+	}
+	select {
+	case s := <-snapshots:
+		if s.OK != 5 || s.Errors != 0 || s.Issued != 6 {
+			t.Errorf("snapshot OK %d, Errors %d, Issued %d; want 5, 0 and 6", s.OK, s.Errors, s.Issued)
+		}
+		if s.P50 < time.Millisecond || s.P99 < s.P50 || s.Throughput <= 0 || s.Elapsed <= 0 {
+			t.Errorf("snapshot stats %+v", s)
+		}
+	default:
+		t.Fatal("SIGUSR1 produced no snapshot")
+	}
+}
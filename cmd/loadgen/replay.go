@@ -0,0 +1,86 @@
+package loadgen
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Replay orders for Config.ReplayOrder
+const (
+	ReplayRoundRobin = "round-robin"
+	ReplayRandom     = "random"
+)
+
+// replaySource serves recorded request bodies from a JSON-lines file. Only
+// the offset and length of each line are kept in memory; bodies are read
+// from the file on demand, so files larger than memory work.
+type replaySource struct {
+	f       *os.File
+	offsets []int64
+	lengths []int32
+}
+
+// openReplay indexes path, skipping blank lines and rejecting lines that are
+// not valid JSON.
+func openReplay(path string) (*replaySource, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	rs := &replaySource{f: f}
+	r := bufio.NewReaderSize(f, 1<<16)
+	var (
+		off    int64
+		lineNo int
+		line   []byte
+	)
+	for {
+		line, err = r.ReadBytes('\n')
+		lineNo++
+		n := int64(len(line))
+		body := bytes.TrimSpace(line)
+		if len(body) > 0 {
+			if !json.Valid(body) {
+				f.Close()
+				return nil, fmt.Errorf("%s:%d: invalid JSON", path, lineNo)
+			}
+			lead := bytes.Index(line, body)
+			rs.offsets = append(rs.offsets, off+int64(lead))
+			rs.lengths = append(rs.lengths, int32(len(body)))
+		}
+		off += n
+		if err != nil {
+			break
+		}
+	}
+	if !errors.Is(err, io.EOF) {
+		f.Close()
+		return nil, err
+	}
+	if len(rs.offsets) == 0 {
+		f.Close()
+		return nil, fmt.Errorf("%s: no request bodies", path)
+	}
+	return rs, nil
+}
+
+func (rs *replaySource) len() int { return len(rs.offsets) }
+
+// write appends body i to buf. ReadAt is safe for concurrent use.
+func (rs *replaySource) write(buf *bytes.Buffer, i int) error {
+	n := int(rs.lengths[i])
+	buf.Grow(n)
+	b := buf.AvailableBuffer()[:n]
+	if _, err := rs.f.ReadAt(b, rs.offsets[i]); err != nil {
+		return fmt.Errorf("replay body %d: %w", i+1, err)
+	}
+	buf.Write(b)
+	return nil
+}
+
+func (rs *replaySource) Close() error { return rs.f.Close() }
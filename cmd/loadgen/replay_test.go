@@ -0,0 +1,76 @@
+package loadgen
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func writeReplayFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "bodies.jsonl")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReplayFile(t *testing.T) {
+	bodies := []string{
+		`{"points":[{"lat":1,"lng":2}]}`,
+		`{"points":[{"lat":3,"lng":4},{"lat":5,"lng":6}]}`,
+		`{"points":[]}`,
+	}
+	// Blank lines and surrounding whitespace are skipped; no final newline
+	path := writeReplayFile(t, bodies[0]+"\n\n  "+bodies[1]+"\t\r\n"+bodies[2])
+
+	var mu sync.Mutex
+	var got []string
+	h := func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		got = append(got, string(b))
+		mu.Unlock()
+	}
+
+	res := testRun(t, h, Config{Requests: 7, Concurrency: 1, ReplayFile: path})
+	if res.OK != 7 || res.ReplayBodies != 3 {
+		t.Fatalf("OK %d, ReplayBodies %d; want 7 and 3", res.OK, res.ReplayBodies)
+	}
+	want := append(append(slices.Clone(bodies), bodies...), bodies[0])
+	if !slices.Equal(got, want) {
+		t.Errorf("round robin sent\n%q\nwant\n%q", got, want)
+	}
+
+	got = nil
+	testRun(t, h, Config{Requests: 30, Concurrency: 3, ReplayFile: path, ReplayOrder: ReplayRandom})
+	for _, b := range got {
+		if !slices.Contains(bodies, b) {
+			t.Fatalf("random order sent %q, not a recorded body", b)
+		}
+	}
+	if len(got) != 30 {
+		t.Errorf("random order sent %d bodies, want 30", len(got))
+	}
+}
+
+func TestReplayFileErrors(t *testing.T) {
+	for content, want := range map[string]string{
+		"{\"points\":[]}\n{not json}\n": ":2: invalid JSON",
+		"\n  \n":                        "no request bodies",
+	} {
+		_, err := Run(context.Background(), Config{URL: "http://127.0.0.1:1", Requests: 1, Concurrency: 1, ReplayFile: writeReplayFile(t, content)})
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("replay file %q: %v, want %q", content, err, want)
+		}
+	}
+	if _, err := openReplay(filepath.Join(t.TempDir(), "missing.jsonl")); err == nil {
+		t.Error("missing file opened")
+	}
+}
@@ -0,0 +1,124 @@
+package loadgen
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// resultJSON adds the error fields, which encoding/json cannot represent,
+// as strings.
+type resultJSON struct {
+	Result
+	FirstError string `json:"first_error,omitempty"`
+	TraceError string `json:"trace_error,omitempty"`
+}
+
+// WriteJSON writes res as one JSON object, indented or on a single line
+// (for newline-delimited JSON).
+func (res Result) WriteJSON(w io.Writer, indent bool) error {
+	out := resultJSON{Result: res}
+	if res.FirstErr != nil {
+		out.FirstError = res.FirstErr.Error()
+	}
+	if res.TraceErr != nil {
+		out.TraceError = res.TraceErr.Error()
+	}
+	enc := json.NewEncoder(w)
+	if indent {
+		enc.SetIndent("", "  ")
+	}
+	return enc.Encode(out)
+}
+
+// ReadResultFile loads a Result written by WriteJSON. For a file of
+// appended (newline-delimited) results, the last one is returned.
+func ReadResultFile(path string) (Result, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Result{}, err
+	}
+	defer f.Close()
+	var in resultJSON
+	dec := json.NewDecoder(f)
+	for n := 0; ; n++ {
+		var next resultJSON
+		err := dec.Decode(&next)
+		if errors.Is(err, io.EOF) && n > 0 {
+			break
+		}
+		if err != nil {
+			return Result{}, fmt.Errorf("%s: %w", path, err)
+		}
+		in = next
+	}
+	res := in.Result
+	if in.FirstError != "" {
+		res.FirstErr = errors.New(in.FirstError)
+	}
+	if in.TraceError != "" {
+		res.TraceErr = errors.New(in.TraceError)
+	}
+	return res, nil
+}
+
+// ErrorRate is the fraction of completed requests that failed.
+func (res Result) ErrorRate() float64 {
+	if res.OK+res.Errors == 0 {
+		return 0
+	}
+	return float64(res.Errors) / float64(res.OK+res.Errors)
+}
+
+// Delta compares a run against a baseline. Percentages are relative to the
+// baseline and 0 when the baseline value is 0.
+type Delta struct {
+	ThroughputPct float64
+
+	P50, P99       time.Duration // current minus baseline
+	P50Pct, P99Pct float64
+
+	BaseErrorRate, ErrorRate float64
+
+	// Regressions describes every change beyond the thresholds; empty when
+	// the run is no worse than the baseline.
+	Regressions []string
+}
+
+// Compare computes the delta from base to cur. A throughput drop or p50/p99
+// rise of more than tolPct percent, or an error rate more than errTolPts
+// percentage points higher, counts as a regression.
+func Compare(base, cur Result, tolPct, errTolPts float64) Delta {
+	d := Delta{
+		ThroughputPct: pctChange(base.Throughput, cur.Throughput),
+		P50:           cur.Latency.P50 - base.Latency.P50,
+		P99:           cur.Latency.P99 - base.Latency.P99,
+		P50Pct:        pctChange(float64(base.Latency.P50), float64(cur.Latency.P50)),
+		P99Pct:        pctChange(float64(base.Latency.P99), float64(cur.Latency.P99)),
+		BaseErrorRate: base.ErrorRate(),
+		ErrorRate:     cur.ErrorRate(),
+	}
+	if -d.ThroughputPct > tolPct {
+		d.Regressions = append(d.Regressions, fmt.Sprintf("throughput down %.1f%%", -d.ThroughputPct))
+	}
+	if d.P50Pct > tolPct {
+		d.Regressions = append(d.Regressions, fmt.Sprintf("p50 up %.1f%%", d.P50Pct))
+	}
+	if d.P99Pct > tolPct {
+		d.Regressions = append(d.Regressions, fmt.Sprintf("p99 up %.1f%%", d.P99Pct))
+	}
+	if pts := 100 * (d.ErrorRate - d.BaseErrorRate); pts > errTolPts {
+		d.Regressions = append(d.Regressions, fmt.Sprintf("error rate up %.2f points", pts))
+	}
+	return d
+}
+
+func pctChange(base, cur float64) float64 {
+	if base == 0 {
+		return 0
+	}
+	return 100 * (cur - base) / base
+}
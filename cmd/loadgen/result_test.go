@@ -0,0 +1,82 @@
+package loadgen
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestCompareDeltas(t *testing.T) {
+	base := Result{Throughput: 1000, OK: 990, Errors: 10, Latency: LatencyStats{P50: 10 * time.Millisecond, P99: 40 * time.Millisecond}}
+	cur := Result{Throughput: 850, OK: 970, Errors: 30, Latency: LatencyStats{P50: 10500 * time.Microsecond, P99: 60 * time.Millisecond}}
+
+	d := Compare(base, cur, 10, 1)
+	near := func(got, want float64) bool { return math.Abs(got-want) < 1e-9 }
+	if !near(d.ThroughputPct, -15) || !near(d.P50Pct, 5) || !near(d.P99Pct, 50) {
+		t.Errorf("throughput %+.2f%%, p50 %+.2f%%, p99 %+.2f%%; want -15, +5, +50", d.ThroughputPct, d.P50Pct, d.P99Pct)
+	}
+	if d.P50 != 500*time.Microsecond || d.P99 != 20*time.Millisecond {
+		t.Errorf("p50 %s, p99 %s; want +500µs and +20ms", d.P50, d.P99)
+	}
+	if !near(d.BaseErrorRate, 0.01) || !near(d.ErrorRate, 0.03) {
+		t.Errorf("error rates %v -> %v, want 0.01 -> 0.03", d.BaseErrorRate, d.ErrorRate)
+	}
+	want := []string{"throughput down 15.0%", "p99 up 50.0%", "error rate up 2.00 points"}
+	if !slices.Equal(d.Regressions, want) {
+		t.Errorf("regressions %q, want %q", d.Regressions, want)
+	}
+
+	// Within looser thresholds, or better than the baseline, nothing regressed
+	if d := Compare(base, cur, 60, 5); len(d.Regressions) != 0 {
+		t.Errorf("thresholds 60%%/5pt: regressions %q", d.Regressions)
+	}
+	if d := Compare(cur, base, 10, 1); len(d.Regressions) != 0 {
+		t.Errorf("improvement flagged: %q", d.Regressions)
+	}
+	if d := Compare(Result{}, cur, 10, 1); d.ThroughputPct != 0 || d.P50Pct != 0 {
+		t.Errorf("empty baseline: %+v, want 0%% changes", d)
+	}
+}
+
+func TestResultFileRoundTrip(t *testing.T) {
+	first := Result{Target: "http://a", Seed: 1, OK: 3, Throughput: 12.5, Latency: LatencyStats{Count: 3, P99: time.Second}}
+	last := Result{Target: "http://b", Seed: 2, Errors: 1, FirstErr: errors.New("status 503")}
+	var buf bytes.Buffer
+	for _, res := range []Result{first, last} {
+		if err := res.WriteJSON(&buf, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := filepath.Join(t.TempDir(), "results.json")
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Appended results: the last one counts
+	got, err := ReadResultFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Target != "http://b" || got.Seed != 2 || got.Errors != 1 || got.FirstErr == nil || got.FirstErr.Error() != "status 503" {
+		t.Errorf("read back %+v", got)
+	}
+
+	buf.Reset()
+	_ = first.WriteJSON(&buf, true)
+	_ = os.WriteFile(path, buf.Bytes(), 0o644)
+	if got, err := ReadResultFile(path); err != nil || got.Latency.P99 != time.Second || got.Throughput != 12.5 {
+		t.Errorf("indented result read back as %+v, %v", got, err)
+	}
+
+	for _, content := range []string{"", "{not json"} {
+		_ = os.WriteFile(path, []byte(content), 0o644)
+		if _, err := ReadResultFile(path); err == nil {
+			t.Errorf("file %q read without error", content)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package loadgen
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WeightedTarget is one URL of a multi-target run.
+type WeightedTarget struct {
+	URL    string `json:"url"`
+	Weight int    `json:"weight"` // share of requests relative to the other targets, 0 = 1
+}
+
+// TargetStats counts the requests sent to one target of a multi-target run.
+type TargetStats struct {
+	URL      string        `json:"url"`
+	Weight   int           `json:"weight"`
+	Requests int           `json:"requests"`
+	OK       int           `json:"ok"`
+	Errors   int           `json:"errors"`
+	P50      time.Duration `json:"p50_ns"` // successful requests only
+	P99      time.Duration `json:"p99_ns"`
+}
+
+// ReadTargetFile reads "url[,weight]" lines. Blank lines and lines starting
+// with # are skipped; every URL must be an absolute http(s) URL.
+func ReadTargetFile(path string) ([]WeightedTarget, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var targets []WeightedTarget
+	sc := bufio.NewScanner(f)
+	for lineNo := 1; sc.Scan(); lineNo++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rawURL, weight, hasWeight := strings.Cut(line, ",")
+		t := WeightedTarget{URL: strings.TrimSpace(rawURL), Weight: 1}
+		if hasWeight {
+			if t.Weight, err = strconv.Atoi(strings.TrimSpace(weight)); err != nil || t.Weight <= 0 {
+				return nil, fmt.Errorf("%s:%d: weight must be a positive integer", path, lineNo)
+			}
+		}
+		if err := checkTargetURL(t.URL); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNo, err)
+		}
+		targets = append(targets, t)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("%s: no targets", path)
+	}
+	return targets, nil
+}
+
+// DiscoverTargets lists the backends of the Broker at brokerURL from its
+// /backends admin endpoint, as one equally weighted target per backend: its
+// base URL followed by brokerURL's path and query, the route to load (e.g.
+// http://broker:8080/geo_average targets <backend>/geo_average). A
+// non-empty secret is sent as X-Admin-Secret.
+func DiscoverTargets(ctx context.Context, client *http.Client, brokerURL, secret string) ([]WeightedTarget, error) {
+	u, err := url.Parse(brokerURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid Broker URL %q", brokerURL)
+	}
+	list := &url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/backends"}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, list.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if secret != "" {
+		req.Header.Set("X-Admin-Secret", secret)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", list, resp.Status)
+	}
+
+	var backends []struct {
+		Name string `json:"name"`
+		URL  string `json:"url"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&backends); err != nil {
+		return nil, fmt.Errorf("%s: %w", list, err)
+	}
+	if len(backends) == 0 {
+		return nil, fmt.Errorf("%s: no backends", list)
+	}
+	targets := make([]WeightedTarget, 0, len(backends))
+	for _, be := range backends {
+		base, err := url.Parse(be.URL)
+		if err != nil || be.URL == "" {
+			return nil, fmt.Errorf("backend %s: invalid URL %q", be.Name, be.URL)
+		}
+		t := *base
+		t.Path = strings.TrimSuffix(base.Path, "/") + u.Path
+		t.RawPath = ""
+		t.RawQuery = u.RawQuery
+		if err := checkTargetURL(t.String()); err != nil {
+			return nil, fmt.Errorf("backend %s: %w", be.Name, err)
+		}
+		targets = append(targets, WeightedTarget{URL: t.String(), Weight: 1})
+	}
+	return targets, nil
+}
+
+func checkTargetURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid URL %q", raw)
+	}
+	return nil
+}
+
+func targetURLs(targets []WeightedTarget) []string {
+	urls := make([]string, len(targets))
+	for i, t := range targets {
+		urls[i] = t.URL
+	}
+	return urls
+}
+
+// targetSchedule expands the weights into a rotation of target indexes;
+// request i goes to schedule[i%len(schedule)].
+func targetSchedule(targets []WeightedTarget) []int {
+	var schedule []int
+	for i, t := range targets {
+		for range max(t.Weight, 1) {
+			schedule = append(schedule, i)
+		}
+	}
+	return schedule
+}
@@ -0,0 +1,219 @@
+package loadgen
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func writeTargetFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "targets.txt")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestTargetFileWeights(t *testing.T) {
+	var hits [2]atomic.Int64
+	var urls [2]string
+	for i := range hits {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { hits[i].Add(1) }))
+		t.Cleanup(srv.Close)
+		urls[i] = srv.URL
+	}
+	path := writeTargetFile(t, fmt.Sprintf("# vm and serverless\n\n%s , 3\n  # spare\n%s,1\n", urls[0], urls[1]))
+
+	targets, err := ReadTargetFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 2 || targets[0] != (WeightedTarget{URL: urls[0], Weight: 3}) || targets[1] != (WeightedTarget{URL: urls[1], Weight: 1}) {
+		t.Fatalf("targets %+v", targets)
+	}
+
+	res, err := Run(context.Background(), Config{Targets: targets, Requests: 400, Concurrency: 8, Precision: 6})
+	if err != nil {
+		t.Fatal(err)
+	}
+	share := float64(hits[0].Load()) / 400
+	if res.OK != 400 || math.Abs(share-0.75) > 0.05 {
+		t.Errorf("OK %d, first target got %.0f%% of requests; want 75%%", res.OK, share*100)
+	}
+	if len(res.Targets) != 2 || res.Targets[0].Requests != int(hits[0].Load()) || res.Targets[1].Requests != int(hits[1].Load()) {
+		t.Errorf("per-target stats %+v, hits %d and %d", res.Targets, hits[0].Load(), hits[1].Load())
+	}
+}
+
+func TestTargetFileErrors(t *testing.T) {
+	for content, want := range map[string]string{
+		"http://a\nftp://b\n":     `:2: invalid URL "ftp://b"`,
+		"http://a,0\n":            ":1: weight must be a positive integer",
+		"http://a,heavy\n":        ":1: weight must be a positive integer",
+		"# nothing here\n\n":      "no targets",
+		"http://a\n/relative,2\n": `:2: invalid URL "/relative"`,
+	} {
+		_, err := ReadTargetFile(writeTargetFile(t, content))
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q: %v, want %q", content, err, want)
+		}
+	}
+	if _, err := ReadTargetFile(filepath.Join(t.TempDir(), "missing.txt")); err == nil {
+		t.Error("missing file read")
+	}
+}
+
+func TestFanout(t *testing.T) {
+	var mu sync.Mutex
+	bodies := [2]map[string]int{{}, {}} // body -> times received
+	var targets []WeightedTarget
+	for i, delay := range []time.Duration{0, 5 * time.Millisecond} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			b, _ := io.ReadAll(r.Body)
+			mu.Lock()
+			bodies[i][string(b)]++
+			mu.Unlock()
+			time.Sleep(delay)
+		}))
+		t.Cleanup(srv.Close)
+		targets = append(targets, WeightedTarget{URL: srv.URL, Weight: 1 + 2*i}) // weights don't apply
+	}
+
+	res, err := Run(context.Background(), Config{Targets: targets, Fanout: true, Requests: 20, Concurrency: 4, Precision: 6})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.OK != 40 || res.Latency.Count != 40 {
+		t.Fatalf("OK %d over %d latencies, want 40 for 20 requests to 2 targets", res.OK, res.Latency.Count)
+	}
+	if !maps.Equal(bodies[0], bodies[1]) {
+		t.Errorf("targets got different bodies: %v and %v", bodies[0], bodies[1])
+	}
+	fast, slow := res.Targets[0], res.Targets[1]
+	if fast.Requests != 20 || fast.OK != 20 || slow.Requests != 20 || slow.OK != 20 {
+		t.Errorf("per-target stats %+v", res.Targets)
+	}
+	if slow.P50 < 5*time.Millisecond || fast.P50 >= slow.P50 {
+		t.Errorf("p50 %s and %s, want the second target's 5ms delay to show", fast.P50, slow.P50)
+	}
+
+	if _, err := Run(context.Background(), Config{Targets: targets[:1], Fanout: true, Requests: 1, Concurrency: 1}); err == nil {
+		t.Error("Fanout with one target accepted")
+	}
+}
+
+func TestDiscoverTargets(t *testing.T) {
+	backends := `[{"name":"vm","url":"http://10.0.0.1:8080","state":"active"},{"name":"fn","url":"https://fn.example.com/Average/","state":"drained"}]`
+	broker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path != "/backends" || r.Method != http.MethodGet:
+			http.NotFound(w, r)
+		case r.Header.Get("X-Admin-Secret") != "s3cret":
+			w.WriteHeader(http.StatusForbidden)
+		default:
+			_, _ = io.WriteString(w, backends)
+		}
+	}))
+	t.Cleanup(broker.Close)
+
+	// The Broker URL's path and query are kept, the backend's path prefixed
+	targets, err := DiscoverTargets(context.Background(), broker.Client(), broker.URL+"/geo_average?method=simple", "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []WeightedTarget{
+		{URL: "http://10.0.0.1:8080/geo_average?method=simple", Weight: 1},
+		{URL: "https://fn.example.com/Average/geo_average?method=simple", Weight: 1},
+	}
+	if len(targets) != 2 || targets[0] != want[0] || targets[1] != want[1] {
+		t.Errorf("targets %+v, want %+v", targets, want)
+	}
+
+	if _, err := DiscoverTargets(context.Background(), broker.Client(), broker.URL+"/geo_average", "wrong"); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("wrong secret: %v, want a 403 error", err)
+	}
+	for content, wantErr := range map[string]string{
+		`[]`:                              "no backends",
+		`{"name":"vm"}`:                   "cannot unmarshal",
+		`[{"name":"vm","url":""}]`:        `backend vm: invalid URL ""`,
+		`[{"name":"vm","url":"ftp://a"}]`: `backend vm: invalid URL "ftp://a/x"`,
+	} {
+		backends = content
+		_, err := DiscoverTargets(context.Background(), broker.Client(), broker.URL+"/x", "s3cret")
+		if err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Errorf("/backends %s: %v, want %q", content, err, wantErr)
+		}
+	}
+	if _, err := DiscoverTargets(context.Background(), broker.Client(), "broker:8080/geo_average", ""); err == nil {
+		t.Error("Broker URL without a scheme accepted")
+	}
+}
+
+func TestURLTemplate(t *testing.T) {
+	var mu sync.Mutex
+	paths := map[string]int{}
+	rands := map[string]bool{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		paths[r.URL.Path]++
+		rands[r.URL.Query().Get("r")] = true
+	}))
+	t.Cleanup(srv.Close)
+
+	// The base URL's trailing slash isn't doubled
+	res, err := Run(context.Background(), Config{URL: srv.URL + "/", URLTemplate: "/item/{i}?r={rand}", Requests: 50, Concurrency: 4, Precision: 6})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.OK != 50 || len(paths) != 50 || len(rands) < 45 {
+		t.Errorf("OK %d over %d distinct paths and %d distinct {rand}", res.OK, len(paths), len(rands))
+	}
+	for i := range 50 {
+		if paths[fmt.Sprintf("/item/%d", i)] != 1 {
+			t.Errorf("/item/%d requested %d times", i, paths[fmt.Sprintf("/item/%d", i)])
+		}
+	}
+	if want := srv.URL + "/item/{i}?r={rand}"; res.Target != want {
+		t.Errorf("Target %q, want %q", res.Target, want)
+	}
+
+	for tmpl, cfg := range map[string]Config{
+		"/{i}":    {URL: srv.URL, Compare: true},
+		"/%zz{i}": {URL: srv.URL},
+		"/x/{i}":  {Targets: []WeightedTarget{{URL: srv.URL, Weight: 1}, {URL: "http://a/%zz", Weight: 1}}},
+	} {
+		cfg.URLTemplate, cfg.Requests, cfg.Concurrency = tmpl, 1, 1
+		if _, err := Run(context.Background(), cfg); err == nil {
+			t.Errorf("URLTemplate %q with %+v accepted", tmpl, cfg)
+		}
+	}
+}
+
+func TestWithTemplate(t *testing.T) {
+	for _, tc := range []struct{ target, tmpl, want string }{
+		{"http://a", "/x/{i}", "http://a/x/{i}"},
+		{"http://a/", "/x/{i}", "http://a/x/{i}"},
+		{"http://a/geo", "?id={rand}", "http://a/geo?id={rand}"},
+		{"http://a/item-", "{i}", "http://a/item-{i}"},
+	} {
+		if got := withTemplate(tc.target, tc.tmpl); got != tc.want {
+			t.Errorf("withTemplate(%q, %q) = %q, want %q", tc.target, tc.tmpl, got, tc.want)
+		}
+	}
+	if got := expandURL("http://a/{i}/{rand}?again={i}", "7", "42"); got != "http://a/7/42?again=7" {
+		t.Errorf("expandURL = %q", got)
+	}
+}
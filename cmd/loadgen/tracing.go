@@ -0,0 +1,39 @@
+package loadgen
+
+import (
+	"time"
+
+	"github.com/dwladdimiroc/load-serverless/broker/tracing"
+)
+
+// TraceMaxQueued bounds the spans waiting for export: a load run ends far
+// more of them per interval than the Broker does.
+const TraceMaxQueued = 65536
+
+// NewTracer exports a client span per sampled request to the OTLP/HTTP
+// collector at endpoint, e.g. "http://localhost:4318", sampling the given
+// fraction of requests in [0,1]. Every request carries a traceparent header;
+// only the sampled fraction is flagged as sampled, so downstream services
+// make the same call. The caller shuts it down once done with it.
+func NewTracer(endpoint string, sample float64) *tracing.Tracer {
+	exp := tracing.NewOTLPExporter(endpoint, "load-client", "load-serverless/loadgen")
+	return tracing.New(exp, tracing.Config{Sample: sample, MaxQueued: TraceMaxQueued})
+}
+
+// endSpan finishes a request's span with the response status (0 when the
+// request failed without one); statuses outside 2xx/3xx mark it as an error.
+func endSpan(s *tracing.Span, target string, status int, dur time.Duration, err error) {
+	s.SetAttr("url.full", target)
+	s.SetAttr("http.request.method", "POST")
+	s.SetAttr("loadgen.latency_ms", float64(dur)/float64(time.Millisecond))
+	if status != 0 {
+		s.SetAttr("http.response.status_code", status)
+	}
+	if err != nil {
+		s.SetAttr("error.message", err.Error())
+	}
+	if err != nil || status < 200 || status >= 400 {
+		s.SetError()
+	}
+	s.End()
+}
@@ -0,0 +1,77 @@
+package loadgen
+
+import (
+	"context"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/dwladdimiroc/load-serverless/broker/tracing"
+)
+
+func TestTracingStatusCodeSpans(t *testing.T) {
+	var mu sync.Mutex
+	parents := map[string]int{} // traceparent span ID -> status answered
+	var n atomic.Int64
+	h := func(w http.ResponseWriter, r *http.Request) {
+		status := http.StatusOK
+		if n.Add(1)%2 == 0 {
+			status = http.StatusServiceUnavailable
+		}
+		parts := strings.Split(r.Header.Get(tracing.TraceparentHeader), "-")
+		if len(parts) == 4 {
+			mu.Lock()
+			parents[parts[2]] = status
+			mu.Unlock()
+		}
+		w.WriteHeader(status)
+	}
+	exp := new(tracing.InMemoryExporter)
+	tracer := tracing.New(exp, tracing.Config{Sample: 1})
+	res := testRun(t, h, Config{Requests: 10, Tracer: tracer})
+	if res.TraceErr != nil {
+		t.Fatal(res.TraceErr)
+	}
+	if err := tracer.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := exp.Spans()
+	if len(spans) != 10 {
+		t.Fatalf("exported %d spans, want one per request", len(spans))
+	}
+	for _, s := range spans {
+		want, ok := parents[hex.EncodeToString(s.SpanID[:])]
+		if !ok {
+			t.Fatalf("span %x was not propagated in a traceparent", s.SpanID)
+		}
+		if s.Kind != tracing.SpanKindClient || s.Name != http.MethodPost {
+			t.Errorf("span %s kind %d", s.Name, s.Kind)
+		}
+		if got := s.Attrs["http.response.status_code"]; got != want {
+			t.Errorf("span status code = %v, want %d", got, want)
+		}
+		if s.Error != (want >= 400) {
+			t.Errorf("status %d: span error = %v", want, s.Error)
+		}
+	}
+}
+
+func TestTracingSampling(t *testing.T) {
+	var sampled atomic.Int64
+	h := func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.Header.Get(tracing.TraceparentHeader), "-01") {
+			sampled.Add(1)
+		}
+	}
+	exp := new(tracing.InMemoryExporter)
+	tracer := tracing.New(exp, tracing.Config{Sample: 0})
+	testRun(t, h, Config{Tracer: tracer})
+	_ = tracer.Shutdown(context.Background())
+	if n := len(exp.Spans()); n != 0 || sampled.Load() != 0 {
+		t.Errorf("Sample 0: %d spans exported, %d requests flagged sampled", n, sampled.Load())
+	}
+}
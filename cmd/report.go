@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dwladdimiroc/load-serverless/cmd/loadgen"
+)
+
+// printReport writes the human-readable summary of a run.
+func printReport(w io.Writer, cfg loadgen.Config, res loadgen.Result, traceURL string, traceSample float64) {
+	fmt.Fprintln(w, "==== Load Test Result ====")
+	fmt.Fprintf(w, "Go: %s | CPUs: %d | GOMAXPROCS: %d\n", runtime.Version(), runtime.NumCPU(), runtime.GOMAXPROCS(0))
+	fmt.Fprintf(w, "Target URL: %s\n", res.Target)
+	if cfg.Fanout {
+		fmt.Fprintf(w, "Requests: %d x %d targets (fanout) | Concurrency(workers): %d\n", cfg.Requests, len(cfg.Targets), cfg.Concurrency)
+	} else {
+		fmt.Fprintf(w, "Requests: %d | Concurrency(workers): %d\n", cfg.Requests, cfg.Concurrency)
+	}
+	fmt.Fprintf(w, "Transport: max-conns-per-host=%d | max-idle-conns=%d | idle-timeout=%s | keep-alive=%t | http2=%t\n",
+		cfg.MaxConnsPerHost, cfg.MaxIdleConns, cfg.IdleTimeout, !cfg.NoKeepAlive, !cfg.HTTP1)
+	hdrTimeout := "off"
+	if cfg.ResponseHeaderTimeout > 0 {
+		hdrTimeout = cfg.ResponseHeaderTimeout.String()
+	}
+	fmt.Fprintf(w, "Timeouts: total=%s | connect=%s | tls=%s | response-header=%s\n",
+		cfg.Timeout, cfg.ConnectTimeout, cfg.TLSTimeout, hdrTimeout)
+	if cfg.IPFamily != "" && cfg.IPFamily != loadgen.IPFamilyAny {
+		fmt.Fprintf(w, "IP family: %s only\n", cfg.IPFamily)
+	}
+	if res.Interrupted {
+		fmt.Fprintf(w, "INTERRUPTED: partial results over %d completed requests\n", res.OK+res.Errors)
+	}
+	if res.Aborted {
+		fmt.Fprintf(w, "ABORTED: more than %d errors, partial results over %d completed requests\n", cfg.MaxErrors, res.OK+res.Errors)
+	}
+	if cfg.DeterministicPayloads {
+		fmt.Fprintf(w, "Seed: %d (deterministic payloads per request index)\n", res.Seed)
+	} else {
+		fmt.Fprintf(w, "Seed: %d\n", res.Seed)
+	}
+	if cfg.Prewarm > 0 {
+		fmt.Fprintf(w, "Prewarm: %d requests opened %d connections; the measured run opened %d more\n", cfg.Prewarm, res.PrewarmConns, res.NewConns)
+	}
+	if cfg.ReplayFile != "" {
+		fmt.Fprintf(w, "Payload: replayed from %s (%d bodies, %s)\n", cfg.ReplayFile, res.ReplayBodies, cfg.ReplayOrder)
+	} else if cfg.Cluster {
+		fmt.Fprintf(w, "Payload: clustered (%d centers, stddev %.3f°)\n", cfg.ClusterCenters, cfg.ClusterStdDev)
+	}
+	if cfg.PadBytes > 0 {
+		fmt.Fprintf(w, "Padding: %d filler bytes per payload (\"_pad\" field)\n", cfg.PadBytes)
+	}
+	if traceURL != "" {
+		fmt.Fprintf(w, "Tracing: %.2f%% of requests exported to %s\n", traceSample*100, traceURL)
+		if res.TraceErr != nil {
+			fmt.Fprintf(w, "Trace export error: %v\n", res.TraceErr)
+		}
+	}
+	fmt.Fprintf(w, "Total time: %s\n", res.Duration)
+	fmt.Fprintf(w, "OK: %d | Errors: %d\n", res.OK, res.Errors)
+	if len(res.Protocols) > 0 {
+		protos := make([]string, 0, len(res.Protocols))
+		for p, n := range res.Protocols {
+			protos = append(protos, fmt.Sprintf("%s=%d", p, n))
+		}
+		sort.Strings(protos)
+		fmt.Fprintf(w, "Protocol: %s\n", strings.Join(protos, " "))
+	}
+
+	if res.Errors > 0 {
+		fmt.Fprintf(w, "Errors breakdown: 4xx=%d 5xx=%d other=%d\n", res.Status4xx, res.Status5xx, res.StatusOther)
+		if res.FirstErr != nil {
+			fmt.Fprintf(w, "First error: %v\n", res.FirstErr)
+		}
+	}
+	if len(res.TransportErrors) > 0 {
+		fmt.Fprintln(w, "---- Transport errors (no response) ----")
+		for _, e := range res.TransportErrors {
+			fmt.Fprintf(w, "%-12s %d | first: %s\n", e.Class+":", e.Count, e.First)
+		}
+	}
+
+	if cfg.Compare {
+		fmt.Fprintf(w, "Compare: %d checked | %d diverged > %.3f km", res.Compared, res.Diverged, cfg.CompareTol)
+		if res.Compared > 0 {
+			fmt.Fprintf(w, " (%.2f%%)", 100*float64(res.Diverged)/float64(res.Compared))
+		}
+		fmt.Fprintln(w)
+	}
+
+	if cfg.ExpectEcho {
+		fmt.Fprintf(w, "Echo: %d matched | %d mismatched\n", res.EchoMatched, res.EchoMismatched)
+	}
+
+	if cfg.ColdStartHeader != "" {
+		fmt.Fprintf(w, "---- Instances (by %s) ----\n", cfg.ColdStartHeader)
+		fmt.Fprintf(w, "Cold (new instance): %d", res.Cold)
+		if res.Cold > 0 {
+			fmt.Fprintf(w, " | avg latency %s", res.ColdAvg)
+		}
+		fmt.Fprintf(w, "\nWarm (reused):       %d", res.Warm)
+		if res.Warm > 0 {
+			fmt.Fprintf(w, " | avg latency %s", res.WarmAvg)
+		}
+		fmt.Fprintln(w)
+	}
+
+	fmt.Fprintf(w, "Throughput (total): %.2f req/s\n", res.Throughput)
+
+	// The sections after the latency stats hold without successful requests
+	// too: errors per target or window are what such a run is about
+	lat := res.Latency
+	if lat.Count == 0 {
+		fmt.Fprintln(w, "No successful requests to compute latency stats.")
+	} else {
+		fmt.Fprintln(w, "---- Latency (successful requests) ----")
+		if lat.Insignificant {
+			fmt.Fprintf(w, "WARNING: only %d successful requests (-min-samples %d): the percentiles below are statistically insignificant\n", lat.Count, cfg.MinSamples)
+		}
+		fmt.Fprintf(w, "Count: %d\n", lat.Count)
+		fmt.Fprintf(w, "Min: %s\n", lat.Min)
+		fmt.Fprintf(w, "Avg: %s\n", lat.Avg)
+		fmt.Fprintf(w, "Max: %s\n", lat.Max)
+		fmt.Fprintf(w, "p50: %s\n", lat.P50)
+		fmt.Fprintf(w, "p90: %s\n", lat.P90)
+		fmt.Fprintf(w, "p95: %s\n", lat.P95)
+		fmt.Fprintf(w, "p99: %s\n", lat.P99)
+	}
+
+	if len(res.Targets) > 0 {
+		fmt.Fprintln(w, "---- Per target ----")
+		for _, t := range res.Targets {
+			share := 0.0
+			if sent := res.OK + res.Errors; sent > 0 {
+				share = 100 * float64(t.Requests) / float64(sent)
+			}
+			fmt.Fprintf(w, "%s (weight %d): requests=%d (%.1f%%) ok=%d errors=%d", t.URL, t.Weight, t.Requests, share, t.OK, t.Errors)
+			if t.OK > 0 {
+				fmt.Fprintf(w, " | p50=%s p99=%s", t.P50, t.P99)
+			}
+			fmt.Fprintln(w)
+		}
+	}
+
+	if cfg.PerWorker {
+		fmt.Fprintln(w, "---- Per worker (successful requests) ----")
+		for _, ws := range res.Workers {
+			fmt.Fprintf(w, "Worker %4d: count=%d p50=%s p99=%s\n", ws.ID, ws.Count, ws.P50, ws.P99)
+		}
+	}
+
+	if cfg.Window > 0 {
+		fmt.Fprintf(w, "---- Per %s window (by request start) ----\n", cfg.Window)
+		for _, win := range res.Windows {
+			fmt.Fprintf(w, "%8s: %9.2f req/s | ok=%d errors=%d | p50=%s p99=%s\n",
+				win.Start, win.Throughput, win.OK, win.Errors, win.P50, win.P99)
+		}
+	}
+
+	if cfg.NoKeepAlive {
+		fmt.Fprintln(w, "---- Connections (keep-alive disabled) ----")
+		fmt.Fprintf(w, "New connections: %d\n", res.NewConns)
+		if res.NewConns > 0 {
+			fmt.Fprintf(w, "Avg setup (DNS+TCP+TLS): %s", res.ConnSetupAvg)
+			if lat.Avg > 0 {
+				fmt.Fprintf(w, " (%.1f%% of avg latency)", 100*float64(res.ConnSetupAvg)/float64(lat.Avg))
+			}
+			fmt.Fprintln(w)
+		}
+	}
+}
+
+// printDelta prints a before/after table of the headline numbers.
+func printDelta(w io.Writer, baseFile string, base, cur loadgen.Result, d loadgen.Delta) {
+	fmt.Fprintf(w, "---- Compared with %s ----\n", baseFile)
+	fmt.Fprintf(w, "%-12s %14s %14s %14s %9s\n", "", "before", "after", "delta", "change")
+	fmt.Fprintf(w, "%-12s %14.2f %14.2f %+14.2f %+8.1f%%\n", "req/s", base.Throughput, cur.Throughput, cur.Throughput-base.Throughput, d.ThroughputPct)
+	fmt.Fprintf(w, "%-12s %14s %14s %14s %+8.1f%%\n", "p50", base.Latency.P50, cur.Latency.P50, signed(d.P50), d.P50Pct)
+	fmt.Fprintf(w, "%-12s %14s %14s %14s %+8.1f%%\n", "p99", base.Latency.P99, cur.Latency.P99, signed(d.P99), d.P99Pct)
+	fmt.Fprintf(w, "%-12s %13.2f%% %13.2f%% %+12.2fpt\n", "error rate", 100*d.BaseErrorRate, 100*d.ErrorRate, 100*(d.ErrorRate-d.BaseErrorRate))
+	if len(d.Regressions) == 0 {
+		fmt.Fprintln(w, "No regressions")
+		return
+	}
+	for _, r := range d.Regressions {
+		fmt.Fprintf(w, "REGRESSION: %s\n", r)
+	}
+}
+
+// signed formats a duration delta with an explicit sign.
+func signed(d time.Duration) string {
+	if d >= 0 {
+		return "+" + d.String()
+	}
+	return d.String()
+}
+
+// csvHeader names the columns written by writeCSV.
+var csvHeader = []string{
+	"time", "target", "requests", "concurrency", "seed", "interrupted", "duration_s", "throughput",
+	"ok", "errors", "status_4xx", "status_5xx", "status_other",
+	"min_ms", "avg_ms", "p50_ms", "p90_ms", "p95_ms", "p99_ms", "max_ms",
+}
+
+// writeCSV writes one row summarising the run, preceded by the header row
+// when header is set.
+func writeCSV(w io.Writer, cfg loadgen.Config, res loadgen.Result, header bool) error {
+	ms := func(d time.Duration) string {
+		return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 3, 64)
+	}
+	lat := res.Latency
+	cw := csv.NewWriter(w)
+	if header {
+		_ = cw.Write(csvHeader)
+	}
+	_ = cw.Write([]string{
+		time.Now().UTC().Format(time.RFC3339), res.Target,
+		strconv.Itoa(cfg.Requests), strconv.Itoa(cfg.Concurrency), strconv.FormatInt(res.Seed, 10),
+		strconv.FormatBool(res.Interrupted),
+		strconv.FormatFloat(res.Duration.Seconds(), 'f', 3, 64), strconv.FormatFloat(res.Throughput, 'f', 2, 64),
+		strconv.Itoa(res.OK), strconv.Itoa(res.Errors),
+		strconv.Itoa(res.Status4xx), strconv.Itoa(res.Status5xx), strconv.Itoa(res.StatusOther),
+		ms(lat.Min), ms(lat.Avg), ms(lat.P50), ms(lat.P90), ms(lat.P95), ms(lat.P99), ms(lat.Max),
+	})
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dwladdimiroc/load-serverless/cmd/loadgen"
+)
+
+func TestPrintDelta(t *testing.T) {
+	base := loadgen.Result{Throughput: 1000, OK: 100, Latency: loadgen.LatencyStats{P50: 10 * time.Millisecond, P99: 40 * time.Millisecond}}
+	cur := loadgen.Result{Throughput: 850, OK: 100, Latency: loadgen.LatencyStats{P50: 9 * time.Millisecond, P99: 60 * time.Millisecond}}
+	var out strings.Builder
+	printDelta(&out, "before.json", base, cur, loadgen.Compare(base, cur, 10, 1))
+	for _, want := range []string{
+		"---- Compared with before.json ----\n",
+		"-150.00    -15.0%\n",
+		"-1ms",
+		"+20ms",
+		"REGRESSION: throughput down 15.0%\n",
+		"REGRESSION: p99 up 50.0%\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("delta table lacks %q:\n%s", want, out.String())
+		}
+	}
+
+	out.Reset()
+	printDelta(&out, "before.json", base, base, loadgen.Compare(base, base, 10, 1))
+	if !strings.HasSuffix(out.String(), "No regressions\n") {
+		t.Errorf("unchanged run:\n%s", out.String())
+	}
+}
+
+func TestPrintReportTransport(t *testing.T) {
+	cfg := loadgen.Config{Requests: 1, Concurrency: 1, MaxConnsPerHost: 4, MaxIdleConns: 8, IdleTimeout: 30 * time.Second, HTTP1: true, IPFamily: loadgen.IPFamily6}
+	var out strings.Builder
+	printReport(&out, cfg, loadgen.Result{OK: 3, Protocols: map[string]int{"HTTP/2.0": 1, "HTTP/1.1": 2}}, "", 0)
+	for _, want := range []string{
+		"Transport: max-conns-per-host=4 | max-idle-conns=8 | idle-timeout=30s | keep-alive=true | http2=false\n",
+		"Protocol: HTTP/1.1=2 HTTP/2.0=1\n",
+		"IP family: tcp6 only\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("report lacks %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestPrintReportTransportErrors(t *testing.T) {
+	res := loadgen.Result{Errors: 3, TransportErrors: []loadgen.TransportErrorStats{
+		{Class: loadgen.ErrClassRefused, Count: 2, First: "dial tcp: connection refused"},
+		{Class: loadgen.ErrClassHeaderTimeout, Count: 1, First: "net/http: timeout awaiting response headers"},
+	}}
+	var out strings.Builder
+	printReport(&out, loadgen.Config{Requests: 3, Concurrency: 1}, res, "", 0)
+	for _, want := range []string{
+		"---- Transport errors (no response) ----\n",
+		"refused:     2 | first: dial tcp: connection refused\n",
+		"header_timeout: 1 | first: net/http: timeout awaiting response headers\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("report lacks %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestPrintReportAborted(t *testing.T) {
+	cfg := loadgen.Config{Requests: 100, Concurrency: 2, MaxErrors: 3}
+	res := loadgen.Result{Aborted: true, OK: 2, Errors: 4, Latency: loadgen.LatencyStats{Count: 2, P50: time.Millisecond}}
+	var out strings.Builder
+	printReport(&out, cfg, res, "", 0)
+	if want := "ABORTED: more than 3 errors, partial results over 6 completed requests\n"; !strings.Contains(out.String(), want) {
+		t.Errorf("report lacks %q:\n%s", want, out.String())
+	}
+	if strings.Contains(out.String(), "INTERRUPTED") {
+		t.Errorf("aborted run reported as interrupted:\n%s", out.String())
+	}
+}
+
+func TestPrintReportInsignificant(t *testing.T) {
+	cfg := loadgen.Config{Requests: 100, Concurrency: 2, MinSamples: 30}
+	res := loadgen.Result{OK: 12, Errors: 88, Latency: loadgen.LatencyStats{Count: 12, P50: time.Millisecond, Insignificant: true}}
+	var out strings.Builder
+	printReport(&out, cfg, res, "", 0)
+	want := "---- Latency (successful requests) ----\nWARNING: only 12 successful requests (-min-samples 30): the percentiles below are statistically insignificant\nCount: 12\n"
+	if !strings.Contains(out.String(), want) {
+		t.Errorf("report lacks %q:\n%s", want, out.String())
+	}
+
+	res.Latency.Insignificant = false
+	out.Reset()
+	printReport(&out, cfg, res, "", 0)
+	if strings.Contains(out.String(), "WARNING") {
+		t.Errorf("warning without Insignificant:\n%s", out.String())
+	}
+}
+
+func TestPrintReportWithoutSuccesses(t *testing.T) {
+	cfg := loadgen.Config{
+		Requests:    4,
+		Concurrency: 2,
+		Targets:     []loadgen.WeightedTarget{{URL: "http://a", Weight: 1}, {URL: "http://b", Weight: 1}},
+		PerWorker:   true,
+		Window:      time.Second,
+		NoKeepAlive: true,
+	}
+	res := loadgen.Result{
+		Errors:    4,
+		Status5xx: 4,
+		FirstErr:  errors.New("status 503"),
+		NewConns:  4,
+		Targets: []loadgen.TargetStats{
+			{URL: "http://a", Weight: 1, Requests: 2, Errors: 2},
+			{URL: "http://b", Weight: 1, Requests: 2, Errors: 2},
+		},
+		Workers:      []loadgen.WorkerStats{{ID: 0}, {ID: 1}},
+		Windows:      []loadgen.WindowStats{{Errors: 4}},
+		ConnSetupAvg: time.Millisecond,
+	}
+	var out strings.Builder
+	printReport(&out, cfg, res, "", 0)
+	report := out.String()
+
+	for _, want := range []string{
+		"No successful requests to compute latency stats.",
+		"---- Per target ----",
+		"http://b (weight 1): requests=2 (50.0%) ok=0 errors=2",
+		"---- Per worker (successful requests) ----",
+		"---- Per 1s window (by request start) ----",
+		"---- Connections (keep-alive disabled) ----",
+		"New connections: 4",
+		"Avg setup (DNS+TCP+TLS): 1ms\n",
+	} {
+		if !strings.Contains(report, want) {
+			t.Errorf("report lacks %q:\n%s", want, report)
+		}
+	}
+	if strings.Contains(report, "---- Latency") || strings.Contains(report, "NaN") || strings.Contains(report, "Inf") {
+		t.Errorf("report shows latency stats without successes:\n%s", report)
+	}
+}
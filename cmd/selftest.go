@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/dwladdimiroc/load-serverless/broker/proxy"
+	"github.com/dwladdimiroc/load-serverless/cmd/loadgen"
+	"github.com/dwladdimiroc/load-serverless/server/geo"
+	"github.com/gogearbox/gearbox"
+)
+
+const (
+	selftestRequests    = 500
+	selftestConcurrency = 8
+)
+
+// runSelfTest runs the client against an in-process Broker on an ephemeral
+// port, fronting two in-process geo servers (the real gearbox routes, with
+// the default configuration), and checks that every request succeeds and
+// that both backends return the right average. It writes a PASS/FAIL
+// summary to w and reports whether it passed.
+func runSelfTest(w io.Writer) bool {
+	fail := func(format string, args ...any) bool {
+		fmt.Fprintf(w, "FAIL: "+format+"\n", args...)
+		return false
+	}
+
+	var backends []proxy.Backend
+	for _, name := range []string{"serverless", "vm"} {
+		addr, stop, err := serveGeo()
+		if err != nil {
+			return fail("backend %s: %v", name, err)
+		}
+		defer stop()
+		backends = append(backends, proxy.Backend{
+			Name:      name,
+			BaseURL:   &url.URL{Scheme: "http", Host: addr},
+			Transport: http.DefaultTransport,
+		})
+	}
+	// Before the backends stop: gearbox waits for open client connections
+	defer http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+
+	b := proxy.New(proxy.Config{Backends: backends})
+	addr, stop, err := serveLocal(b.Handler())
+	if err != nil {
+		return fail("broker: %v", err)
+	}
+	defer stop()
+	brokerURL := "http://" + addr + "/geo_average"
+	fmt.Fprintf(w, "Self-test: Broker on %s, backends %s and %s\n", addr, backends[0].BaseURL.Host, backends[1].BaseURL.Host)
+
+	// Known points through the Broker: every backend must return their average
+	points := []map[string]float64{{"lat": 10, "lng": 20}, {"lat": 10, "lng": 22}, {"lat": 12, "lng": 20}, {"lat": 12, "lng": 22}}
+	body, _ := json.Marshal(map[string]any{"points": points})
+	served := map[string]bool{}
+	for range len(backends) * 2 {
+		resp, err := http.Post(brokerURL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			return fail("request: %v", err)
+		}
+		var avg struct{ Lat, Lng float64 }
+		err = json.NewDecoder(resp.Body).Decode(&avg)
+		_ = resp.Body.Close()
+		switch {
+		case resp.StatusCode != http.StatusOK:
+			return fail("status %d from %s", resp.StatusCode, resp.Header.Get("X-Selected-Backend"))
+		case err != nil:
+			return fail("invalid response from %s: %v", resp.Header.Get("X-Selected-Backend"), err)
+		case math.Abs(avg.Lat-11.0026) > 1e-3 || math.Abs(avg.Lng-21) > 1e-9:
+			return fail("wrong average %.6f,%.6f from %s", avg.Lat, avg.Lng, resp.Header.Get("X-Selected-Backend"))
+		}
+		served[resp.Header.Get("X-Selected-Backend")] = true
+	}
+	if len(served) != len(backends) {
+		return fail("requests reached %d of %d backends", len(served), len(backends))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	res, err := loadgen.Run(ctx, loadgen.Config{
+		URL:         brokerURL,
+		Requests:    selftestRequests,
+		Concurrency: selftestConcurrency,
+		Timeout:     5 * time.Second,
+		Precision:   6,
+	})
+	if err != nil {
+		return fail("load: %v", err)
+	}
+	fmt.Fprintf(w, "Load: %d requests | OK: %d | Errors: %d | p50: %s | p99: %s\n",
+		selftestRequests, res.OK, res.Errors, res.Latency.P50, res.Latency.P99)
+	if res.OK != selftestRequests {
+		return fail("%d of %d requests failed (first error: %v)", selftestRequests-res.OK, selftestRequests, res.FirstErr)
+	}
+	fmt.Fprintln(w, "PASS")
+	return true
+}
+
+// serveLocal serves h on an ephemeral loopback port until stop is called.
+func serveLocal(h http.Handler) (addr string, stop func(), err error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, err
+	}
+	srv := &http.Server{Handler: h, ReadHeaderTimeout: 5 * time.Second}
+	go func() { _ = srv.Serve(ln) }()
+	return ln.Addr().String(), func() { _ = srv.Close() }, nil
+}
+
+// serveGeo serves the geo routes with gearbox on an ephemeral loopback port
+// until stop is called. gearbox only listens on an address it is given, so
+// the port is picked by a throwaway listener first.
+func serveGeo() (addr string, stop func(), err error) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, err
+	}
+	addr = ln.Addr().String()
+	_ = ln.Close()
+
+	gb := gearbox.New(&gearbox.Settings{DisableStartupMessage: true})
+	geo.Register(gb, geo.DefaultConfig())
+	started := make(chan error, 1)
+	go func() { started <- gb.Start(addr) }()
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if conn, err := net.DialTimeout("tcp4", addr, time.Second); err == nil {
+			_ = conn.Close()
+			return addr, func() { _ = gb.Stop() }, nil
+		}
+		select {
+		case err := <-started:
+			return "", nil, err
+		case <-time.After(10 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			_ = gb.Stop()
+			return "", nil, fmt.Errorf("%s not listening after 5s", addr)
+		}
+	}
+}
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSelfTest(t *testing.T) {
+	var out strings.Builder
+	if !runSelfTest(&out) {
+		t.Fatalf("self-test failed:\n%s", out.String())
+	}
+	if !strings.HasSuffix(out.String(), "PASS\n") {
+		t.Errorf("output does not end with PASS:\n%s", out.String())
+	}
+}
@@ -1,13 +1,87 @@
 package functions
 
 import (
+	"compress/gzip"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
 	"math"
+	"math/rand"
+	"mime"
 	"net/http"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/GoogleCloudPlatform/functions-framework-go/functions"
 )
 
+const (
+	// MaxPrecision is the most decimal places accepted by ?precision=.
+	MaxPrecision = 15
+
+	// MaxDecompressedBytes caps a Content-Encoding: gzip request body once
+	// decompressed, so a small upload can't expand without bound.
+	MaxDecompressedBytes = 4 << 20
+
+	// FUNCTION_COLD_DELAY_MS delays the first invocation after process start
+	// by that many milliseconds, to simulate a cold start (unset = off).
+	ColdDelayEnv = "FUNCTION_COLD_DELAY_MS"
+
+	// GEO_FIXED_POINT=true writes lat/lng in plain decimal notation, never
+	// exponents such as 1e-07, for strict JSON clients.
+	FixedPointEnv = "GEO_FIXED_POINT"
+
+	// GEO_LENIENT_CONTENT_TYPE=true decodes the request body whatever its
+	// Content-Type instead of answering 415 to anything but JSON.
+	LenientContentTypeEnv = "GEO_LENIENT_CONTENT_TYPE"
+
+	// GEO_EMPTY_NO_CONTENT=false answers an empty point list with 400 like
+	// any other wrong count, instead of 204 No Content.
+	EmptyNoContentEnv = "GEO_EMPTY_NO_CONTENT"
+
+	// RequiredPoints is the exact count the function averages; any other is
+	// a 400.
+	RequiredPoints = 4
+
+	// GEO_MAX_POINTS caps the points of a request before any computation,
+	// answering 413 above it (0 = no cap). While the function only averages
+	// RequiredPoints points it merely turns that 400 into an early 413 for
+	// oversized requests, and a cap below RequiredPoints is refused at
+	// startup; it takes full effect once arbitrary counts are supported, as
+	// on the gearbox server.
+	MaxPointsEnv     = "GEO_MAX_POINTS"
+	DefaultMaxPoints = 10000
+
+	// A mean vector this short has no direction (the points cancel out, e.g.
+	// antipodal pairs); one this close to the polar axis is a pole, whose
+	// longitude is reported as 0.
+	DegenerateEpsilon = 1e-12
+
+	// ERROR_INJECT_RATE in [0,1] fails that fraction of requests with
+	// ERROR_INJECT_STATUS (default 503), for resilience testing.
+	ErrorInjectRateEnv    = "ERROR_INJECT_RATE"
+	ErrorInjectStatusEnv  = "ERROR_INJECT_STATUS"
+	DefaultInjectedStatus = 503
+)
+
+var (
+	coldDelay time.Duration
+	coldStart sync.Once
+
+	injectRate   float64
+	injectStatus = DefaultInjectedStatus
+
+	fixedPoint     bool
+	lenientTypes   bool
+	emptyNoContent = true
+	maxPoints      = DefaultMaxPoints
+)
+
 type Point struct {
 	Lat float64 `json:"lat"`
 	Lng float64 `json:"lng"`
@@ -21,40 +95,259 @@ type AvgResponse struct {
 	Lat    float64 `json:"lat"`
 	Lng    float64 `json:"lng"`
 	Method string  `json:"method"`
+
+	fixedPoint bool // GEO_FIXED_POINT
+}
+
+// MarshalJSON writes Lat and Lng without exponent notation when fixedPoint
+// is set.
+func (r AvgResponse) MarshalJSON() ([]byte, error) {
+	type plain AvgResponse
+	if !r.fixedPoint {
+		return json.Marshal(plain(r))
+	}
+	return json.Marshal(struct {
+		Lat json.Number `json:"lat"`
+		Lng json.Number `json:"lng"`
+		plain
+	}{fixedNumber(r.Lat), fixedNumber(r.Lng), plain(r)})
+}
+
+// fixedNumber formats v as a JSON number in plain decimal notation.
+func fixedNumber(v float64) json.Number {
+	return json.Number(strconv.FormatFloat(v, 'f', -1, 64))
+}
+
+// PointError is the 400 body naming the first out-of-range point.
+type PointError struct {
+	Error  string `json:"error"` // always "invalid_points"
+	Index  int    `json:"index"`
+	Reason string `json:"reason"`
 }
 
 func init() {
-	functions.HTTP("Average", Average)
+	if v := os.Getenv(ColdDelayEnv); v != "" {
+		ms, err := strconv.Atoi(v)
+		if err != nil || ms < 0 {
+			log.Fatalf("Invalid %s: %q", ColdDelayEnv, v)
+		}
+		coldDelay = time.Duration(ms) * time.Millisecond
+	}
+	if v := os.Getenv(ErrorInjectRateEnv); v != "" {
+		rate, err := strconv.ParseFloat(v, 64)
+		if err != nil || rate < 0 || rate > 1 {
+			log.Fatalf("Invalid %s: %q", ErrorInjectRateEnv, v)
+		}
+		injectRate = rate
+	}
+	if v := os.Getenv(ErrorInjectStatusEnv); v != "" {
+		status, err := strconv.Atoi(v)
+		if err != nil || status < 400 || status > 599 {
+			log.Fatalf("Invalid %s: %q", ErrorInjectStatusEnv, v)
+		}
+		injectStatus = status
+	}
+	if v := os.Getenv(FixedPointEnv); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("Invalid %s: %q", FixedPointEnv, v)
+		}
+		fixedPoint = b
+	}
+	if v := os.Getenv(LenientContentTypeEnv); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("Invalid %s: %q", LenientContentTypeEnv, v)
+		}
+		lenientTypes = b
+	}
+	if v := os.Getenv(EmptyNoContentEnv); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("Invalid %s: %q", EmptyNoContentEnv, v)
+		}
+		emptyNoContent = b
+	}
+	if v := os.Getenv(MaxPointsEnv); v != "" {
+		n, err := parseMaxPoints(v)
+		if err != nil {
+			log.Fatalf("Invalid %s: %v", MaxPointsEnv, err)
+		}
+		maxPoints = n
+	}
+	functions.HTTP("Average", withRecover(Average))
+}
+
+// parseMaxPoints reads a GEO_MAX_POINTS value: 0 (no cap) or a cap that
+// still lets RequiredPoints points through.
+func parseMaxPoints(v string) (int, error) {
+	n, err := strconv.Atoi(v)
+	switch {
+	case err != nil || n < 0:
+		return 0, fmt.Errorf("%q (must be an integer >= 0)", v)
+	case n > 0 && n < RequiredPoints:
+		return 0, fmt.Errorf("%d (must be 0 or at least %d, the points a request carries)", n, RequiredPoints)
+	}
+	return n, nil
 }
 
 func Average(w http.ResponseWriter, r *http.Request) {
+	// Simulated cold start: requests arriving meanwhile wait for it too
+	if coldDelay > 0 {
+		coldStart.Do(func() { time.Sleep(coldDelay) })
+	}
+
+	if injectRate > 0 && rand.Float64() < injectRate {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(injectStatus)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "injected error"})
+		return
+	}
+
 	if r.Method != http.MethodPost {
 		http.Error(w, "Use POST", http.StatusMethodNotAllowed)
 		return
 	}
+	if !lenientTypes && !isJSONContentType(r.Header.Get("Content-Type")) {
+		http.Error(w, "Unsupported Content-Type (use application/json)", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	precision, ok := parsePrecision(r.URL.Query().Get("precision"))
+	if !ok {
+		http.Error(w, "Query parameter precision must be an integer between 0 and 15", http.StatusBadRequest)
+		return
+	}
+
+	body := r.Body
+	if strings.EqualFold(r.Header.Get("Content-Encoding"), "gzip") {
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, "Invalid gzip body", http.StatusBadRequest)
+			return
+		}
+		body = http.MaxBytesReader(w, zr, MaxDecompressedBytes)
+	}
 
 	var req AvgRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, fmt.Sprintf("Decompressed body exceeds %d bytes", MaxDecompressedBytes), http.StatusRequestEntityTooLarge)
+			return
+		}
 		http.Error(w, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
 
+	// No points, no average: 204 rather than a 200 whose zero lat/lng would
+	// read as a real result at (0,0)
+	if len(req.Points) == 0 && emptyNoContent {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if maxPoints > 0 && len(req.Points) > maxPoints {
+		http.Error(w, fmt.Sprintf("Too many points: at most %d allowed, got %d", maxPoints, len(req.Points)), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	start := time.Now()
 	avg, ok := averageLatLngSpherical(req.Points)
+	w.Header().Set("Server-Timing", serverTiming(time.Since(start)))
 	if !ok {
+		if perr, found := invalidPoint(req.Points); found {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(perr)
+			return
+		}
+		if len(req.Points) == RequiredPoints {
+			http.Error(w, "Invalid Points: no defined average (they cancel out, as antipodal pairs do)", http.StatusBadRequest)
+			return
+		}
 		http.Error(w, "Invalid Points", http.StatusBadRequest)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	_ = json.NewEncoder(w).Encode(AvgResponse{
-		Lat:    avg.Lat,
-		Lng:    avg.Lng,
-		Method: "spherical",
+		Lat:        roundTo(avg.Lat, precision),
+		Lng:        roundTo(avg.Lng, precision),
+		Method:     "spherical",
+		fixedPoint: fixedPoint,
 	})
 }
 
+// isJSONContentType accepts application/json with any parameters, but a
+// charset must be UTF-8.
+func isJSONContentType(contentType string) bool {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType != "application/json" {
+		return false
+	}
+	cs, ok := params["charset"]
+	return !ok || strings.EqualFold(cs, "utf-8")
+}
+
+// withRecover turns a panic in h into a logged stack trace and a 500 JSON
+// error instead of an opaque failure.
+func withRecover(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if rec := recover(); rec != nil {
+				log.Printf("panic serving %s: %v\n%s", r.URL.Path, rec, debug.Stack())
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusInternalServerError)
+				_ = json.NewEncoder(w).Encode(map[string]string{"error": "internal error"})
+			}
+		}()
+		h(w, r)
+	}
+}
+
+// parsePrecision parses the ?precision= decimal places; -1 (full precision)
+// when absent.
+func parsePrecision(v string) (int, bool) {
+	if v == "" {
+		return -1, true
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 || n > MaxPrecision {
+		return 0, false
+	}
+	return n, true
+}
+
+// roundTo rounds v to places decimal places; negative places leave v untouched.
+func roundTo(v float64, places int) float64 {
+	if places < 0 {
+		return v
+	}
+	r, _ := strconv.ParseFloat(strconv.FormatFloat(v, 'f', places, 64), 64)
+	return r
+}
+
+// serverTiming formats a Server-Timing header value for the computation time.
+func serverTiming(d time.Duration) string {
+	return "compute;dur=" + strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 3, 64)
+}
+
+// invalidPoint finds the first point outside [-90,90] x [-180,180].
+func invalidPoint(points []Point) (PointError, bool) {
+	for i, p := range points {
+		switch {
+		case !(p.Lat >= -90 && p.Lat <= 90):
+			return PointError{Error: "invalid_points", Index: i, Reason: "lat out of range"}, true
+		case !(p.Lng >= -180 && p.Lng <= 180):
+			return PointError{Error: "invalid_points", Index: i, Reason: "lng out of range"}, true
+		}
+	}
+	return PointError{}, false
+}
+
 func averageLatLngSpherical(points []Point) (Point, bool) {
-	if len(points) != 4 {
+	if len(points) != RequiredPoints {
 		return Point{}, false
 	}
 
@@ -72,12 +365,19 @@ func averageLatLngSpherical(points []Point) (Point, bool) {
 		z += math.Sin(lat)
 	}
 
-	x /= 4
-	y /= 4
-	z /= 4
+	x /= RequiredPoints
+	y /= RequiredPoints
+	z /= RequiredPoints
 
-	lng := math.Atan2(y, x)
 	hyp := math.Sqrt(x*x + y*y)
+	if math.Sqrt(x*x+y*y+z*z) < DegenerateEpsilon {
+		return Point{}, false
+	}
+	// On the polar axis the longitude is rounding noise: report the pole at 0
+	if hyp <= DegenerateEpsilon*math.Abs(z) {
+		x, y, hyp = 0, 0, 0
+	}
+	lng := math.Atan2(y, x)
 	lat := math.Atan2(z, hyp)
 
 	return Point{Lat: lat * 180 / math.Pi, Lng: lng * 180 / math.Pi}, true
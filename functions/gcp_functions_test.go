@@ -0,0 +1,311 @@
+package functions
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// call runs Average on a JSON POST of body.
+func call(t *testing.T, query, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, "/"+query, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	withRecover(Average)(w, r)
+	return w
+}
+
+// pointsBody is a request carrying n copies of the point (lat, lng).
+func pointsBody(n int, lat, lng float64) string {
+	points := make([]Point, n)
+	for i := range points {
+		points[i] = Point{Lat: lat, Lng: lng}
+	}
+	b, _ := json.Marshal(AvgRequest{Points: points})
+	return string(b)
+}
+
+func TestParseMaxPoints(t *testing.T) {
+	for _, tc := range []struct {
+		v    string
+		want int
+		ok   bool
+	}{
+		{"0", 0, true},
+		{"4", 4, true},
+		{"10000", 10000, true},
+		{"3", 0, false},
+		{"1", 0, false},
+		{"-1", 0, false},
+		{"many", 0, false},
+	} {
+		n, err := parseMaxPoints(tc.v)
+		if (err == nil) != tc.ok || n != tc.want {
+			t.Errorf("parseMaxPoints(%q) = %d, %v", tc.v, n, err)
+		}
+	}
+}
+
+func TestServerTiming(t *testing.T) {
+	if got := serverTiming(1234567 * time.Nanosecond); got != "compute;dur=1.235" {
+		t.Errorf("serverTiming = %q", got)
+	}
+	w := call(t, "", pointsBody(4, 10, 20))
+	if !strings.HasPrefix(w.Header().Get("Server-Timing"), "compute;dur=") {
+		t.Errorf("Server-Timing = %q", w.Header().Get("Server-Timing"))
+	}
+}
+
+func TestWithRecover(t *testing.T) {
+	h := withRecover(func(w http.ResponseWriter, r *http.Request) { panic("boom") })
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodPost, "/", nil))
+	if w.Code != http.StatusInternalServerError || strings.TrimSpace(w.Body.String()) != `{"error":"internal error"}` {
+		t.Errorf("status %d: %s", w.Code, w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+}
+
+func TestPrecision(t *testing.T) {
+	for _, tc := range []struct {
+		v      float64
+		places int
+		want   float64
+	}{
+		{10.12345, 2, 10.12},
+		{20.98765, 2, 20.99},
+		{-3.14159, 2, -3.14},
+		{-0.004, 2, 0},
+		{7.5, 0, 8},
+		{1.23456789, -1, 1.23456789},
+	} {
+		if got := roundTo(tc.v, tc.places); got != tc.want {
+			t.Errorf("roundTo(%v, %d) = %v, want %v", tc.v, tc.places, got, tc.want)
+		}
+	}
+
+	body := pointsBody(4, 10.12345, 20.98765)
+	var avg struct{ Lat, Lng float64 }
+	w := call(t, "?precision=2", body)
+	if err := json.Unmarshal(w.Body.Bytes(), &avg); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("precision=2: status %d: %s", w.Code, w.Body)
+	}
+	if avg.Lat != 10.12 || avg.Lng != 20.99 {
+		t.Errorf("precision=2: %+v, want 10.12, 20.99", avg)
+	}
+
+	w = call(t, "", body)
+	if err := json.Unmarshal(w.Body.Bytes(), &avg); err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(avg.Lat-10.12345) > 1e-9 || math.Abs(avg.Lng-20.98765) > 1e-9 {
+		t.Errorf("default: %+v, want full precision", avg)
+	}
+
+	for _, bad := range []string{"-1", "16", "two"} {
+		if w := call(t, "?precision="+bad, body); w.Code != http.StatusBadRequest {
+			t.Errorf("precision=%s: status %d", bad, w.Code)
+		}
+	}
+}
+
+func TestColdDelay(t *testing.T) {
+	defer func(d time.Duration) { coldDelay, coldStart = d, sync.Once{} }(coldDelay)
+	coldDelay, coldStart = 100*time.Millisecond, sync.Once{}
+
+	body := pointsBody(4, 10, 20)
+	for i, slow := range []bool{true, false, false} {
+		start := time.Now()
+		w := call(t, "", body)
+		took := time.Since(start)
+		if w.Code != http.StatusOK {
+			t.Fatalf("call %d: status %d: %s", i, w.Code, w.Body)
+		}
+		if slow && took < coldDelay {
+			t.Errorf("first call took %s, want the %s cold start", took, coldDelay)
+		}
+		if !slow && took >= coldDelay/2 {
+			t.Errorf("call %d took %s after the cold start", i, took)
+		}
+	}
+}
+
+func TestErrorInjection(t *testing.T) {
+	defer func(rate float64, status int) { injectRate, injectStatus = rate, status }(injectRate, injectStatus)
+	body := pointsBody(4, 10, 20)
+
+	injectRate, injectStatus = 1, http.StatusTooManyRequests
+	for range 20 {
+		if w := call(t, "", body); w.Code != http.StatusTooManyRequests || !strings.Contains(w.Body.String(), "injected error") {
+			t.Fatalf("rate 1: status %d: %s", w.Code, w.Body)
+		}
+	}
+	injectRate = 0
+	for range 20 {
+		if w := call(t, "", body); w.Code != http.StatusOK {
+			t.Fatalf("rate 0: status %d: %s", w.Code, w.Body)
+		}
+	}
+}
+
+func gzipped(t *testing.T, s string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestGzipBody(t *testing.T) {
+	post := func(body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("Content-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		withRecover(Average)(w, r)
+		return w
+	}
+
+	w := post(gzipped(t, pointsBody(4, 10, 20)))
+	var avg AvgResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &avg); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	if math.Abs(avg.Lat-10) > 1e-9 || math.Abs(avg.Lng-20) > 1e-9 {
+		t.Errorf("average = %+v", avg)
+	}
+
+	// A few KB that decompress past the cap
+	bomb := gzipped(t, `{"pad":"`+strings.Repeat("x", MaxDecompressedBytes)+`","points":[]}`)
+	if w := post(bomb); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized body: status %d: %s", w.Code, w.Body)
+	}
+	if w := post(pointsBody(4, 10, 20)); w.Code != http.StatusBadRequest {
+		t.Errorf("plain body marked gzip: status %d: %s", w.Code, w.Body)
+	}
+	if w := call(t, "", pointsBody(4, 10, 20)); w.Code != http.StatusOK {
+		t.Errorf("plain body: status %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestInvalidPointDetail(t *testing.T) {
+	for body, want := range map[string]PointError{
+		`{"points":[{"lat":10,"lng":20},{"lat":10,"lng":22},{"lat":95,"lng":20},{"lat":12,"lng":22}]}`:   {"invalid_points", 2, "lat out of range"},
+		`{"points":[{"lat":10,"lng":20},{"lat":10,"lng":22},{"lat":12,"lng":20},{"lat":12,"lng":-181}]}`: {"invalid_points", 3, "lng out of range"},
+	} {
+		w := call(t, "", body)
+		var got PointError
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || w.Code != http.StatusBadRequest || got != want {
+			t.Errorf("%s: status %d: %s, want %+v", body, w.Code, w.Body, want)
+		}
+	}
+}
+
+func TestFixedPoint(t *testing.T) {
+	defer func(v bool) { fixedPoint = v }(fixedPoint)
+	body := `{"points":[{"lat":1e-7,"lng":-2e-7},{"lat":1e-7,"lng":-2e-7},{"lat":1e-7,"lng":-2e-7},{"lat":1e-7,"lng":-2e-7}]}`
+	for _, fixed := range []bool{false, true} {
+		fixedPoint = fixed
+		w := call(t, "", body)
+		var avg AvgResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &avg); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", w.Code, w.Body)
+		}
+		if math.Abs(avg.Lat-1e-7) > 1e-15 || math.Abs(avg.Lng+2e-7) > 1e-15 {
+			t.Errorf("FixedPoint %t: average %+v", fixed, avg)
+		}
+		if exp := strings.Contains(w.Body.String(), "e-"); exp == fixed {
+			t.Errorf("FixedPoint %t: %s", fixed, w.Body)
+		}
+	}
+}
+
+func TestContentType(t *testing.T) {
+	defer func(v bool) { lenientTypes = v }(lenientTypes)
+	body := pointsBody(4, 10, 20)
+	for _, tc := range []struct {
+		contentType string
+		want        int
+	}{
+		{"application/json", http.StatusOK},
+		{"application/json; charset=utf-8", http.StatusOK},
+		{"", http.StatusUnsupportedMediaType},
+		{"text/plain", http.StatusUnsupportedMediaType},
+		{"application/json; charset=iso-8859-1", http.StatusUnsupportedMediaType},
+	} {
+		for _, lenient := range []bool{false, true} {
+			lenientTypes = lenient
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+			if tc.contentType != "" {
+				r.Header.Set("Content-Type", tc.contentType)
+			}
+			w := httptest.NewRecorder()
+			Average(w, r)
+			want := tc.want
+			if lenient {
+				want = http.StatusOK
+			}
+			if w.Code != want {
+				t.Errorf("%q (lenient %t): status %d, want %d: %s", tc.contentType, lenient, w.Code, want, w.Body)
+			}
+		}
+	}
+}
+
+func TestEmptyPointsNoContent(t *testing.T) {
+	defer func(v bool) { emptyNoContent = v }(emptyNoContent)
+	for _, tc := range []struct {
+		enabled bool
+		want    int
+	}{{true, http.StatusNoContent}, {false, http.StatusBadRequest}} {
+		emptyNoContent = tc.enabled
+		w := call(t, "", `{"points":[]}`)
+		if w.Code != tc.want || (tc.want == http.StatusNoContent && w.Body.Len() > 0) {
+			t.Errorf("emptyNoContent %t: status %d: %q, want %d", tc.enabled, w.Code, w.Body, tc.want)
+		}
+	}
+}
+
+func TestMaxPoints(t *testing.T) {
+	defer func(v int) { maxPoints = v }(maxPoints)
+	maxPoints = 4
+	if w := call(t, "", pointsBody(4, 10, 20)); w.Code != http.StatusOK {
+		t.Errorf("4 points: status %d: %s", w.Code, w.Body)
+	}
+	w := call(t, "", pointsBody(5, 10, 20))
+	if w.Code != http.StatusRequestEntityTooLarge || !strings.Contains(w.Body.String(), "at most 4 allowed, got 5") {
+		t.Errorf("5 points: status %d: %s", w.Code, w.Body)
+	}
+	maxPoints = 0
+	if w := call(t, "", pointsBody(5, 10, 20)); w.Code == http.StatusRequestEntityTooLarge {
+		t.Errorf("no cap: status %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestDegeneratePoints(t *testing.T) {
+	w := call(t, "", `{"points":[{"lat":0,"lng":0},{"lat":0,"lng":180},{"lat":0,"lng":0},{"lat":0,"lng":180}]}`)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "no defined average") {
+		t.Errorf("antipodal points: status %d: %s", w.Code, w.Body)
+	}
+
+	w = call(t, "", `{"points":[{"lat":90,"lng":10},{"lat":90,"lng":-50},{"lat":90,"lng":120},{"lat":90,"lng":0}]}`)
+	var got Point
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || w.Code != http.StatusOK || math.Abs(got.Lat-90) > 1e-9 || got.Lng != 0 {
+		t.Errorf("north pole: status %d: %s, want lat 90 lng 0", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,728 @@
+// Package geo is the geo server: the averaging and clustering computations
+// and the gearbox routes serving them (Register). The server command
+// configures it from the environment; the load client's -selftest serves it
+// in-process.
+package geo
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	DefaultRequiredPoints = 4
+	DefaultMaxPoints      = 10000
+	DefaultDedupeEpsilon  = 1e-9
+	DefaultOutlierFactor  = 3.0
+	DefaultAutoSpreadKm   = 50.0
+	DefaultGzipMinBytes   = 1024
+	DefaultInjectedStatus = 503
+
+	EarthRadiusKm = 6371.0
+	MaxPrecision  = 15 // decimal places accepted by ?precision=
+
+	// Request bodies larger than this are refused with 413, except on
+	// /geo_average/stream, which decodes its body as it arrives
+	MaxRequestBodyBytes = 4 << 20
+
+	// Cap on a Content-Encoding: gzip request body once decompressed, so a
+	// small upload can't expand without bound (MaxRequestBodyBytes bounds
+	// the raw body)
+	MaxDecompressedBytes = 4 << 20
+
+	// /geo_average response formats, chosen by the Accept header
+	FormatJSON = "json"
+	FormatText = "text" // "<lat>,<lng>"
+
+	// SpreadKm compares every pair of up to this many points; above it
+	// bounds the spread in one pass
+	SpreadExactMaxPoints = 256
+
+	KMeansMaxIterations = 100
+	DefaultClusterSeed  = 1
+
+	WeiszfeldMaxIterations = 1000
+	WeiszfeldTolerance     = 1e-12 // radians between successive estimates
+
+	// A vector this short (relative to the unit sphere) has no direction: the
+	// points cancel out, e.g. antipodal pairs. One this close to the polar
+	// axis is a pole, whose longitude is reported as 0.
+	DegenerateEpsilon = 1e-12
+
+	// Set, with Config.BodyChecksum, to the hex SHA-256 of the request body
+	// as received (after gzip decoding)
+	BodyChecksumHeader = "X-Body-Checksum"
+)
+
+// averagers maps the ?method= values of /geo_average to their implementation;
+// method=auto picks "simple" or "spherical" per request (autoMethod).
+var averagers = map[string]func([]Point) (Point, bool){
+	"spherical": AverageLatLngSpherical,
+	"simple":    AverageLatLngSimple,
+	"median":    AverageLatLngMedian,
+}
+
+type Point struct {
+	Lat float64 `json:"lat"`
+	Lng float64 `json:"lng"`
+}
+
+type AvgRequest struct {
+	Points []Point `json:"points"`
+}
+
+type AvgResponse struct {
+	Lat    float64 `json:"lat"`
+	Lng    float64 `json:"lng"`
+	Method string  `json:"method"`
+
+	DuplicatesRemoved *int `json:"duplicates_removed,omitempty"` // only with dedupe=true
+	OutliersRejected  *int `json:"outliers_rejected,omitempty"`  // only with reject_outliers=true
+
+	fixedPoint bool // Config.FixedPoint
+}
+
+// MarshalJSON writes Lat and Lng without exponent notation when fixedPoint
+// is set.
+func (r AvgResponse) MarshalJSON() ([]byte, error) {
+	type plain AvgResponse
+	if !r.fixedPoint {
+		return json.Marshal(plain(r))
+	}
+	return json.Marshal(struct {
+		Lat json.Number `json:"lat"`
+		Lng json.Number `json:"lng"`
+		plain
+	}{fixedNumber(r.Lat), fixedNumber(r.Lng), plain(r)})
+}
+
+// fixedNumber formats v as a JSON number in plain decimal notation.
+func fixedNumber(v float64) json.Number {
+	return json.Number(strconv.FormatFloat(v, 'f', -1, 64))
+}
+
+// GeoJSON is the subset of RFC 7946 objects /geo_average/geojson reads and
+// writes. Positions are [lng, lat] (optionally with an altitude, ignored),
+// the reverse of Point's field order.
+type GeoJSON struct {
+	Type        string          `json:"type"`
+	Coordinates json.RawMessage `json:"coordinates,omitempty"` // Point and MultiPoint
+	Geometry    *GeoJSON        `json:"geometry,omitempty"`    // Feature
+	Features    []GeoJSON       `json:"features,omitempty"`    // FeatureCollection
+	Properties  map[string]any  `json:"properties,omitempty"`  // Feature
+}
+
+// SphericalSteps exposes how the spherical average is computed: each point
+// becomes a unit vector, the vectors are summed and divided by the count,
+// and the mean vector is converted back to lat/lng.
+type SphericalSteps struct {
+	Average Point `json:"average"`
+
+	SumX float64 `json:"sum_x"` // sums of the unit vectors
+	SumY float64 `json:"sum_y"`
+	SumZ float64 `json:"sum_z"`
+
+	X float64 `json:"x"` // mean vector (sums / count)
+	Y float64 `json:"y"`
+	Z float64 `json:"z"`
+
+	Hyp    float64 `json:"hyp"`    // sqrt(x²+y²), the equatorial component; lat = atan2(z, hyp)
+	Length float64 `json:"length"` // of the mean vector: 1 = all points equal, near 0 = they cancel out
+
+	Undefined bool `json:"undefined,omitempty"` // Length below DegenerateEpsilon: no average, Average left zero
+}
+
+// StreamAvgResponse is the /geo_average/stream body.
+type StreamAvgResponse struct {
+	Lat    float64 `json:"lat"`
+	Lng    float64 `json:"lng"`
+	Method string  `json:"method"` // always "spherical"
+	Count  int     `json:"count"`  // points consumed
+}
+
+type CompareResponse struct {
+	Spherical Point   `json:"spherical"`
+	Simple    Point   `json:"simple"`
+	DeltaKm   float64 `json:"delta_km"`
+}
+
+type Cluster struct {
+	Lat   float64 `json:"lat"`
+	Lng   float64 `json:"lng"`
+	Count int     `json:"count"`
+}
+
+type ClustersResponse struct {
+	Clusters []Cluster `json:"clusters"`
+}
+
+// BatchRequest is the /geo_average/batch body: independent point groups.
+type BatchRequest struct {
+	Groups []AvgRequest `json:"groups"`
+}
+
+// BatchResponse holds one result per group, in request order.
+type BatchResponse struct {
+	Method  string        `json:"method"`
+	Results []BatchResult `json:"results"`
+}
+
+// BatchResult is either a group's average or why it has none.
+type BatchResult struct {
+	Average *Point `json:"average,omitempty"`
+	Count   int    `json:"count"`
+	Error   string `json:"error,omitempty"` // e.g. "point 2: lat out of range"
+}
+
+// vec3 is a point on the unit sphere in Cartesian coordinates.
+type vec3 struct {
+	x, y, z float64
+}
+
+func toVec3(p Point) vec3 {
+	lat := p.Lat * math.Pi / 180.0
+	lng := p.Lng * math.Pi / 180.0
+
+	clat := math.Cos(lat)
+	return vec3{
+		x: clat * math.Cos(lng),
+		y: clat * math.Sin(lng),
+		z: math.Sin(lat),
+	}
+}
+
+// point converts back to lat/lng. v need not be normalized. A v on the
+// polar axis (within DegenerateEpsilon) gives the pole at longitude 0 rather
+// than whatever Atan2 makes of rounding noise in x and y.
+func (v vec3) point() Point {
+	hyp := math.Sqrt(v.x*v.x + v.y*v.y)
+	if hyp <= DegenerateEpsilon*math.Abs(v.z) {
+		v.x, v.y, hyp = 0, 0, 0
+	}
+	lng := math.Atan2(v.y, v.x)
+	lat := math.Atan2(v.z, hyp)
+
+	return Point{
+		Lat: lat * 180.0 / math.Pi,
+		Lng: lng * 180.0 / math.Pi,
+	}
+}
+
+func (v vec3) dot(o vec3) float64 {
+	return v.x*o.x + v.y*o.y + v.z*o.z
+}
+
+// PointError is the 400 body naming the first out-of-range point.
+type PointError struct {
+	Error  string `json:"error"` // always "invalid_points"
+	Index  int    `json:"index"`
+	Reason string `json:"reason"`
+}
+
+// invalidPoint finds the first point outside [-90,90] x [-180,180].
+func invalidPoint(points []Point) (PointError, bool) {
+	for i, p := range points {
+		switch {
+		case !(p.Lat >= -90 && p.Lat <= 90):
+			return PointError{Error: "invalid_points", Index: i, Reason: "lat out of range"}, true
+		case !(p.Lng >= -180 && p.Lng <= 180):
+			return PointError{Error: "invalid_points", Index: i, Reason: "lng out of range"}, true
+		}
+	}
+	return PointError{}, false
+}
+
+func validPoint(p Point) bool {
+	return p.Lat >= -90 && p.Lat <= 90 && p.Lng >= -180 && p.Lng <= 180
+}
+
+// sphericalSum accumulates unit vectors one point at a time, giving the same
+// result as AverageLatLngSpherical in constant memory.
+type sphericalSum struct {
+	sum vec3
+	n   int
+}
+
+func (s *sphericalSum) add(p Point) {
+	v := toVec3(p)
+	s.sum.x += v.x
+	s.sum.y += v.y
+	s.sum.z += v.z
+	s.n++
+}
+
+func (s *sphericalSum) average() (Point, bool) {
+	if s.n == 0 {
+		return Point{}, false
+	}
+	n := float64(s.n)
+	mean := vec3{s.sum.x / n, s.sum.y / n, s.sum.z / n}
+	if math.Sqrt(mean.dot(mean)) < DegenerateEpsilon {
+		return Point{}, false
+	}
+	return mean.point(), true
+}
+
+// AverageLatLngSpherical returns the normalized mean of the points' unit
+// vectors. It fails on invalid input and on points that cancel out, which
+// have no average direction.
+func AverageLatLngSpherical(points []Point) (Point, bool) {
+	steps, ok := SphericalAverageSteps(points)
+	return steps.Average, ok && !steps.Undefined
+}
+
+// SphericalAverageSteps computes the spherical average and keeps its
+// intermediate values; points that cancel out still give their steps, with
+// Undefined set.
+func SphericalAverageSteps(points []Point) (SphericalSteps, bool) {
+	if len(points) == 0 {
+		return SphericalSteps{}, false
+	}
+
+	var sum vec3
+	for _, p := range points {
+		if !validPoint(p) {
+			return SphericalSteps{}, false
+		}
+
+		v := toVec3(p)
+		sum.x += v.x
+		sum.y += v.y
+		sum.z += v.z
+	}
+
+	n := float64(len(points))
+	mean := vec3{sum.x / n, sum.y / n, sum.z / n}
+
+	hyp := math.Sqrt(mean.x*mean.x + mean.y*mean.y)
+	length := math.Sqrt(mean.dot(mean))
+	steps := SphericalSteps{
+		SumX:   sum.x,
+		SumY:   sum.y,
+		SumZ:   sum.z,
+		X:      mean.x,
+		Y:      mean.y,
+		Z:      mean.z,
+		Hyp:    hyp,
+		Length: length,
+	}
+	if length < DegenerateEpsilon {
+		steps.Undefined = true
+	} else {
+		steps.Average = mean.point()
+	}
+	return steps, true
+}
+
+// AverageLatLngMedian returns the geometric median on the sphere (the point
+// minimizing the sum of great-circle distances), which unlike the centroid is
+// robust to outliers. It runs Weiszfeld's algorithm from the spherical mean and
+// fails on invalid input, a degenerate start or non-convergence.
+func AverageLatLngMedian(points []Point) (Point, bool) {
+	if len(points) == 0 {
+		return Point{}, false
+	}
+
+	vecs := make([]vec3, len(points))
+	var y vec3
+	for i, p := range points {
+		if !validPoint(p) {
+			return Point{}, false
+		}
+		vecs[i] = toVec3(p)
+		y.x += vecs[i].x
+		y.y += vecs[i].y
+		y.z += vecs[i].z
+	}
+	if y = y.normalize(); y == (vec3{}) {
+		return Point{}, false
+	}
+
+	for iter := 0; iter < WeiszfeldMaxIterations; iter++ {
+		var next vec3
+		for _, v := range vecs {
+			d := angle(y, v)
+			if d < WeiszfeldTolerance {
+				// Estimate sits on an input point: that point is the median
+				return y.point(), true
+			}
+			next.x += v.x / d
+			next.y += v.y / d
+			next.z += v.z / d
+		}
+		if next = next.normalize(); next == (vec3{}) {
+			return Point{}, false
+		}
+
+		moved := angle(y, next)
+		y = next
+		if moved < WeiszfeldTolerance {
+			return y.point(), true
+		}
+	}
+	return Point{}, false
+}
+
+// normalize scales v to unit length, or returns the zero vector when v is
+// too short to have a meaningful direction.
+func (v vec3) normalize() vec3 {
+	norm := math.Sqrt(v.dot(v))
+	if norm < DegenerateEpsilon {
+		return vec3{}
+	}
+	return vec3{v.x / norm, v.y / norm, v.z / norm}
+}
+
+// angle is the great-circle distance in radians between two unit vectors.
+func angle(a, b vec3) float64 {
+	return math.Acos(math.Max(-1, math.Min(1, a.dot(b))))
+}
+
+// DistanceKm is the great-circle distance between two points.
+func DistanceKm(a, b Point) float64 {
+	return angle(toVec3(a), toVec3(b)) * EarthRadiusKm
+}
+
+// SpreadKm is the largest great-circle distance between any two of points,
+// exact for up to SpreadExactMaxPoints points. Above that it is bounded in
+// one pass: twice the farthest any point lies from the first one, which by
+// the triangle inequality is at least the true spread and at most twice it,
+// and never exceeds half the Earth's circumference.
+func SpreadKm(points []Point) float64 {
+	if len(points) == 0 {
+		return 0
+	}
+	if len(points) <= SpreadExactMaxPoints {
+		vs := make([]vec3, len(points))
+		for i, p := range points {
+			vs[i] = toVec3(p)
+		}
+		var spread float64
+		for i := range vs {
+			for j := i + 1; j < len(vs); j++ {
+				spread = max(spread, angle(vs[i], vs[j]))
+			}
+		}
+		return spread * EarthRadiusKm
+	}
+	first := toVec3(points[0])
+	var radius float64
+	for _, p := range points[1:] {
+		radius = max(radius, angle(first, toVec3(p)))
+	}
+	return min(2*radius, math.Pi) * EarthRadiusKm
+}
+
+// autoMethod picks the averager for method=auto: simple for points spread
+// less than thresholdKm, where it is close enough and cheaper, else spherical.
+func autoMethod(points []Point, thresholdKm float64) string {
+	if SpreadKm(points) < thresholdKm {
+		return "simple"
+	}
+	return "spherical"
+}
+
+// DedupePoints drops every point within eps degrees (on both lat and lng) of
+// an earlier one, keeping first occurrences in order.
+func DedupePoints(points []Point, eps float64) []Point {
+	out := make([]Point, 0, len(points))
+	for _, p := range points {
+		dup := false
+		for _, q := range out {
+			if math.Abs(p.Lat-q.Lat) <= eps && math.Abs(p.Lng-q.Lng) <= eps {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// RejectOutliers drops the points whose great-circle distance from the
+// provisional average exceeds factor times the median distance, returning
+// the kept points in order. Nothing is dropped when the average fails or the
+// median distance is 0 (most points coincide).
+func RejectOutliers(points []Point, average func([]Point) (Point, bool), factor float64) []Point {
+	center, ok := average(points)
+	if !ok {
+		return points
+	}
+	dists := make([]float64, len(points))
+	for i, p := range points {
+		dists[i] = DistanceKm(center, p)
+	}
+	sorted := slices.Clone(dists)
+	slices.Sort(sorted)
+	median := sorted[len(sorted)/2]
+	if len(sorted)%2 == 0 {
+		median = (sorted[len(sorted)/2-1] + median) / 2
+	}
+	if median == 0 {
+		return points
+	}
+	kept := make([]Point, 0, len(points))
+	for i, p := range points {
+		if dists[i] <= factor*median {
+			kept = append(kept, p)
+		}
+	}
+	return kept
+}
+
+// ClusterLatLng splits points into at most k clusters with k-means on the
+// sphere: points join the centroid at the smallest great-circle distance and
+// centroids are the spherical average of their members. Initial centroids are
+// picked from the points with seed, so results are reproducible. k is clamped
+// to the number of points; empty clusters are dropped.
+func ClusterLatLng(points []Point, k int, seed int64) ([]Cluster, bool) {
+	if len(points) == 0 || k <= 0 {
+		return nil, false
+	}
+	if k > len(points) {
+		k = len(points)
+	}
+
+	vecs := make([]vec3, len(points))
+	for i, p := range points {
+		if !validPoint(p) {
+			return nil, false
+		}
+		vecs[i] = toVec3(p)
+	}
+
+	rng := rand.New(rand.NewSource(seed))
+	centers := make([]vec3, k)
+	for c, i := range rng.Perm(len(vecs))[:k] {
+		centers[c] = vecs[i]
+	}
+
+	assign := make([]int, len(vecs))
+	for i := range assign {
+		assign[i] = -1
+	}
+	counts := make([]int, k)
+
+	for iter := 0; iter < KMeansMaxIterations; iter++ {
+		changed := false
+		for i, v := range vecs {
+			// Largest dot product = smallest great-circle distance
+			best := 0
+			for c := 1; c < k; c++ {
+				if v.dot(centers[c]) > v.dot(centers[best]) {
+					best = c
+				}
+			}
+			if assign[i] != best {
+				assign[i] = best
+				changed = true
+			}
+		}
+		if !changed {
+			break
+		}
+
+		sums := make([]vec3, k)
+		clear(counts)
+		for i, v := range vecs {
+			s := &sums[assign[i]]
+			s.x += v.x
+			s.y += v.y
+			s.z += v.z
+			counts[assign[i]]++
+		}
+		for c, s := range sums {
+			if n := s.normalize(); counts[c] > 0 && n != (vec3{}) {
+				centers[c] = n
+			}
+		}
+	}
+
+	clusters := make([]Cluster, 0, k)
+	for c, center := range centers {
+		if counts[c] == 0 {
+			continue
+		}
+		p := center.point()
+		clusters = append(clusters, Cluster{Lat: p.Lat, Lng: p.Lng, Count: counts[c]})
+	}
+	return clusters, true
+}
+
+func AverageLatLngSimple(points []Point) (Point, bool) {
+	if len(points) == 0 {
+		return Point{}, false
+	}
+
+	var latSum, lngSum float64
+	for _, p := range points {
+		if p.Lat < -90 || p.Lat > 90 || p.Lng < -180 || p.Lng > 180 {
+			return Point{}, false
+		}
+		latSum += p.Lat
+		lngSum += p.Lng
+	}
+
+	n := float64(len(points))
+	return Point{Lat: latSum / n, Lng: lngSum / n}, true
+}
+
+// averageBatch averages every group on its own goroutine, each holding a
+// slot of sem while it runs, so all batches together never use more than
+// cap(sem) CPUs. Each result is written at its group's index only, and a
+// panic in one group becomes that group's error.
+func averageBatch(groups []AvgRequest, average func([]Point) (Point, bool), sem chan struct{}) []BatchResult {
+	results := make([]BatchResult, len(groups))
+	var wg sync.WaitGroup
+	for i, g := range groups {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				if rec := recover(); rec != nil {
+					log.Printf("panic averaging batch group %d: %v", i, rec)
+					results[i] = BatchResult{Count: len(g.Points), Error: "internal error"}
+				}
+				<-sem
+				wg.Done()
+			}()
+			results[i] = batchResult(g.Points, average)
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+func batchResult(points []Point, average func([]Point) (Point, bool)) BatchResult {
+	res := BatchResult{Count: len(points)}
+	if len(points) == 0 {
+		res.Error = "no points"
+		return res
+	}
+	avg, ok := average(points)
+	switch perr, found := invalidPoint(points); {
+	case found:
+		res.Error = fmt.Sprintf("point %d: %s", perr.Index, perr.Reason)
+	case !ok:
+		res.Error = "no defined average (e.g. the points cancel out)"
+	default:
+		res.Average = &avg
+	}
+	return res
+}
+
+// flightGroup coalesces concurrent calls with the same key into one execution
+// whose result every caller receives (like x/sync/singleflight).
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	wg  sync.WaitGroup
+	val any
+	ok  bool
+}
+
+// Do runs fn for key unless a call for key is already in flight, in which
+// case it waits for that call and returns its result. A nil group always runs fn.
+func (g *flightGroup) Do(key string, fn func() (any, bool)) (any, bool) {
+	if g == nil {
+		return fn()
+	}
+	g.mu.Lock()
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		c.wg.Wait()
+		return c.val, c.ok
+	}
+	c := new(flightCall)
+	c.wg.Add(1)
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		c.wg.Done()
+	}()
+	c.val, c.ok = fn()
+	return c.val, c.ok
+}
+
+// pointsKey identifies a point list, in order, for coalescing. Order is part
+// of the key: it changes the floating-point sums slightly, and which points
+// seed ClusterLatLng.
+func pointsKey(points []Point) string {
+	var sb strings.Builder
+	for _, p := range points {
+		sb.WriteString(strconv.FormatFloat(p.Lat, 'g', -1, 64))
+		sb.WriteByte(',')
+		sb.WriteString(strconv.FormatFloat(p.Lng, 'g', -1, 64))
+		sb.WriteByte(';')
+	}
+	return sb.String()
+}
+
+// geoJSONPoints collects the points of a FeatureCollection, Feature,
+// MultiPoint or Point, swapping GeoJSON's [lng, lat] into Point.
+func geoJSONPoints(g *GeoJSON) ([]Point, error) {
+	switch g.Type {
+	case "FeatureCollection":
+		var points []Point
+		for i := range g.Features {
+			ps, err := geoJSONPoints(&g.Features[i])
+			if err != nil {
+				return nil, fmt.Errorf("features[%d]: %w", i, err)
+			}
+			points = append(points, ps...)
+		}
+		return points, nil
+	case "Feature":
+		if g.Geometry == nil {
+			return nil, errors.New("feature without geometry")
+		}
+		return geoJSONPoints(g.Geometry)
+	case "Point":
+		var pos []float64
+		if err := json.Unmarshal(g.Coordinates, &pos); err != nil || len(pos) < 2 {
+			return nil, errors.New("Point coordinates must be [lng, lat]")
+		}
+		return []Point{{Lat: pos[1], Lng: pos[0]}}, nil
+	case "MultiPoint":
+		var positions [][]float64
+		if err := json.Unmarshal(g.Coordinates, &positions); err != nil {
+			return nil, errors.New("MultiPoint coordinates must be [[lng, lat], ...]")
+		}
+		points := make([]Point, 0, len(positions))
+		for _, pos := range positions {
+			if len(pos) < 2 {
+				return nil, errors.New("MultiPoint coordinates must be [[lng, lat], ...]")
+			}
+			points = append(points, Point{Lat: pos[1], Lng: pos[0]})
+		}
+		return points, nil
+	}
+	return nil, fmt.Errorf("unsupported type %q (use FeatureCollection, Feature, MultiPoint or Point)", g.Type)
+}
+
+// geoJSONFeature wraps p as a Point Feature, with p as [lng, lat].
+func geoJSONFeature(p Point, props map[string]any) GeoJSON {
+	coords, _ := json.Marshal([]float64{p.Lng, p.Lat})
+	return GeoJSON{
+		Type:       "Feature",
+		Geometry:   &GeoJSON{Type: "Point", Coordinates: coords},
+		Properties: props,
+	}
+}
@@ -0,0 +1,302 @@
+package geo
+
+import (
+	"math"
+	"math/rand"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// pairwiseSpreadKm is the exact spread, comparing every pair.
+func pairwiseSpreadKm(points []Point) float64 {
+	var spread float64
+	for i := range points {
+		for j := i + 1; j < len(points); j++ {
+			spread = max(spread, DistanceKm(points[i], points[j]))
+		}
+	}
+	return spread
+}
+
+func randomPoints(rng *rand.Rand, n int, center Point, sd float64) []Point {
+	points := make([]Point, n)
+	for i := range points {
+		points[i] = Point{
+			Lat: max(-90, min(90, center.Lat+rng.NormFloat64()*sd)),
+			Lng: math.Remainder(center.Lng+rng.NormFloat64()*sd, 360),
+		}
+	}
+	return points
+}
+
+func TestSpreadKm(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for range 200 {
+		center := Point{Lat: rng.Float64()*180 - 90, Lng: rng.Float64()*360 - 180}
+		points := randomPoints(rng, 2+rng.Intn(SpreadExactMaxPoints-1), center, math.Pow(10, rng.Float64()*4-2))
+		if exact, got := pairwiseSpreadKm(points), SpreadKm(points); math.Abs(got-exact) > 1e-9 {
+			t.Fatalf("SpreadKm = %v for %d points spread %v", got, len(points), exact)
+		}
+	}
+
+	// Above SpreadExactMaxPoints, a bound
+	for range 20 {
+		center := Point{Lat: rng.Float64()*180 - 90, Lng: rng.Float64()*360 - 180}
+		points := randomPoints(rng, SpreadExactMaxPoints+1+rng.Intn(100), center, math.Pow(10, rng.Float64()*4-2))
+		exact, bound := pairwiseSpreadKm(points), SpreadKm(points)
+		if bound < exact-1e-9 || bound > 2*exact+1e-9 || bound > math.Pi*EarthRadiusKm+1e-9 {
+			t.Fatalf("SpreadKm = %v for a spread of %v: %v", bound, exact, points)
+		}
+	}
+
+	if s := SpreadKm(nil); s != 0 {
+		t.Errorf("SpreadKm(nil) = %v", s)
+	}
+	if s := SpreadKm([]Point{{Lat: 90}, {Lat: -90}}); math.Abs(s-math.Pi*EarthRadiusKm) > 1e-6 {
+		t.Errorf("pole to pole = %v, want half the circumference", s)
+	}
+}
+
+func TestSpreadKmIsLinear(t *testing.T) {
+	points := randomPoints(rand.New(rand.NewSource(1)), 1_000_000, Point{Lat: 40, Lng: -3}, 0.1)
+	start := time.Now()
+	SpreadKm(points)
+	// A pairwise comparison of a million points would take hours
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("SpreadKm took %v for %d points", d, len(points))
+	}
+}
+
+func TestAutoMethod(t *testing.T) {
+	near := []Point{{Lat: 40, Lng: -3}, {Lat: 40.01, Lng: -3.01}}
+	if m := autoMethod(near, DefaultAutoSpreadKm); m != "simple" {
+		t.Errorf("points ~1km apart: %s", m)
+	}
+	far := []Point{{Lat: 40, Lng: -3}, {Lat: 48.85, Lng: 2.35}}
+	if m := autoMethod(far, DefaultAutoSpreadKm); m != "spherical" {
+		t.Errorf("Madrid to Paris: %s", m)
+	}
+}
+
+func TestClusterLatLng(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	madrid := randomPoints(rng, 20, Point{Lat: 40.4, Lng: -3.7}, 0.05)
+	tokyo := randomPoints(rng, 10, Point{Lat: 35.7, Lng: 139.7}, 0.05)
+	points := append(madrid, tokyo...)
+
+	clusters, ok := ClusterLatLng(points, 2, 7)
+	if !ok || len(clusters) != 2 {
+		t.Fatalf("ClusterLatLng = %v, %v", clusters, ok)
+	}
+	byCount := map[int]Point{}
+	for _, c := range clusters {
+		byCount[c.Count] = Point{Lat: c.Lat, Lng: c.Lng}
+	}
+	if d := DistanceKm(byCount[20], Point{Lat: 40.4, Lng: -3.7}); d > 20 {
+		t.Errorf("Madrid cluster %v is %.0fkm off", byCount[20], d)
+	}
+	if d := DistanceKm(byCount[10], Point{Lat: 35.7, Lng: 139.7}); d > 20 {
+		t.Errorf("Tokyo cluster %v is %.0fkm off", byCount[10], d)
+	}
+
+	again, _ := ClusterLatLng(points, 2, 7)
+	if !slices.Equal(clusters, again) {
+		t.Errorf("same seed gave %v then %v", clusters, again)
+	}
+	if clusters, ok := ClusterLatLng(points[:3], 10, 1); !ok || len(clusters) > 3 {
+		t.Errorf("k above the point count: %v, %v", clusters, ok)
+	}
+	for _, bad := range [][]Point{nil, {{Lat: 91}}} {
+		if _, ok := ClusterLatLng(bad, 2, 1); ok {
+			t.Errorf("ClusterLatLng(%v) succeeded", bad)
+		}
+	}
+	if _, ok := ClusterLatLng(points, 0, 1); ok {
+		t.Error("k=0 succeeded")
+	}
+}
+
+func TestSphericalPolesAndCancellation(t *testing.T) {
+	// At a pole the longitude is 0, not whatever rounding leaves in x and y
+	for _, pole := range [][]Point{
+		{{90, 10}, {90, -50}, {90, 120}, {90, 0}},
+		{{-90, 179}, {-90, -179}, {-90, 33}, {-90, 90}},
+		{{45, 10}, {45, -170}, {90, 0}, {90, 0}}, // symmetric about the axis
+	} {
+		avg, ok := AverageLatLngSpherical(pole)
+		if !ok || math.Abs(math.Abs(avg.Lat)-90) > 1e-9 || avg.Lng != 0 {
+			t.Errorf("%v: %+v, %t; want a pole at lng 0", pole, avg, ok)
+		}
+	}
+
+	// Points that cancel out have no average, in one go or streamed
+	for _, cancel := range [][]Point{
+		{{0, 0}, {0, 180}},
+		{{45, 30}, {-45, -150}},
+		{{0, 0}, {0, 90}, {0, 180}, {0, -90}},
+		{{90, 0}, {-90, 0}},
+	} {
+		if avg, ok := AverageLatLngSpherical(cancel); ok {
+			t.Errorf("%v: average %+v", cancel, avg)
+		}
+		var acc sphericalSum
+		for _, p := range cancel {
+			acc.add(p)
+		}
+		if avg, ok := acc.average(); ok {
+			t.Errorf("%v streamed: average %+v", cancel, avg)
+		}
+	}
+
+	// Nearly cancelling points still have one
+	if avg, ok := AverageLatLngSpherical([]Point{{0, 0}, {0, 179.9}}); !ok || math.Abs(avg.Lng-89.95) > 1e-9 {
+		t.Errorf("near-antipodal points: %+v, %t", avg, ok)
+	}
+}
+
+func TestAverageLatLngMedian(t *testing.T) {
+	// Four points around (10,20) and a far outlier: the median stays put
+	points := []Point{{10, 19.9}, {10, 20.1}, {9.9, 20}, {10.1, 20}, {60, -100}}
+	median, ok := AverageLatLngMedian(points)
+	if !ok || DistanceKm(median, Point{10, 20}) > 5 {
+		t.Errorf("median = %v, %v; want about (10,20)", median, ok)
+	}
+	if mean, _ := AverageLatLngSpherical(points); DistanceKm(mean, Point{10, 20}) < 500 {
+		t.Errorf("spherical mean %v is not pulled by the outlier; the test proves nothing", mean)
+	}
+
+	if p, ok := AverageLatLngMedian([]Point{{5, 5}, {5, 5}, {5, 5}}); !ok || math.Abs(p.Lat-5) > 1e-9 || math.Abs(p.Lng-5) > 1e-9 {
+		t.Errorf("identical points: %v, %v", p, ok)
+	}
+	for _, bad := range [][]Point{nil, {{0, 200}}, {{0, 0}, {0, 180}}} {
+		if p, ok := AverageLatLngMedian(bad); ok {
+			t.Errorf("AverageLatLngMedian(%v) = %v", bad, p)
+		}
+	}
+}
+
+func TestDedupePoints(t *testing.T) {
+	points := []Point{{1, 2}, {3, 4}, {1, 2.0005}, {1, 2}, {3.002, 4}}
+	if got := DedupePoints(points, 1e-9); !slices.Equal(got, []Point{{1, 2}, {3, 4}, {1, 2.0005}, {3.002, 4}}) {
+		t.Errorf("exact duplicates: %v", got)
+	}
+	if got := DedupePoints(points, 1e-3); !slices.Equal(got, []Point{{1, 2}, {3, 4}, {3.002, 4}}) {
+		t.Errorf("within 1e-3: %v", got)
+	}
+	if got := DedupePoints(nil, 1); len(got) != 0 {
+		t.Errorf("no points: %v", got)
+	}
+}
+
+func TestFlightGroupCoalesces(t *testing.T) {
+	g := &flightGroup{calls: make(map[string]*flightCall)}
+	var runs atomic.Int64
+	started, release := make(chan struct{}), make(chan struct{})
+	compute := func() (any, bool) {
+		if runs.Add(1) == 1 {
+			close(started)
+		}
+		<-release
+		return Point{Lat: 1, Lng: 2}, true
+	}
+
+	const callers = 50
+	results := make([]any, callers)
+	var wg sync.WaitGroup
+	for i := range callers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if i > 0 {
+				<-started
+			}
+			results[i], _ = g.Do(pointsKey(square), compute)
+		}()
+	}
+	<-started
+	time.Sleep(20 * time.Millisecond) // the others join the call in flight
+	close(release)
+	wg.Wait()
+
+	if n := runs.Load(); n != 1 {
+		t.Errorf("%d computations for %d identical concurrent calls, want 1", n, callers)
+	}
+	for i, r := range results {
+		if r != (Point{Lat: 1, Lng: 2}) {
+			t.Fatalf("caller %d got %v", i, r)
+		}
+	}
+
+	// Once finished, the key runs again; a nil group never coalesces
+	if _, ok := g.Do(pointsKey(square), func() (any, bool) { runs.Add(1); return nil, true }); !ok || runs.Load() != 2 {
+		t.Errorf("call after the flight landed: ran %d times in all", runs.Load())
+	}
+	if _, ok := (*flightGroup)(nil).Do("k", func() (any, bool) { return nil, true }); !ok {
+		t.Error("nil group did not run fn")
+	}
+}
+
+func TestPointsKeyKeepsOrder(t *testing.T) {
+	reversed := slices.Clone(square)
+	slices.Reverse(reversed)
+	if pointsKey(square) == pointsKey(reversed) {
+		t.Errorf("reordered points share the key %q", pointsKey(square))
+	}
+	if pointsKey(square) != pointsKey(slices.Clone(square)) {
+		t.Error("equal point lists got different keys")
+	}
+	if pointsKey(square) == pointsKey(square[:3]) || pointsKey([]Point{{1, 2}}) == pointsKey([]Point{{2, 1}}) {
+		t.Error("different point sets share a key")
+	}
+}
+
+func TestAverageBatchMatchesSequential(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	groups := make([]AvgRequest, 500)
+	for i := range groups {
+		center := Point{Lat: rng.Float64()*120 - 60, Lng: rng.Float64()*360 - 180}
+		groups[i].Points = randomPoints(rng, 1+rng.Intn(50), center, 2)
+	}
+	groups[7].Points = nil                                // no points
+	groups[42].Points[0] = Point{Lat: 100}                // invalid
+	groups[99].Points = []Point{{0, 0}, {0, 180}}         // cancel out
+	groups[123].Points = []Point{{Lat: math.Pi, Lng: -1}} // panics below
+
+	var inflight, peak atomic.Int64
+	average := func(points []Point) (Point, bool) {
+		n := inflight.Add(1)
+		defer inflight.Add(-1)
+		for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+		}
+		if len(points) == 1 && points[0].Lat == math.Pi {
+			panic("boom")
+		}
+		return AverageLatLngSpherical(points)
+	}
+
+	got := averageBatch(groups, average, make(chan struct{}, 4))
+	if len(got) != len(groups) {
+		t.Fatalf("%d results for %d groups", len(got), len(groups))
+	}
+	for i, g := range groups {
+		var want BatchResult
+		if i == 123 {
+			want = BatchResult{Count: 1, Error: "internal error"}
+		} else {
+			want = batchResult(g.Points, AverageLatLngSpherical)
+		}
+		if got[i].Count != want.Count || got[i].Error != want.Error || (got[i].Average == nil) != (want.Average == nil) ||
+			(want.Average != nil && *got[i].Average != *want.Average) {
+			t.Errorf("group %d: %+v, want %+v", i, got[i], want)
+		}
+	}
+	if got[42].Error != "point 0: lat out of range" || got[7].Error != "no points" || got[99].Average != nil {
+		t.Errorf("error groups: %+v, %+v, %+v", got[42], got[7], got[99])
+	}
+	if p := peak.Load(); p > 4 {
+		t.Errorf("%d groups averaged at once with 4 slots", p)
+	}
+}
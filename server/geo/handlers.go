@@ -0,0 +1,771 @@
+package geo
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"mime"
+	"reflect"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gogearbox/gearbox"
+	"github.com/valyala/fasthttp"
+)
+
+// Config holds the server's settings; the server command reads them from
+// GEO_* environment variables. The zero value is not usable: start from
+// DefaultConfig.
+type Config struct {
+	RequiredPoints  int     // points a request must carry, 0 = any count >= 1
+	MaxPoints       int     // 413 above this many points (a batch's groups together), 0 = no cap
+	StreamMaxPoints int     // the same for /geo_average/stream, which MaxPoints doesn't cover
+	DedupeEpsilon   float64 // dedupe=true: points closer than this (degrees, on both axes) are duplicates
+	OutlierFactor   float64 // reject_outliers=true: farther than this multiple of the median distance is an outlier
+	AutoSpreadKm    float64 // method=auto: simple below this SpreadKm, spherical above
+	Iterations      int     // times each /geo_average computation runs (>= 1), to simulate heavier CPU work
+
+	FixedPoint         bool // lat/lng in plain decimal notation, never exponents
+	LenientContentType bool // decode bodies whatever their Content-Type instead of answering 415
+	EmptyNoContent     bool // 204 No Content for an empty point list instead of 400
+	Coalesce           bool // share one computation among concurrent identical requests
+	BodyChecksum       bool // set BodyChecksumHeader on every response
+
+	BatchWorkers int // batch groups averaged at once, across all requests (>= 1)
+	GzipMinBytes int // gzip responses of at least this many bytes to clients accepting it, 0 = never
+
+	InjectRate   float64 // fraction of requests failed with InjectStatus, for resilience testing
+	InjectStatus int
+}
+
+// DefaultConfig returns the settings the server runs with when no GEO_*
+// variable is set.
+func DefaultConfig() Config {
+	return Config{
+		RequiredPoints: DefaultRequiredPoints,
+		MaxPoints:      DefaultMaxPoints,
+		DedupeEpsilon:  DefaultDedupeEpsilon,
+		OutlierFactor:  DefaultOutlierFactor,
+		AutoSpreadKm:   DefaultAutoSpreadKm,
+		Iterations:     1,
+		EmptyNoContent: true,
+		BatchWorkers:   runtime.GOMAXPROCS(0),
+		GzipMinBytes:   DefaultGzipMinBytes,
+		InjectStatus:   DefaultInjectedStatus,
+	}
+}
+
+// Register adds the geo routes, and the middlewares cfg enables, to gb.
+func Register(gb gearbox.Gearbox, cfg Config) {
+	batchSem := make(chan struct{}, cfg.BatchWorkers)
+	var flights *flightGroup
+	if cfg.Coalesce {
+		flights = &flightGroup{calls: make(map[string]*flightCall)}
+	}
+
+	if !streamRequestBodies(gb) {
+		log.Printf("Request body streaming unavailable: %s bodies are limited to %d bytes", streamPath, MaxRequestBodyBytes)
+	}
+	gb.Use(limitRequestBody(MaxRequestBodyBytes))
+
+	gb.Use(decompressRequest(MaxDecompressedBytes))
+
+	if cfg.GzipMinBytes > 0 {
+		gb.Use(compressResponse(cfg.GzipMinBytes))
+	}
+
+	if cfg.BodyChecksum {
+		gb.Use(bodyChecksum)
+	}
+
+	if cfg.InjectRate > 0 {
+		gb.Use(injectErrors(cfg.InjectRate, cfg.InjectStatus))
+	}
+
+	gb.Post("/geo_average", requireContentType(cfg.LenientContentType, "application/json"), withRecover(func(ctx gearbox.Context) {
+		method := ctx.Query("method")
+		if method == "" {
+			method = "spherical"
+		}
+		average, found := averagers[method]
+		if !found && method != "auto" {
+			ctx.Status(gearbox.StatusBadRequest).SendString("Unknown method (use spherical, simple, median or auto)")
+			return
+		}
+
+		precision, ok := parsePrecision(ctx.Query("precision"))
+		if !ok {
+			ctx.Status(gearbox.StatusBadRequest).SendString("Query parameter precision must be an integer between 0 and 15")
+			return
+		}
+		format, ok := negotiateFormat(ctx.Get("Accept"))
+		if !ok {
+			ctx.Status(gearbox.StatusNotAcceptable).SendString("Not acceptable (use application/json or text/plain)")
+			return
+		}
+
+		var req AvgRequest
+		if err := parseBody(ctx, &req); err != nil {
+			ctx.Status(gearbox.StatusBadRequest).SendString("Invalid JSON body")
+			return
+		}
+
+		if noContentIfEmpty(ctx, len(req.Points), cfg.EmptyNoContent) {
+			return
+		}
+		if tooManyPoints(ctx, len(req.Points), cfg.MaxPoints) {
+			return
+		}
+		if msg, ok := checkPointCount(len(req.Points), cfg.RequiredPoints); !ok {
+			ctx.Status(gearbox.StatusBadRequest).SendString(msg)
+			return
+		}
+
+		points := req.Points
+		var removed *int
+		if ctx.Query("dedupe") == "true" {
+			points = DedupePoints(points, cfg.DedupeEpsilon)
+			n := len(req.Points) - len(points)
+			removed = &n
+		}
+		// Reported as e.g. "auto:simple"
+		if method == "auto" {
+			chosen := autoMethod(points, cfg.AutoSpreadKm)
+			average, method = averagers[chosen], "auto:"+chosen
+		}
+		var rejected *int
+		if ctx.Query("reject_outliers") == "true" {
+			kept := RejectOutliers(points, average, cfg.OutlierFactor)
+			n := len(points) - len(kept)
+			points, rejected = kept, &n
+		}
+
+		start := time.Now()
+		v, ok := flights.Do("average "+method+" "+pointsKey(points), func() (any, bool) {
+			for i := 1; i < cfg.Iterations; i++ {
+				average(points)
+			}
+			return average(points)
+		})
+		avg, _ := v.(Point)
+		ctx.Set("Server-Timing", serverTiming(time.Since(start)))
+		if !ok {
+			sendInvalidPoints(ctx, req.Points)
+			return
+		}
+
+		lat, lng := roundTo(avg.Lat, precision), roundTo(avg.Lng, precision)
+		if format == FormatText {
+			ctx.Set("Content-Type", "text/plain; charset=utf-8")
+			ctx.SendString(strconv.FormatFloat(lat, 'f', -1, 64) + "," + strconv.FormatFloat(lng, 'f', -1, 64))
+			return
+		}
+		_ = ctx.SendJSON(AvgResponse{
+			Lat:               lat,
+			Lng:               lng,
+			Method:            method,
+			DuplicatesRemoved: removed,
+			OutliersRejected:  rejected,
+			fixedPoint:        cfg.FixedPoint,
+		})
+	}))
+
+	// Both methods side by side, to see where they diverge (poles, antimeridian)
+	gb.Post("/geo_average/compare", requireContentType(cfg.LenientContentType, "application/json"), withRecover(func(ctx gearbox.Context) {
+		var req AvgRequest
+		if err := parseBody(ctx, &req); err != nil {
+			ctx.Status(gearbox.StatusBadRequest).SendString("Invalid JSON body")
+			return
+		}
+		if noContentIfEmpty(ctx, len(req.Points), cfg.EmptyNoContent) {
+			return
+		}
+		if tooManyPoints(ctx, len(req.Points), cfg.MaxPoints) {
+			return
+		}
+		if msg, ok := checkPointCount(len(req.Points), cfg.RequiredPoints); !ok {
+			ctx.Status(gearbox.StatusBadRequest).SendString(msg)
+			return
+		}
+
+		start := time.Now()
+		v, ok := flights.Do("compare "+pointsKey(req.Points), func() (any, bool) {
+			spherical, ok := AverageLatLngSpherical(req.Points)
+			if !ok {
+				return nil, false
+			}
+			simple, _ := AverageLatLngSimple(req.Points)
+			return CompareResponse{
+				Spherical: spherical,
+				Simple:    simple,
+				DeltaKm:   DistanceKm(spherical, simple),
+			}, true
+		})
+		ctx.Set("Server-Timing", serverTiming(time.Since(start)))
+		if !ok {
+			sendInvalidPoints(ctx, req.Points)
+			return
+		}
+
+		_ = ctx.SendJSON(v.(CompareResponse))
+	}))
+
+	// GeoJSON in, the spherical centroid out as a Point Feature
+	gb.Post("/geo_average/geojson", requireContentType(cfg.LenientContentType, "application/geo+json", "application/json"), withRecover(func(ctx gearbox.Context) {
+		var g GeoJSON
+		if err := json.Unmarshal(ctx.Context().PostBody(), &g); err != nil {
+			ctx.Status(gearbox.StatusBadRequest).SendString("Invalid JSON body")
+			return
+		}
+		points, err := geoJSONPoints(&g)
+		if err != nil {
+			ctx.Status(gearbox.StatusBadRequest).SendString("Invalid GeoJSON: " + err.Error())
+			return
+		}
+		if noContentIfEmpty(ctx, len(points), cfg.EmptyNoContent) {
+			return
+		}
+		if tooManyPoints(ctx, len(points), cfg.MaxPoints) {
+			return
+		}
+		if msg, ok := checkPointCount(len(points), cfg.RequiredPoints); !ok {
+			ctx.Status(gearbox.StatusBadRequest).SendString(msg)
+			return
+		}
+
+		avg, ok := AverageLatLngSpherical(points)
+		if !ok {
+			sendInvalidPoints(ctx, points)
+			return
+		}
+		body, _ := json.Marshal(geoJSONFeature(avg, map[string]any{"method": "spherical", "count": len(points)}))
+		ctx.Set("Content-Type", "application/geo+json")
+		ctx.SendBytes(body)
+	}))
+
+	// Intermediate vectors of the spherical average, for teaching/debugging
+	gb.Post("/geo_average/debug", requireContentType(cfg.LenientContentType, "application/json"), withRecover(func(ctx gearbox.Context) {
+		var req AvgRequest
+		if err := parseBody(ctx, &req); err != nil {
+			ctx.Status(gearbox.StatusBadRequest).SendString("Invalid JSON body")
+			return
+		}
+		if noContentIfEmpty(ctx, len(req.Points), cfg.EmptyNoContent) {
+			return
+		}
+		if tooManyPoints(ctx, len(req.Points), cfg.MaxPoints) {
+			return
+		}
+		if msg, ok := checkPointCount(len(req.Points), cfg.RequiredPoints); !ok {
+			ctx.Status(gearbox.StatusBadRequest).SendString(msg)
+			return
+		}
+
+		steps, ok := SphericalAverageSteps(req.Points)
+		if !ok {
+			sendInvalidPoints(ctx, req.Points)
+			return
+		}
+		_ = ctx.SendJSON(steps)
+	}))
+
+	// Newline-delimited point objects, averaged as they are read off the
+	// request body stream: the running sum needs constant memory whatever
+	// the point count or body size, so MaxRequestBodyBytes doesn't apply.
+	// Nor do Config.RequiredPoints and Config.MaxPoints; Config.StreamMaxPoints
+	// caps the count instead. The body is decompressed and checksummed here,
+	// not by the middlewares, which would have to buffer it.
+	gb.Post(streamPath, requireContentType(cfg.LenientContentType, "application/x-ndjson", "application/json"), withRecover(func(ctx gearbox.Context) {
+		body := ctx.Context().RequestBodyStream()
+		if body == nil {
+			body = bytes.NewReader(ctx.Context().PostBody())
+		}
+		if strings.EqualFold(ctx.Get("Content-Encoding"), "gzip") {
+			zr, err := gzip.NewReader(body)
+			if err != nil {
+				ctx.Status(gearbox.StatusBadRequest).SendString("Invalid gzip body")
+				return
+			}
+			body = zr
+		}
+		if cfg.BodyChecksum {
+			h := sha256.New()
+			body = io.TeeReader(body, h)
+			defer func() {
+				// Whatever the handler left unread still counts
+				_, _ = io.Copy(io.Discard, body)
+				ctx.Set(BodyChecksumHeader, hex.EncodeToString(h.Sum(nil)))
+			}()
+		}
+
+		precision, ok := parsePrecision(ctx.Query("precision"))
+		if !ok {
+			ctx.Status(gearbox.StatusBadRequest).SendString("Query parameter precision must be an integer between 0 and 15")
+			return
+		}
+
+		start := time.Now()
+		var acc sphericalSum
+		dec := json.NewDecoder(body)
+		for {
+			var p Point
+			if err := dec.Decode(&p); err == io.EOF {
+				break
+			} else if err != nil {
+				ctx.Status(gearbox.StatusBadRequest).SendString(fmt.Sprintf("Invalid JSON at point %d", acc.n))
+				return
+			}
+			if perr, found := invalidPoint([]Point{p}); found {
+				perr.Index = acc.n
+				_ = ctx.Status(gearbox.StatusBadRequest).SendJSON(perr)
+				return
+			}
+			acc.add(p)
+			if tooManyPoints(ctx, acc.n, cfg.StreamMaxPoints) {
+				return
+			}
+		}
+		if noContentIfEmpty(ctx, acc.n, cfg.EmptyNoContent) {
+			return
+		}
+		avg, ok := acc.average()
+		ctx.Set("Server-Timing", serverTiming(time.Since(start)))
+		if !ok {
+			msg := undefinedAverage
+			if acc.n == 0 {
+				msg = "Invalid points: expected at least 1 point"
+			}
+			ctx.Status(gearbox.StatusBadRequest).SendString(msg)
+			return
+		}
+
+		_ = ctx.SendJSON(StreamAvgResponse{
+			Lat:    roundTo(avg.Lat, precision),
+			Lng:    roundTo(avg.Lng, precision),
+			Method: "spherical",
+			Count:  acc.n,
+		})
+	}))
+
+	// Many independent groups in one request, averaged in parallel; a bad
+	// group gets an error in its result instead of failing the batch.
+	// Config.RequiredPoints doesn't apply to the groups.
+	gb.Post("/geo_average/batch", requireContentType(cfg.LenientContentType, "application/json"), withRecover(func(ctx gearbox.Context) {
+		method := ctx.Query("method")
+		if method == "" {
+			method = "spherical"
+		}
+		average, found := averagers[method]
+		if !found {
+			ctx.Status(gearbox.StatusBadRequest).SendString("Unknown method (use spherical, simple or median)")
+			return
+		}
+
+		var req BatchRequest
+		if err := parseBody(ctx, &req); err != nil {
+			ctx.Status(gearbox.StatusBadRequest).SendString("Invalid JSON body")
+			return
+		}
+		if noContentIfEmpty(ctx, len(req.Groups), cfg.EmptyNoContent) {
+			return
+		}
+		total := 0
+		for _, g := range req.Groups {
+			total += len(g.Points)
+		}
+		if tooManyPoints(ctx, total, cfg.MaxPoints) {
+			return
+		}
+
+		start := time.Now()
+		var key strings.Builder
+		key.WriteString("batch " + method)
+		for _, g := range req.Groups {
+			key.WriteString(" " + pointsKey(g.Points))
+		}
+		v, _ := flights.Do(key.String(), func() (any, bool) {
+			return averageBatch(req.Groups, average, batchSem), true
+		})
+		results, _ := v.([]BatchResult)
+		ctx.Set("Server-Timing", serverTiming(time.Since(start)))
+		_ = ctx.SendJSON(BatchResponse{Method: method, Results: results})
+	}))
+
+	// The points in k clusters (k-means). Like an empty point list, k=0 has
+	// no result and answers 204 (Config.EmptyNoContent), not an empty 200.
+	gb.Post("/geo_clusters", requireContentType(cfg.LenientContentType, "application/json"), withRecover(func(ctx gearbox.Context) {
+		k, err := strconv.Atoi(ctx.Query("k"))
+		if err != nil || k < 0 || (k == 0 && !cfg.EmptyNoContent) {
+			ctx.Status(gearbox.StatusBadRequest).SendString("Query parameter k must be a positive integer")
+			return
+		}
+		// k=0 asks for no clusters: an empty result like an empty point list
+		if noContentIfEmpty(ctx, k, cfg.EmptyNoContent) {
+			return
+		}
+		seed := int64(DefaultClusterSeed)
+		if v := ctx.Query("seed"); v != "" {
+			if seed, err = strconv.ParseInt(v, 10, 64); err != nil {
+				ctx.Status(gearbox.StatusBadRequest).SendString("Invalid seed")
+				return
+			}
+		}
+
+		var req AvgRequest
+		if err := parseBody(ctx, &req); err != nil {
+			ctx.Status(gearbox.StatusBadRequest).SendString("Invalid JSON body")
+			return
+		}
+
+		if noContentIfEmpty(ctx, len(req.Points), cfg.EmptyNoContent) {
+			return
+		}
+		if tooManyPoints(ctx, len(req.Points), cfg.MaxPoints) {
+			return
+		}
+
+		start := time.Now()
+		key := fmt.Sprintf("clusters %d %d %s", k, seed, pointsKey(req.Points))
+		v, ok := flights.Do(key, func() (any, bool) { return ClusterLatLng(req.Points, k, seed) })
+		clusters, _ := v.([]Cluster)
+		ctx.Set("Server-Timing", serverTiming(time.Since(start)))
+		if !ok {
+			sendInvalidPoints(ctx, req.Points)
+			return
+		}
+
+		_ = ctx.SendJSON(ClustersResponse{Clusters: clusters})
+	}))
+}
+
+// withRecover turns a panic in h into a logged stack trace and a 500 JSON
+// error, so one bad request can't take the process down.
+func withRecover(h func(gearbox.Context)) func(gearbox.Context) {
+	return func(ctx gearbox.Context) {
+		defer func() {
+			if rec := recover(); rec != nil {
+				log.Printf("panic serving %s: %v\n%s", ctx.Context().Path(), rec, debug.Stack())
+				ctx.Status(gearbox.StatusInternalServerError)
+				_ = ctx.SendJSON(map[string]string{"error": "internal error"})
+			}
+		}()
+		h(ctx)
+	}
+}
+
+// injectErrors is a middleware failing a random rate of requests with status.
+func injectErrors(rate float64, status int) func(gearbox.Context) {
+	return func(ctx gearbox.Context) {
+		if rand.Float64() < rate {
+			ctx.Status(status)
+			_ = ctx.SendJSON(map[string]string{"error": "injected error"})
+			return
+		}
+		ctx.Next()
+	}
+}
+
+// sendInvalidPoints answers 400 for points a computation rejected, as a
+// PointError when one of them is out of range.
+func sendInvalidPoints(ctx gearbox.Context, points []Point) {
+	ctx.Status(gearbox.StatusBadRequest)
+	if perr, found := invalidPoint(points); found {
+		_ = ctx.SendJSON(perr)
+		return
+	}
+	ctx.SendString(undefinedAverage)
+}
+
+// undefinedAverage explains the rejection of points that are all in range:
+// they have no defined average, typically because they cancel out.
+const undefinedAverage = "Invalid points: no defined average (e.g. they cancel out, as antipodal pairs do)"
+
+// requireContentType is a route middleware answering 415 unless the request
+// declares one of the media types (parameters aside, but a charset must be
+// UTF-8). With lenient set it lets everything through.
+func requireContentType(lenient bool, types ...string) func(gearbox.Context) {
+	want := strings.Join(types, " or ")
+	return func(ctx gearbox.Context) {
+		if !lenient && !contentTypeAllowed(ctx.Get("Content-Type"), types) {
+			ctx.Status(gearbox.StatusUnsupportedMediaType).SendString("Unsupported Content-Type (use " + want + ")")
+			return
+		}
+		ctx.Next()
+	}
+}
+
+func contentTypeAllowed(contentType string, types []string) bool {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if cs, ok := params["charset"]; ok && !strings.EqualFold(cs, "utf-8") {
+		return false
+	}
+	return slices.Contains(types, mediaType)
+}
+
+// parseBody decodes the JSON request body into out whatever its declared
+// Content-Type, which requireContentType has checked unless lenient.
+func parseBody(ctx gearbox.Context, out any) error {
+	return json.Unmarshal(ctx.Context().PostBody(), out)
+}
+
+// streamPath is the route reading its request body as a stream; the body
+// middlewares leave it alone.
+const streamPath = "/geo_average/stream"
+
+// streamRequestBodies turns on fasthttp's request body streaming, which
+// gearbox doesn't expose, and reports whether it could. The server is read
+// from gearbox's unexported httpServer field, so this is tied to the gearbox
+// version in go.mod; it must run before Start.
+func streamRequestBodies(gb gearbox.Gearbox) bool {
+	v := reflect.ValueOf(gb)
+	if v.Kind() != reflect.Pointer || v.Elem().Kind() != reflect.Struct {
+		return false
+	}
+	f := v.Elem().FieldByName("httpServer")
+	if !f.IsValid() || f.Type() != reflect.TypeFor[*fasthttp.Server]() || f.IsNil() {
+		return false
+	}
+	(*fasthttp.Server)(f.UnsafePointer()).StreamRequestBody = true
+	return true
+}
+
+// limitRequestBody is a middleware reading request bodies of up to max bytes
+// into memory (413 beyond that) for every route but streamPath: with body
+// streaming on, fasthttp no longer enforces a size limit itself. A response
+// that leaves body bytes unread on the connection closes it, or they would
+// be parsed as the next request.
+func limitRequestBody(max int) func(gearbox.Context) {
+	return func(ctx gearbox.Context) {
+		fctx := ctx.Context()
+		if string(fctx.Path()) == streamPath {
+			ctx.Next()
+			// Only a complete read of the body can succeed
+			if fctx.Response.StatusCode() >= 300 {
+				fctx.SetConnectionClose()
+			}
+			return
+		}
+		if stream := fctx.RequestBodyStream(); stream != nil {
+			body, err := io.ReadAll(io.LimitReader(stream, int64(max)+1))
+			if err != nil {
+				fctx.SetConnectionClose()
+				ctx.Status(gearbox.StatusBadRequest).SendString("Invalid request body")
+				return
+			}
+			if len(body) > max {
+				fctx.SetConnectionClose()
+				ctx.Status(gearbox.StatusRequestEntityTooLarge).SendString(fmt.Sprintf("Request body exceeds %d bytes", max))
+				return
+			}
+			fctx.Request.SetBody(body)
+		}
+		ctx.Next()
+	}
+}
+
+// decompressRequest is a middleware replacing a gzip-encoded request body
+// with its decompressed form, up to max bytes (413 beyond that).
+func decompressRequest(max int64) func(gearbox.Context) {
+	return func(ctx gearbox.Context) {
+		req := &ctx.Context().Request
+		if string(ctx.Context().Path()) == streamPath || !strings.EqualFold(string(req.Header.Peek("Content-Encoding")), "gzip") {
+			ctx.Next()
+			return
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(req.Body()))
+		if err != nil {
+			ctx.Status(gearbox.StatusBadRequest).SendString("Invalid gzip body")
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(zr, max+1))
+		if err != nil {
+			ctx.Status(gearbox.StatusBadRequest).SendString("Invalid gzip body")
+			return
+		}
+		if int64(len(body)) > max {
+			ctx.Status(gearbox.StatusRequestEntityTooLarge).SendString(fmt.Sprintf("Decompressed body exceeds %d bytes", max))
+			return
+		}
+		req.SetBody(body)
+		req.Header.Del("Content-Encoding")
+		ctx.Next()
+	}
+}
+
+// bodyChecksum sets BodyChecksumHeader to the hex SHA-256 of the request
+// body before the handler runs; the body itself is left for the handler.
+// streamPath checksums its body as it reads it.
+func bodyChecksum(ctx gearbox.Context) {
+	if string(ctx.Context().Path()) == streamPath {
+		ctx.Next()
+		return
+	}
+	sum := sha256.Sum256(ctx.Context().PostBody())
+	ctx.Set(BodyChecksumHeader, hex.EncodeToString(sum[:]))
+	ctx.Next()
+}
+
+// compressResponse gzips response bodies of at least min bytes once the
+// handler is done, when the request accepts gzip and the body isn't
+// encoded already.
+func compressResponse(min int) func(gearbox.Context) {
+	return func(ctx gearbox.Context) {
+		ctx.Next()
+
+		resp := &ctx.Context().Response
+		body := resp.Body()
+		if len(body) < min || len(resp.Header.Peek("Content-Encoding")) > 0 {
+			return
+		}
+		resp.Header.Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(ctx.Get("Accept-Encoding")) {
+			return
+		}
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		_, _ = zw.Write(body)
+		if err := zw.Close(); err != nil {
+			return
+		}
+		resp.SetBody(buf.Bytes())
+		resp.Header.Set("Content-Encoding", "gzip")
+	}
+}
+
+// acceptsGzip reports whether an Accept-Encoding header allows gzip with a
+// non-zero q, named or through "*".
+func acceptsGzip(header string) bool {
+	gzipQ, anyQ := -1.0, -1.0
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			if v, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					q = f
+				}
+			}
+		}
+		switch strings.ToLower(strings.TrimSpace(coding)) {
+		case "gzip":
+			gzipQ = q
+		case "*":
+			anyQ = q
+		}
+	}
+	if gzipQ >= 0 {
+		return gzipQ > 0
+	}
+	return anyQ > 0
+}
+
+// serverTiming formats a Server-Timing header value for the computation time,
+// so clients can tell it apart from network time.
+func serverTiming(d time.Duration) string {
+	return "compute;dur=" + strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 3, 64)
+}
+
+// parsePrecision parses the ?precision= decimal places; -1 (full precision)
+// when absent.
+func parsePrecision(v string) (int, bool) {
+	if v == "" {
+		return -1, true
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 || n > MaxPrecision {
+		return 0, false
+	}
+	return n, true
+}
+
+// roundTo rounds v to places decimal places; negative places leave v untouched.
+func roundTo(v float64, places int) float64 {
+	if places < 0 {
+		return v
+	}
+	r, _ := strconv.ParseFloat(strconv.FormatFloat(v, 'f', places, 64), 64)
+	return r
+}
+
+// negotiateFormat picks the /geo_average response format from an Accept
+// header: the supported type with the highest q wins, the earliest on ties.
+// A missing header means JSON; no supported type means 406.
+func negotiateFormat(accept string) (string, bool) {
+	if strings.TrimSpace(accept) == "" {
+		return FormatJSON, true
+	}
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, _ := strings.Cut(part, ";")
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			if v, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					q = f
+				}
+			}
+		}
+		var format string
+		switch strings.ToLower(strings.TrimSpace(mediaType)) {
+		case "application/json", "application/*", "*/*":
+			format = FormatJSON
+		case "text/plain", "text/*":
+			format = FormatText
+		default:
+			continue
+		}
+		if q > bestQ {
+			best, bestQ = format, q
+		}
+	}
+	return best, best != ""
+}
+
+// noContentIfEmpty answers 204 No Content, with no body, to a request that
+// carries no points at all when enabled (Config.EmptyNoContent, the default)
+// and reports whether it did. With nothing to average there is no result,
+// and a 200 with a zero lat/lng would read as a real one at (0,0); an empty
+// list therefore takes precedence over Config.RequiredPoints, while a wrong
+// non-zero count is still a 400.
+func noContentIfEmpty(ctx gearbox.Context, n int, enabled bool) bool {
+	if n > 0 || !enabled {
+		return false
+	}
+	ctx.Status(gearbox.StatusNoContent)
+	return true
+}
+
+// tooManyPoints answers 413 to a request carrying more than max points
+// (Config.MaxPoints, 0 = no cap) and reports whether it did, so an oversized
+// request is refused before any computation.
+func tooManyPoints(ctx gearbox.Context, n, max int) bool {
+	if max <= 0 || n <= max {
+		return false
+	}
+	ctx.Status(gearbox.StatusRequestEntityTooLarge).SendString(fmt.Sprintf("Too many points: at most %d allowed, got %d", max, n))
+	return true
+}
+
+// checkPointCount validates n against the configured count (0 = any count >= 1).
+func checkPointCount(n, required int) (string, bool) {
+	switch {
+	case required == 0 && n < 1:
+		return "Invalid points: expected at least 1 point", false
+	case required > 0 && n != required:
+		return fmt.Sprintf("Invalid points: expected exactly %d points, got %d", required, n), false
+	}
+	return "", true
+}
@@ -0,0 +1,1197 @@
+package geo
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gogearbox/gearbox"
+)
+
+// serve runs the geo routes with cfg on a loopback port for the duration of
+// the test and returns the base URL.
+func serve(t *testing.T, cfg Config) string {
+	t.Helper()
+	return serveWith(t, func(gb gearbox.Gearbox) { Register(gb, cfg) })
+}
+
+// serveWith is serve with the routes set up by register.
+func serveWith(t *testing.T, register func(gearbox.Gearbox)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	_ = ln.Close()
+
+	gb := gearbox.New(&gearbox.Settings{DisableStartupMessage: true})
+	register(gb)
+	go func() { _ = gb.Start(addr) }()
+	t.Cleanup(func() {
+		// fasthttp's Shutdown waits for client connections it doesn't see
+		// as idle, such as one dialed but never used
+		http.DefaultClient.CloseIdleConnections()
+		_ = gb.Stop()
+	})
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if conn, err := net.Dial("tcp4", addr); err == nil {
+			_ = conn.Close()
+			return "http://" + addr
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s not listening", addr)
+		}
+	}
+}
+
+// post sends body as JSON and returns the response with its body read.
+func post(t *testing.T, url string, body any) (*http.Response, []byte) {
+	t.Helper()
+	var b []byte
+	switch v := body.(type) {
+	case string:
+		b = []byte(v)
+	case []byte:
+		b = v
+	case io.Reader:
+		resp, err := http.Post(url, "application/json", v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp, data
+	default:
+		b, _ = json.Marshal(v)
+	}
+	resp, err := http.Post(url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, data
+}
+
+func points(ps ...Point) map[string]any {
+	return map[string]any{"points": ps}
+}
+
+var square = []Point{{10, 20}, {10, 22}, {12, 20}, {12, 22}}
+
+func TestRegisterServesAverage(t *testing.T) {
+	base := serve(t, DefaultConfig())
+
+	resp, body := post(t, base+"/geo_average", points(square...))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d: %s", resp.StatusCode, body)
+	}
+	var avg AvgResponse
+	if err := json.Unmarshal(body, &avg); err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(avg.Lat-11.0026) > 1e-3 || math.Abs(avg.Lng-21) > 1e-9 || avg.Method != "spherical" {
+		t.Errorf("average = %+v", avg)
+	}
+
+	resp, body = post(t, base+"/geo_average", points(square[:3]...))
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("3 points with RequiredPoints 4: status %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestConfigApplies(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.RequiredPoints = 0
+	cfg.MaxPoints = 3
+	cfg.EmptyNoContent = false
+	base := serve(t, cfg)
+
+	for _, tc := range []struct {
+		n    int
+		want int
+	}{{0, http.StatusBadRequest}, {2, http.StatusOK}, {4, http.StatusRequestEntityTooLarge}} {
+		t.Run(fmt.Sprint(tc.n), func(t *testing.T) {
+			resp, body := post(t, base+"/geo_average", points(square[:tc.n]...))
+			if resp.StatusCode != tc.want {
+				t.Errorf("status %d, want %d: %s", resp.StatusCode, tc.want, body)
+			}
+		})
+	}
+}
+
+// ndjson generates n newline-delimited copies of p without holding them in
+// memory, so a test can send bodies far larger than it could buffer.
+type ndjson struct {
+	line []byte
+	n    int
+	off  int
+}
+
+func newNDJSON(p Point, n int) *ndjson {
+	line, _ := json.Marshal(p)
+	return &ndjson{line: append(line, '\n'), n: n}
+}
+
+func (r *ndjson) size() int64 { return int64(len(r.line) * r.n) }
+
+func (r *ndjson) Read(b []byte) (int, error) {
+	total := 0
+	for len(b) > 0 && r.n > 0 {
+		c := copy(b, r.line[r.off:])
+		b, total, r.off = b[c:], total+c, r.off+c
+		if r.off == len(r.line) {
+			r.off, r.n = 0, r.n-1
+		}
+	}
+	if total == 0 {
+		return 0, io.EOF
+	}
+	return total, nil
+}
+
+// heapPeak samples the heap in use until the returned func is called, which
+// reports the peak growth over the starting point.
+func heapPeak() func() uint64 {
+	var ms runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&ms)
+	base, peak := ms.HeapAlloc, ms.HeapAlloc
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(2 * time.Millisecond):
+			}
+			runtime.ReadMemStats(&ms)
+			peak = max(peak, ms.HeapAlloc)
+		}
+	}()
+	return func() uint64 {
+		close(stop)
+		<-done
+		return peak - base
+	}
+}
+
+func TestStreamLargeBodyInBoundedMemory(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MaxPoints = 4 // the stream route has its own cap
+	base := serve(t, cfg)
+
+	const n = 2_000_000 // ~40MB, ten times MaxRequestBodyBytes
+	for _, chunked := range []bool{false, true} {
+		t.Run(fmt.Sprint("chunked=", chunked), func(t *testing.T) {
+			body := newNDJSON(Point{Lat: 10, Lng: 20}, n)
+			size := body.size()
+			req, _ := http.NewRequest(http.MethodPost, base+"/geo_average/stream", body)
+			req.Header.Set("Content-Type", "application/x-ndjson")
+			if !chunked {
+				req.ContentLength = size
+			}
+			peak := heapPeak()
+			resp, err := http.DefaultClient.Do(req)
+			grown := peak()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			var got StreamAvgResponse
+			if err := json.NewDecoder(resp.Body).Decode(&got); err != nil || resp.StatusCode != http.StatusOK {
+				t.Fatalf("status %d, %v", resp.StatusCode, err)
+			}
+			if got.Count != n || math.Abs(got.Lat-10) > 1e-9 || math.Abs(got.Lng-20) > 1e-9 {
+				t.Errorf("response = %+v", got)
+			}
+			if grown > uint64(size/4) {
+				t.Errorf("heap grew %d bytes for a %d-byte body", grown, size)
+			}
+		})
+	}
+
+	// The buffered routes are still capped
+	large := newNDJSON(Point{}, MaxRequestBodyBytes/10)
+	if status, body := postOversized(t, base+"/geo_average/batch", io.MultiReader(strings.NewReader(`{"groups":[`), large, strings.NewReader(`]}`))); status != 0 && status != http.StatusRequestEntityTooLarge {
+		t.Errorf("batch over MaxRequestBodyBytes: status %d: %s", status, body)
+	}
+}
+
+// postOversized posts a body the server may answer and close the connection
+// on before the client is done writing it. It returns the status, or 0 when
+// the write was reset.
+func postOversized(t *testing.T, url string, body io.Reader) (int, []byte) {
+	t.Helper()
+	resp, err := http.Post(url, "application/json", body)
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+		return 0, nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, data
+}
+
+func TestStreamMaxPoints(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.StreamMaxPoints = 10
+	base := serve(t, cfg)
+
+	for _, tc := range []struct {
+		n    int
+		want int
+	}{{10, http.StatusOK}, {11, http.StatusRequestEntityTooLarge}, {100_000, http.StatusRequestEntityTooLarge}} {
+		status, body := postOversized(t, base+"/geo_average/stream", newNDJSON(Point{Lat: 1, Lng: 2}, tc.n))
+		if status != tc.want && (status != 0 || tc.want == http.StatusOK) {
+			t.Errorf("%d points: status %d, want %d: %s", tc.n, status, tc.want, body)
+		}
+	}
+	// A rejected stream closes its connection rather than leave the rest of
+	// the body to be read as the next request
+	resp, body := post(t, base+"/geo_average", points(square...))
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("request after a rejected stream: status %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestStreamGzipAndChecksum(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.BodyChecksum = true
+	base := serve(t, cfg)
+
+	raw, _ := io.ReadAll(newNDJSON(Point{Lat: 1, Lng: 2}, 1000))
+	var zbody bytes.Buffer
+	zw := gzip.NewWriter(&zbody)
+	_, _ = zw.Write(raw)
+	_ = zw.Close()
+	req, _ := http.NewRequest(http.MethodPost, base+"/geo_average/stream", &zbody)
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	req.Header.Set("Content-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var got StreamAvgResponse
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil || got.Count != 1000 {
+		t.Fatalf("status %d, %+v, %v", resp.StatusCode, got, err)
+	}
+	sum := sha256.Sum256(raw)
+	if h := resp.Header.Get(BodyChecksumHeader); h != hex.EncodeToString(sum[:]) {
+		t.Errorf("%s = %q, want the SHA-256 of the decompressed body", BodyChecksumHeader, h)
+	}
+}
+
+func TestStream(t *testing.T) {
+	base := serve(t, DefaultConfig())
+	rng := rand.New(rand.NewSource(1))
+	ps := randomPoints(rng, 1000, Point{Lat: 40, Lng: -3}, 5)
+	var ndjson bytes.Buffer
+	for _, p := range ps {
+		b, _ := json.Marshal(p)
+		ndjson.Write(b)
+		ndjson.WriteByte('\n')
+	}
+
+	resp, data := post(t, base+"/geo_average/stream?precision=6", ndjson.Bytes())
+	var got StreamAvgResponse
+	if err := json.Unmarshal(data, &got); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d: %s", resp.StatusCode, data)
+	}
+	want, _ := AverageLatLngSpherical(ps)
+	if got.Count != len(ps) || got.Method != "spherical" || got.Lat != roundTo(want.Lat, 6) || got.Lng != roundTo(want.Lng, 6) {
+		t.Errorf("got %+v, want %d points averaging to %+v", got, len(ps), want)
+	}
+	if !strings.HasPrefix(resp.Header.Get("Server-Timing"), "compute;dur=") {
+		t.Errorf("Server-Timing %q", resp.Header.Get("Server-Timing"))
+	}
+
+	for _, tc := range []struct {
+		body, want string
+	}{
+		{`{"lat":1,"lng":2}` + "\n{oops}\n", "Invalid JSON at point 1"},
+		{`{"lat":1,"lng":2}{"lat":1,"lng":200}`, `{"error":"invalid_points","index":1,"reason":"lng out of range"}`},
+	} {
+		resp, data := post(t, base+"/geo_average/stream", []byte(tc.body))
+		if resp.StatusCode != http.StatusBadRequest || strings.TrimSpace(string(data)) != tc.want {
+			t.Errorf("%q: status %d: %s, want %s", tc.body, resp.StatusCode, data, tc.want)
+		}
+	}
+}
+
+func TestBodyChecksum(t *testing.T) {
+	digest := func(b []byte) string {
+		sum := sha256.Sum256(b)
+		return hex.EncodeToString(sum[:])
+	}
+	raw, _ := json.Marshal(points(square...))
+
+	resp, _ := post(t, serve(t, DefaultConfig())+"/geo_average", raw)
+	if h := resp.Header.Get(BodyChecksumHeader); h != "" {
+		t.Errorf("%s = %q without BodyChecksum", BodyChecksumHeader, h)
+	}
+
+	cfg := DefaultConfig()
+	cfg.BodyChecksum = true
+	base := serve(t, cfg)
+	// Rejected requests carry it too
+	for _, body := range [][]byte{raw, []byte(`{"points":`)} {
+		resp, data := post(t, base+"/geo_average", body)
+		if h := resp.Header.Get(BodyChecksumHeader); h != digest(body) {
+			t.Errorf("status %d (%s): %s = %q, want %s", resp.StatusCode, data, BodyChecksumHeader, h, digest(body))
+		}
+	}
+
+	// Over the decompressed body
+	var zbody bytes.Buffer
+	zw := gzip.NewWriter(&zbody)
+	_, _ = zw.Write(raw)
+	_ = zw.Close()
+	req, _ := http.NewRequest(http.MethodPost, base+"/geo_average", &zbody)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if h := resp.Header.Get(BodyChecksumHeader); resp.StatusCode != http.StatusOK || h != digest(raw) {
+		t.Errorf("gzip body: status %d, %s = %q, want %s", resp.StatusCode, BodyChecksumHeader, h, digest(raw))
+	}
+}
+
+func TestEmptyPointsNoContent(t *testing.T) {
+	requests := []struct{ path, body string }{
+		{"/geo_average", `{"points":[]}`},
+		{"/geo_average/compare", `{"points":[]}`},
+		{"/geo_average/debug", `{"points":[]}`},
+		{"/geo_average/geojson", `{"type":"FeatureCollection","features":[]}`},
+		{"/geo_average/stream", ""},
+		{"/geo_clusters?k=2", `{"points":[]}`},
+		{"/geo_clusters?k=0", `{"points":[{"lat":1,"lng":2}]}`}, // no clusters asked for
+	}
+	for _, enabled := range []bool{true, false} {
+		t.Run(fmt.Sprint("enabled=", enabled), func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.EmptyNoContent = enabled
+			base := serve(t, cfg)
+			want := http.StatusNoContent
+			if !enabled {
+				want = http.StatusBadRequest
+			}
+			for _, r := range requests {
+				resp, body := post(t, base+r.path, []byte(r.body))
+				if resp.StatusCode != want || (want == http.StatusNoContent && len(body) > 0) {
+					t.Errorf("%s %s: status %d: %q, want %d", r.path, r.body, resp.StatusCode, body, want)
+				}
+			}
+		})
+	}
+
+	// A wrong non-zero count is still an error
+	base := serve(t, DefaultConfig())
+	if resp, body := post(t, base+"/geo_average", points(square[:2]...)); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("2 points: status %d: %s", resp.StatusCode, body)
+	}
+	if resp, body := post(t, base+"/geo_clusters?k=-1", `{"points":[]}`); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("k=-1: status %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestClustersEndpoint(t *testing.T) {
+	base := serve(t, DefaultConfig())
+	body := points(Point{1, 1}, Point{1.01, 1}, Point{-40, 100}, Point{-40.01, 100})
+
+	resp, data := post(t, base+"/geo_clusters?k=2&seed=3", body)
+	var got ClustersResponse
+	if err := json.Unmarshal(data, &got); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d: %s", resp.StatusCode, data)
+	}
+	if len(got.Clusters) != 2 || got.Clusters[0].Count != 2 || got.Clusters[1].Count != 2 {
+		t.Errorf("clusters = %+v", got.Clusters)
+	}
+	for _, q := range []string{"", "?k=x", "?k=2&seed=x"} {
+		if resp, data := post(t, base+"/geo_clusters"+q, body); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%q: status %d: %s", q, resp.StatusCode, data)
+		}
+	}
+	if resp, data := post(t, base+"/geo_clusters?k=2", points(Point{Lat: 100})); resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(data), "lat out of range") {
+		t.Errorf("invalid point: status %d: %s", resp.StatusCode, data)
+	}
+}
+
+func TestMethods(t *testing.T) {
+	base := serve(t, DefaultConfig())
+	for _, m := range []string{"spherical", "simple", "median"} {
+		resp, data := post(t, base+"/geo_average?method="+m, points(square...))
+		var avg AvgResponse
+		if err := json.Unmarshal(data, &avg); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", m, resp.StatusCode, data)
+		}
+		if avg.Method != m || DistanceKm(Point{avg.Lat, avg.Lng}, Point{11, 21}) > 1 {
+			t.Errorf("%s: %+v", m, avg)
+		}
+	}
+	if resp, data := post(t, base+"/geo_average?method=mode", points(square...)); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unknown method: status %d: %s", resp.StatusCode, data)
+	}
+}
+
+func TestAutoMethodEndpoint(t *testing.T) {
+	near := []Point{{Lat: 40, Lng: -3}, {Lat: 40.01, Lng: -3.01}, {Lat: 40, Lng: -3.01}, {Lat: 40.01, Lng: -3}}
+	far := []Point{{Lat: 40, Lng: -3}, {Lat: 48.85, Lng: 2.35}, {Lat: 40, Lng: -3}, {Lat: 48.85, Lng: 2.35}}
+	base := serve(t, DefaultConfig())
+	for _, tc := range []struct {
+		points []Point
+		want   string
+	}{{near, "auto:simple"}, {far, "auto:spherical"}} {
+		resp, data := post(t, base+"/geo_average?method=auto", points(tc.points...))
+		var avg AvgResponse
+		if err := json.Unmarshal(data, &avg); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("status %d: %s", resp.StatusCode, data)
+		}
+		want, _ := averagers[strings.TrimPrefix(tc.want, "auto:")](tc.points)
+		if avg.Method != tc.want || math.Abs(avg.Lat-want.Lat) > 1e-6 || math.Abs(avg.Lng-want.Lng) > 1e-6 {
+			t.Errorf("got %+v, want %s averaging to %+v", avg, tc.want, want)
+		}
+	}
+}
+
+func TestDedupe(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.RequiredPoints = 0
+	base := serve(t, cfg)
+	// Three copies of one point outweigh the other without dedupe
+	body := points(Point{0, 0}, Point{0, 0}, Point{0, 0}, Point{0, 10})
+
+	var avg AvgResponse
+	resp, data := post(t, base+"/geo_average?method=simple&dedupe=true", body)
+	if err := json.Unmarshal(data, &avg); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d: %s", resp.StatusCode, data)
+	}
+	if avg.Lng != 5 || avg.DuplicatesRemoved == nil || *avg.DuplicatesRemoved != 2 {
+		t.Errorf("dedupe=true: %s", data)
+	}
+	_, data = post(t, base+"/geo_average?method=simple", body)
+	if strings.Contains(string(data), "duplicates_removed") || !strings.Contains(string(data), `"lng":2.5`) {
+		t.Errorf("without dedupe: %s", data)
+	}
+}
+
+func TestCompareEndpoint(t *testing.T) {
+	base := serve(t, DefaultConfig())
+	for _, tc := range []struct {
+		name     string
+		points   []Point
+		min, max float64 // DeltaKm bounds
+	}{
+		{"small square", square, 0, 1},
+		// The simple average of ±179° lands on the other side of the world
+		{"antimeridian", []Point{{0, 179}, {0, -179}, {1, 179}, {1, -179}}, 10000, math.Inf(1)},
+	} {
+		resp, data := post(t, base+"/geo_average/compare", points(tc.points...))
+		var got CompareResponse
+		if err := json.Unmarshal(data, &got); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", tc.name, resp.StatusCode, data)
+		}
+		if got.DeltaKm < tc.min || got.DeltaKm > tc.max {
+			t.Errorf("%s: %+v", tc.name, got)
+		}
+		if d := DistanceKm(got.Spherical, got.Simple); math.Abs(d-got.DeltaKm) > 1e-6 {
+			t.Errorf("%s: delta_km %v, but the averages are %vkm apart", tc.name, got.DeltaKm, d)
+		}
+	}
+}
+
+func TestCheckPointCount(t *testing.T) {
+	for _, tc := range []struct {
+		n, required int
+		ok          bool
+	}{
+		{0, 0, false}, {1, 0, true}, {500, 0, true},
+		{4, 4, true}, {3, 4, false}, {5, 4, false},
+		{1, 1, true}, {2, 1, false},
+	} {
+		msg, ok := checkPointCount(tc.n, tc.required)
+		if ok != tc.ok || (ok == (msg != "")) {
+			t.Errorf("checkPointCount(%d, %d) = %q, %v", tc.n, tc.required, msg, ok)
+		}
+	}
+
+	cfg := DefaultConfig()
+	cfg.RequiredPoints = 2
+	base := serve(t, cfg)
+	for _, path := range []string{"/geo_average", "/geo_average/compare", "/geo_average/debug"} {
+		if resp, data := post(t, base+path, points(square[:2]...)); resp.StatusCode != http.StatusOK {
+			t.Errorf("%s with 2 of 2 points: status %d: %s", path, resp.StatusCode, data)
+		}
+		if resp, data := post(t, base+path, points(square...)); resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(data), "exactly 2 points, got 4") {
+			t.Errorf("%s with 4 of 2 points: status %d: %s", path, resp.StatusCode, data)
+		}
+	}
+}
+
+func TestServerTiming(t *testing.T) {
+	if got := serverTiming(1234567 * time.Nanosecond); got != "compute;dur=1.235" {
+		t.Errorf("serverTiming = %q", got)
+	}
+	base := serve(t, DefaultConfig())
+	for _, path := range []string{"/geo_average", "/geo_average/compare", "/geo_clusters?k=2"} {
+		resp, data := post(t, base+path, points(square...))
+		if h := resp.Header.Get("Server-Timing"); resp.StatusCode != http.StatusOK || !strings.HasPrefix(h, "compute;dur=") {
+			t.Errorf("%s: status %d, Server-Timing %q: %s", path, resp.StatusCode, h, data)
+		}
+	}
+}
+
+func TestWithRecover(t *testing.T) {
+	base := serveWith(t, func(gb gearbox.Gearbox) {
+		gb.Post("/panic", withRecover(func(ctx gearbox.Context) { panic("boom") }))
+		gb.Post("/ok", withRecover(func(ctx gearbox.Context) { ctx.SendString("ok") }))
+	})
+	resp, data := post(t, base+"/panic", "{}")
+	if resp.StatusCode != http.StatusInternalServerError || strings.TrimSpace(string(data)) != `{"error":"internal error"}` {
+		t.Errorf("panicking handler: status %d: %s", resp.StatusCode, data)
+	}
+	// The server survived it
+	if resp, data := post(t, base+"/ok", "{}"); resp.StatusCode != http.StatusOK || string(data) != "ok" {
+		t.Errorf("after a panic: status %d: %s", resp.StatusCode, data)
+	}
+}
+
+func TestPrecision(t *testing.T) {
+	for _, tc := range []struct {
+		v      float64
+		places int
+		want   float64
+	}{
+		{10.12345, 2, 10.12},
+		{20.98765, 2, 20.99},
+		{-3.14159, 2, -3.14},
+		{7.5, 0, 8},
+		{1.23456789, -1, 1.23456789},
+	} {
+		if got := roundTo(tc.v, tc.places); got != tc.want {
+			t.Errorf("roundTo(%v, %d) = %v, want %v", tc.v, tc.places, got, tc.want)
+		}
+	}
+
+	base := serve(t, DefaultConfig())
+	same := points(Point{10.12345, 20.98765}, Point{10.12345, 20.98765}, Point{10.12345, 20.98765}, Point{10.12345, 20.98765})
+	var avg AvgResponse
+	resp, body := post(t, base+"/geo_average?precision=2", same)
+	if err := json.Unmarshal(body, &avg); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("precision=2: status %d: %s", resp.StatusCode, body)
+	}
+	if avg.Lat != 10.12 || avg.Lng != 20.99 {
+		t.Errorf("precision=2: %+v, want 10.12, 20.99", avg)
+	}
+
+	_, body = post(t, base+"/geo_average", same)
+	if err := json.Unmarshal(body, &avg); err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(avg.Lat-10.12345) > 1e-9 || math.Abs(avg.Lng-20.98765) > 1e-9 {
+		t.Errorf("default: %+v, want full precision", avg)
+	}
+
+	for _, bad := range []string{"-1", "16", "two"} {
+		if resp, _ := post(t, base+"/geo_average?precision="+bad, same); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("precision=%s: status %d", bad, resp.StatusCode)
+		}
+	}
+}
+
+func TestAcceptFormats(t *testing.T) {
+	base := serve(t, DefaultConfig())
+	body, _ := json.Marshal(points(Point{10.5, 20.25}, Point{10.5, 20.25}, Point{10.5, 20.25}, Point{10.5, 20.25}))
+
+	for _, tc := range []struct {
+		accept      string
+		status      int
+		contentType string
+	}{
+		{"", http.StatusOK, "application/json"},
+		{"application/json", http.StatusOK, "application/json"},
+		{"*/*", http.StatusOK, "application/json"},
+		{"text/plain", http.StatusOK, "text/plain; charset=utf-8"},
+		{"text/plain;q=0.5, application/json", http.StatusOK, "application/json"},
+		{"application/json;q=0.1, text/*", http.StatusOK, "text/plain; charset=utf-8"},
+		{"application/xml", http.StatusNotAcceptable, ""},
+		{"image/png, text/html", http.StatusNotAcceptable, ""},
+	} {
+		req, _ := http.NewRequest(http.MethodPost, base+"/geo_average?precision=6", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if tc.accept != "" {
+			req.Header.Set("Accept", tc.accept)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+
+		if resp.StatusCode != tc.status {
+			t.Errorf("Accept %q: status %d: %s", tc.accept, resp.StatusCode, data)
+			continue
+		}
+		if tc.contentType == "" {
+			continue
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != tc.contentType {
+			t.Errorf("Accept %q: Content-Type %q, want %q", tc.accept, ct, tc.contentType)
+		}
+		var avg AvgResponse
+		switch {
+		case strings.HasPrefix(tc.contentType, "text/plain"):
+			if string(data) != "10.5,20.25" {
+				t.Errorf("Accept %q: body %q, want \"10.5,20.25\"", tc.accept, data)
+			}
+		case json.Unmarshal(data, &avg) != nil || avg.Lat != 10.5 || avg.Lng != 20.25:
+			t.Errorf("Accept %q: body %s", tc.accept, data)
+		}
+	}
+}
+
+func TestIterationsScaleWork(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	body := points(randomPoints(rng, 5000, Point{Lat: 40, Lng: -3}, 5)...)
+
+	// computeMs is the fastest Server-Timing of a few runs
+	run := func(iterations int) (AvgResponse, float64) {
+		cfg := DefaultConfig()
+		cfg.RequiredPoints, cfg.MaxPoints, cfg.Iterations, cfg.Coalesce = 0, 0, iterations, false
+		base := serve(t, cfg)
+		var avg AvgResponse
+		computeMs := math.Inf(1)
+		for range 3 {
+			resp, data := post(t, base+"/geo_average?method=median", body)
+			if err := json.Unmarshal(data, &avg); err != nil || resp.StatusCode != http.StatusOK {
+				t.Fatalf("iterations %d: status %d: %s", iterations, resp.StatusCode, data)
+			}
+			ms, err := strconv.ParseFloat(strings.TrimPrefix(resp.Header.Get("Server-Timing"), "compute;dur="), 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			computeMs = min(computeMs, ms)
+		}
+		return avg, computeMs
+	}
+	once, onceMs := run(1)
+	ten, tenMs := run(10)
+	if once != ten {
+		t.Errorf("iterations 1 answered %+v, iterations 10 %+v", once, ten)
+	}
+	if tenMs < 4*onceMs {
+		t.Errorf("iterations 10 computed in %.3fms, iterations 1 in %.3fms: want roughly 10 times longer", tenMs, onceMs)
+	}
+}
+
+func TestErrorInjection(t *testing.T) {
+	for _, tc := range []struct {
+		rate   float64
+		status int
+	}{{1, http.StatusServiceUnavailable}, {1, http.StatusTooManyRequests}, {0, http.StatusOK}} {
+		cfg := DefaultConfig()
+		cfg.InjectRate = tc.rate
+		if tc.status != http.StatusOK {
+			cfg.InjectStatus = tc.status
+		}
+		base := serve(t, cfg)
+		for range 20 {
+			if resp, body := post(t, base+"/geo_average", points(square...)); resp.StatusCode != tc.status {
+				t.Fatalf("rate %v: status %d, want %d: %s", tc.rate, resp.StatusCode, tc.status, body)
+			}
+		}
+	}
+}
+
+func TestDebugSteps(t *testing.T) {
+	base := serve(t, DefaultConfig())
+
+	// Unit vectors (1,0,0), (0,1,0), (0,0,1) and (-1,0,0)
+	resp, body := post(t, base+"/geo_average/debug", points(Point{0, 0}, Point{0, 90}, Point{90, 0}, Point{0, 180}))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d: %s", resp.StatusCode, body)
+	}
+	var steps SphericalSteps
+	if err := json.Unmarshal(body, &steps); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		name      string
+		got, want float64
+	}{
+		{"sum_x", steps.SumX, 0}, {"sum_y", steps.SumY, 1}, {"sum_z", steps.SumZ, 1},
+		{"x", steps.X, 0}, {"y", steps.Y, 0.25}, {"z", steps.Z, 0.25},
+		{"hyp", steps.Hyp, 0.25}, {"length", steps.Length, math.Sqrt(0.125)},
+		{"lat", steps.Average.Lat, 45}, {"lng", steps.Average.Lng, 90},
+	} {
+		if math.Abs(c.got-c.want) > 1e-9 {
+			t.Errorf("%s = %v, want %v", c.name, c.got, c.want)
+		}
+	}
+	if steps.Undefined {
+		t.Error("undefined average")
+	}
+
+	// Antipodal points: the steps still show why there is no average
+	resp, body = post(t, base+"/geo_average/debug", points(Point{0, 0}, Point{0, 180}, Point{0, 0}, Point{0, 180}))
+	steps = SphericalSteps{}
+	if err := json.Unmarshal(body, &steps); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d: %s", resp.StatusCode, body)
+	}
+	if !steps.Undefined || steps.Length > DegenerateEpsilon || steps.Average != (Point{}) {
+		t.Errorf("antipodal points: %+v", steps)
+	}
+
+	if resp, body := post(t, base+"/geo_average/debug", points(Point{91, 0}, Point{0, 0}, Point{0, 0}, Point{0, 0})); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid point: status %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestGeoJSON(t *testing.T) {
+	base := serve(t, DefaultConfig())
+	feature := func(p Point) string {
+		return fmt.Sprintf(`{"type":"Feature","properties":{"name":"p"},"geometry":{"type":"Point","coordinates":[%g,%g,100]}}`, p.Lng, p.Lat)
+	}
+	var features []string
+	for _, p := range square {
+		features = append(features, feature(p))
+	}
+
+	for name, body := range map[string]string{
+		"FeatureCollection": `{"type":"FeatureCollection","features":[` + strings.Join(features, ",") + `]}`,
+		"MultiPoint":        `{"type":"MultiPoint","coordinates":[[20,10],[22,10],[20,12],[22,12]]}`,
+	} {
+		resp, data := post(t, base+"/geo_average/geojson", body)
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/geo+json" {
+			t.Fatalf("%s: status %d, Content-Type %q: %s", name, resp.StatusCode, resp.Header.Get("Content-Type"), data)
+		}
+		var out struct {
+			Type     string `json:"type"`
+			Geometry struct {
+				Type        string    `json:"type"`
+				Coordinates []float64 `json:"coordinates"`
+			} `json:"geometry"`
+			Properties map[string]any `json:"properties"`
+		}
+		if err := json.Unmarshal(data, &out); err != nil {
+			t.Fatal(err)
+		}
+		// [lng, lat]: the square's centre is at lng 21, lat ~11
+		c := out.Geometry.Coordinates
+		if out.Type != "Feature" || out.Geometry.Type != "Point" || len(c) != 2 || math.Abs(c[0]-21) > 1e-9 || math.Abs(c[1]-11.0026) > 1e-3 {
+			t.Errorf("%s: centroid %s", name, data)
+		}
+		if out.Properties["count"] != 4.0 || out.Properties["method"] != "spherical" {
+			t.Errorf("%s: properties %v", name, out.Properties)
+		}
+	}
+
+	for body, want := range map[string]string{
+		`{"type":"LineString","coordinates":[[0,0],[1,1]]}`:                      `unsupported type "LineString"`,
+		`{"type":"MultiPoint","coordinates":[[0,0],[1]]}`:                        "MultiPoint coordinates must be [[lng, lat], ...]",
+		`{"type":"FeatureCollection","features":[{"type":"Feature"}]}`:           "features[0]: feature without geometry",
+		`{"type":"Feature","geometry":{"type":"Point","coordinates":"nowhere"}}`: "Point coordinates must be [lng, lat]",
+	} {
+		resp, data := post(t, base+"/geo_average/geojson", body)
+		if resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(data), want) {
+			t.Errorf("%s: status %d: %s, want %q", body, resp.StatusCode, data, want)
+		}
+	}
+}
+
+func TestGzipRequestBody(t *testing.T) {
+	base := serve(t, DefaultConfig())
+	postGzip := func(raw []byte) (*http.Response, []byte) {
+		var zbody bytes.Buffer
+		zw := gzip.NewWriter(&zbody)
+		_, _ = zw.Write(raw)
+		_ = zw.Close()
+		req, _ := http.NewRequest(http.MethodPost, base+"/geo_average", &zbody)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Content-Encoding", "gzip")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp, data
+	}
+
+	raw, _ := json.Marshal(points(square...))
+	resp, body := postGzip(raw)
+	var avg AvgResponse
+	if err := json.Unmarshal(body, &avg); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d: %s", resp.StatusCode, body)
+	}
+	if math.Abs(avg.Lat-11.0026) > 1e-3 || math.Abs(avg.Lng-21) > 1e-9 {
+		t.Errorf("average = %+v", avg)
+	}
+
+	// A few KB that decompress past the cap
+	bomb := []byte(`{"pad":"` + strings.Repeat("x", MaxDecompressedBytes) + `","points":[]}`)
+	if resp, body := postGzip(bomb); resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized body: status %d: %s", resp.StatusCode, body)
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, base+"/geo_average", bytes.NewReader(raw))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("plain body marked gzip: status %d", resp.StatusCode)
+	}
+}
+
+func TestRejectOutliers(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.RequiredPoints = 0
+	base := serve(t, cfg)
+	cluster := append(slices.Clone(square), Point{11, 21}, Point{11.5, 20.5})
+	withOutlier := append(slices.Clone(cluster), Point{-40, -120})
+
+	for _, m := range []string{"spherical", "simple"} {
+		want, _ := averagers[m](cluster)
+		resp, data := post(t, base+"/geo_average?method="+m, points(withOutlier...))
+		var pulled AvgResponse
+		if err := json.Unmarshal(data, &pulled); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", m, resp.StatusCode, data)
+		}
+		if pulled.OutliersRejected != nil {
+			t.Errorf("%s: outliers_rejected reported without reject_outliers", m)
+		}
+
+		resp, data = post(t, base+"/geo_average?reject_outliers=true&method="+m, points(withOutlier...))
+		var avg AvgResponse
+		if err := json.Unmarshal(data, &avg); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", m, resp.StatusCode, data)
+		}
+		if avg.OutliersRejected == nil || *avg.OutliersRejected != 1 {
+			t.Errorf("%s: outliers_rejected %v, want 1", m, avg.OutliersRejected)
+		}
+		got := Point{avg.Lat, avg.Lng}
+		if d := DistanceKm(got, want); d > 0.01 {
+			t.Errorf("%s: average %v is %.2f km from the cluster's %v", m, got, d, want)
+		}
+		if DistanceKm(Point{pulled.Lat, pulled.Lng}, want) < 100 {
+			t.Errorf("%s: the outlier barely moved the average; the test proves nothing", m)
+		}
+	}
+
+	// A tight cluster keeps every point
+	if kept := RejectOutliers(cluster, AverageLatLngSpherical, DefaultOutlierFactor); len(kept) != len(cluster) {
+		t.Errorf("cluster without outliers lost %d points", len(cluster)-len(kept))
+	}
+	same := []Point{{0, 0}, {0, 0}, {0, 0}, {0, 10}, {0, -10}}
+	if kept := RejectOutliers(same, AverageLatLngSpherical, DefaultOutlierFactor); len(kept) != 5 {
+		t.Errorf("zero median distance: kept %d of 5 points", len(kept))
+	}
+}
+
+func TestInvalidPointDetail(t *testing.T) {
+	base := serve(t, DefaultConfig())
+	for _, tc := range []struct {
+		points []Point
+		want   PointError
+	}{
+		{[]Point{{10, 20}, {10, 22}, {95, 20}, {12, 22}}, PointError{"invalid_points", 2, "lat out of range"}},
+		{[]Point{{10, 20}, {10, 22}, {12, 20}, {12, -181}}, PointError{"invalid_points", 3, "lng out of range"}},
+		{[]Point{{-91, 0}, {10, 200}, {12, 20}, {12, 22}}, PointError{"invalid_points", 0, "lat out of range"}},
+	} {
+		for _, path := range []string{"/geo_average", "/geo_average?method=simple", "/geo_average/debug"} {
+			resp, data := post(t, base+path, points(tc.points...))
+			var got PointError
+			if err := json.Unmarshal(data, &got); err != nil || resp.StatusCode != http.StatusBadRequest || got != tc.want {
+				t.Errorf("%s %v: status %d: %s, want %+v", path, tc.points, resp.StatusCode, data, tc.want)
+			}
+		}
+	}
+
+	// Points in range without an average keep the plain message
+	resp, data := post(t, base+"/geo_average", points(Point{0, 0}, Point{0, 180}, Point{0, 0}, Point{0, 180}))
+	if resp.StatusCode != http.StatusBadRequest || string(data) != undefinedAverage {
+		t.Errorf("antipodal points: status %d: %s", resp.StatusCode, data)
+	}
+}
+
+func TestFixedPoint(t *testing.T) {
+	tiny := points(Point{1e-7, -2e-7}, Point{1e-7, -2e-7}, Point{1e-7, -2e-7}, Point{1e-7, -2e-7})
+	for _, fixed := range []bool{false, true} {
+		cfg := DefaultConfig()
+		cfg.FixedPoint = fixed
+		base := serve(t, cfg)
+		resp, data := post(t, base+"/geo_average?method=simple", tiny)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status %d: %s", resp.StatusCode, data)
+		}
+		if want := `"lat":0.0000001,"lng":-0.0000002,`; fixed != strings.Contains(string(data), want) {
+			t.Errorf("FixedPoint %t: %s", fixed, data)
+		}
+		if want := `"lat":1e-7,"lng":-2e-7,`; !fixed && !strings.Contains(string(data), want) {
+			t.Errorf("default encoding changed: %s", data)
+		}
+		var avg AvgResponse
+		if err := json.Unmarshal(data, &avg); err != nil || avg.Lat != 1e-7 || avg.Lng != -2e-7 || avg.Method != "simple" {
+			t.Errorf("FixedPoint %t: decoded %+v, %v", fixed, avg, err)
+		}
+	}
+}
+
+func TestContentType(t *testing.T) {
+	body, _ := json.Marshal(points(square...))
+	send := func(base, path, contentType string) int {
+		req, _ := http.NewRequest(http.MethodPost, base+path, bytes.NewReader(body))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	strict := serve(t, DefaultConfig())
+	cfg := DefaultConfig()
+	cfg.LenientContentType = true
+	lenient := serve(t, cfg)
+	for _, tc := range []struct {
+		path, contentType string
+		want              int
+	}{
+		{"/geo_average", "application/json", http.StatusOK},
+		{"/geo_average", "application/json; charset=UTF-8", http.StatusOK},
+		{"/geo_average", "", http.StatusUnsupportedMediaType},
+		{"/geo_average", "text/plain", http.StatusUnsupportedMediaType},
+		{"/geo_average", "application/json; charset=latin1", http.StatusUnsupportedMediaType},
+		{"/geo_average/debug", "application/xml", http.StatusUnsupportedMediaType},
+	} {
+		if got := send(strict, tc.path, tc.contentType); got != tc.want {
+			t.Errorf("%s with %q: status %d, want %d", tc.path, tc.contentType, got, tc.want)
+		}
+		if got := send(lenient, tc.path, tc.contentType); got != http.StatusOK {
+			t.Errorf("lenient %s with %q: status %d", tc.path, tc.contentType, got)
+		}
+	}
+}
+
+func TestBatchEndpoint(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.BatchWorkers = 3
+	base := serve(t, cfg)
+	rng := rand.New(rand.NewSource(2))
+	req := BatchRequest{Groups: make([]AvgRequest, 200)}
+	for i := range req.Groups {
+		req.Groups[i].Points = randomPoints(rng, 4, Point{Lat: float64(i%90) - 45, Lng: float64(i) - 100}, 1)
+	}
+	req.Groups[10].Points[2].Lng = 500
+
+	resp, data := post(t, base+"/geo_average/batch?method=simple", req)
+	var out BatchResponse
+	if err := json.Unmarshal(data, &out); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d: %.200s", resp.StatusCode, data)
+	}
+	if out.Method != "simple" || len(out.Results) != 200 {
+		t.Fatalf("method %q, %d results", out.Method, len(out.Results))
+	}
+	for i, g := range req.Groups {
+		want := batchResult(g.Points, AverageLatLngSimple)
+		if got := out.Results[i]; got.Error != want.Error || (want.Average != nil && (got.Average == nil || *got.Average != *want.Average)) {
+			t.Errorf("group %d: %+v, want %+v", i, got, want)
+		}
+	}
+	if out.Results[10].Error != "point 2: lng out of range" {
+		t.Errorf("invalid group: %+v", out.Results[10])
+	}
+}
+
+func TestCoalesceConcurrentRequests(t *testing.T) {
+	defer func(f func([]Point) (Point, bool)) { averagers["spherical"] = f }(averagers["spherical"])
+	const callers = 20
+	for _, tc := range []struct {
+		path string
+		body any
+	}{
+		{"/geo_average", points(square...)},
+		{"/geo_average/batch", BatchRequest{Groups: []AvgRequest{{Points: square}}}},
+	} {
+		for _, coalesce := range []bool{true, false} {
+			// Computations block until every request is in
+			var runs atomic.Int64
+			release := make(chan struct{})
+			averagers["spherical"] = func(ps []Point) (Point, bool) {
+				runs.Add(1)
+				<-release
+				return AverageLatLngSpherical(ps)
+			}
+			cfg := DefaultConfig()
+			cfg.Coalesce = coalesce
+			base := serve(t, cfg)
+
+			var wg sync.WaitGroup
+			bodies := make([]string, callers)
+			for i := range callers {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					resp, data := post(t, base+tc.path, tc.body)
+					if resp.StatusCode != http.StatusOK {
+						t.Errorf("%s: status %d: %s", tc.path, resp.StatusCode, data)
+					}
+					bodies[i] = string(data)
+				}()
+			}
+			time.Sleep(200 * time.Millisecond)
+			close(release)
+			wg.Wait()
+
+			want := int64(callers)
+			if coalesce {
+				want = 1
+			}
+			if n := runs.Load(); n != want {
+				t.Errorf("%s, Coalesce %t: %d computations for %d identical requests, want %d", tc.path, coalesce, n, callers, want)
+			}
+			for i, b := range bodies {
+				if b != bodies[0] {
+					t.Errorf("%s: response %d = %s, want %s", tc.path, i, b, bodies[0])
+				}
+			}
+		}
+	}
+}
+
+func TestMaxPoints(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.RequiredPoints = 0
+	cfg.MaxPoints = 10
+	base := serve(t, cfg)
+	batch := func(sizes ...int) map[string]any {
+		groups := make([]map[string]any, len(sizes))
+		for i, n := range sizes {
+			groups[i] = points(slices.Repeat(square[:1], n)...)
+		}
+		return map[string]any{"groups": groups}
+	}
+	for _, tc := range []struct {
+		path      string
+		ok, large any
+	}{
+		{"/geo_average", points(slices.Repeat(square[:1], 10)...), points(slices.Repeat(square[:1], 11)...)},
+		{"/geo_average/compare", points(slices.Repeat(square[:1], 10)...), points(slices.Repeat(square[:1], 11)...)},
+		{"/geo_average/debug", points(slices.Repeat(square[:1], 10)...), points(slices.Repeat(square[:1], 11)...)},
+		{"/geo_average/batch", batch(5, 5), batch(5, 6)}, // all groups together
+		{"/geo_clusters?k=2", points(slices.Repeat(square[:1], 10)...), points(slices.Repeat(square[:1], 11)...)},
+	} {
+		if resp, data := post(t, base+tc.path, tc.ok); resp.StatusCode != http.StatusOK {
+			t.Errorf("%s with 10 points: status %d: %s", tc.path, resp.StatusCode, data)
+		}
+		resp, data := post(t, base+tc.path, tc.large)
+		if resp.StatusCode != http.StatusRequestEntityTooLarge || !strings.Contains(string(data), "at most 10 allowed, got 11") {
+			t.Errorf("%s with 11 points: status %d: %s", tc.path, resp.StatusCode, data)
+		}
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	for header, want := range map[string]bool{
+		"":                      false,
+		"gzip":                  true,
+		"deflate, GZIP;q=0.5":   true,
+		"gzip;q=0":              false,
+		"br, *":                 true,
+		"*;q=0":                 false,
+		"*, gzip;q=0":           false, // named beats "*"
+		"gzip;q=0.0, *;q=1":     false,
+		"identity, deflate, br": false,
+	} {
+		if got := acceptsGzip(header); got != want {
+			t.Errorf("acceptsGzip(%q) = %t, want %t", header, got, want)
+		}
+	}
+}
+
+func TestCompressResponse(t *testing.T) {
+	batch := BatchRequest{Groups: make([]AvgRequest, 100)}
+	for i := range batch.Groups {
+		batch.Groups[i].Points = []Point{{Lat: 1, Lng: float64(i)}}
+	}
+	raw, _ := json.Marshal(batch)
+	fetch := func(base, path string, body []byte, acceptEncoding string) (*http.Response, []byte) {
+		req, _ := http.NewRequest(http.MethodPost, base+path, bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Accept-Encoding", acceptEncoding) // set, so the transport leaves it encoded
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp, data
+	}
+
+	base := serve(t, DefaultConfig())
+	plainResp, plain := fetch(base, "/geo_average/batch", raw, "identity")
+	if len(plain) < DefaultGzipMinBytes || plainResp.Header.Get("Content-Encoding") != "" || plainResp.Header.Get("Vary") != "Accept-Encoding" {
+		t.Fatalf("identity: %d bytes, Content-Encoding %q, Vary %q", len(plain), plainResp.Header.Get("Content-Encoding"), plainResp.Header.Get("Vary"))
+	}
+	resp, zipped := fetch(base, "/geo_average/batch", raw, "gzip")
+	if resp.Header.Get("Content-Encoding") != "gzip" || len(zipped) >= len(plain) {
+		t.Fatalf("gzip: Content-Encoding %q, %d bytes of %d", resp.Header.Get("Content-Encoding"), len(zipped), len(plain))
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(zipped))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unzipped, err := io.ReadAll(zr); err != nil || !bytes.Equal(unzipped, plain) {
+		t.Errorf("gunzipped body differs: %v\n%.200s", err, unzipped)
+	}
+
+	// Small responses stay as they are
+	small, _ := json.Marshal(points(square...))
+	if resp, _ := fetch(base, "/geo_average", small, "gzip"); resp.Header.Get("Content-Encoding") != "" || resp.Header.Get("Vary") != "" {
+		t.Errorf("small response: Content-Encoding %q, Vary %q", resp.Header.Get("Content-Encoding"), resp.Header.Get("Vary"))
+	}
+
+	cfg := DefaultConfig()
+	cfg.GzipMinBytes = 0
+	if resp, _ := fetch(serve(t, cfg), "/geo_average/batch", raw, "gzip"); resp.Header.Get("Content-Encoding") != "" {
+		t.Errorf("GzipMinBytes 0: Content-Encoding %q", resp.Header.Get("Content-Encoding"))
+	}
+}
@@ -2,7 +2,10 @@ module github.com/dwladdimiroc/load-serverless/server
 
 go 1.25
 
-require github.com/gogearbox/gearbox v1.2.4
+require (
+	github.com/gogearbox/gearbox v1.2.4
+	github.com/valyala/fasthttp v1.31.0
+)
 
 require (
 	github.com/andybalholm/brotli v1.0.2 // indirect
@@ -11,7 +14,6 @@ require (
 	github.com/modern-go/concurrent v0.0.0-20180228061459-e0a39a4cb421 // indirect
 	github.com/modern-go/reflect2 v1.0.2 // indirect
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
-	github.com/valyala/fasthttp v1.31.0 // indirect
 	github.com/valyala/tcplisten v1.0.0 // indirect
 	golang.org/x/sys v0.0.0-20210514084401-e8d321eab015 // indirect
 )
@@ -1,99 +1,226 @@
 package main
 
 import (
-	"math"
+	"log"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
 
+	"github.com/dwladdimiroc/load-serverless/server/geo"
 	"github.com/gogearbox/gearbox"
 )
 
-type Point struct {
-	Lat float64 `json:"lat"`
-	Lng float64 `json:"lng"`
-}
+const (
+	// GEO_REQUIRED_POINTS: points a /geo_average request must carry (0 = any count >= 1)
+	RequiredPointsEnv = "GEO_REQUIRED_POINTS"
+
+	// GEO_MAX_POINTS caps the points of a request (all groups of a batch
+	// together) before any computation, answering 413 above it (0 = no cap)
+	MaxPointsEnv = "GEO_MAX_POINTS"
+
+	// GEO_STREAM_MAX_POINTS caps the points of a /geo_average/stream request,
+	// which GEO_MAX_POINTS doesn't cover since it averages in constant memory
+	// (0 = no cap, the default)
+	StreamMaxPointsEnv = "GEO_STREAM_MAX_POINTS"
+
+	// GEO_DEDUPE_EPSILON: points closer than this (degrees, on both axes) are duplicates
+	DedupeEpsilonEnv = "GEO_DEDUPE_EPSILON"
+
+	// GEO_OUTLIER_FACTOR: with reject_outliers=true, points farther from the provisional
+	// average than this multiple of the median distance are dropped
+	OutlierFactorEnv = "GEO_OUTLIER_FACTOR"
+
+	// GEO_AUTO_SPREAD_KM: method=auto averages points spread less than this
+	// with the simple method, others spherically; above
+	// geo.SpreadExactMaxPoints points the spread is estimated in linear time
+	// and may overstate the largest pairwise distance up to twofold (see
+	// geo.SpreadKm)
+	AutoSpreadKmEnv = "GEO_AUTO_SPREAD_KM"
+
+	// GEO_GZIP_MIN_BYTES: responses of at least this many bytes are gzipped
+	// for clients sending Accept-Encoding: gzip (0 = never), so large batch
+	// and cluster results shrink on the wire while single averages don't pay
+	// for it
+	GzipMinBytesEnv = "GEO_GZIP_MIN_BYTES"
+
+	// GEO_LENIENT_CONTENT_TYPE=true decodes request bodies whatever their
+	// Content-Type instead of answering 415 to anything but JSON
+	LenientContentTypeEnv = "GEO_LENIENT_CONTENT_TYPE"
+
+	// GEO_EMPTY_NO_CONTENT=false answers an empty point list with 400 like any
+	// other wrong count, instead of 204 No Content
+	EmptyNoContentEnv = "GEO_EMPTY_NO_CONTENT"
+
+	// GEO_COALESCE=true shares one computation among concurrent identical
+	// requests. Off by default, so that every request under load costs its
+	// full computation
+	CoalesceEnv = "GEO_COALESCE"
+
+	// GEO_FIXED_POINT=true writes /geo_average lat/lng in plain decimal notation,
+	// never exponents such as 1e-07, for strict JSON clients
+	FixedPointEnv = "GEO_FIXED_POINT"
+
+	// GEO_BODY_CHECKSUM=true sets X-Body-Checksum on every response to the hex
+	// SHA-256 of the request body as received (after gzip decoding), so
+	// clients can check their payload arrived intact
+	BodyChecksumEnv = "GEO_BODY_CHECKSUM"
+
+	// GEO_BATCH_WORKERS bounds how many /geo_average/batch groups are averaged
+	// at once, across all requests (default GOMAXPROCS)
+	BatchWorkersEnv = "GEO_BATCH_WORKERS"
+
+	// GEO_COMPUTE_ITERATIONS repeats each /geo_average computation to simulate
+	// heavier CPU work (the result is unchanged)
+	ComputeIterationsEnv = "GEO_COMPUTE_ITERATIONS"
+
+	// ERROR_INJECT_RATE in [0,1] fails that fraction of requests with
+	// ERROR_INJECT_STATUS (default 503), for resilience testing
+	ErrorInjectRateEnv   = "ERROR_INJECT_RATE"
+	ErrorInjectStatusEnv = "ERROR_INJECT_STATUS"
+)
 
-type AvgRequest struct {
-	Points []Point `json:"points"`
-}
+// Build details injected at link time with
+// -ldflags "-X main.buildRevision=... -X main.buildTime=..."; when empty,
+// /version falls back to the VCS stamp in the binary's build info (with
+// the commit time as build time).
+var (
+	buildRevision string
+	buildTime     string
+)
 
-type AvgResponse struct {
-	Lat    float64 `json:"lat"`
-	Lng    float64 `json:"lng"`
-	Method string  `json:"method"`
+// VersionResponse is the /version body.
+type VersionResponse struct {
+	GoVersion string `json:"go_version"`
+	Revision  string `json:"revision,omitempty"`
+	BuildTime string `json:"build_time,omitempty"`
+	Modified  bool   `json:"modified,omitempty"` // built from a dirty checkout
 }
 
-func AverageLatLngSpherical(points []Point) (Point, bool) {
-	if len(points) != 4 {
-		return Point{}, false
-	}
-
-	var x, y, z float64
-	for _, p := range points {
-		if p.Lat < -90 || p.Lat > 90 || p.Lng < -180 || p.Lng > 180 {
-			return Point{}, false
+// buildVersion reports the running build, preferring the link-time values.
+func buildVersion() VersionResponse {
+	v := VersionResponse{GoVersion: runtime.Version(), Revision: buildRevision, BuildTime: buildTime}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				if v.Revision == "" {
+					v.Revision = s.Value
+				}
+			case "vcs.time":
+				if v.BuildTime == "" {
+					v.BuildTime = s.Value
+				}
+			case "vcs.modified":
+				v.Modified = s.Value == "true"
+			}
 		}
-
-		lat := p.Lat * math.Pi / 180.0
-		lng := p.Lng * math.Pi / 180.0
-
-		clat := math.Cos(lat)
-		x += clat * math.Cos(lng)
-		y += clat * math.Sin(lng)
-		z += math.Sin(lat)
 	}
-
-	x /= 4.0
-	y /= 4.0
-	z /= 4.0
-
-	lng := math.Atan2(y, x)
-	hyp := math.Sqrt(x*x + y*y)
-	lat := math.Atan2(z, hyp)
-
-	return Point{
-		Lat: lat * 180.0 / math.Pi,
-		Lng: lng * 180.0 / math.Pi,
-	}, true
+	return v
 }
 
-func AverageLatLngSimple(points []Point) (Point, bool) {
-	if len(points) != 4 {
-		return Point{}, false
+func envInt(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Fatalf("Invalid %s: %q", key, v)
 	}
+	return n
+}
 
-	var latSum, lngSum float64
-	for _, p := range points {
-		if p.Lat < -90 || p.Lat > 90 || p.Lng < -180 || p.Lng > 180 {
-			return Point{}, false
-		}
-		latSum += p.Lat
-		lngSum += p.Lng
+func envBool(key string, def bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Fatalf("Invalid %s: %q", key, v)
 	}
+	return b
+}
 
-	return Point{Lat: latSum / 4.0, Lng: lngSum / 4.0}, true
+func envFloat(key string, def float64) float64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		log.Fatalf("Invalid %s: %q", key, v)
+	}
+	return f
 }
 
 func main() {
-	gb := gearbox.New()
+	cfg := geo.DefaultConfig()
+	cfg.DedupeEpsilon = envFloat(DedupeEpsilonEnv, cfg.DedupeEpsilon)
+	cfg.OutlierFactor = envFloat(OutlierFactorEnv, cfg.OutlierFactor)
+	if cfg.OutlierFactor <= 0 {
+		log.Fatalf("Invalid %s: %v (must be > 0)", OutlierFactorEnv, cfg.OutlierFactor)
+	}
+	cfg.AutoSpreadKm = envFloat(AutoSpreadKmEnv, cfg.AutoSpreadKm)
+	if cfg.AutoSpreadKm < 0 {
+		log.Fatalf("Invalid %s: %v (must be >= 0)", AutoSpreadKmEnv, cfg.AutoSpreadKm)
+	}
+	cfg.RequiredPoints = envInt(RequiredPointsEnv, cfg.RequiredPoints)
+	if cfg.RequiredPoints < 0 {
+		log.Fatalf("Invalid %s: %d (must be >= 0)", RequiredPointsEnv, cfg.RequiredPoints)
+	}
+	cfg.MaxPoints = envInt(MaxPointsEnv, cfg.MaxPoints)
+	if cfg.MaxPoints < 0 || (cfg.MaxPoints > 0 && cfg.RequiredPoints > cfg.MaxPoints) {
+		log.Fatalf("Invalid %s: %d (must be >= 0 and not below %s)", MaxPointsEnv, cfg.MaxPoints, RequiredPointsEnv)
+	}
+	cfg.StreamMaxPoints = envInt(StreamMaxPointsEnv, cfg.StreamMaxPoints)
+	if cfg.StreamMaxPoints < 0 {
+		log.Fatalf("Invalid %s: %d (must be >= 0)", StreamMaxPointsEnv, cfg.StreamMaxPoints)
+	}
+	cfg.Iterations = envInt(ComputeIterationsEnv, cfg.Iterations)
+	if cfg.Iterations < 1 {
+		log.Fatalf("Invalid %s: %d (must be >= 1)", ComputeIterationsEnv, cfg.Iterations)
+	}
+	cfg.FixedPoint = envBool(FixedPointEnv, cfg.FixedPoint)
+	cfg.LenientContentType = envBool(LenientContentTypeEnv, cfg.LenientContentType)
+	cfg.EmptyNoContent = envBool(EmptyNoContentEnv, cfg.EmptyNoContent)
+	cfg.Coalesce = envBool(CoalesceEnv, cfg.Coalesce)
+	cfg.BatchWorkers = envInt(BatchWorkersEnv, cfg.BatchWorkers)
+	if cfg.BatchWorkers < 1 {
+		log.Fatalf("Invalid %s: %d (must be >= 1)", BatchWorkersEnv, cfg.BatchWorkers)
+	}
 
-	gb.Post("/geo_average", func(ctx gearbox.Context) {
-		var req AvgRequest
-		if err := ctx.ParseBody(&req); err != nil {
-			ctx.Status(gearbox.StatusBadRequest).SendString("Invalid JSON body")
-			return
-		}
+	cfg.InjectRate = envFloat(ErrorInjectRateEnv, cfg.InjectRate)
+	cfg.InjectStatus = envInt(ErrorInjectStatusEnv, cfg.InjectStatus)
+	if cfg.InjectRate < 0 || cfg.InjectRate > 1 {
+		log.Fatalf("Invalid %s: %v (must be between 0 and 1)", ErrorInjectRateEnv, cfg.InjectRate)
+	}
+	if cfg.InjectStatus < 400 || cfg.InjectStatus > 599 {
+		log.Fatalf("Invalid %s: %d (must be a 4xx or 5xx status)", ErrorInjectStatusEnv, cfg.InjectStatus)
+	}
 
-		avg, ok := AverageLatLngSpherical(req.Points)
-		if !ok {
-			ctx.Status(gearbox.StatusBadRequest).SendString("Invalid points")
-			return
-		}
+	cfg.GzipMinBytes = envInt(GzipMinBytesEnv, cfg.GzipMinBytes)
+	if cfg.GzipMinBytes < 0 {
+		log.Fatalf("Invalid %s: %d (must be >= 0)", GzipMinBytesEnv, cfg.GzipMinBytes)
+	}
 
-		_ = ctx.SendJSON(AvgResponse{
-			Lat:    avg.Lat,
-			Lng:    avg.Lng,
-			Method: "spherical",
-		})
+	cfg.BodyChecksum = envBool(BodyChecksumEnv, cfg.BodyChecksum)
+	if cfg.BodyChecksum {
+		log.Printf("Responses carry %s", geo.BodyChecksumHeader)
+	}
+	if cfg.InjectRate > 0 {
+		log.Printf("Injecting status %d into %.1f%% of requests", cfg.InjectStatus, cfg.InjectRate*100)
+	}
+
+	gb := gearbox.New()
+
+	version := buildVersion()
+	gb.Get("/version", func(ctx gearbox.Context) {
+		_ = ctx.SendJSON(version)
 	})
 
+	geo.Register(gb, cfg)
+
 	_ = gb.Start(":8080")
 }
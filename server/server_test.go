@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"runtime/debug"
+	"testing"
+	"time"
+)
+
+// runMainEnv makes the test binary run the server's main instead of the
+// tests, so the routes can be exercised with the configuration main loads.
+const runMainEnv = "SERVER_TEST_RUN_MAIN"
+
+const serverAddr = "127.0.0.1:8080"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(runMainEnv) == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// startServer runs main in a child process with env added to the environment
+// for the duration of the test and returns the base URL.
+func startServer(t *testing.T, env ...string) string {
+	t.Helper()
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(append(os.Environ(), runMainEnv+"=1"), env...)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+	waitListening(t, serverAddr)
+	return "http://" + serverAddr
+}
+
+// waitListening blocks until addr accepts connections.
+func waitListening(t *testing.T, addr string) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if conn, err := net.Dial("tcp4", addr); err == nil {
+			_ = conn.Close()
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s not listening", addr)
+		}
+	}
+}
+
+func TestVersion(t *testing.T) {
+	base := startServer(t)
+	resp, err := http.Get(base + "/version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var v VersionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	if v.GoVersion != runtime.Version() {
+		t.Errorf("/version = %+v", v)
+	}
+
+	// Link-time values win over the VCS stamp
+	defer func(rev, at string) { buildRevision, buildTime = rev, at }(buildRevision, buildTime)
+	buildRevision, buildTime = "0123abc", "2024-01-02T03:04:05Z"
+	if got := buildVersion(); got.Revision != "0123abc" || got.BuildTime != "2024-01-02T03:04:05Z" || got.GoVersion != runtime.Version() {
+		t.Errorf("with link-time values: %+v", got)
+	}
+	buildRevision, buildTime = "", ""
+	got := buildVersion()
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			if s.Key == "vcs.revision" && got.Revision != s.Value {
+				t.Errorf("revision %q, want the build info's %q", got.Revision, s.Value)
+			}
+		}
+	}
+}
@@ -1,2 +1,2 @@
-go build -o server server.go
+go build -ldflags "-X main.buildRevision=$(git rev-parse HEAD) -X main.buildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ)" -o server .
 gcloud compute scp --zone "us-east1-c" ./server server:~/server
\ No newline at end of file